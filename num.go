@@ -2,8 +2,103 @@
 
 This single file contains a multi-file project laid out so you can copy each section into separate files. Files included:
 - server.go
+- server_admin.go
+- server_clientconfig.go
+- server_trash.go
+- server_apiversion.go
+- server_openapi.go
+- server_health.go
+- server_batch.go
+- server_import.go
+- server_export.go
+- server_config.go
+- server_logging.go
+- server_accesslog.go
+- server_gzip.go
+- server_conditional.go
+- server_geo.go
+- server_geojson.go
+- server_stats.go
+- server_summaries.go
+- server_heatmap.go
+- server_trips.go
+- server_stops.go
+- server_geofence.go
+- server_webhooks.go
+- server_notify.go
+- server_wsauth.go
+- server_hub.go
+- server_wssub.go
+- server_wsreplay.go
+- server_sse.go
+- server_grpc.go
+- server_protobuf.go
+- server_codec.go
+- server_mqtt.go
+- server_nats.go
+- server_kafka.go
+- server_relay.go
+- server_redis.go
+- server_udp.go
+- server_geocode.go
+- server_secrets.go
+- server_auth.go
+- server_tenants.go
+- server_devices.go
+- server_apikeys.go
+- server_quota.go
+- server_session.go
+- server_oidc.go
+- server_rbac.go
+- server_audit.go
+- server_signature.go
+- server_persist.go
+- server_tls.go
+- server_mtls.go
+- server_limits.go
+- server_validate.go
+- server_ratelimit.go
+- server_lockout.go
+- server_csrf.go
+- server_ipfilter.go
+- server_pairing.go
+- server_owntracks.go
+- server_gt06.go
+- nulocpb/nuloc.proto
+- nulocpb/nuloc.pb.go
+- nulocpb/nuloc_grpc.pb.go
+- reporter/reporter.go
+- reporter/batch.go
+- reporter/control.go
+- reporter/e2e.go
+- reporter/filter.go
+- reporter/http.go
+- reporter/pace.go
+- reporter/queue.go
+- reporter/retry.go
+- reporter/seq.go
+- reporter/telemetry.go
+- reporter/watchdog.go
 - client.go
+- client_cell.go
+- client_config.go
+- client_env.go
+- client_geoip.go
+- client_gpsd.go
+- client_grpc.go
+- client_metrics.go
+- client_mqtt.go
+- client_nmea.go
+- client_proxy.go
+- client_service.go
+- client_tor.go
+- client_transport.go
+- client_wifi.go
+- client_e2e.go
+- client_secrets.go
 - viewer.html
+- server.example.yaml
+- client.example.yaml
 - go.mod
 - Dockerfile
 - docker-compose.yml
@@ -21,12 +116,20 @@ package main
 // - Serves embedded map viewer (viewer.html)
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -39,210 +142,16862 @@ type Location struct {
 	Lat   float64 `json:"lat"`
 	Lon   float64 `json:"lon"`
 	IP    string  `json:"ip,omitempty"`
-	When  string  `json:"when"`
+	// Accuracy is the reported uncertainty radius in metres; 0 is unknown
+	Accuracy float64 `json:"accuracy,omitempty"`
+	// Optional telemetry from richer clients, see checkTelemetry
+	Altitude *float64 `json:"altitude,omitempty"` // metres above sea level
+	Speed    *float64 `json:"speed,omitempty"`    // m/s
+	Bearing  *float64 `json:"bearing,omitempty"`  // degrees clockwise from north
+	Battery  *int     `json:"battery,omitempty"`  // percent
+	Network  string   `json:"network,omitempty"`  // see networkTypes
+	// Which box the point came from and how it is doing, as sent by the
+	// bundled client
+	Hostname   string `json:"hostname,omitempty"`
+	Uptime     *int64 `json:"uptime,omitempty"`     // seconds since boot
+	Interface  string `json:"interface,omitempty"`  // e.g. wlan0
+	Recoveries int    `json:"recoveries,omitempty"` // client watchdog resets since it started
+	// When the point was recorded, in UTC. Clients may supply it (RFC 3339);
+	// otherwise it is the time the server received the report.
+	When time.Time `json:"when"`
+	// Seq is the client's report counter, rising with each report. With
+	// Received, when the server took the report in, it lets points that
+	// arrived out of order or from a box with a wrong clock be put right.
+	Seq      uint64     `json:"seq,omitempty"`
+	Received *time.Time `json:"received,omitempty"`
+
+	// Ciphertext holds end-to-end encrypted coordinates (base64 of the
+	// AES-GCM nonce and sealed {"lat","lon"}); Lat and Lon are then zero.
+	// Only the client and viewer hold the key.
+	Ciphertext string `json:"ct,omitempty"`
+
+	// Place is the reverse-geocoded address, filled in by the server when
+	// geocoding is enabled
+	Place string `json:"place,omitempty"`
+
+	// arrival numbers live reports in the order they were stored, for SSE
+	// event ids; 0 for imported, reloaded and relayed points
+	arrival uint64
 }
 
+// maxHistory is the number of points kept per device; older points are
+// dropped. Set with HISTORY_LIMIT.
+var maxHistory = 200
+
 var (
-	// In-memory storage guarded by mutex for demo purposes
+	// In-memory storage guarded by mutex for demo purposes. Points already
+	// stored are never written in place, since readers use the slice they
+	// took after unlocking; changes go to a copy (see setPlace)
 	store   = map[string][]Location{}
 	stMutex = sync.RWMutex{}
+	// storeVersion and storeModified change whenever a device's history
+	// does (see touchHistoryLocked); they back conditional GETs
+	storeVersion  = map[string]uint64{}
+	storeModified = map[string]time.Time{}
+	storeSeq      uint64
+	// arrivalSeq is the last arrival number handed out. It starts from the
+	// clock at boot, so numbers are not reused after a restart.
+	arrivalSeq = uint64(time.Now().UnixMicro())
 
-	// WebSocket clients
-	clients   = make(map[*websocket.Conn]bool)
-	clientsMu = sync.Mutex{}
-	upgrader  = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	// WebSocket viewers live in the hub (server_hub.go)
+	upgrader = websocket.Upgrader{}
 )
 
 func main() {
+	insecureOrigins := flag.Bool("insecure-origins", false, "accept websocket connections from any origin")
+	configPath := registerConfigFlags()
+	flag.Parse()
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fatal("config", err)
+	}
+	if err := setupLogging(); err != nil {
+		fatal("logging", err)
+	}
+	if err := setupAccessLog(); err != nil {
+		fatal("access log", err)
+	}
+	upgrader.CheckOrigin = originChecker(setting("ALLOWED_ORIGINS"), *insecureOrigins)
+
+	if err := setupSecrets(); err != nil {
+		fatal("secrets", err)
+	}
+	if err := loadDeviceTokens(); err != nil {
+		fatal("device tokens", err)
+	}
+	if err := loadTenants(); err != nil {
+		fatal("tenants", err)
+	}
+	if err := loadDevices(); err != nil {
+		fatal("devices", err)
+	}
+	if err := loadAPIKeys(); err != nil {
+		fatal("api keys", err)
+	}
+	if err := loadUsage(); err != nil {
+		fatal("usage", err)
+	}
+	if err := loadViewerUsers(); err != nil {
+		fatal("viewer users", err)
+	}
+	if err := loadSignatureConfig(); err != nil {
+		fatal("report signatures", err)
+	}
+	if err := loadBodyLimits(); err != nil {
+		fatal("body limits", err)
+	}
+	if err := loadCoordRules(); err != nil {
+		fatal("coordinate rules", err)
+	}
+	if err := loadRateLimits(); err != nil {
+		fatal("rate limits", err)
+	}
+	if err := openAuditLog(); err != nil {
+		fatal("audit log", err)
+	}
+	if err := setupOIDC(); err != nil {
+		fatal("oidc", err)
+	}
+	if err := loadIPRules(); err != nil {
+		fatal("ip rules", err)
+	}
+	if err := loadPairings(); err != nil {
+		fatal("pairings", err)
+	}
+	if err := loadLockoutConfig(); err != nil {
+		fatal("lockouts", err)
+	}
+	if err := setupCSRF(); err != nil {
+		fatal("csrf", err)
+	}
+	if err := setupGeocoder(); err != nil {
+		fatal("geocoder", err)
+	}
+	if err := loadGeofences(); err != nil {
+		fatal("geofences", err)
+	}
+	if err := setupWebhooks(); err != nil {
+		fatal("webhooks", err)
+	}
+	if err := loadNotifiers(); err != nil {
+		fatal("notifiers", err)
+	}
+	if err := loadSummaries(); err != nil {
+		fatal("summaries", err)
+	}
+	if err := loadPurgeGrace(); err != nil {
+		fatal("trash", err)
+	}
+	if err := loadClientConfigs(); err != nil {
+		fatal("client config", err)
+	}
+
+	go runHub()
+
 	r := mux.NewRouter()
+	r.Use(ipFilter)
+	r.Use(gunzipped)
+	r.Use(identify)
+	r.Use(csrfCheck)
+
+	// Probes
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET", "HEAD")
+
+	// Everything but probes and the viewer is versioned; see server_apiversion.go
+	api := r.PathPrefix(apiPrefix).Subrouter()
+
+	// Viewer sessions
+	api.Handle("/auth/csrf", withCSRF(http.HandlerFunc(csrfTokenHandler))).Methods("GET")
+	api.HandleFunc("/auth/login", loginHandler).Methods("POST")
+	api.HandleFunc("/auth/methods", authMethodsHandler).Methods("GET")
+	api.HandleFunc("/auth/oidc/login", oidcLoginHandler).Methods("GET")
+	api.HandleFunc("/auth/oidc/callback", oidcCallbackHandler).Methods("GET")
+
+	// Device registry
+	api.Handle("/devices", gzipped(audited("device.list")(withRole(listDevicesHandler, roleAdmin, roleViewer)))).Methods("GET")
+	api.Handle("/devices", audited("device.register")(withRole(registerDeviceHandler, roleAdmin))).Methods("POST")
+	api.Handle("/devices/{phone}", audited("device.update")(withRole(requirePhone(updateDeviceHandler), roleAdmin))).Methods("PATCH")
+	api.Handle("/devices/{phone}", audited("device.delete")(withRole(requirePhone(deleteDeviceHandler), roleAdmin))).Methods("DELETE")
+
+	// Geofences
+	api.Handle("/geofences", audited("geofence.list")(withRole(listGeofencesHandler, roleAdmin, roleViewer))).Methods("GET")
+	api.Handle("/geofences", audited("geofence.create")(withRole(createGeofenceHandler, roleAdmin))).Methods("POST")
+	api.Handle("/geofences/{id}", audited("geofence.update")(withRole(updateGeofenceHandler, roleAdmin))).Methods("PUT")
+	api.Handle("/geofences/{id}", audited("geofence.delete")(withRole(deleteGeofenceHandler, roleAdmin))).Methods("DELETE")
+
+	// Device pairing and consent
+	api.HandleFunc("/pair", pairHandler).Methods("POST")
+	api.HandleFunc("/pair", unpairHandler).Methods("DELETE")
+
+	// Settings polled by the bundled client
+	api.Handle("/client/config", rateLimitIP(http.HandlerFunc(clientConfigHandler))).Methods("POST")
 
 	// API endpoints
-	r.HandleFunc("/report", reportHandler).Methods("POST")
-	r.HandleFunc("/get/{phone}", getHandler).Methods("GET")
+	api.Handle("/report", rateLimitIP(http.HandlerFunc(reportHandler))).Methods("POST")
+	api.Handle("/report/batch", rateLimitIP(http.HandlerFunc(batchReportHandler))).Methods("POST")
+	api.Handle("/get/{phone}", gzipped(rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(getHandler)), roleAdmin, roleViewer))))).Methods("GET")
+	api.Handle("/get/{phone}", audited("history.delete")(withRole(requirePhone(deleteHistoryHandler), roleAdmin))).Methods("DELETE")
+	api.Handle("/latest/{phone}", rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(latestHandler)), roleAdmin, roleViewer)))).Methods("GET")
+	api.Handle("/stats/{phone}", rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(statsHandler)), roleAdmin, roleViewer)))).Methods("GET")
+	api.Handle("/heatmap/{phone}", gzipped(rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(heatmapHandler)), roleAdmin, roleViewer))))).Methods("GET")
+	api.Handle("/trips/{phone}", gzipped(rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(tripsHandler)), roleAdmin, roleViewer))))).Methods("GET")
+	api.Handle("/stops/{phone}", gzipped(rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(stopsHandler)), roleAdmin, roleViewer))))).Methods("GET")
+	api.Handle("/summaries/{phone}", gzipped(rateLimitIP(audited("history.read")(withRole(requirePhone(rateLimitPhone(summariesHandler)), roleAdmin, roleViewer))))).Methods("GET")
+
+	// Quotas and usage of the calling API key
+	api.HandleFunc("/usage", usageHandler).Methods("GET")
+
+	// Third-party client protocols
+	api.Handle("/owntracks", rateLimitIP(http.HandlerFunc(owntracksHandler))).Methods("POST")
+
+	// Bulk history import
+	api.Handle("/import/{phone}/takeout", audited("history.import")(withRole(requirePhone(takeoutImportHandler), roleAdmin))).Methods("POST")
+	api.Handle("/import/{phone}/gpx", audited("history.import")(withRole(requirePhone(gpxImportHandler), roleAdmin))).Methods("POST")
+
+	// Data-subject access requests
+	api.Handle("/export/{phone}/bundle", rateLimitIP(audited("history.export")(withRole(requirePhone(exportBundleHandler), roleAdmin)))).Methods("GET")
+
+	// Operator endpoints
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(gzipped)
+	admin.Use(audited("admin"))
+	admin.Use(requireRole(roleAdmin))
+	admin.HandleFunc("/status", requireOperator(statusHandler)).Methods("GET")
+	admin.HandleFunc("/storage", storageHandler).Methods("GET")
+	admin.HandleFunc("/audit", auditQueryHandler).Methods("GET")
+	admin.HandleFunc("/keys", listKeysHandler).Methods("GET")
+	admin.HandleFunc("/keys", createKeyHandler).Methods("POST")
+	admin.HandleFunc("/keys/{id}/rotate", rotateKeyHandler).Methods("POST")
+	admin.HandleFunc("/keys/{id}", revokeKeyHandler).Methods("DELETE")
+	admin.HandleFunc("/keys/{id}/quota", setQuotaHandler).Methods("PUT")
+	admin.HandleFunc("/usage", listUsageHandler).Methods("GET")
+	admin.HandleFunc("/lockouts", requireOperator(listLockoutsHandler)).Methods("GET")
+	admin.HandleFunc("/lockouts", requireOperator(clearLockoutsHandler)).Methods("DELETE")
+	admin.HandleFunc("/lockouts/{key}", requireOperator(clearLockoutsHandler)).Methods("DELETE")
+	admin.HandleFunc("/pairings", listPairingsHandler).Methods("GET")
+	admin.HandleFunc("/pairings", issuePairingHandler).Methods("POST")
+	admin.HandleFunc("/pairings/{phone}/confirm", requirePhone(confirmPairingHandler)).Methods("POST")
+	admin.HandleFunc("/trash", listTrashHandler).Methods("GET")
+	admin.HandleFunc("/trash/{phone}/restore", requirePhone(restoreHistoryHandler)).Methods("POST")
+	admin.HandleFunc("/purge", purgeHandler).Methods("POST")
+	admin.HandleFunc("/client-config", listClientConfigsHandler).Methods("GET")
+	admin.HandleFunc("/client-config", requireOperator(setClientConfigHandler)).Methods("PUT")
+	admin.HandleFunc("/client-config/{phone}", requirePhone(setClientConfigHandler)).Methods("PUT")
+	admin.HandleFunc("/client-config/{phone}", requirePhone(deleteClientConfigHandler)).Methods("DELETE")
+	admin.HandleFunc("/tenants", requireOperator(listTenantsHandler)).Methods("GET")
+	admin.HandleFunc("/tenants", requireOperator(createTenantHandler)).Methods("POST")
+	admin.HandleFunc("/tenants/{id}", requireOperator(deleteTenantHandler)).Methods("DELETE")
 
 	// Websocket for live updates
-	r.HandleFunc("/ws", wsHandler)
+	api.Handle("/ws", audited("live.subscribe")(http.HandlerFunc(wsHandler)))
+	api.Handle("/events/{phone}", rateLimitIP(audited("live.subscribe")(withRole(requirePhone(sseHandler), roleAdmin, roleViewer)))).Methods("GET")
+
+	// API description and Swagger UI
+	r.HandleFunc("/openapi.json", openAPIHandler(r)).Methods("GET")
+	r.HandleFunc("/docs", docsHandler).Methods("GET")
 
 	// Serve viewer.html and static assets
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "./viewer.html") })
 
-	port := os.Getenv("PORT")
+	port := setting("PORT")
 	if port == "" {
 		port = "5000"
 	}
 
-	addr := fmt.Sprintf(":%s", port)
-	log.Printf("Starting server on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	// SIGINT/SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Hardware GPS trackers speaking GT06 over TCP
+	if gt06Addr := setting("GT06_ADDR"); gt06Addr != "" {
+		go serveGT06(ctx, gt06Addr)
+	}
+	// Typed API for Go and mobile clients
+	if grpcAddr := setting("GRPC_ADDR"); grpcAddr != "" {
+		go serveGRPC(ctx, grpcAddr)
+	}
+	// Battery-constrained trackers sending single datagrams
+	if udpAddr := setting("UDP_ADDR"); udpAddr != "" {
+		go serveUDP(ctx, udpAddr)
+	}
+	// IoT trackers publishing to an MQTT broker
+	if broker := setting("MQTT_BROKER"); broker != "" {
+		if err := startMQTT(ctx, broker); err != nil {
+			fatal("mqtt", err)
+		}
+	}
+	// Ingestion from and fan-out to a NATS mesh
+	if url, err := secret("NATS_URL"); err != nil {
+		fatal("nats", err)
+	} else if url != "" {
+		if err := startNATS(ctx, url); err != nil {
+			fatal("nats", err)
+		}
+	}
+	// The full movement stream for analytics
+	if brokers := setting("KAFKA_BROKERS"); brokers != "" {
+		if err := startKafka(ctx, brokers); err != nil {
+			fatal("kafka", err)
+		}
+	}
+	// Live updates shared between replicas
+	if url, err := secret("REDIS_URL"); err != nil {
+		fatal("redis", err)
+	} else if url != "" {
+		if err := startRedis(ctx, url); err != nil {
+			fatal("redis", err)
+		}
+	}
+
+	addr := fmt.Sprintf(":%s", port)
+	slog.Info("starting server", "addr", addr)
+	err := serve(ctx, addr, requestLogger(accessLog(legacyAPI(r))))
+	closeAuditLog()
+	saveUsage()
+	if err != nil && err != http.ErrServerClosed {
+		fatal("server", err)
+	}
+	slog.Info("server stopped")
+}
+
+// reportHandler accepts JSON body with phone, lat, lon, token(optional)
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, maxBodyBytes)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	var loc Location
+	if isProtobuf(r) {
+		if loc, err = unmarshalReportPB(body); err != nil {
+			http.Error(w, "invalid protobuf: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := decodeBody(r, body, &loc); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if cerr := checkLocation(loc); cerr != nil {
+		writeCoordError(w, cerr)
+		return
+	}
+	if !authorizeReport(w, r, body, loc.Phone, loc.Token) {
+		return
+	}
+	if loc.When, err = reportTime(loc.When); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ingest(loc)
+	reqLogger(r).Debug("report stored", "device", loc.Phone)
+
+	writeEncoded(w, r, map[string]string{"status": "ok"})
+}
+
+// authorizeReport runs checkReporter for the HTTP report endpoints, with
+// the client certificate and the signature, reporter key or device token
+// as proof. It writes the error response and returns false on failure.
+func authorizeReport(w http.ResponseWriter, r *http.Request, body []byte, phone, token string) bool {
+	refusal := checkReporter(clientIP(r), phone, func() error {
+		if err := checkClientCert(r, phone); err != nil {
+			return err
+		}
+		signed, err := verifyReportSignature(r, body, phone)
+		if err != nil {
+			return err
+		}
+		if !signed && !canReport(r, phone) && !checkDeviceToken(phone, token) {
+			return errors.New("invalid device token")
+		}
+		return nil
+	})
+	switch {
+	case refusal == nil:
+		return true
+	case refusal.status == http.StatusTooManyRequests:
+		tooManyRequests(w, refusal.wait)
+	default:
+		if refusal.status == http.StatusUnauthorized {
+			reqLogger(r).Warn("report rejected", "device", phone, "err", refusal.msg)
+		}
+		http.Error(w, refusal.msg, refusal.status)
+	}
+	return false
+}
+
+// reportRefusal is why checkReporter turned a report away. status is the
+// HTTP status; the other transports map it onto their own errors.
+type reportRefusal struct {
+	status int
+	msg    string
+	wait   time.Duration // before trying again, for 429
+}
+
+func (e *reportRefusal) Error() string { return e.msg }
+
+// checkReporter runs the device checks every report transport shares, so
+// HTTP, gRPC, MQTT, UDP and OwnTracks cannot drift apart: device rate
+// limit, lockout, proof of identity, registration and consent. ip is the
+// caller's address, locked out along with the device, or "" for reports
+// relayed by a broker or from a forgeable source such as UDP. prove is the transport's credential check, nil when
+// the broker is trusted to have done it. Listener-level IP rules and rate
+// limits are the transport's own (HTTP middleware, peerAllowed).
+func checkReporter(ip, phone string, prove func() error) *reportRefusal {
+	if ok, wait := deviceLimits.allow(phone); !ok {
+		return &reportRefusal{status: http.StatusTooManyRequests, msg: "rate limit exceeded", wait: wait}
+	}
+	if prove != nil {
+		lockKeys := []string{deviceKey(phone)}
+		if ip != "" {
+			lockKeys = append(lockKeys, "ip:"+ip)
+		}
+		if wait := lockedFor(lockKeys...); wait > 0 {
+			return &reportRefusal{status: http.StatusTooManyRequests, msg: "too many failed attempts", wait: wait}
+		}
+		if err := prove(); err != nil {
+			authFailed(lockKeys...)
+			return &reportRefusal{status: http.StatusUnauthorized, msg: err.Error()}
+		}
+		authSucceeded(lockKeys...)
+	}
+	if !deviceKnown(phone) {
+		return &reportRefusal{status: http.StatusNotFound, msg: "unknown device, register it with POST /devices"}
+	}
+	if !devicePaired(phone) {
+		return &reportRefusal{status: http.StatusForbidden, msg: "device has not completed pairing"}
+	}
+	return nil
+}
+
+// ingest stores accepted live reports, all for one device, and broadcasts
+// them to websocket clients. Every ingestion path (HTTP, OwnTracks, ...)
+// ends up here; a batch is merged into the history in one go, so points
+// delayed in a client's queue land in time order.
+func ingest(locs ...Location) {
+	if len(locs) == 0 {
+		return
+	}
+	received := time.Now().UTC()
+	for i := range locs {
+		loc := &locs[i]
+		// Tokens are credentials; never keep or broadcast them
+		loc.Token = ""
+		// Places are ours to resolve, not the client's to claim
+		loc.Place = ""
+		// Nor is the receive time
+		loc.Received = &received
+		// Never keep plaintext coordinates next to an encrypted payload
+		if loc.Ciphertext != "" {
+			loc.Lat, loc.Lon = 0, 0
+		}
+	}
+
+	// Store, numbered in the same step so a reader of the history has
+	// every point up to the highest number it sees
+	stMutex.Lock()
+	for i := range locs {
+		arrivalSeq++
+		locs[i].arrival = arrivalSeq
+	}
+	appendHistoryLocked(locs[0].Phone, locs...)
+	stMutex.Unlock()
+	for _, loc := range locs {
+		publish(loc)
+	}
+}
+
+// publish hands a stored report to everything that follows live updates
+func publish(loc Location) {
+	countReport()
+
+	// Broadcast to websocket clients
+	broadcast(loc)
+
+	// Fire geofence enter/exit events
+	evaluateGeofences(loc)
+
+	// Tell other systems
+	dispatchWebhooks("location", loc)
+	if natsPublish != nil {
+		natsPublish(loc)
+	}
+	if kafkaPublish != nil {
+		kafkaPublish(loc)
+	}
+	checkAlerts(loc)
+
+	// Resolve an address in the background
+	enqueueGeocode(loc)
+}
+
+// appendHistory merges locs into phone's history by When, so points older
+// than what is stored (imports, a late batch) land in time order instead of
+// after newer ones, then keeps only the newest maxHistory points. It returns
+// how many of locs survived that trim.
+func appendHistory(phone string, locs ...Location) int {
+	stMutex.Lock()
+	defer stMutex.Unlock()
+	return appendHistoryLocked(phone, locs...)
+}
+
+// appendHistoryLocked is appendHistory for callers holding stMutex
+func appendHistoryLocked(phone string, locs ...Location) int {
+	if len(locs) == 0 {
+		return 0
+	}
+	locs = append([]Location(nil), locs...)
+	sort.SliceStable(locs, func(i, j int) bool { return locs[i].When.Before(locs[j].When) })
+
+	old := store[phone]
+	over := len(old) + len(locs) - maxHistory
+	dropped := 0
+	var merged []Location
+	if len(old) == 0 || !locs[0].When.Before(old[len(old)-1].When) {
+		// the usual case: everything is newer than what is stored
+		merged = append(old, locs...)
+		dropped = max(over-len(old), 0)
+	} else {
+		// a fresh slice, since readers may still hold the old one
+		merged = make([]Location, 0, len(old)+len(locs))
+		for i, j := 0, 0; i < len(old) || j < len(locs); {
+			if j < len(locs) && (i == len(old) || locs[j].When.Before(old[i].When)) {
+				if len(merged) < over {
+					dropped++
+				}
+				merged = append(merged, locs[j])
+				j++
+			} else {
+				merged = append(merged, old[i])
+				i++
+			}
+		}
+	}
+	if over > 0 {
+		merged = merged[over:]
+	}
+	store[phone] = merged
+	touchHistoryLocked(phone)
+	return len(locs) - dropped
+}
+
+// touchHistoryLocked records that phone's history changed; callers hold
+// stMutex for writing. Versions are never reused, even across deletes.
+func touchHistoryLocked(phone string) {
+	storeSeq++
+	storeVersion[phone] = storeSeq
+	storeModified[phone] = time.Now()
+}
+
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	phone := vars["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+
+	stMutex.RLock()
+	locs := store[phone]
+	version, modified := storeVersion[phone], storeModified[phone]
+	stMutex.RUnlock()
+
+	w.Header().Add("Vary", "Accept")
+	if notModified(w, r, historyETag(r, phone, version), historyModified(modified)) {
+		return
+	}
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	locs = filter.apply(locs)
+
+	if wantsGeoJSON(r) {
+		writeGeoJSON(w, locs)
+		return
+	}
+	writeEncoded(w, r, map[string]interface{}{"phone": phone, "locations": locs})
+}
+
+// latestHandler returns only the newest point for phone and how old it is
+func latestHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stMutex.RLock()
+	locs := filter.apply(store[phone])
+	var last Location
+	if len(locs) > 0 {
+		last = locs[len(locs)-1]
+	}
+	stMutex.RUnlock()
+	if len(locs) == 0 {
+		http.Error(w, "no locations for device", http.StatusNotFound)
+		return
+	}
+
+	resp := map[string]interface{}{"phone": phone, "location": last}
+	resp["age_seconds"] = int64(time.Since(last.When).Seconds())
+	writeEncoded(w, r, resp)
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	who := requestPrincipal(r)
+	if who != nil && !mayWatch(who) {
+		http.Error(w, "forbidden for role "+who.Role, http.StatusForbidden)
+		return
+	}
+	if who == nil && authBlocked(w, ipKey(r)) {
+		return
+	}
+	snapshot, err := snapshotSize(r.URL.Query().Get("snapshot"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since, err := sinceSeq(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	phones, subscribed := initialSubscription(r)
+	if subscribed && who != nil {
+		if err := checkSubscription(who, phones); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		reqLogger(r).Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	if who == nil {
+		// No token on the upgrade request; the first message must carry one
+		status := http.StatusUnauthorized
+		if who, err = wsAuthenticate(conn, r); err == nil && subscribed {
+			status = http.StatusForbidden
+			err = checkSubscription(who, phones)
+		}
+		if err != nil {
+			auditAccess("live.subscribe", r.Method, r.URL.Path, clientIP(r), who, phones, status)
+			refuseViewer(conn, err)
+			return
+		}
+	}
+	auditAccess("live.subscribe", r.Method, r.URL.Path, clientIP(r), who, phones, http.StatusSwitchingProtocols)
+	client := newWSClient(conn, who)
+	client.ip = clientIP(r)
+	if subscribed {
+		client.phones = map[string]bool{}
+		for _, p := range phones {
+			client.phones[p] = true
+		}
+	}
+	registerClient(client, snapshot, since)
+	go client.writePump()
+
+	// A viewer that stops answering pings is dropped after wsPongWait
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	// Read subscription changes until the viewer goes away
+	for {
+		var msg wsSubscription
+		if err := conn.ReadJSON(&msg); err != nil {
+			hub.unregister <- client
+			conn.Close()
+			return
+		}
+		handleSubscription(client, msg)
+	}
+}
+
+const (
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsWriteWait  = 10 * time.Second
+)
+
+// originChecker builds the websocket CheckOrigin func. Browsers may only open
+// /ws from the server's own origin or one listed in allowed (comma-separated,
+// e.g. "https://map.example.com"); insecure accepts every origin.
+// Non-browser clients that send no Origin header are always accepted.
+func originChecker(allowed string, insecure bool) func(*http.Request) bool {
+	if insecure {
+		slog.Warn("--insecure-origins set, any website can open the live feed")
+		return func(*http.Request) bool { return true }
+	}
+	origins := map[string]bool{}
+	for _, o := range strings.Split(allowed, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		}
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if origins[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// closeWebSockets sends every live viewer a going-away close frame
+func closeWebSockets() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	inHub(func(clients map[*wsClient]bool) {
+		for c := range clients {
+			dropClient(clients, c, msg)
+		}
+	})
+}
+
+func broadcast(loc Location) {
+	broadcastFor(loc.Phone, loc)
+}
+
+// broadcastFor sends v to every live viewer allowed to see phone, here and
+// on the other replicas
+func broadcastFor(phone string, v interface{}) {
+	deliver(phone, v)
+	relay(phone, v)
+}
+
+// deliver sends v to this replica's live viewers allowed to see phone
+func deliver(phone string, v interface{}) {
+	publishLive(phone, v)
+	hub.broadcast <- hubMessage{phone: phone, v: v}
+}
+
+// maxClockSkew is how far in the future a client timestamp may be
+const maxClockSkew = time.Minute
+
+// reportTime normalises a client-supplied timestamp to UTC, defaulting to
+// now when the client sent none
+func reportTime(t time.Time) (time.Time, error) {
+	now := time.Now().UTC()
+	if t.IsZero() {
+		return now, nil
+	}
+	if t.After(now.Add(maxClockSkew)) {
+		return time.Time{}, errors.New("when is in the future")
+	}
+	return t.UTC(), nil
+}
+```
+
+---
+
+### server_apiversion.go
+```go
+package main
+
+// server_apiversion.go
+// - The API is served under /v1 so breaking changes (field renames, new
+//   auth requirements) can ship under /v2 without breaking deployed clients
+// - The old unversioned paths keep working: they are rewritten to /v1 and
+//   answered with "Deprecation: true" and a Link to the versioned path
+// - Probes, the viewer and static files are not part of the API and stay
+//   unversioned
+
+import (
+	"net/http"
+	"strings"
+)
+
+const apiPrefix = "/v1"
+
+// legacyAPIPaths are the unversioned API roots still accepted
+var legacyAPIPaths = []string{
+	"/auth", "/devices", "/geofences", "/pair", "/report", "/get", "/latest",
+	"/stats", "/owntracks", "/import", "/admin", "/ws", "/events",
+}
+
+func isLegacyAPIPath(path string) bool {
+	for _, p := range legacyAPIPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unversionedPath strips the API version from path, for rules written
+// against the old paths
+func unversionedPath(path string) string {
+	if strings.HasPrefix(path, apiPrefix+"/") {
+		return path[len(apiPrefix):]
+	}
+	return path
+}
+
+// legacyAPI serves unversioned API paths from /v1
+func legacyAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLegacyAPIPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = apiPrefix + r.URL.Path
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = apiPrefix + r.URL.RawPath
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+r2.URL.EscapedPath()+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r2)
+	})
+}
+```
+
+---
+
+### server_openapi.go
+```go
+package main
+
+// server_openapi.go
+// - GET /openapi.json describes the API as an OpenAPI 3 document built from
+//   the router, so every registered route shows up even before it has a
+//   summary in apiOps
+// - GET /docs is Swagger UI for trying requests from the browser; its
+//   assets come from the unpkg CDN (SWAGGER_UI_URL to self-host them)
+// - Viewer and admin routes are marked as needing a bearer token or API key;
+//   device routes carry their token in the body
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOp documents one route, keyed by "METHOD /path"
+type apiOp struct {
+	summary string
+	tag     string
+	public  bool     // no viewer or admin credentials needed
+	query   []string // query parameters
+}
+
+var apiOps = map[string]apiOp{
+	"GET /v1/auth/csrf":                       {"CSRF token for browser sessions", "auth", true, nil},
+	"POST /v1/auth/login":                     {"Log in with a viewer password", "auth", true, nil},
+	"GET /v1/auth/methods":                    {"Enabled login methods", "auth", true, nil},
+	"GET /v1/auth/oidc/login":                 {"Start an OIDC login", "auth", true, nil},
+	"GET /v1/auth/oidc/callback":              {"OIDC redirect target", "auth", true, []string{"code", "state"}},
+	"GET /v1/devices":                         {"List devices", "devices", false, nil},
+	"POST /v1/devices":                        {"Register a device", "devices", false, nil},
+	"PATCH /v1/devices/{phone}":               {"Change a device's label, color or icon", "devices", false, nil},
+	"DELETE /v1/devices/{phone}":              {"Delete a device and its history", "devices", false, nil},
+	"GET /v1/geofences":                       {"List geofences", "geofences", false, nil},
+	"POST /v1/geofences":                      {"Create a geofence", "geofences", false, nil},
+	"PUT /v1/geofences/{id}":                  {"Replace a geofence", "geofences", false, nil},
+	"DELETE /v1/geofences/{id}":               {"Delete a geofence", "geofences", false, nil},
+	"POST /v1/pair":                           {"Confirm pairing with a code", "devices", true, nil},
+	"DELETE /v1/pair":                         {"Withdraw consent", "devices", true, nil},
+	"POST /v1/client/config":                  {"Settings for the bundled client", "devices", true, nil},
+	"POST /v1/report":                         {"Report a location", "reports", true, nil},
+	"POST /v1/report/batch":                   {"Report several locations", "reports", true, nil},
+	"DELETE /v1/get/{phone}":                  {"Move a device's history to the trash", "history", false, nil},
+	"GET /v1/get/{phone}":                     {"Location history", "history", false, []string{"bbox", "near", "radius", "max_accuracy"}},
+	"GET /v1/latest/{phone}":                  {"Latest location", "history", false, []string{"bbox", "near", "radius", "max_accuracy"}},
+	"GET /v1/stats/{phone}":                   {"Distance and speed statistics", "history", false, []string{"from", "to"}},
+	"GET /v1/heatmap/{phone}":                 {"Point density per grid cell", "history", false, []string{"cell", "from", "to"}},
+	"GET /v1/trips/{phone}":                   {"Trips split from the history", "history", false, []string{"from", "to", "tolerance"}},
+	"GET /v1/stops/{phone}":                   {"Places where the device stayed", "history", false, []string{"radius", "min_duration", "from", "to"}},
+	"GET /v1/summaries/{phone}":               {"Daily and weekly summaries", "history", false, []string{"period"}},
+	"POST /v1/import/{phone}/takeout":         {"Import Google Takeout history", "history", false, nil},
+	"POST /v1/import/{phone}/gpx":             {"Import a GPX track", "history", false, nil},
+	"GET /v1/export/{phone}/bundle":           {"Everything held about a device, as a zip", "history", false, nil},
+	"POST /v1/owntracks":                      {"OwnTracks HTTP endpoint", "reports", true, nil},
+	"GET /v1/ws":                              {"Live updates over a WebSocket", "live", false, []string{"phones", "phone", "snapshot", "since"}},
+	"GET /v1/events/{phone}":                  {"Live updates as Server-Sent Events", "live", false, []string{"last_event_id"}},
+	"GET /v1/admin/audit":                     {"Query the audit log", "admin", false, []string{"limit", "since", "phone", "actor", "action"}},
+	"GET /v1/admin/status":                    {"Uptime, viewers, throughput and health", "admin", false, nil},
+	"GET /v1/admin/storage":                   {"Storage usage", "admin", false, nil},
+	"GET /v1/admin/keys":                      {"List API keys", "admin", false, nil},
+	"POST /v1/admin/keys":                     {"Create an API key", "admin", false, nil},
+	"POST /v1/admin/keys/{id}/rotate":         {"Rotate an API key", "admin", false, nil},
+	"DELETE /v1/admin/keys/{id}":              {"Revoke an API key", "admin", false, nil},
+	"PUT /v1/admin/keys/{id}/quota":           {"Set an API key's quotas", "admin", false, nil},
+	"GET /v1/admin/usage":                     {"Quotas and usage of every API key", "admin", false, nil},
+	"GET /v1/usage":                           {"Quotas and usage of the calling API key", "keys", false, nil},
+	"GET /v1/admin/trash":                     {"List deleted history awaiting purge", "admin", false, nil},
+	"POST /v1/admin/trash/{phone}/restore":    {"Undo a history delete", "admin", false, nil},
+	"POST /v1/admin/purge":                    {"Remove deleted history past its grace period", "admin", false, []string{"phone"}},
+	"GET /v1/admin/client-config":             {"Client settings for the fleet and each device", "admin", false, nil},
+	"PUT /v1/admin/client-config":             {"Set the fleet's client settings (operators)", "admin", false, nil},
+	"PUT /v1/admin/client-config/{phone}":     {"Override client settings for a device", "admin", false, nil},
+	"DELETE /v1/admin/client-config/{phone}":  {"Drop a device's client settings override", "admin", false, nil},
+	"GET /v1/admin/lockouts":                  {"List login lockouts", "admin", false, nil},
+	"DELETE /v1/admin/lockouts":               {"Clear all lockouts", "admin", false, nil},
+	"DELETE /v1/admin/lockouts/{key}":         {"Clear one lockout", "admin", false, nil},
+	"GET /v1/admin/pairings":                  {"List pending pairings", "admin", false, nil},
+	"POST /v1/admin/pairings":                 {"Issue a pairing code", "admin", false, nil},
+	"GET /v1/admin/tenants":                   {"List tenants (operators)", "admin", false, nil},
+	"POST /v1/admin/tenants":                  {"Create a tenant (operators)", "admin", false, nil},
+	"DELETE /v1/admin/tenants/{id}":           {"Delete an empty tenant (operators)", "admin", false, nil},
+	"POST /v1/admin/pairings/{phone}/confirm": {"Confirm a pairing for a device", "admin", false, nil},
+	"GET /healthz":                            {"Liveness probe", "probes", true, nil},
+	"GET /readyz":                             {"Readiness probe", "probes", true, nil},
+}
+
+type openAPIParam struct {
+	Name     string            `json:"name"`
+	In       string            `json:"in"`
+	Required bool              `json:"required,omitempty"`
+	Schema   map[string]string `json:"schema"`
+}
+
+type openAPIOp struct {
+	Summary     string                `json:"summary,omitempty"`
+	OperationID string                `json:"operationId"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []openAPIParam        `json:"parameters,omitempty"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Responses   map[string]any        `json:"responses"`
+}
+
+var pathVar = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// buildOpenAPI walks the router and describes every route with a template
+// and methods
+func buildOpenAPI(router *mux.Router) ([]byte, error) {
+	paths := map[string]map[string]*openAPIOp{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil // a subrouter prefix
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil || tpl == "/" || strings.HasPrefix(tpl, "/static") || tpl == "/openapi.json" || tpl == "/docs" {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"} // the WebSocket upgrade
+		}
+		path := pathVar.ReplaceAllString(tpl, "{$1}")
+		for _, m := range methods {
+			if m == http.MethodHead {
+				continue
+			}
+			if paths[path] == nil {
+				paths[path] = map[string]*openAPIOp{}
+			}
+			paths[path][strings.ToLower(m)] = describeRoute(m, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "nu-loc",
+			"version": strings.TrimPrefix(apiPrefix, "/"),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+				"token":  map[string]string{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func describeRoute(method, path string) *openAPIOp {
+	doc := apiOps[method+" "+path]
+	op := &openAPIOp{
+		Summary:     doc.summary,
+		OperationID: operationID(method, path),
+		Responses:   map[string]any{"200": map[string]string{"description": "OK"}},
+	}
+	if doc.tag != "" {
+		op.Tags = []string{doc.tag}
+	}
+	for _, m := range pathVar.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, openAPIParam{
+			Name: m[1], In: "path", Required: true, Schema: map[string]string{"type": "string"},
+		})
+	}
+	for _, q := range doc.query {
+		op.Parameters = append(op.Parameters, openAPIParam{
+			Name: q, In: "query", Schema: map[string]string{"type": "string"},
+		})
+	}
+	if !doc.public {
+		op.Security = []map[string][]string{{"bearer": {}}, {"token": {}}}
+		op.Responses["401"] = map[string]string{"description": "Missing or invalid credentials"}
+	}
+	return op
+}
+
+// operationID turns "DELETE /v1/devices/{phone}" into "deleteDevicesPhone"
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' }) {
+		if "/"+part == apiPrefix {
+			continue
+		}
+		for _, word := range strings.Split(part, "_") {
+			if word != "" {
+				id += strings.ToUpper(word[:1]) + word[1:]
+			}
+		}
+	}
+	return id
+}
+
+// openAPIHandler serves the document for router, built on first use once
+// every route is registered
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	var (
+		once sync.Once
+		spec []byte
+		err  error
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { spec, err = buildOpenAPI(router) })
+		if err != nil {
+			reqLogger(r).Error("openapi", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nu-loc API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({ url: '/openapi.json', dom_id: '#swagger-ui' });
+</script>
+</body>
+</html>
+`))
+
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	base := setting("SWAGGER_UI_URL")
+	if base == "" {
+		base = "https://unpkg.com/swagger-ui-dist@5.17.14"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	docsPage.Execute(w, strings.TrimSuffix(base, "/"))
+}
+```
+
+---
+
+### server_health.go
+```go
+package main
+
+// server_health.go
+// - GET /healthz: liveness, 200 whenever the process is serving HTTP
+// - GET /readyz: readiness, 200 only when every registered check passes
+//   (storage, audit log, and any broker a backend registers), else 503
+//   with the failing checks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const readyTimeout = 2 * time.Second
+
+var (
+	readyChecks = map[string]func(context.Context) error{
+		"storage":   checkStorage,
+		"audit_log": checkAuditLog,
+	}
+	readyMu = sync.RWMutex{}
+)
+
+// registerReadyCheck adds a dependency that must be healthy for /readyz
+func registerReadyCheck(name string, check func(context.Context) error) {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	readyChecks[name] = check
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	results, ok := runReadyChecks(r.Context())
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	state := "ok"
+	if !ok {
+		state = "unavailable"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": state, "checks": results})
+}
+
+// runReadyChecks runs every registered check, returning "ok" or the error
+// for each and whether all passed
+func runReadyChecks(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	readyMu.RLock()
+	names := make([]string, 0, len(readyChecks))
+	for name := range readyChecks {
+		names = append(names, name)
+	}
+	readyMu.RUnlock()
+	sort.Strings(names)
+
+	results := map[string]string{}
+	ok := true
+	for _, name := range names {
+		readyMu.RLock()
+		check := readyChecks[name]
+		readyMu.RUnlock()
+		if err := check(ctx); err != nil {
+			results[name] = err.Error()
+			ok = false
+			continue
+		}
+		results[name] = "ok"
+	}
+	return results, ok
+}
+
+// checkStorage makes sure the in-memory store is not wedged behind its lock
+func checkStorage(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		stMutex.RLock()
+		stMutex.RUnlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("store lock not acquired in time")
+	}
+}
+
+func checkAuditLog(ctx context.Context) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return errors.New("audit log not open")
+	}
+	_, err := auditFile.Stat()
+	return err
+}
+```
+
+---
+
+### server_admin.go
+```go
+package main
+
+// server_admin.go
+// - Operator endpoints under /admin for inspecting the server
+// - GET /admin/status: uptime, live viewers, report throughput, dependency
+//   health and memory use
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var startedAt = time.Now()
+
+// reportMeter counts accepted reports in one-second buckets over the last
+// minute, plus a running total
+var reportMeter struct {
+	sync.Mutex
+	total   uint64
+	buckets [60]uint64
+	seconds [60]int64
+}
+
+// countReport records one accepted report
+func countReport() {
+	now := time.Now().Unix()
+	i := now % 60
+	reportMeter.Lock()
+	defer reportMeter.Unlock()
+	if reportMeter.seconds[i] != now {
+		reportMeter.seconds[i], reportMeter.buckets[i] = now, 0
+	}
+	reportMeter.buckets[i]++
+	reportMeter.total++
+}
+
+// reportsLastMinute returns the total and the count over the last 60s
+func reportsLastMinute() (total, lastMinute uint64) {
+	now := time.Now().Unix()
+	reportMeter.Lock()
+	defer reportMeter.Unlock()
+	for i, sec := range reportMeter.seconds {
+		if now-sec < 60 {
+			lastMinute += reportMeter.buckets[i]
+		}
+	}
+	return reportMeter.total, lastMinute
+}
+
+// statusHandler is a one-stop overview for operators and dashboards
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	// Live viewers, and how many of them receive each device's updates
+	stMutex.RLock()
+	phones := make([]string, 0, len(store))
+	points := 0
+	for phone, locs := range store {
+		phones = append(phones, phone)
+		points += len(locs)
+	}
+	stMutex.RUnlock()
+
+	perPhone := map[string]int{}
+	wsTotal := 0
+	inHub(func(clients map[*wsClient]bool) {
+		wsTotal = len(clients)
+		for c := range clients {
+			for _, phone := range phones {
+				if c.wants(phone) {
+					perPhone[phone]++
+				}
+			}
+		}
+	})
+	liveSubscribersMu.Lock()
+	sseTotal := len(liveSubscribers)
+	liveSubscribersMu.Unlock()
+
+	total, lastMinute := reportsLastMinute()
+	checks, healthy := runReadyChecks(r.Context())
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"started_at":     startedAt.UTC(),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"websocket": map[string]interface{}{
+			"clients":   wsTotal,
+			"per_phone": perPhone,
+		},
+		"event_streams": sseTotal,
+		"reports": map[string]interface{}{
+			"total":       total,
+			"last_minute": lastMinute,
+			"per_second":  float64(lastMinute) / 60,
+		},
+		"store": map[string]interface{}{
+			"backend": "memory",
+			"status":  checks["storage"],
+			"devices": len(phones),
+			"points":  points,
+		},
+		"healthy": healthy,
+		"checks":  checks,
+		"memory": map[string]interface{}{
+			"alloc_bytes":  mem.Alloc,
+			"heap_inuse":   mem.HeapInuse,
+			"sys_bytes":    mem.Sys,
+			"heap_objects": mem.HeapObjects,
+			"num_gc":       mem.NumGC,
+			"goroutines":   runtime.NumGoroutine(),
+		},
+	})
+}
+
+// deviceStorage summarises what the store holds for a single device
+type deviceStorage struct {
+	Phone       string     `json:"phone"`
+	Points      int        `json:"points"`
+	Oldest      *time.Time `json:"oldest,omitempty"`
+	Newest      *time.Time `json:"newest,omitempty"`
+	ApproxBytes int        `json:"approx_bytes"`
+	AtLimit     bool       `json:"at_retention_limit"`
+}
+
+// storageHandler reports per-device point counts, time span and approximate
+// memory usage so operators can see what the store is holding.
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	stMutex.RLock()
+	devices := make([]deviceStorage, 0, len(store))
+	totalPoints, totalBytes := 0, 0
+	for phone, locs := range store {
+		if !p.canView(phone) {
+			continue
+		}
+		d := deviceStorage{Phone: phone, Points: len(locs), AtLimit: len(locs) >= maxHistory}
+		if len(locs) > 0 {
+			d.Oldest = &locs[0].When
+			d.Newest = &locs[len(locs)-1].When
+		}
+		for _, l := range locs {
+			d.ApproxBytes += locationSize(l)
+		}
+		totalPoints += d.Points
+		totalBytes += d.ApproxBytes
+		devices = append(devices, d)
+	}
+	stMutex.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Phone < devices[j].Phone })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backend":      "memory",
+		"devices":      devices,
+		"total_points": totalPoints,
+		"approx_bytes": totalBytes,
+		"disk_bytes":   0,
+		"retention": map[string]interface{}{
+			"max_points_per_device": maxHistory,
+			"policy":                "drop-oldest",
+		},
+	})
+}
+
+// locationSize estimates the in-memory footprint of a stored Location
+func locationSize(l Location) int {
+	return int(unsafe.Sizeof(l)) + len(l.Phone) + len(l.Token) + len(l.IP) + len(l.Ciphertext)
+}
+```
+
+---
+
+### server_clientconfig.go
+```go
+package main
+
+// server_clientconfig.go
+// - Central configuration for the bundled client: report interval, adaptive
+//   interval bounds, location sources and pause/resume, so a fleet can be
+//   retuned without logging in to each machine
+// - PUT /admin/client-config sets the fleet default (operators);
+//   PUT /admin/client-config/{phone} overrides it for one device and
+//   DELETE removes the override. Fields left empty fall through to the
+//   fleet default and then to the client's own environment
+// - Clients poll POST /client/config with {"phone", "token"} and get the
+//   merged settings; If-None-Match saves the body when nothing changed
+// - Kept in CLIENT_CONFIG_FILE (default client_config.json)
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultClientConfigFile = "client_config.json"
+
+// clientSourceNames are the location sources the bundled client knows
+var clientSourceNames = map[string]bool{"geoip": true, "gpsd": true, "nmea": true, "wifi": true, "cell": true}
+
+// clientConfig is a set of client settings; empty fields are unset
+type clientConfig struct {
+	Interval    string `json:"interval,omitempty"`     // e.g. 30s, like REPORT_INTERVAL
+	IntervalMin string `json:"interval_min,omitempty"` // INTERVAL_MIN
+	IntervalMax string `json:"interval_max,omitempty"` // INTERVAL_MAX
+	Source      string `json:"source,omitempty"`       // SOURCE, e.g. gpsd,geoip
+	Paused      *bool  `json:"paused,omitempty"`       // stop reporting until unpaused
+}
+
+type clientConfigs struct {
+	Fleet   clientConfig            `json:"fleet"`
+	Devices map[string]clientConfig `json:"devices"`
+	Updated time.Time               `json:"updated"`
+}
+
+var (
+	clientCfg        = clientConfigs{Devices: map[string]clientConfig{}}
+	clientCfgMu      sync.RWMutex
+	clientConfigFile = defaultClientConfigFile
+)
+
+func loadClientConfigs() error {
+	if p := setting("CLIENT_CONFIG_FILE"); p != "" {
+		clientConfigFile = p
+	}
+	clientCfgMu.Lock()
+	defer clientCfgMu.Unlock()
+	if err := loadJSON(clientConfigFile, &clientCfg); err != nil {
+		return err
+	}
+	if clientCfg.Devices == nil {
+		clientCfg.Devices = map[string]clientConfig{}
+	}
+	return nil
+}
+
+// check validates c the way the client will read it
+func (c clientConfig) check() error {
+	intervals := map[string]string{"interval": c.Interval, "interval_min": c.IntervalMin, "interval_max": c.IntervalMax}
+	parsed := map[string]time.Duration{}
+	for name, v := range intervals {
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if n, nerr := strconv.Atoi(v); nerr == nil {
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d%time.Second != 0 || d < time.Second || d > 24*time.Hour {
+			return fmt.Errorf("%s: want whole seconds between 1s and 24h, e.g. 30s or 5m", name)
+		}
+		parsed[name] = d
+	}
+	if min, max := parsed["interval_min"], parsed["interval_max"]; min > 0 && max > 0 && min > max {
+		return fmt.Errorf("interval_min is longer than interval_max")
+	}
+	if c.Source != "" {
+		for _, name := range strings.Split(c.Source, ",") {
+			if !clientSourceNames[strings.TrimSpace(name)] {
+				return fmt.Errorf("source: unknown source %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// over returns c with the fields set in o replacing its own
+func (c clientConfig) over(o clientConfig) clientConfig {
+	for dst, src := range map[*string]string{&c.Interval: o.Interval, &c.IntervalMin: o.IntervalMin, &c.IntervalMax: o.IntervalMax, &c.Source: o.Source} {
+		if src != "" {
+			*dst = src
+		}
+	}
+	if o.Paused != nil {
+		c.Paused = o.Paused
+	}
+	return c
+}
+
+// clientConfigHandler is polled by clients with {"phone", "token"}
+func clientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone string `json:"phone"`
+		Token string `json:"token"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	lockKeys := []string{ipKey(r), deviceKey(req.Phone)}
+	if authBlocked(w, lockKeys...) {
+		return
+	}
+	if !checkDeviceToken(req.Phone, req.Token) {
+		authFailed(lockKeys...)
+		http.Error(w, "invalid device token", http.StatusUnauthorized)
+		return
+	}
+
+	clientCfgMu.RLock()
+	cfg := clientCfg.Fleet.over(clientCfg.Devices[req.Phone])
+	updated := clientCfg.Updated
+	clientCfgMu.RUnlock()
+	b, _ := json.Marshal(cfg)
+	if notModified(w, r, fmt.Sprintf(`"%08x"`, crc32.ChecksumIEEE(b)), updated) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// listClientConfigsHandler shows the fleet default and the overrides of the
+// devices the caller can see
+func listClientConfigsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	clientCfgMu.RLock()
+	out := clientConfigs{Fleet: clientCfg.Fleet, Devices: map[string]clientConfig{}, Updated: clientCfg.Updated}
+	for phone, c := range clientCfg.Devices {
+		if p.canView(phone) {
+			out.Devices[phone] = c
+		}
+	}
+	clientCfgMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// setClientConfigHandler replaces the fleet default, or one device's
+// override when the route has {phone}
+func setClientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	phone, forDevice := mux.Vars(r)["phone"]
+	var c clientConfig
+	if err := decodeJSON(w, r, &c); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := c.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if forDevice && !deviceKnown(phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	clientCfgMu.Lock()
+	defer clientCfgMu.Unlock()
+	prev := clientCfg
+	prev.Devices = make(map[string]clientConfig, len(clientCfg.Devices))
+	for k, v := range clientCfg.Devices {
+		prev.Devices[k] = v
+	}
+	if forDevice {
+		clientCfg.Devices[phone] = c
+	} else {
+		clientCfg.Fleet = c
+	}
+	clientCfg.Updated = time.Now().UTC()
+	if err := saveJSON(clientConfigFile, clientCfg); err != nil {
+		clientCfg = prev
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteClientConfigHandler drops a device's override
+func deleteClientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	clientCfgMu.Lock()
+	defer clientCfgMu.Unlock()
+	c, ok := clientCfg.Devices[phone]
+	if !ok {
+		http.Error(w, "no override for this device", http.StatusNotFound)
+		return
+	}
+	delete(clientCfg.Devices, phone)
+	clientCfg.Updated = time.Now().UTC()
+	if err := saveJSON(clientConfigFile, clientCfg); err != nil {
+		clientCfg.Devices[phone] = c
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetClientConfig drops a deleted device's override
+func forgetClientConfig(phone string) {
+	clientCfgMu.Lock()
+	defer clientCfgMu.Unlock()
+	if _, ok := clientCfg.Devices[phone]; !ok {
+		return
+	}
+	delete(clientCfg.Devices, phone)
+	if err := saveJSON(clientConfigFile, clientCfg); err != nil {
+		slog.Error("saving client config failed", "err", err)
+	}
+}
+```
+
+---
+
+### server_trash.go
+```go
+package main
+
+// server_trash.go
+// - DELETE /get/{phone} (admin) moves a device's history to the trash: it
+//   is hidden from queries, exports and live replays at once, but can be
+//   brought back with POST /admin/trash/{phone}/restore
+// - POST /admin/purge removes trashed history for good once it has been
+//   there for PURGE_GRACE (default 168h); ?phone= limits it to one device
+// - GET /admin/trash lists what is waiting to be purged
+// - New reports after a delete start a fresh history; a restore merges the
+//   two. Like the store itself, the trash is lost on restart
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultPurgeGrace = 7 * 24 * time.Hour
+
+var purgeGrace = defaultPurgeGrace
+
+// trashEntry is a device's deleted history; it belongs to stMutex
+type trashEntry struct {
+	Locations []Location
+	Deleted   time.Time
+	By        string
+}
+
+var trash = map[string]*trashEntry{}
+
+// loadPurgeGrace reads PURGE_GRACE
+func loadPurgeGrace() error {
+	if v := setting("PURGE_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("PURGE_GRACE: invalid value %q", v)
+		}
+		purgeGrace = d
+	}
+	return nil
+}
+
+// trashedSummary is one entry of GET /admin/trash and the delete response
+type trashedSummary struct {
+	Phone       string    `json:"phone"`
+	Points      int       `json:"points"`
+	Deleted     time.Time `json:"deleted"`
+	DeletedBy   string    `json:"deleted_by,omitempty"`
+	PurgeableAt time.Time `json:"purgeable_at"`
+}
+
+func (t *trashEntry) summary(phone string) trashedSummary {
+	return trashedSummary{Phone: phone, Points: len(t.Locations), Deleted: t.Deleted, DeletedBy: t.By, PurgeableAt: t.Deleted.Add(purgeGrace)}
+}
+
+// deleteHistoryHandler moves phone's history to the trash. Deleting again
+// adds newer points to what is already there and restarts the grace period.
+func deleteHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+
+	stMutex.Lock()
+	locs := store[phone]
+	if len(locs) == 0 {
+		stMutex.Unlock()
+		http.Error(w, "no history to delete", http.StatusNotFound)
+		return
+	}
+	t, ok := trash[phone]
+	if !ok {
+		t = &trashEntry{}
+		trash[phone] = t
+	}
+	t.Locations = append(t.Locations, locs...)
+	t.Deleted, t.By = time.Now().UTC(), requestPrincipal(r).Name
+	delete(store, phone)
+	touchHistoryLocked(phone)
+	summary := t.summary(phone)
+	stMutex.Unlock()
+
+	forgetBroadcasts(phone)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// restoreHistoryHandler puts trashed history back, merged with anything
+// reported since and trimmed to the retention limit
+func restoreHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+
+	stMutex.Lock()
+	defer stMutex.Unlock()
+	t, ok := trash[phone]
+	if !ok {
+		http.Error(w, "nothing in the trash for this device", http.StatusNotFound)
+		return
+	}
+	merged := append(append([]Location(nil), t.Locations...), store[phone]...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].When.Before(merged[j].When) })
+	if len(merged) > maxHistory {
+		merged = merged[len(merged)-maxHistory:]
+	}
+	store[phone] = merged
+	delete(trash, phone)
+	touchHistoryLocked(phone)
+	go func() {
+		// summaries made while the old points were away left them out
+		dropSummaries(phone, func(s Summary) bool { return s.Start.Before(t.Deleted) && s.CreatedAt.After(t.Deleted) })
+		summarizeFinished(time.Now().UTC())
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"phone": phone, "restored_points": len(t.Locations), "points": len(merged)})
+}
+
+// listTrashHandler lists trashed history the caller may view
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	stMutex.RLock()
+	list := make([]trashedSummary, 0, len(trash))
+	for phone, t := range trash {
+		if p.canView(phone) {
+			list = append(list, t.summary(phone))
+		}
+	}
+	stMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Phone < list[j].Phone })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"trash": list, "grace_seconds": int64(purgeGrace.Seconds())})
+}
+
+// purgeHandler removes trashed history whose grace period is over. Entries
+// still in their grace period are listed as kept.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	only := r.URL.Query().Get("phone")
+	now := time.Now()
+
+	purged := []trashedSummary{}
+	kept := []trashedSummary{}
+	stMutex.Lock()
+	for phone, t := range trash {
+		if !p.canView(phone) || only != "" && phone != only {
+			continue
+		}
+		if now.Sub(t.Deleted) < purgeGrace {
+			kept = append(kept, t.summary(phone))
+			continue
+		}
+		purged = append(purged, t.summary(phone))
+		delete(trash, phone)
+	}
+	stMutex.Unlock()
+	for _, t := range purged {
+		// later summaries are of the history started since
+		dropSummaries(t.Phone, func(s Summary) bool { return s.Start.Before(t.Deleted) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"purged": purged, "kept": kept})
+}
+
+// forgetTrash drops phone's trashed history without a grace period, for
+// decommissioned devices
+func forgetTrash(phone string) {
+	stMutex.Lock()
+	delete(trash, phone)
+	stMutex.Unlock()
+}
+```
+
+---
+
+### server_batch.go
+```go
+package main
+
+// server_batch.go
+// - POST /report/batch takes a JSON array of reports queued by a client
+//   while offline, all for one phone
+// - The batch is authorized once, like /report; each point is then checked
+//   on its own and the valid ones are merged into the history by time, so a
+//   batch held back in an offline queue never lands after newer points, and
+//   broadcast oldest first
+// - Points keep their "when" so history reflects when they were recorded;
+//   points without one are stamped with the arrival time
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const maxBatchSize = 1000
+
+// batchRejection explains why one point of a batch was dropped
+type batchRejection struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func batchReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, maxBodyBytes)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	var locs []Location
+	if err := decodeBody(r, body, &locs); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if len(locs) == 0 {
+		http.Error(w, "empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(locs) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("batch larger than %d points", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	phone, token := locs[0].Phone, ""
+	for _, loc := range locs {
+		if loc.Phone != phone {
+			http.Error(w, "all points in a batch must share one phone", http.StatusBadRequest)
+			return
+		}
+		if token == "" {
+			token = loc.Token
+		}
+	}
+	if !authorizeReport(w, r, body, phone, token) {
+		return
+	}
+
+	accepted := make([]Location, 0, len(locs))
+	rejected := []batchRejection{}
+	for i, loc := range locs {
+		if cerr := checkLocation(loc); cerr != nil {
+			rejected = append(rejected, batchRejection{i, cerr.Error()})
+			continue
+		}
+		if loc.When, err = reportTime(loc.When); err != nil {
+			rejected = append(rejected, batchRejection{i, err.Error()})
+			continue
+		}
+		accepted = append(accepted, loc)
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if !accepted[i].When.Equal(accepted[j].When) {
+			return accepted[i].When.Before(accepted[j].When)
+		}
+		return accepted[i].Seq < accepted[j].Seq
+	})
+	ingest(accepted...)
+	reqLogger(r).Debug("batch stored", "device", phone, "accepted", len(accepted), "rejected", len(rejected))
+
+	writeEncoded(w, r, map[string]interface{}{"accepted": len(accepted), "rejected": rejected})
+}
+```
+
+---
+
+### server_import.go
+```go
+package main
+
+// server_import.go
+// - Imports location history exported from other services into the store
+// - Imported points are stored but not broadcast to live viewers; they are
+//   merged into the history by time, so old ones never push out newer live
+//   points when the retention limit trims
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// takeoutRecords mirrors the parts of Google Takeout Records.json we use
+type takeoutRecords struct {
+	Locations []struct {
+		LatitudeE7  int64  `json:"latitudeE7"`
+		LongitudeE7 int64  `json:"longitudeE7"`
+		Accuracy    int    `json:"accuracy"`
+		Timestamp   string `json:"timestamp"`
+		TimestampMs string `json:"timestampMs"`
+	} `json:"locations"`
+}
+
+// takeoutImportHandler loads a Google Takeout Records.json body under the
+// device ID given in the path.
+func takeoutImportHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !deviceKnown(phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	// Takeout carries many fields we don't use, so decoding is size-limited
+	// but not strict
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var recs takeoutRecords
+	if err := json.NewDecoder(r.Body).Decode(&recs); err != nil {
+		if isTooLarge(err) {
+			bodyError(w, err)
+			return
+		}
+		http.Error(w, "invalid takeout json", http.StatusBadRequest)
+		return
+	}
+
+	locs := make([]Location, 0, len(recs.Locations))
+	skipped := 0
+	for _, rec := range recs.Locations {
+		when, ok := takeoutTime(rec.Timestamp, rec.TimestampMs)
+		loc := Location{Phone: phone, Lat: float64(rec.LatitudeE7) / 1e7, Lon: float64(rec.LongitudeE7) / 1e7,
+			Accuracy: float64(rec.Accuracy), When: when.UTC()}
+		if !ok || checkLocation(loc) != nil {
+			skipped++
+			continue
+		}
+		locs = append(locs, loc)
+	}
+	writeImportResult(w, phone, locs, skipped)
+}
+
+// takeoutTime parses either the newer RFC3339 timestamp or the legacy
+// millisecond epoch string used by older exports.
+func takeoutTime(ts, ms string) (time.Time, bool) {
+	if ts != "" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		return t, err == nil
+	}
+	if ms != "" {
+		n, err := strconv.ParseInt(ms, 10, 64)
+		return time.UnixMilli(n), err == nil
+	}
+	return time.Time{}, false
+}
+
+// gpxPoint is a GPX <trkpt>, <rtept> or <wpt> element
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+// tcxPoint is a TCX <Trackpoint> element
+type tcxPoint struct {
+	Time     string `xml:"Time"`
+	Position *struct {
+		Lat float64 `xml:"LatitudeDegrees"`
+		Lon float64 `xml:"LongitudeDegrees"`
+	} `xml:"Position"`
+}
+
+// gpxImportHandler accepts a GPX or TCX document, either as the raw request
+// body or as the "file" field of a multipart upload, and stores its
+// trackpoints with their original timestamps.
+func gpxImportHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !deviceKnown(phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if isTooLarge(err) {
+			bodyError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "missing file field", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	var locs []Location
+	skipped := 0
+	add := func(lat, lon float64, ts string) {
+		when, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(ts))
+		if err != nil || checkCoords(lat, lon, false) != nil {
+			skipped++
+			return
+		}
+		locs = append(locs, Location{Phone: phone, Lat: lat, Lon: lon, When: when.UTC()})
+	}
+
+	dec := xml.NewDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if isTooLarge(err) {
+			bodyError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid gpx/tcx xml", http.StatusBadRequest)
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "trkpt", "rtept", "wpt":
+			var p gpxPoint
+			if err := dec.DecodeElement(&p, &se); err != nil {
+				http.Error(w, "invalid gpx point", http.StatusBadRequest)
+				return
+			}
+			add(p.Lat, p.Lon, p.Time)
+		case "Trackpoint":
+			var p tcxPoint
+			if err := dec.DecodeElement(&p, &se); err != nil {
+				http.Error(w, "invalid tcx trackpoint", http.StatusBadRequest)
+				return
+			}
+			if p.Position == nil {
+				// heart-rate only samples carry no position
+				skipped++
+				continue
+			}
+			add(p.Position.Lat, p.Position.Lon, p.Time)
+		}
+	}
+	writeImportResult(w, phone, locs, skipped)
+}
+
+// writeImportResult merges locs into the history and reports how many of
+// them survived retention.
+// Only the newest maxHistory points survive retention.
+func writeImportResult(w http.ResponseWriter, phone string, locs []Location, skipped int) {
+	kept := appendHistory(phone, locs...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"phone":    phone,
+		"imported": len(locs),
+		"skipped":  skipped,
+		"retained": kept,
+	})
+}
+```
+
+---
+
+### server_export.go
+```go
+package main
+
+// server_export.go
+// - GET /export/{phone}/bundle (admin) answers data-subject access
+//   requests: a zip of everything held about one device
+// - history.json has every stored point, and any still in the trash;
+//   history.gpx and history.csv have the same points for other tools (GPX
+//   leaves out end-to-end encrypted points, which have no coordinates)
+// - device.json has the registration (without its token), pairing state
+//   and summaries; audit.jsonl has the audit log entries naming the device
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// gpxDocument is the GPX 1.1 track written to the bundle
+type gpxDocument struct {
+	XMLName xml.Name `xml:"gpx"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   struct {
+		Name    string `xml:"name"`
+		Segment struct {
+			Points []gpxTrackPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type gpxTrackPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele,omitempty"`
+	Time string   `xml:"time"`
+}
+
+// exportBundleHandler streams the zip for one device
+func exportBundleHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	p := requestPrincipal(r)
+	if !deviceKnown(phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	stMutex.RLock()
+	locs := append([]Location(nil), store[phone]...)
+	deleted := []Location{}
+	if t, ok := trash[phone]; ok {
+		deleted = append(deleted, t.Locations...)
+	}
+	stMutex.RUnlock()
+
+	// every access to the device, operators' included; the caller's right
+	// to the device was checked by requirePhone
+	audit, err := readAudit(func(e AuditEntry) bool { return e.Phone == phone })
+	if err != nil {
+		http.Error(w, "read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	name := phone + "-" + now.Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"device.json", func(out io.Writer) error { return writeBundleDevice(out, phone, p, now) }},
+		{"history.json", func(out io.Writer) error {
+			return json.NewEncoder(out).Encode(map[string]interface{}{"phone": phone, "locations": locs, "deleted_locations": deleted})
+		}},
+		{"history.gpx", func(out io.Writer) error { return writeBundleGPX(out, phone, append(deleted, locs...)) }},
+		{"history.csv", func(out io.Writer) error { return writeBundleCSV(out, locs, deleted) }},
+		{"audit.jsonl", func(out io.Writer) error {
+			enc := json.NewEncoder(out)
+			for _, e := range audit {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	}
+	for _, f := range files {
+		out, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			err = f.write(out)
+		}
+		if err != nil {
+			// the status is already sent; a truncated zip fails to open
+			slog.Error("export bundle failed", "phone", phone, "file", f.name, "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Error("export bundle failed", "phone", phone, "err", err)
+	}
+}
+
+// writeBundleDevice writes device.json
+func writeBundleDevice(out io.Writer, phone string, p *principal, now time.Time) error {
+	info := map[string]interface{}{
+		"phone":       phone,
+		"paired":      devicePaired(phone),
+		"exported_at": now,
+		"exported_by": p.Name,
+	}
+	devicesMu.RLock()
+	if d, ok := devices[phone]; ok {
+		reg := *d
+		reg.Token = ""
+		info["registration"] = reg
+	}
+	devicesMu.RUnlock()
+	summariesMu.RLock()
+	info["summaries"] = append([]Summary{}, summaries[phone]...)
+	summariesMu.RUnlock()
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+// writeBundleGPX writes locs as one GPX track
+func writeBundleGPX(out io.Writer, phone string, locs []Location) error {
+	doc := gpxDocument{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "nuloc"}
+	doc.Track.Name = phone
+	for _, l := range locs {
+		if l.Ciphertext != "" {
+			continue
+		}
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxTrackPoint{Lat: l.Lat, Lon: l.Lon, Ele: l.Altitude, Time: l.When.Format(time.RFC3339Nano)})
+	}
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// writeBundleCSV writes one row per point, trashed points marked deleted
+func writeBundleCSV(out io.Writer, locs, deleted []Location) error {
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"when", "received", "seq", "lat", "lon", "accuracy", "altitude", "speed", "bearing", "battery", "network",
+		"hostname", "uptime", "interface", "recoveries", "place", "ip", "ciphertext", "deleted"})
+	num := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	for i, l := range append(append([]Location(nil), deleted...), locs...) {
+		received, seq, accuracy, battery, uptime, recoveries := "", "", "", "", "", ""
+		if l.Received != nil {
+			received = l.Received.Format(time.RFC3339Nano)
+		}
+		if l.Seq > 0 {
+			seq = strconv.FormatUint(l.Seq, 10)
+		}
+		if l.Accuracy > 0 {
+			accuracy = num(&l.Accuracy)
+		}
+		if l.Battery != nil {
+			battery = strconv.Itoa(*l.Battery)
+		}
+		if l.Uptime != nil {
+			uptime = strconv.FormatInt(*l.Uptime, 10)
+		}
+		if l.Recoveries > 0 {
+			recoveries = strconv.Itoa(l.Recoveries)
+		}
+		lat, lon := strconv.FormatFloat(l.Lat, 'f', -1, 64), strconv.FormatFloat(l.Lon, 'f', -1, 64)
+		if l.Ciphertext != "" {
+			lat, lon = "", ""
+		}
+		cw.Write([]string{
+			l.When.Format(time.RFC3339Nano), received, seq, lat, lon, accuracy,
+			num(l.Altitude), num(l.Speed), num(l.Bearing), battery, l.Network,
+			csvText(l.Hostname), uptime, csvText(l.Interface), recoveries, csvText(l.Place), l.IP, l.Ciphertext, strconv.FormatBool(i < len(deleted)),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvText keeps spreadsheets from running free text as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+```
+
+---
+
+### server_config.go
+```go
+package main
+
+// server_config.go
+// - Every server setting has an environment-style name (PORT, RATE_IP_RPS,
+//   TLS_CERT_FILE, ...) and is read with setting(name)
+// - Values are layered, highest first: command-line flags, environment
+//   variables, the YAML config file (--config or CONFIG_FILE), then each
+//   setting's built-in default
+// - The config file groups the common settings (see server.example.yaml);
+//   anything else goes under "settings" by name
+// - --set NAME=value overrides any setting from the command line
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of the YAML config file
+type fileConfig struct {
+	Port    string `yaml:"port"`
+	Storage struct {
+		Backend       string `yaml:"backend"`
+		Retention     string `yaml:"retention"`
+		DevicesFile   string `yaml:"devices_file"`
+		PairingsFile  string `yaml:"pairings_file"`
+		APIKeysFile   string `yaml:"api_keys_file"`
+		AuditLogFile  string `yaml:"audit_log_file"`
+		GeofencesFile string `yaml:"geofences_file"`
+		NotifiersFile string `yaml:"notifiers_file"`
+		TenantsFile   string `yaml:"tenants_file"`
+		UsageFile     string `yaml:"usage_file"`
+		SummariesFile string `yaml:"summaries_file"`
+	} `yaml:"storage"`
+	Tokens struct {
+		Admin     string            `yaml:"admin"`
+		Devices   map[string]string `yaml:"devices"`
+		JWTSecret string            `yaml:"jwt_secret"`
+	} `yaml:"tokens"`
+	TLS struct {
+		CertFile      string   `yaml:"cert_file"`
+		KeyFile       string   `yaml:"key_file"`
+		ClientCAFile  string   `yaml:"client_ca_file"`
+		AutocertHosts []string `yaml:"autocert_hosts"`
+		AutocertCache string   `yaml:"autocert_cache"`
+		AutocertEmail string   `yaml:"autocert_email"`
+		RedirectAddr  string   `yaml:"redirect_addr"`
+	} `yaml:"tls"`
+	RateLimits struct {
+		IPRPS       string `yaml:"ip_rps"`
+		IPBurst     string `yaml:"ip_burst"`
+		DeviceRPS   string `yaml:"device_rps"`
+		DeviceBurst string `yaml:"device_burst"`
+	} `yaml:"rate_limits"`
+	Settings map[string]string `yaml:"settings"`
+}
+
+// values flattens the file into setting names
+func (c *fileConfig) values() (map[string]string, error) {
+	v := map[string]string{
+		"PORT":               c.Port,
+		"STORAGE_BACKEND":    c.Storage.Backend,
+		"HISTORY_LIMIT":      c.Storage.Retention,
+		"DEVICES_FILE":       c.Storage.DevicesFile,
+		"PAIRINGS_FILE":      c.Storage.PairingsFile,
+		"API_KEYS_FILE":      c.Storage.APIKeysFile,
+		"AUDIT_LOG_FILE":     c.Storage.AuditLogFile,
+		"GEOFENCES_FILE":     c.Storage.GeofencesFile,
+		"NOTIFIERS_FILE":     c.Storage.NotifiersFile,
+		"TENANTS_FILE":       c.Storage.TenantsFile,
+		"USAGE_FILE":         c.Storage.UsageFile,
+		"SUMMARIES_FILE":     c.Storage.SummariesFile,
+		"ADMIN_TOKEN":        c.Tokens.Admin,
+		"JWT_SECRET":         c.Tokens.JWTSecret,
+		"TLS_CERT_FILE":      c.TLS.CertFile,
+		"TLS_KEY_FILE":       c.TLS.KeyFile,
+		"TLS_CLIENT_CA_FILE": c.TLS.ClientCAFile,
+		"AUTOCERT_HOSTS":     strings.Join(c.TLS.AutocertHosts, ","),
+		"AUTOCERT_CACHE":     c.TLS.AutocertCache,
+		"AUTOCERT_EMAIL":     c.TLS.AutocertEmail,
+		"HTTP_REDIRECT_ADDR": c.TLS.RedirectAddr,
+		"RATE_IP_RPS":        c.RateLimits.IPRPS,
+		"RATE_IP_BURST":      c.RateLimits.IPBurst,
+		"RATE_DEVICE_RPS":    c.RateLimits.DeviceRPS,
+		"RATE_DEVICE_BURST":  c.RateLimits.DeviceBurst,
+	}
+	if len(c.Tokens.Devices) > 0 {
+		b, err := json.Marshal(c.Tokens.Devices)
+		if err != nil {
+			return nil, err
+		}
+		v["DEVICE_TOKENS"] = string(b)
+	}
+	for name, val := range c.Settings {
+		name = strings.ToUpper(name)
+		if v[name] != "" {
+			return nil, fmt.Errorf("settings.%s is also set by its own config key", name)
+		}
+		v[name] = val
+	}
+	for name, val := range v {
+		if val == "" {
+			delete(v, name)
+		}
+	}
+	return v, nil
+}
+
+var (
+	fileSettings = map[string]string{}
+	flagSettings = map[string]string{}
+)
+
+// setting returns the named setting from the highest layer that sets it
+func setting(name string) string {
+	if v, ok := flagSettings[name]; ok {
+		return v
+	}
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fileSettings[name]
+}
+
+// settingFlag is a command-line flag bound to one setting
+type settingFlag string
+
+func (f settingFlag) String() string { return flagSettings[string(f)] }
+
+func (f settingFlag) Set(v string) error {
+	flagSettings[string(f)] = v
+	return nil
+}
+
+// setFlag implements the repeatable --set NAME=value
+type setFlag struct{}
+
+func (setFlag) String() string { return "" }
+
+func (setFlag) Set(v string) error {
+	name, val, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return errors.New("want NAME=value")
+	}
+	flagSettings[strings.ToUpper(name)] = val
+	return nil
+}
+
+// registerConfigFlags defines the config flags; call before flag.Parse
+func registerConfigFlags() *string {
+	path := flag.String("config", "", "YAML config file (default $CONFIG_FILE)")
+	flag.Var(settingFlag("PORT"), "port", "listen port")
+	flag.Var(settingFlag("STORAGE_BACKEND"), "storage", "storage backend")
+	flag.Var(settingFlag("HISTORY_LIMIT"), "retention", "points kept per device")
+	flag.Var(settingFlag("TLS_CERT_FILE"), "tls-cert", "TLS certificate file (PEM)")
+	flag.Var(settingFlag("TLS_KEY_FILE"), "tls-key", "TLS private key file (PEM)")
+	flag.Var(setFlag{}, "set", "override any setting, NAME=value (repeatable)")
+	return path
+}
+
+// loadConfig reads the config file, if any, and applies the settings that
+// live in server.go
+func loadConfig(path string) error {
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var c fileConfig
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if fileSettings, err = c.values(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	switch b := setting("STORAGE_BACKEND"); b {
+	case "", "memory":
+	default:
+		return fmt.Errorf("STORAGE_BACKEND: unknown backend %q", b)
+	}
+	if v := setting("HISTORY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("HISTORY_LIMIT: invalid value %q", v)
+		}
+		maxHistory = n
+	}
+	return nil
+}
+```
+
+---
+
+### server_logging.go
+```go
+package main
+
+// server_logging.go
+// - Structured, leveled logging with log/slog: LOG_LEVEL (debug, info, warn,
+//   error; default info) and LOG_FORMAT (text or json; default text)
+// - Every request gets an ID (X-Request-ID if the client sent a sane one)
+//   echoed in the response; reqLogger(r) carries it with the remote IP, and
+//   handlers add the device
+// - The standard log package is routed through the same handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func setupLogging() error {
+	var level slog.Level
+	if v := setting("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch f := setting("LOG_FORMAT"); f {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT: unknown format %q", f)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs a startup failure and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// requestLogger is middleware attaching a request ID and a logger carrying
+// it to the request context
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		l := slog.Default().With("request_id", id, "remote_ip", clientIP(r))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
+
+// reqLogger returns the request-scoped logger, or the default one
+func reqLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool {
+		return !(c == '-' || c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+	}) < 0
+}
+```
+
+---
+
+### server_accesslog.go
+```go
+package main
+
+// server_accesslog.go
+// - One line per HTTP request with method, path, status, response bytes,
+//   latency, client IP and request ID
+// - ACCESS_LOG=false turns it off; ACCESS_LOG_FILE sends it to a file
+//   instead of stderr; ACCESS_LOG_FORMAT (text or json) defaults to
+//   LOG_FORMAT
+// - Query strings are left out since ?token= may carry a credential
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var accessLogger *slog.Logger
+
+func setupAccessLog() error {
+	if v := setting("ACCESS_LOG"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("ACCESS_LOG: %w", err)
+		}
+		if !on {
+			return nil
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	if path := setting("ACCESS_LOG_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	format := setting("ACCESS_LOG_FORMAT")
+	if format == "" {
+		format = setting("LOG_FORMAT")
+	}
+	switch format {
+	case "", "text":
+		accessLogger = slog.New(slog.NewTextHandler(out, nil))
+	case "json":
+		accessLogger = slog.New(slog.NewJSONHandler(out, nil))
+	default:
+		return fmt.Errorf("ACCESS_LOG_FORMAT: unknown format %q", format)
+	}
+	return nil
+}
+
+// accessLog is middleware logging every request once it completes
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLogger == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		accessLogger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_ip", clientIP(r),
+			"request_id", w.Header().Get("X-Request-ID"),
+		)
+	})
+}
+```
+
+---
+
+### server_gzip.go
+```go
+package main
+
+// server_gzip.go
+// - gzip compression for the large JSON responses (history, device lists,
+//   admin listings) when the client sends Accept-Encoding: gzip
+// - Bodies under gzipMinSize are sent as-is; compressing them costs more
+//   than it saves
+// - Request bodies sent with Content-Encoding: gzip are decompressed before
+//   any handler sees them; body size limits apply to the decompressed bytes,
+//   so a small bomb cannot expand past them. Other encodings get 415
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const gzipMinSize = 1024
+
+var gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// gzipped is middleware compressing h's response for clients accepting gzip
+func gzipped(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// gunzipped is middleware decompressing gzip request bodies
+func gunzipped(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+		case "", "identity":
+			h.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			http.Error(w, "unsupported content encoding "+enc, http.StatusUnsupportedMediaType)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "bad gzip body", http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{zr, r.Body}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		h.ServeHTTP(w, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response and switches to gzip once it
+// is clearly large enough to be worth it
+type gzipWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.decided {
+		return
+	}
+	g.status = code
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	if g.decided {
+		return g.ResponseWriter.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start sends the headers and the buffered bytes, compressed or not
+func (g *gzipWriter) start(compress bool) error {
+	g.decided = true
+	hdr := g.ResponseWriter.Header()
+	if compress && hdr.Get("Content-Encoding") == "" && g.status == http.StatusOK {
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		g.gz = gzipPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	buf := g.buf
+	g.buf = nil
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(buf)
+	} else {
+		_, err = g.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (g *gzipWriter) finish() {
+	if !g.decided {
+		g.start(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+		g.gz = nil
+	}
+}
+```
+
+---
+
+### server_conditional.go
+```go
+package main
+
+// server_conditional.go
+// - Conditional GETs for history: responses carry an ETag and Last-Modified
+//   (when the history or device metadata last changed, not the newest point's time, since
+//   offline batches and imports add older points), and If-None-Match /
+//   If-Modified-Since requests for unchanged history get 304 with no body
+// - ETags combine the process start, the history version, the device
+//   registry version and the query string, so they never survive a
+//   restart, miss a label, color or icon change, or match a different
+//   filter
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var bootID = fmt.Sprintf("%x", time.Now().UnixNano())
+
+// historyETag identifies one representation of phone's history
+func historyETag(r *http.Request, phone string, version uint64) string {
+	variant := crc32.ChecksumIEEE([]byte(r.URL.RawQuery + "\x00" + r.Header.Get("Accept")))
+	registry, _ := registryVersion()
+	return fmt.Sprintf(`"%s-%d.%d-%08x"`, bootID, version, registry, variant)
+}
+
+// historyModified is when phone's history, or the device metadata shown
+// with it, last changed
+func historyModified(modified time.Time) time.Time {
+	if _, registry := registryVersion(); registry.After(modified) {
+		return registry
+	}
+	return modified
+}
+
+// notModified sets the validators on w and, when the request's conditions
+// show the client already has this representation, writes 304 and returns
+// true
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+```
+
+---
+
+### server_geo.go
+```go
+package main
+
+// server_geo.go
+// - Great-circle distance (haversine) shared by the history filters and
+//   anything else measuring between points
+// - History filters for /get/{phone}:
+//   ?bbox=minLon,minLat,maxLon,maxLat   points inside the box
+//   ?near=lat,lon&radius=metres         points within radius of near
+//   ?max_accuracy=metres                points at least that accurate
+//   Encrypted points have no coordinates to test, so area filters drop
+//   them. Points of unknown accuracy pass max_accuracy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusM = 6371008.8
+
+// haversine returns the distance in metres between two points
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// historyFilter selects points of a history by area and accuracy
+type historyFilter struct {
+	bbox        *[4]float64 // minLon, minLat, maxLon, maxLat
+	near        *[2]float64 // lat, lon
+	radius      float64
+	maxAccuracy float64
+}
+
+func parseHistoryFilter(r *http.Request) (historyFilter, error) {
+	var f historyFilter
+	q := r.URL.Query()
+	if v := q.Get("bbox"); v != "" {
+		b, err := parseFloats(v, 4)
+		if err != nil {
+			return f, fmt.Errorf("bbox: %w", err)
+		}
+		if !inRange(b[1], b[0]) || !inRange(b[3], b[2]) {
+			return f, errors.New("bbox: coordinates out of range")
+		}
+		if b[1] > b[3] {
+			return f, errors.New("bbox: minLat is above maxLat")
+		}
+		f.bbox = &[4]float64{b[0], b[1], b[2], b[3]}
+	}
+	if v := q.Get("near"); v != "" {
+		p, err := parseFloats(v, 2)
+		if err != nil {
+			return f, fmt.Errorf("near: %w", err)
+		}
+		if !inRange(p[0], p[1]) {
+			return f, errors.New("near: coordinates out of range")
+		}
+		radius, err := strconv.ParseFloat(q.Get("radius"), 64)
+		if err != nil || radius <= 0 || !finite(radius) {
+			return f, errors.New("radius: want a positive number of metres")
+		}
+		f.near = &[2]float64{p[0], p[1]}
+		f.radius = radius
+	} else if q.Get("radius") != "" {
+		return f, errors.New("radius needs near=lat,lon")
+	}
+	if v := q.Get("max_accuracy"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 || !finite(n) {
+			return f, errors.New("max_accuracy: want a positive number of metres")
+		}
+		f.maxAccuracy = n
+	}
+	return f, nil
+}
+
+func inRange(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+func parseFloats(s string, n int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("want %d comma-separated numbers", n)
+	}
+	out := make([]float64, n)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || !finite(v) {
+			return nil, fmt.Errorf("bad number %q", p)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (f historyFilter) active() bool { return f.bbox != nil || f.near != nil || f.maxAccuracy > 0 }
+
+func (f historyFilter) match(l Location) bool {
+	if f.maxAccuracy > 0 && l.Accuracy > f.maxAccuracy {
+		return false
+	}
+	if f.bbox == nil && f.near == nil {
+		return true
+	}
+	if l.Ciphertext != "" {
+		return false
+	}
+	if b := f.bbox; b != nil {
+		if l.Lat < b[1] || l.Lat > b[3] {
+			return false
+		}
+		// a box crossing the antimeridian has minLon > maxLon
+		if b[0] <= b[2] && (l.Lon < b[0] || l.Lon > b[2]) ||
+			b[0] > b[2] && l.Lon < b[0] && l.Lon > b[2] {
+			return false
+		}
+	}
+	if f.near != nil && haversine(f.near[0], f.near[1], l.Lat, l.Lon) > f.radius {
+		return false
+	}
+	return true
+}
+
+// apply returns the points of locs matching f, or locs itself when f is empty
+func (f historyFilter) apply(locs []Location) []Location {
+	if !f.active() {
+		return locs
+	}
+	out := []Location{}
+	for _, l := range locs {
+		if f.match(l) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+```
+
+---
+
+### server_geojson.go
+```go
+package main
+
+// server_geojson.go
+// - /get/{phone} answers with a GeoJSON FeatureCollection (RFC 7946) of
+//   Point features when the client sends Accept: application/geo+json
+// - Encrypted points become features with a null geometry and the
+//   ciphertext in their properties
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const geoJSONType = "application/geo+json"
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONPoint          `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // lon, lat
+}
+
+// wantsGeoJSON reports whether the Accept header asks for GeoJSON
+func wantsGeoJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mt == geoJSONType && params["q"] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+func locationFeature(l Location) geoJSONFeature {
+	f := geoJSONFeature{
+		Type:       "Feature",
+		Properties: map[string]interface{}{"phone": l.Phone, "when": l.When.Format(time.RFC3339Nano)},
+	}
+	if l.Received != nil {
+		f.Properties["received"] = l.Received.Format(time.RFC3339Nano)
+	}
+	if l.Seq > 0 {
+		f.Properties["seq"] = l.Seq
+	}
+	if l.Place != "" {
+		f.Properties["place"] = l.Place
+	}
+	if l.Accuracy > 0 {
+		f.Properties["accuracy"] = l.Accuracy
+	}
+	for name, v := range map[string]*float64{"altitude": l.Altitude, "speed": l.Speed, "bearing": l.Bearing} {
+		if v != nil {
+			f.Properties[name] = *v
+		}
+	}
+	if l.Battery != nil {
+		f.Properties["battery"] = *l.Battery
+	}
+	if l.Network != "" {
+		f.Properties["network"] = l.Network
+	}
+	if l.Hostname != "" {
+		f.Properties["hostname"] = l.Hostname
+	}
+	if l.Uptime != nil {
+		f.Properties["uptime"] = *l.Uptime
+	}
+	if l.Interface != "" {
+		f.Properties["interface"] = l.Interface
+	}
+	if l.Recoveries > 0 {
+		f.Properties["recoveries"] = l.Recoveries
+	}
+	if l.Ciphertext != "" {
+		f.Properties["ct"] = l.Ciphertext
+	} else {
+		f.Geometry = &geoJSONPoint{Type: "Point", Coordinates: [2]float64{l.Lon, l.Lat}}
+	}
+	if l.IP != "" {
+		f.Properties["ip"] = l.IP
+	}
+	return f
+}
+
+// writeGeoJSON writes locs as a FeatureCollection. Device labels, colors
+// and icons become "label", "marker-color" and "marker-symbol" properties
+// (simplestyle), which most GeoJSON viewers understand.
+func writeGeoJSON(w http.ResponseWriter, locs []Location) {
+	fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(locs))}
+	style := map[string]map[string]interface{}{}
+	for _, l := range locs {
+		f := locationFeature(l)
+		props, ok := style[l.Phone]
+		if !ok {
+			props = map[string]interface{}{}
+			label, color, icon := deviceMeta(l.Phone)
+			for name, v := range map[string]string{"label": label, "marker-color": color, "marker-symbol": icon} {
+				if v != "" {
+					props[name] = v
+				}
+			}
+			style[l.Phone] = props
+		}
+		for name, v := range props {
+			f.Properties[name] = v
+		}
+		fc.Features = append(fc.Features, f)
+	}
+	w.Header().Set("Content-Type", geoJSONType)
+	json.NewEncoder(w).Encode(fc)
+}
+```
+
+---
+
+### server_stats.go
+```go
+package main
+
+// server_stats.go
+// - GET /stats/{phone}[?from=RFC3339&to=RFC3339] summarises a history:
+//   total distance, average and maximum speed, and time spent moving
+//   versus standing still
+// - Figures come from consecutive pairs of points; a pair counts as
+//   moving when its speed is at least movingSpeed, so GPS jitter while
+//   parked does not add up to a journey
+// - Encrypted points have no coordinates and are skipped
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// movingSpeed is the slowest speed, in m/s, still counted as moving (~1.8 km/h)
+const movingSpeed = 0.5
+
+type historyStats struct {
+	Phone             string     `json:"phone"`
+	From              *time.Time `json:"from,omitempty"`
+	To                *time.Time `json:"to,omitempty"`
+	Points            int        `json:"points"`
+	DistanceM         float64    `json:"distance_m"`
+	AvgSpeedMps       float64    `json:"avg_speed_mps"` // over moving time
+	MaxSpeedMps       float64    `json:"max_speed_mps"`
+	MovingSeconds     float64    `json:"moving_seconds"`
+	StationarySeconds float64    `json:"stationary_seconds"`
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	st := historyStats{Phone: phone}
+	var err error
+	if st.From, st.To, err = timeRange(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stMutex.RLock()
+	locs := store[phone]
+	stMutex.RUnlock()
+
+	var prev *Location
+	for i := range locs {
+		l := &locs[i]
+		if l.Ciphertext != "" || !withinTimes(l.When, st.From, st.To) {
+			continue
+		}
+		st.Points++
+		if prev != nil {
+			st.addSegment(*prev, *l)
+		}
+		prev = l
+	}
+	if st.MovingSeconds > 0 {
+		st.AvgSpeedMps = st.DistanceM / st.MovingSeconds
+	}
+
+	writeEncoded(w, r, st)
+}
+
+// timeRange parses the optional RFC 3339 from and to parameters
+func timeRange(q url.Values) (from, to *time.Time, err error) {
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, nil, errors.New("bad " + p.name + ", want RFC3339")
+			}
+			*p.dst = &t
+		}
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		return nil, nil, errors.New("to is before from")
+	}
+	return from, to, nil
+}
+
+// withinTimes reports whether t falls within the optional bounds
+func withinTimes(t time.Time, from, to *time.Time) bool {
+	return (from == nil || !t.Before(*from)) && (to == nil || !t.After(*to))
+}
+
+// addSegment accounts for the leg from a to b
+func (st *historyStats) addSegment(a, b Location) {
+	secs := b.When.Sub(a.When).Seconds()
+	if secs <= 0 {
+		return
+	}
+	d := haversine(a.Lat, a.Lon, b.Lat, b.Lon)
+	speed := d / secs
+	if speed < movingSpeed {
+		st.StationarySeconds += secs
+		return
+	}
+	st.DistanceM += d
+	st.MovingSeconds += secs
+	if speed > st.MaxSpeedMps {
+		st.MaxSpeedMps = speed
+	}
+}
+```
+
+---
+
+### server_summaries.go
+```go
+package main
+
+// server_summaries.go
+// - A background job summarises each device's finished UTC days and weeks
+//   (Monday to Sunday): points, distance, hours spent moving (as in
+//   server_stats.go) and the geofences it was seen inside
+// - It runs at startup and then hourly, filling in any finished period
+//   that has points and no summary yet, so a restart catches up. Only the
+//   points still held (HISTORY_LIMIT) can be counted
+// - Summaries persist in SUMMARIES_FILE (default summaries.json), the last
+//   summaryKeep of each period per device
+// - GET /summaries/{phone}[?period=day|week] returns them newest first
+// - Summaries of periods begun before a device's history went to the trash
+//   are hidden while it is there; a purge drops them and a restore
+//   recomputes any worked out from the new history alone meanwhile
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultSummariesFile = "summaries.json"
+	summaryKeep          = 90
+)
+
+// Summary describes one device over one finished day or week
+type Summary struct {
+	Phone       string    `json:"phone"`
+	Period      string    `json:"period"` // "day" or "week"
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Points      int       `json:"points"`
+	DistanceM   float64   `json:"distance_m"`
+	ActiveHours float64   `json:"active_hours"`
+	Regions     []string  `json:"regions,omitempty"` // geofence names
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var (
+	summaries     = map[string][]Summary{} // by phone, oldest first
+	summariesMu   = sync.RWMutex{}
+	summariesFile = defaultSummariesFile
+)
+
+// loadSummaries reads SUMMARIES_FILE and starts the hourly job
+func loadSummaries() error {
+	if p := setting("SUMMARIES_FILE"); p != "" {
+		summariesFile = p
+	}
+	summariesMu.Lock()
+	err := loadJSON(summariesFile, &summaries)
+	summariesMu.Unlock()
+	if err != nil {
+		return err
+	}
+	go func() {
+		summarizeFinished(time.Now().UTC())
+		for now := range time.Tick(time.Hour) {
+			summarizeFinished(now.UTC())
+		}
+	}()
+	return nil
+}
+
+// periodStart returns the start of the day or week containing t
+func periodStart(period string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if period == "week" {
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	}
+	return start
+}
+
+func periodEnd(period string, start time.Time) time.Time {
+	if period == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// summarizeFinished adds the missing summaries of every day and week that
+// finished before now, from the one holding a device's oldest point, or
+// summaryKeep periods back if that is later, since addSummary would drop
+// anything older straight away
+func summarizeFinished(now time.Time) {
+	stMutex.RLock()
+	oldest := make(map[string]time.Time, len(store))
+	for phone, locs := range store {
+		if len(locs) > 0 {
+			oldest[phone] = locs[0].When
+		}
+	}
+	stMutex.RUnlock()
+
+	added := 0
+	for _, period := range []string{"day", "week"} {
+		current := periodStart(period, now)
+		floor := current
+		for i := 0; i < summaryKeep; i++ {
+			floor = periodStart(period, floor.Add(-time.Second))
+		}
+		for phone, first := range oldest {
+			start := periodStart(period, first)
+			if start.Before(floor) {
+				start = floor
+			}
+			for ; start.Before(current); start = periodEnd(period, start) {
+				if hasSummary(phone, period, start) {
+					continue
+				}
+				if sum, ok := summarize(phone, period, start, periodEnd(period, start)); ok {
+					addSummary(sum)
+					added++
+				}
+			}
+		}
+	}
+	if added == 0 {
+		return
+	}
+	slog.Info("summaries added", "count", added)
+	summariesMu.Lock()
+	defer summariesMu.Unlock()
+	if err := saveJSON(summariesFile, summaries); err != nil {
+		slog.Error("saving summaries failed", "err", err)
+	}
+}
+
+func hasSummary(phone, period string, start time.Time) bool {
+	summariesMu.RLock()
+	defer summariesMu.RUnlock()
+	for _, s := range summaries[phone] {
+		if s.Period == period && s.Start.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// summarize computes phone's summary for [start, end); ok is false when
+// there are no readable points in it
+func summarize(phone, period string, start, end time.Time) (Summary, bool) {
+	stMutex.RLock()
+	var locs []Location
+	for _, l := range store[phone] {
+		if l.Ciphertext == "" && !l.When.Before(start) && l.When.Before(end) {
+			locs = append(locs, l)
+		}
+	}
+	stMutex.RUnlock()
+	if len(locs) == 0 {
+		return Summary{}, false
+	}
+
+	var st historyStats
+	for i := 1; i < len(locs); i++ {
+		st.addSegment(locs[i-1], locs[i])
+	}
+	sum := Summary{
+		Phone:       phone,
+		Period:      period,
+		Start:       start,
+		End:         end,
+		Points:      len(locs),
+		DistanceM:   st.DistanceM,
+		ActiveHours: st.MovingSeconds / 3600,
+		Regions:     regionsVisited(phone, locs),
+		CreatedAt:   time.Now().UTC(),
+	}
+	return sum, true
+}
+
+// regionsVisited names the geofences of phone that contain any of locs
+func regionsVisited(phone string, locs []Location) []string {
+	tenant := deviceTenant(phone)
+	var names []string
+	geofencesMu.RLock()
+	defer geofencesMu.RUnlock()
+	for _, f := range geofences {
+		if !f.appliesTo(phone, tenant) {
+			continue
+		}
+		for _, l := range locs {
+			if f.contains(l.Lat, l.Lon) {
+				names = append(names, f.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addSummary stores sum, dropping the oldest of its period past summaryKeep
+func addSummary(sum Summary) {
+	summariesMu.Lock()
+	defer summariesMu.Unlock()
+	list := append(summaries[sum.Phone], sum)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	extra := -summaryKeep
+	for _, s := range list {
+		if s.Period == sum.Period {
+			extra++
+		}
+	}
+	kept := list[:0]
+	for _, s := range list {
+		if s.Period == sum.Period && extra > 0 {
+			extra--
+			continue
+		}
+		kept = append(kept, s)
+	}
+	summaries[sum.Phone] = kept
+}
+
+// forgetSummaries drops phone's summaries, for deleted devices
+func forgetSummaries(phone string) {
+	dropSummaries(phone, func(Summary) bool { return true })
+}
+
+// dropSummaries removes phone's summaries that drop picks
+func dropSummaries(phone string, drop func(Summary) bool) {
+	summariesMu.Lock()
+	defer summariesMu.Unlock()
+	kept := summaries[phone][:0:0]
+	for _, s := range summaries[phone] {
+		if !drop(s) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(summaries[phone]) {
+		return
+	}
+	if len(kept) == 0 {
+		delete(summaries, phone)
+	} else {
+		summaries[phone] = kept
+	}
+	if err := saveJSON(summariesFile, summaries); err != nil {
+		slog.Error("saving summaries failed", "err", err)
+	}
+}
+
+// trashedSince returns when phone's history went to the trash, if it is there
+func trashedSince(phone string) (time.Time, bool) {
+	stMutex.RLock()
+	defer stMutex.RUnlock()
+	if t, ok := trash[phone]; ok {
+		return t.Deleted, true
+	}
+	return time.Time{}, false
+}
+
+func summariesHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period != "" && period != "day" && period != "week" {
+		http.Error(w, "period must be day or week", http.StatusBadRequest)
+		return
+	}
+	deleted, trashed := trashedSince(phone)
+	summariesMu.RLock()
+	list := make([]Summary, 0, len(summaries[phone]))
+	for i := len(summaries[phone]) - 1; i >= 0; i-- {
+		s := summaries[phone][i]
+		if trashed && s.Start.Before(deleted) {
+			// it describes points in the trash
+			continue
+		}
+		if period == "" || s.Period == period {
+			list = append(list, s)
+		}
+	}
+	summariesMu.RUnlock()
+	writeEncoded(w, r, map[string]interface{}{"phone": phone, "summaries": list})
+}
+```
+
+---
+
+### server_heatmap.go
+```go
+package main
+
+// server_heatmap.go
+// - GET /heatmap/{phone}[?cell=100m&from=RFC3339&to=RFC3339] counts a
+//   device's points per grid cell, so clients can draw where it spends its
+//   time without fetching every point
+// - cell is the cell size: plain metres, or with an m or km suffix
+//   (default 100m, 10m to 100km). Cells are cell metres tall and about as
+//   wide, measured at each row's latitude
+// - Each cell has its centre, the number of points and the seconds spent
+//   there: the time until the next point, capped at maxDwell so gaps in
+//   reporting do not count as staying put
+// - Accept: application/geo+json returns the cells as Point features
+// - Encrypted points are skipped
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultHeatmapCell = 100.0
+	minHeatmapCell     = 10.0
+	maxHeatmapCell     = 100000.0
+	// metresPerDegree is the length of a degree of latitude
+	metresPerDegree = 111320.0
+	// maxDwell is the most time one point may account for
+	maxDwell = 30 * time.Minute
+)
+
+type heatmapCell struct {
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Count   int     `json:"count"`
+	Seconds float64 `json:"seconds"`
+}
+
+type heatmap struct {
+	Phone string        `json:"phone"`
+	CellM float64       `json:"cell_m"`
+	Cells []heatmapCell `json:"cells"`
+}
+
+// parseCellSize reads a cell size such as "250", "250m" or "1.5km"
+func parseCellSize(v string) (float64, error) {
+	if v == "" {
+		return defaultHeatmapCell, nil
+	}
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(v, "km"):
+		v, scale = strings.TrimSuffix(v, "km"), 1000
+	case strings.HasSuffix(v, "m"):
+		v = strings.TrimSuffix(v, "m")
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(n) {
+		return 0, errors.New("cell: want a size like 100m or 1km")
+	}
+	n *= scale
+	if n < minHeatmapCell || n > maxHeatmapCell {
+		return 0, errors.New("cell must be between 10m and 100km")
+	}
+	return n, nil
+}
+
+// cellKey identifies a grid cell
+type cellKey struct{ row, col int }
+
+// gridCell returns the cell of size metres containing lat, lon, and its centre
+func gridCell(lat, lon, size float64) (cellKey, float64, float64) {
+	dLat := size / metresPerDegree
+	row := int(math.Floor(lat / dLat))
+	centreLat := (float64(row) + 0.5) * dLat
+	dLon := size / (metresPerDegree * math.Max(math.Cos(centreLat*math.Pi/180), 0.01))
+	col := int(math.Floor(lon / dLon))
+	return cellKey{row, col}, centreLat, (float64(col) + 0.5) * dLon
+}
+
+func heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	size, err := parseCellSize(q.Get("cell"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := timeRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stMutex.RLock()
+	var locs []Location
+	for _, l := range store[phone] {
+		if l.Ciphertext == "" && withinTimes(l.When, from, to) {
+			locs = append(locs, l)
+		}
+	}
+	stMutex.RUnlock()
+
+	cells := map[cellKey]*heatmapCell{}
+	for i, l := range locs {
+		key, lat, lon := gridCell(l.Lat, l.Lon, size)
+		c, ok := cells[key]
+		if !ok {
+			c = &heatmapCell{Lat: lat, Lon: lon}
+			cells[key] = c
+		}
+		c.Count++
+		if i+1 < len(locs) {
+			dwell := locs[i+1].When.Sub(l.When)
+			c.Seconds += math.Max(0, math.Min(dwell.Seconds(), maxDwell.Seconds()))
+		}
+	}
+	hm := heatmap{Phone: phone, CellM: size, Cells: make([]heatmapCell, 0, len(cells))}
+	for _, c := range cells {
+		hm.Cells = append(hm.Cells, *c)
+	}
+	sort.Slice(hm.Cells, func(i, j int) bool { return hm.Cells[i].Count > hm.Cells[j].Count })
+
+	if wantsGeoJSON(r) {
+		fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(hm.Cells))}
+		for _, c := range hm.Cells {
+			fc.Features = append(fc.Features, geoJSONFeature{
+				Type:       "Feature",
+				Geometry:   &geoJSONPoint{Type: "Point", Coordinates: [2]float64{c.Lon, c.Lat}},
+				Properties: map[string]interface{}{"count": c.Count, "seconds": c.Seconds, "cell_m": size},
+			})
+		}
+		w.Header().Set("Content-Type", geoJSONType)
+		json.NewEncoder(w).Encode(fc)
+		return
+	}
+	writeEncoded(w, r, hm)
+}
+```
+
+---
+
+### server_trips.go
+```go
+package main
+
+// server_trips.go
+// - GET /trips/{phone}[?from=RFC3339&to=RFC3339&tolerance=10] splits a
+//   history into trips: runs of movement (legs at movingSpeed or faster,
+//   see server_stats.go) that end when the device stands still for
+//   tripMaxPause or stops reporting for tripMaxGap
+// - Trips shorter than minTripDistance are GPS jitter and left out; the
+//   last trip is marked ongoing while its device still moved recently
+// - Each trip has its start, end, duration, distance and path, simplified
+//   with Douglas-Peucker to within tolerance metres (0 keeps every point)
+// - Encrypted points are skipped
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	tripMaxPause     = 5 * time.Minute
+	tripMaxGap       = 20 * time.Minute
+	minTripDistance  = 200.0
+	defaultTolerance = 10.0
+)
+
+type tripPoint struct {
+	Lat  float64   `json:"lat"`
+	Lon  float64   `json:"lon"`
+	When time.Time `json:"when"`
+}
+
+type Trip struct {
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	DurationS  float64     `json:"duration_s"`
+	DistanceM  float64     `json:"distance_m"`
+	Ongoing    bool        `json:"ongoing,omitempty"`
+	Path       []tripPoint `json:"path"`
+	lastMoving time.Time
+	points     []Location
+}
+
+// detectTrips splits locs, oldest first, into trips as of now
+func detectTrips(locs []Location, tolerance float64, now time.Time) []Trip {
+	trips := []Trip{}
+	var cur *Trip
+	finish := func() {
+		if cur != nil && cur.DistanceM >= minTripDistance {
+			cur.Start, cur.End = cur.points[0].When, cur.points[len(cur.points)-1].When
+			cur.DurationS = cur.End.Sub(cur.Start).Seconds()
+			for _, l := range simplifyPath(cur.points, tolerance) {
+				cur.Path = append(cur.Path, tripPoint{l.Lat, l.Lon, l.When})
+			}
+			trips = append(trips, *cur)
+		}
+		cur = nil
+	}
+	for i := 1; i < len(locs); i++ {
+		a, b := locs[i-1], locs[i]
+		gap := b.When.Sub(a.When)
+		if gap <= 0 {
+			continue
+		}
+		if gap > tripMaxGap {
+			finish()
+			continue
+		}
+		d := haversine(a.Lat, a.Lon, b.Lat, b.Lon)
+		if d/gap.Seconds() < movingSpeed {
+			if cur != nil && b.When.Sub(cur.lastMoving) >= tripMaxPause {
+				finish()
+			}
+			continue
+		}
+		if cur == nil {
+			cur = &Trip{points: []Location{a}}
+		}
+		cur.points = append(cur.points, b)
+		cur.DistanceM += d
+		cur.lastMoving = b.When
+	}
+	if cur != nil && now.Sub(cur.lastMoving) < tripMaxPause {
+		cur.Ongoing = true
+	}
+	finish()
+	return trips
+}
+
+// simplifyPath drops points of path that lie within tolerance metres of the
+// line through their neighbours that are kept (Douglas-Peucker)
+func simplifyPath(path []Location, tolerance float64) []Location {
+	if tolerance <= 0 || len(path) < 3 {
+		return path
+	}
+	keep := make([]bool, len(path))
+	keep[0], keep[len(path)-1] = true, true
+	var walk func(i, j int)
+	walk = func(i, j int) {
+		far, at := 0.0, -1
+		for k := i + 1; k < j; k++ {
+			if d := offLine(path[k], path[i], path[j]); d > far {
+				far, at = d, k
+			}
+		}
+		if at >= 0 && far > tolerance {
+			keep[at] = true
+			walk(i, at)
+			walk(at, j)
+		}
+	}
+	walk(0, len(path)-1)
+	out := make([]Location, 0, len(path))
+	for i, l := range path {
+		if keep[i] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// offLine is the distance in metres from p to the segment a-b, on a flat
+// projection around a (fine at trip scale)
+func offLine(p, a, b Location) float64 {
+	k := math.Cos(a.Lat*math.Pi/180) * metresPerDegree
+	px, py := (p.Lon-a.Lon)*k, (p.Lat-a.Lat)*metresPerDegree
+	bx, by := (b.Lon-a.Lon)*k, (b.Lat-a.Lat)*metresPerDegree
+	t := 0.0
+	if l2 := bx*bx + by*by; l2 > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/l2))
+	}
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// parseTolerance reads the tolerance parameter in metres
+func parseTolerance(v string) (float64, error) {
+	if v == "" {
+		return defaultTolerance, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, errors.New("tolerance: want metres, 0 or more")
+	}
+	return n, nil
+}
+
+func tripsHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := timeRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tolerance, err := parseTolerance(q.Get("tolerance"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stMutex.RLock()
+	var locs []Location
+	for _, l := range store[phone] {
+		if l.Ciphertext == "" && withinTimes(l.When, from, to) {
+			locs = append(locs, l)
+		}
+	}
+	stMutex.RUnlock()
+
+	writeEncoded(w, r, map[string]interface{}{"phone": phone, "trips": detectTrips(locs, tolerance, time.Now())})
+}
+```
+
+---
+
+### server_stops.go
+```go
+package main
+
+// server_stops.go
+// - GET /stops/{phone}[?radius=50&min_duration=10m&from=RFC3339&to=RFC3339]
+//   finds where a device stayed: runs of points all within radius metres of
+//   the first that span at least min_duration
+// - Each stop has its centre (the mean of its points), arrival and
+//   departure times, duration, point count and, with geocoding on, the
+//   address of its first resolved point. A stop still in progress at the
+//   newest point is marked ongoing
+// - Encrypted points are skipped
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultStopRadius   = 50.0
+	defaultStopDuration = 10 * time.Minute
+)
+
+type Stop struct {
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Arrival   time.Time `json:"arrival"`
+	Departure time.Time `json:"departure"`
+	DurationS float64   `json:"duration_s"`
+	Points    int       `json:"points"`
+	Place     string    `json:"place,omitempty"`
+	Ongoing   bool      `json:"ongoing,omitempty"`
+}
+
+// detectStops finds the stops in locs, oldest first
+func detectStops(locs []Location, radius float64, minDuration time.Duration) []Stop {
+	stops := []Stop{}
+	for i := 0; i < len(locs); {
+		j := i + 1
+		for j < len(locs) && haversine(locs[i].Lat, locs[i].Lon, locs[j].Lat, locs[j].Lon) <= radius {
+			j++
+		}
+		run := locs[i:j]
+		if run[len(run)-1].When.Sub(run[0].When) < minDuration {
+			i++
+			continue
+		}
+		st := Stop{Arrival: run[0].When, Departure: run[len(run)-1].When, Points: len(run), Ongoing: j == len(locs)}
+		st.DurationS = st.Departure.Sub(st.Arrival).Seconds()
+		for _, l := range run {
+			st.Lat += l.Lat / float64(len(run))
+			st.Lon += l.Lon / float64(len(run))
+			if st.Place == "" {
+				st.Place = l.Place
+			}
+		}
+		stops = append(stops, st)
+		i = j
+	}
+	return stops
+}
+
+func stopsHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := timeRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	radius, minDuration, err := stopParams(q.Get("radius"), q.Get("min_duration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stMutex.RLock()
+	var locs []Location
+	for _, l := range store[phone] {
+		if l.Ciphertext == "" && withinTimes(l.When, from, to) {
+			locs = append(locs, l)
+		}
+	}
+	stMutex.RUnlock()
+
+	writeEncoded(w, r, map[string]interface{}{"phone": phone, "stops": detectStops(locs, radius, minDuration)})
+}
+
+// stopParams reads radius (metres, 5 to 5000) and min_duration (a Go
+// duration, 1m to 24h)
+func stopParams(radiusV, durationV string) (float64, time.Duration, error) {
+	radius, minDuration := defaultStopRadius, defaultStopDuration
+	if radiusV != "" {
+		n, err := strconv.ParseFloat(radiusV, 64)
+		if err != nil || math.IsNaN(n) || n < 5 || n > 5000 {
+			return 0, 0, errors.New("radius: want metres between 5 and 5000")
+		}
+		radius = n
+	}
+	if durationV != "" {
+		d, err := time.ParseDuration(durationV)
+		if err != nil || d < time.Minute || d > 24*time.Hour {
+			return 0, 0, errors.New("min_duration: want a duration like 10m, between 1m and 24h")
+		}
+		minDuration = d
+	}
+	return radius, minDuration, nil
+}
+```
+
+---
+
+### server_geofence.go
+```go
+package main
+
+// server_geofence.go
+// - Named geofences, either a circle ({"center": {"lat", "lon"},
+//   "radius_m"}) or a polygon ({"polygon": [{"lat", "lon"}, ...]}), for
+//   one device ("phone") or for every device when phone is empty
+// - GET /geofences lists the fences the caller may view; admins create,
+//   replace and delete them with POST /geofences, PUT and DELETE
+//   /geofences/{id}. Fences persist in GEOFENCES_FILE (default
+//   geofences.json)
+// - Every live report is tested against the fences that apply to its
+//   device. Crossing a boundary sends {"type": "geofence", "event":
+//   "enter"|"exit", ...} to WebSocket viewers of the device and to every
+//   function registered with onGeofenceEvent
+// - The first point seen for a device and fence only records which side it
+//   is on, so restarts and new fences do not fire spurious events
+// - Fences belong to a tenant and only watch that tenant's devices
+// - Polygons are tested on plain lat/lon and must not cross the antimeridian;
+//   encrypted points and points older than the last one evaluated are skipped
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultGeofencesFile = "geofences.json"
+
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Geofence is a named area watched for devices entering and leaving
+type Geofence struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Phone   string     `json:"phone,omitempty"` // empty applies to every device of the tenant
+	Tenant  string     `json:"tenant,omitempty"`
+	Center  *geoPoint  `json:"center,omitempty"`
+	Radius  float64    `json:"radius_m,omitempty"`
+	Polygon []geoPoint `json:"polygon,omitempty"`
+	Created time.Time  `json:"created"`
+}
+
+// GeofenceEvent reports a device crossing a fence boundary
+type GeofenceEvent struct {
+	Type     string   `json:"type"`  // always "geofence"
+	Event    string   `json:"event"` // "enter" or "exit"
+	FenceID  string   `json:"fence_id"`
+	Fence    string   `json:"fence"`
+	Phone    string   `json:"phone"`
+	Location Location `json:"location"`
+}
+
+var (
+	geofences     = map[string]*Geofence{}
+	geofencesMu   = sync.RWMutex{}
+	geofencesFile = defaultGeofencesFile
+
+	// fenceInside[phone][fence id] is whether phone was last seen inside
+	fenceInside  = map[string]map[string]bool{}
+	fenceLastAt  = map[string]time.Time{}
+	fenceStateMu = sync.Mutex{}
+
+	geofenceListeners   []func(GeofenceEvent)
+	geofenceListenersMu = sync.RWMutex{}
+)
+
+func loadGeofences() error {
+	if p := setting("GEOFENCES_FILE"); p != "" {
+		geofencesFile = p
+	}
+	var list []*Geofence
+	if err := loadJSON(geofencesFile, &list); err != nil {
+		return err
+	}
+	geofencesMu.Lock()
+	defer geofencesMu.Unlock()
+	for _, f := range list {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("%s: fence %q: %w", geofencesFile, f.ID, err)
+		}
+		geofences[f.ID] = f
+	}
+	return nil
+}
+
+// saveGeofencesLocked persists the fences; callers hold geofencesMu
+func saveGeofencesLocked() error {
+	list := make([]*Geofence, 0, len(geofences))
+	for _, f := range geofences {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return saveJSON(geofencesFile, list)
+}
+
+// onGeofenceEvent registers fn to be called, on its own goroutine, for
+// every enter and exit event
+func onGeofenceEvent(fn func(GeofenceEvent)) {
+	geofenceListenersMu.Lock()
+	defer geofenceListenersMu.Unlock()
+	geofenceListeners = append(geofenceListeners, fn)
+}
+
+func (f *Geofence) validate() error {
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+	if (f.Center == nil) == (len(f.Polygon) == 0) {
+		return errors.New("want either center and radius_m, or polygon")
+	}
+	if f.Center != nil {
+		if !inRange(f.Center.Lat, f.Center.Lon) {
+			return errors.New("center out of range")
+		}
+		if f.Radius <= 0 || !finite(f.Radius) {
+			return errors.New("radius_m must be a positive number of metres")
+		}
+		return nil
+	}
+	if f.Radius != 0 {
+		return errors.New("radius_m only applies to circles")
+	}
+	if len(f.Polygon) < 3 {
+		return errors.New("polygon needs at least 3 points")
+	}
+	for _, p := range f.Polygon {
+		if !inRange(p.Lat, p.Lon) {
+			return errors.New("polygon point out of range")
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the fence watches phone of tenant
+func (f *Geofence) appliesTo(phone, tenant string) bool {
+	return f.Tenant == tenant && (f.Phone == "" || f.Phone == phone)
+}
+
+func (f *Geofence) contains(lat, lon float64) bool {
+	if f.Center != nil {
+		return haversine(f.Center.Lat, f.Center.Lon, lat, lon) <= f.Radius
+	}
+	return pointInPolygon(f.Polygon, lat, lon)
+}
+
+// pointInPolygon casts a ray east from the point and counts edge crossings
+func pointInPolygon(poly []geoPoint, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.Lat > lat) != (b.Lat > lat) &&
+			lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// evaluateGeofences compares loc with the fences of its device and emits
+// an event for every boundary crossed since the previous point
+func evaluateGeofences(loc Location) {
+	if loc.Ciphertext != "" {
+		return
+	}
+	tenant := deviceTenant(loc.Phone)
+	geofencesMu.RLock()
+	var fences []*Geofence
+	for _, f := range geofences {
+		if f.appliesTo(loc.Phone, tenant) {
+			fences = append(fences, f)
+		}
+	}
+	geofencesMu.RUnlock()
+	if len(fences) == 0 {
+		return
+	}
+
+	var events []GeofenceEvent
+	fenceStateMu.Lock()
+	if loc.When.Before(fenceLastAt[loc.Phone]) {
+		fenceStateMu.Unlock()
+		return
+	}
+	fenceLastAt[loc.Phone] = loc.When
+	state := fenceInside[loc.Phone]
+	if state == nil {
+		state = map[string]bool{}
+		fenceInside[loc.Phone] = state
+	}
+	for _, f := range fences {
+		in := f.contains(loc.Lat, loc.Lon)
+		was, seen := state[f.ID]
+		state[f.ID] = in
+		if !seen || was == in {
+			continue
+		}
+		ev := GeofenceEvent{Type: "geofence", Event: "exit", FenceID: f.ID, Fence: f.Name, Phone: loc.Phone, Location: loc}
+		if in {
+			ev.Event = "enter"
+		}
+		events = append(events, ev)
+	}
+	fenceStateMu.Unlock()
+
+	geofenceListenersMu.RLock()
+	listeners := geofenceListeners
+	geofenceListenersMu.RUnlock()
+	for _, ev := range events {
+		broadcastFor(ev.Phone, ev)
+		for _, fn := range listeners {
+			go fn(ev)
+		}
+	}
+}
+
+// forgetGeofenceState drops what is known about phone's position
+func forgetGeofenceState(phone string) {
+	fenceStateMu.Lock()
+	defer fenceStateMu.Unlock()
+	delete(fenceInside, phone)
+	delete(fenceLastAt, phone)
+}
+
+// forgetFence drops every device's state for fence id
+func forgetFence(id string) {
+	fenceStateMu.Lock()
+	defer fenceStateMu.Unlock()
+	for _, state := range fenceInside {
+		delete(state, id)
+	}
+}
+
+func listGeofencesHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	geofencesMu.RLock()
+	list := []*Geofence{}
+	for _, f := range geofences {
+		if p.inTenant(f.Tenant) && (f.Phone == "" || p.canView(f.Phone)) {
+			list = append(list, f)
+		}
+	}
+	geofencesMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// decodeGeofence reads and validates a fence from the request body
+func decodeGeofence(w http.ResponseWriter, r *http.Request) (*Geofence, bool) {
+	var f Geofence
+	if err := decodeJSON(w, r, &f); err != nil {
+		bodyError(w, err)
+		return nil, false
+	}
+	if err := f.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	p := requestPrincipal(r)
+	tenant, err := assignTenant(p, f.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	f.Tenant = tenant
+	if f.Phone != "" && (!deviceKnown(f.Phone) || !p.canView(f.Phone) || deviceTenant(f.Phone) != tenant) {
+		http.Error(w, "unknown device", http.StatusBadRequest)
+		return nil, false
+	}
+	return &f, true
+}
+
+func createGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := decodeGeofence(w, r)
+	if !ok {
+		return
+	}
+	f.ID = newID()
+	f.Created = time.Now().UTC()
+
+	geofencesMu.Lock()
+	geofences[f.ID] = f
+	err := saveGeofencesLocked()
+	geofencesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// updateGeofenceHandler replaces a fence; devices start afresh against it
+func updateGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f, ok := decodeGeofence(w, r)
+	if !ok {
+		return
+	}
+
+	geofencesMu.Lock()
+	old, exists := geofences[id]
+	if !exists || !requestPrincipal(r).inTenant(old.Tenant) {
+		geofencesMu.Unlock()
+		http.Error(w, "unknown geofence", http.StatusNotFound)
+		return
+	}
+	f.ID, f.Created = id, old.Created
+	geofences[id] = f
+	err := saveGeofencesLocked()
+	geofencesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forgetFence(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+func deleteGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	geofencesMu.Lock()
+	if f, ok := geofences[id]; !ok || !requestPrincipal(r).inTenant(f.Tenant) {
+		geofencesMu.Unlock()
+		http.Error(w, "unknown geofence", http.StatusNotFound)
+		return
+	}
+	delete(geofences, id)
+	err := saveGeofencesLocked()
+	geofencesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forgetFence(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+```
+
+---
+
+### server_webhooks.go
+```go
+package main
+
+// server_webhooks.go
+// - POSTs every accepted location and geofence event to the URLs in
+//   WEBHOOK_URLS (comma-separated) as {"id", "type", "time", "data"};
+//   WEBHOOK_EVENTS limits the types sent (default "location,geofence")
+// - With WEBHOOK_SECRET set, requests carry X-Timestamp (unix seconds) and
+//   X-Signature, the hex HMAC-SHA256 of "timestamp\nbody"
+// - Each URL has its own queue and worker, so one slow receiver does not
+//   hold up the others. Network errors, 429 and 5xx are retried up to
+//   WEBHOOK_MAX_ATTEMPTS (default 5) with exponential backoff from
+//   WEBHOOK_BACKOFF (default 1s, capped at 5m); other statuses are final
+// - Deliveries still queued at shutdown are lost; when a queue is full new
+//   deliveries for that URL are dropped and logged
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookQueueSize  = 1000
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+type webhookDelivery struct {
+	ID    string
+	Event string
+	Body  []byte
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan webhookDelivery
+}
+
+var (
+	webhookTargets     []*webhookTarget
+	webhookEvents      = map[string]bool{"location": true, "geofence": true}
+	webhookSecret      []byte
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	webhookClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+func setupWebhooks() error {
+	urls := setting("WEBHOOK_URLS")
+	if urls == "" {
+		return nil
+	}
+	if v := setting("WEBHOOK_EVENTS"); v != "" {
+		webhookEvents = map[string]bool{}
+		for _, e := range strings.Split(v, ",") {
+			e = strings.TrimSpace(e)
+			if e != "location" && e != "geofence" {
+				return fmt.Errorf("WEBHOOK_EVENTS: unknown event %q", e)
+			}
+			webhookEvents[e] = true
+		}
+	}
+	if v := setting("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("WEBHOOK_MAX_ATTEMPTS: invalid value %q", v)
+		}
+		webhookMaxAttempts = n
+	}
+	if v := setting("WEBHOOK_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("WEBHOOK_BACKOFF: invalid value %q", v)
+		}
+		webhookBackoff = d
+	}
+	key, err := secret("WEBHOOK_SECRET")
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		slog.Warn("WEBHOOK_SECRET not set, webhook requests will be unsigned")
+	}
+	webhookSecret = []byte(key)
+
+	for _, u := range strings.Split(urls, ",") {
+		u = strings.TrimSpace(u)
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("WEBHOOK_URLS: invalid URL %q", u)
+		}
+		t := &webhookTarget{url: u, queue: make(chan webhookDelivery, webhookQueueSize)}
+		webhookTargets = append(webhookTargets, t)
+		go t.run()
+	}
+	onGeofenceEvent(func(ev GeofenceEvent) { dispatchWebhooks("geofence", ev) })
+	slog.Info("webhooks enabled", "targets", len(webhookTargets))
+	return nil
+}
+
+// dispatchWebhooks queues data for every target without blocking
+func dispatchWebhooks(event string, data interface{}) {
+	if len(webhookTargets) == 0 || !webhookEvents[event] {
+		return
+	}
+	d := webhookDelivery{ID: newID(), Event: event}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":   d.ID,
+		"type": event,
+		"time": time.Now().UTC(),
+		"data": data,
+	})
+	if err != nil {
+		slog.Error("encoding webhook failed", "err", err)
+		return
+	}
+	d.Body = body
+	for _, t := range webhookTargets {
+		select {
+		case t.queue <- d:
+		default:
+			slog.Warn("webhook queue full, dropping delivery", "url", t.url, "event", event)
+		}
+	}
+}
+
+func (t *webhookTarget) run() {
+	for d := range t.queue {
+		t.deliver(d)
+	}
+}
+
+// deliver sends d, retrying with backoff until it succeeds, fails for good
+// or runs out of attempts
+func (t *webhookTarget) deliver(d webhookDelivery) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := t.post(d)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= webhookMaxAttempts {
+			slog.Warn("webhook delivery failed", "url", t.url, "id", d.ID, "attempts", attempt, "err", err)
+			return
+		}
+		slog.Debug("webhook delivery failed, retrying", "url", t.url, "id", d.ID, "in", backoff.String(), "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying
+func (t *webhookTarget) post(d webhookDelivery) (bool, error) {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(d.Body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nu-loc-webhook")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", d.Event)
+	if len(webhookSecret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, webhookSecret)
+		fmt.Fprintf(mac, "%s\n", ts)
+		mac.Write(d.Body)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+}
+```
+
+---
+
+### server_notify.go
+```go
+package main
+
+// server_notify.go
+// - Alerts for people rather than systems: geofence enter/exit, a device
+//   going offline (and coming back), and a device exceeding a speed
+// - NOTIFIERS_FILE (default notifiers.json, optional) names channels and
+//   rules saying which alerts of which device go to which channels:
+//     {"channels": {"ops": {"type": "slack", "webhook_url": "..."}},
+//      "rules": [{"phone": "alice", "alerts": ["geofence", "offline"],
+//                 "offline_after": "30m", "channels": ["ops"]}]}
+//   A rule without phone applies to every device
+// - Channel types: telegram (bot_token, chat_id), slack (webhook_url),
+//   email (to; server from SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASSWORD,
+//   SMTP_FROM) and sms (to; Twilio from TWILIO_ACCOUNT_SID,
+//   TWILIO_AUTH_TOKEN, TWILIO_FROM)
+// - Offline and speed alerts fire once per episode; delivery is best
+//   effort with failures logged
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultNotifiersFile = "notifiers.json"
+
+// notifier delivers a short message over one channel
+type notifier interface {
+	notify(ctx context.Context, subject, text string) error
+}
+
+type channelConfig struct {
+	Type       string   `json:"type"`
+	BotToken   string   `json:"bot_token,omitempty"`
+	ChatID     string   `json:"chat_id,omitempty"`
+	APIURL     string   `json:"api_url,omitempty"` // self-hosted Telegram Bot API
+	WebhookURL string   `json:"webhook_url,omitempty"`
+	To         []string `json:"to,omitempty"`
+}
+
+type alertRule struct {
+	Phone        string   `json:"phone,omitempty"`
+	Alerts       []string `json:"alerts"`
+	Channels     []string `json:"channels"`
+	OfflineAfter string   `json:"offline_after,omitempty"`
+	MaxSpeedKmh  float64  `json:"max_speed_kmh,omitempty"`
+
+	offlineAfter time.Duration
+	alerts       map[string]bool
+}
+
+var (
+	notifiers    = map[string]notifier{}
+	alertRules   []*alertRule
+	alertTimeout = 15 * time.Second
+
+	// alertActive["rule/phone/kind"] marks an offline or speeding episode
+	// already reported; lastPoint feeds the speed check
+	alertActive = map[string]bool{}
+	lastPoint   = map[string]Location{}
+	alertMu     = sync.Mutex{}
+)
+
+func loadNotifiers() error {
+	path := defaultNotifiersFile
+	if p := setting("NOTIFIERS_FILE"); p != "" {
+		path = p
+	}
+	var cfg struct {
+		Channels map[string]channelConfig `json:"channels"`
+		Rules    []*alertRule             `json:"rules"`
+	}
+	if err := loadJSON(path, &cfg); err != nil {
+		return err
+	}
+	for name, c := range cfg.Channels {
+		n, err := newNotifier(c)
+		if err != nil {
+			return fmt.Errorf("%s: channel %q: %w", path, name, err)
+		}
+		notifiers[name] = n
+	}
+	for i, rule := range cfg.Rules {
+		if err := rule.prepare(); err != nil {
+			return fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	alertRules = cfg.Rules
+	if len(alertRules) == 0 {
+		return nil
+	}
+
+	onGeofenceEvent(geofenceAlert)
+	if rulesWant("offline") {
+		go watchOffline()
+	}
+	slog.Info("notifications enabled", "channels", len(notifiers), "rules", len(alertRules))
+	return nil
+}
+
+func (rule *alertRule) prepare() error {
+	if len(rule.Channels) == 0 {
+		return errors.New("no channels")
+	}
+	for _, c := range rule.Channels {
+		if _, ok := notifiers[c]; !ok {
+			return fmt.Errorf("unknown channel %q", c)
+		}
+	}
+	rule.alerts = map[string]bool{}
+	for _, a := range rule.Alerts {
+		switch a {
+		case "geofence":
+		case "offline":
+			d, err := time.ParseDuration(rule.OfflineAfter)
+			if err != nil || d <= 0 {
+				return errors.New("offline alerts need offline_after, e.g. \"30m\"")
+			}
+			rule.offlineAfter = d
+		case "speed":
+			if rule.MaxSpeedKmh <= 0 {
+				return errors.New("speed alerts need max_speed_kmh")
+			}
+		default:
+			return fmt.Errorf("unknown alert %q", a)
+		}
+		rule.alerts[a] = true
+	}
+	if len(rule.alerts) == 0 {
+		return errors.New("no alerts")
+	}
+	return nil
+}
+
+func (rule *alertRule) appliesTo(phone string) bool {
+	return rule.Phone == "" || rule.Phone == phone
+}
+
+func rulesWant(alert string) bool {
+	for _, rule := range alertRules {
+		if rule.alerts[alert] {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers an alert to every channel of rule in the background
+func (rule *alertRule) send(subject, text string) {
+	for _, name := range rule.Channels {
+		name, n := name, notifiers[name]
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+			if err := n.notify(ctx, subject, text); err != nil {
+				slog.Warn("notification failed", "channel", name, "err", err)
+			}
+		}()
+	}
+}
+
+func geofenceAlert(ev GeofenceEvent) {
+	verb := "left"
+	if ev.Event == "enter" {
+		verb = "entered"
+	}
+	subject := fmt.Sprintf("%s %s %s", ev.Phone, verb, ev.Fence)
+	text := subject + " at " + describeLocation(ev.Location)
+	for _, rule := range alertRules {
+		if rule.alerts["geofence"] && rule.appliesTo(ev.Phone) {
+			rule.send(subject, text)
+		}
+	}
+}
+
+// checkAlerts runs the speed check and ends offline episodes for loc
+func checkAlerts(loc Location) {
+	if len(alertRules) == 0 {
+		return
+	}
+	alertMu.Lock()
+	defer alertMu.Unlock()
+	for i, rule := range alertRules {
+		if !rule.appliesTo(loc.Phone) || !rule.alerts["offline"] {
+			continue
+		}
+		key := fmt.Sprintf("%d/%s/offline", i, loc.Phone)
+		if alertActive[key] {
+			delete(alertActive, key)
+			rule.send(loc.Phone+" is back online", loc.Phone+" reported again at "+describeLocation(loc))
+		}
+	}
+
+	if loc.Ciphertext != "" {
+		return
+	}
+	prev, ok := lastPoint[loc.Phone]
+	if ok && !loc.When.After(prev.When) {
+		return
+	}
+	lastPoint[loc.Phone] = loc
+	if !ok {
+		return
+	}
+	kmh := haversine(prev.Lat, prev.Lon, loc.Lat, loc.Lon) / loc.When.Sub(prev.When).Seconds() * 3.6
+	for i, rule := range alertRules {
+		if !rule.appliesTo(loc.Phone) || !rule.alerts["speed"] {
+			continue
+		}
+		key := fmt.Sprintf("%d/%s/speed", i, loc.Phone)
+		switch {
+		case kmh > rule.MaxSpeedKmh && !alertActive[key]:
+			alertActive[key] = true
+			subject := fmt.Sprintf("%s is going %.0f km/h", loc.Phone, kmh)
+			rule.send(subject, fmt.Sprintf("%s (limit %.0f km/h) near %s", subject, rule.MaxSpeedKmh, describeLocation(loc)))
+		case kmh <= rule.MaxSpeedKmh:
+			delete(alertActive, key)
+		}
+	}
+}
+
+// watchOffline raises offline alerts for devices that stopped reporting
+func watchOffline() {
+	for range time.Tick(time.Minute) {
+		checkOffline(time.Now())
+	}
+}
+
+func checkOffline(now time.Time) {
+	last := map[string]Location{}
+	stMutex.RLock()
+	for phone, locs := range store {
+		if len(locs) > 0 {
+			last[phone] = locs[len(locs)-1]
+		}
+	}
+	stMutex.RUnlock()
+
+	alertMu.Lock()
+	defer alertMu.Unlock()
+	for i, rule := range alertRules {
+		if !rule.alerts["offline"] {
+			continue
+		}
+		for phone, loc := range last {
+			key := fmt.Sprintf("%d/%s/offline", i, phone)
+			if !rule.appliesTo(phone) || alertActive[key] || now.Sub(loc.When) < rule.offlineAfter {
+				continue
+			}
+			alertActive[key] = true
+			rule.send(phone+" is offline", fmt.Sprintf("%s has not reported since %s, last seen at %s",
+				phone, loc.When.Format(time.RFC3339), describeLocation(loc)))
+		}
+	}
+}
+
+// describeLocation names where loc is for a human
+func describeLocation(loc Location) string {
+	switch {
+	case loc.Ciphertext != "":
+		return "an encrypted position"
+	case loc.Place != "":
+		return loc.Place
+	default:
+		return fmt.Sprintf("%.5f,%.5f", loc.Lat, loc.Lon)
+	}
+}
+
+func newNotifier(c channelConfig) (notifier, error) {
+	switch c.Type {
+	case "telegram":
+		if c.BotToken == "" || c.ChatID == "" {
+			return nil, errors.New("telegram needs bot_token and chat_id")
+		}
+		api := "https://api.telegram.org"
+		if c.APIURL != "" {
+			api = strings.TrimSuffix(c.APIURL, "/")
+		}
+		return &telegramNotifier{url: api + "/bot" + c.BotToken + "/sendMessage", chatID: c.ChatID}, nil
+	case "slack":
+		if c.WebhookURL == "" {
+			return nil, errors.New("slack needs webhook_url")
+		}
+		return &slackNotifier{url: c.WebhookURL}, nil
+	case "email":
+		return newEmailNotifier(c.To)
+	case "sms":
+		return newSMSNotifier(c.To)
+	default:
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// postNotification sends req and turns non-2xx answers into errors
+func postNotification(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(req)
+}
+
+type telegramNotifier struct {
+	url, chatID string
+}
+
+func (t *telegramNotifier) notify(ctx context.Context, subject, text string) error {
+	return postJSON(ctx, t.url, map[string]string{"chat_id": t.chatID, "text": text})
+}
+
+type slackNotifier struct {
+	url string
+}
+
+func (s *slackNotifier) notify(ctx context.Context, subject, text string) error {
+	return postJSON(ctx, s.url, map[string]string{"text": text})
+}
+
+type emailNotifier struct {
+	addr, from string
+	auth       smtp.Auth
+	to         []string
+}
+
+func newEmailNotifier(to []string) (notifier, error) {
+	host, from := setting("SMTP_HOST"), setting("SMTP_FROM")
+	if len(to) == 0 || host == "" || from == "" {
+		return nil, errors.New("email needs to, SMTP_HOST and SMTP_FROM")
+	}
+	port := setting("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	e := &emailNotifier{addr: net.JoinHostPort(host, port), from: from, to: to}
+	if user := setting("SMTP_USER"); user != "" {
+		password, err := secret("SMTP_PASSWORD")
+		if err != nil {
+			return nil, err
+		}
+		e.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return e, nil
+}
+
+func (e *emailNotifier) notify(ctx context.Context, subject, text string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		e.from, strings.Join(e.to, ", "), subject, text)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// net/smtp has no context support, so the context's deadline is put on
+	// the connection and cancelling it closes the connection
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(alertTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// what smtp.SendMail does, on our connection
+	host, _, _ := net.SplitHostPort(e.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.auth != nil {
+		if err := c.Auth(e.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+type smsNotifier struct {
+	sid, token, from string
+	to               []string
+}
+
+func newSMSNotifier(to []string) (notifier, error) {
+	token, err := secret("TWILIO_AUTH_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	s := &smsNotifier{sid: setting("TWILIO_ACCOUNT_SID"), token: token, from: setting("TWILIO_FROM"), to: to}
+	if len(to) == 0 || s.sid == "" || s.token == "" || s.from == "" {
+		return nil, errors.New("sms needs to, TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM")
+	}
+	return s, nil
+}
+
+func (s *smsNotifier) notify(ctx context.Context, subject, text string) error {
+	api := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(s.sid) + "/Messages.json"
+	for _, to := range s.to {
+		form := url.Values{"To": {to}, "From": {s.from}, "Body": {text}}
+		req, err := http.NewRequestWithContext(ctx, "POST", api, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(s.sid, s.token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := postNotification(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+```
+
+---
+
+### server_wsauth.go
+```go
+package main
+
+// server_wsauth.go
+// - /ws needs a viewer or admin token, given on the upgrade request (?token=,
+//   Authorization or X-API-Key) or, to keep it out of URLs and logs, as the
+//   first message: {"type": "auth", "token": "..."}, answered with {"type":
+//   "authenticated"}
+// - Connections that send anything else, or nothing within wsAuthWait, are
+//   closed with a policy-violation frame; bad tokens count toward lockouts
+// - The connection then sees exactly the devices its token may view
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsAuthWait = 10 * time.Second
+
+// mayWatch reports whether p's role may open live streams
+func mayWatch(p *principal) bool {
+	return p.Role == roleAdmin || p.Role == roleViewer
+}
+
+// wsAuthenticate reads the auth message from a connection upgraded
+// without credentials
+func wsAuthenticate(conn *websocket.Conn, r *http.Request) (*principal, error) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthWait))
+	var msg struct {
+		Type  string `json:"type"`
+		Token string `json:"token"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "auth" || msg.Token == "" {
+		return nil, errors.New("authentication required")
+	}
+	if lockedFor(ipKey(r)) > 0 {
+		return nil, errors.New("too many failed attempts")
+	}
+	p, err := authenticateCharged(msg.Token)
+	if errors.Is(err, errBadCredentials) {
+		authFailed(ipKey(r))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !mayWatch(p) {
+		return nil, errors.New("forbidden for role " + p.Role)
+	}
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := conn.WriteJSON(map[string]string{"type": "authenticated"}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// refuseViewer closes a connection that failed to authenticate
+func refuseViewer(conn *websocket.Conn, err error) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
+```
+
+---
+
+### server_hub.go
+```go
+package main
+
+// server_hub.go
+// - One goroutine, the hub, owns the set of WebSocket viewers. Joining,
+//   leaving, broadcasts and every other look at the set are messages to it,
+//   so broadcasts never wait on a lock or on each other
+// - Each viewer has a buffered send channel drained by its own write pump,
+//   which also sends the keepalive pings. A viewer whose buffer fills up is
+//   disconnected instead of slowing down everyone else
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSendBuffer = 64
+	hubBuffer    = 256
+)
+
+// wsClient is one live viewer connection. phones belongs to the hub.
+type wsClient struct {
+	conn   *websocket.Conn
+	who    *principal
+	phones map[string]bool // nil until the viewer subscribes
+	ip     string          // for auditing later subscriptions
+	send   chan interface{}
+	// closeFrame is sent by the write pump once send is closed
+	closeFrame []byte
+}
+
+func newWSClient(conn *websocket.Conn, who *principal) *wsClient {
+	return &wsClient{conn: conn, who: who, send: make(chan interface{}, wsSendBuffer)}
+}
+
+// hubMessage is one broadcast; the hub fills in seq
+type hubMessage struct {
+	phone string
+	v     interface{}
+	seq   uint64
+}
+
+var hub = struct {
+	unregister chan *wsClient
+	broadcast  chan hubMessage
+	calls      chan func(map[*wsClient]bool)
+}{
+	unregister: make(chan *wsClient),
+	broadcast:  make(chan hubMessage, hubBuffer),
+	calls:      make(chan func(map[*wsClient]bool)),
+}
+
+// runHub serves the hub's channels for the life of the process
+func runHub() {
+	clients := map[*wsClient]bool{}
+	for {
+		select {
+		case c := <-hub.unregister:
+			dropClient(clients, c, nil)
+		case m := <-hub.broadcast:
+			m = record(m)
+			for c := range clients {
+				if c.wants(m.phone) {
+					queue(clients, c, sequenced{m.seq, m.v})
+				}
+			}
+		case fn := <-hub.calls:
+			fn(clients)
+		}
+	}
+}
+
+// inHub runs fn on the hub goroutine and waits for it to finish
+func inHub(fn func(clients map[*wsClient]bool)) {
+	done := make(chan struct{})
+	hub.calls <- func(clients map[*wsClient]bool) {
+		fn(clients)
+		close(done)
+	}
+	<-done
+}
+
+// registerClient adds c to the hub and queues what it missed since the
+// given sequence number or, failing that, its snapshot of up to n recent
+// points per device, so nothing falls between the two
+func registerClient(c *wsClient, n int, since *uint64) {
+	inHub(func(clients map[*wsClient]bool) {
+		clients[c] = true
+		if since == nil || !replaySince(clients, c, *since) {
+			sendSnapshot(clients, c, n, nil)
+		}
+	})
+}
+
+// queue hands v to c's write pump, dropping c if it has fallen behind.
+// Only the hub calls it.
+func queue(clients map[*wsClient]bool, c *wsClient, v interface{}) {
+	select {
+	case c.send <- v:
+	default:
+		slog.Debug("websocket viewer too slow, dropping it")
+		dropClient(clients, c, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+	}
+}
+
+// dropClient removes c and tells its write pump to finish, sending
+// closeFrame if set. Only the hub calls it.
+func dropClient(clients map[*wsClient]bool, c *wsClient, closeFrame []byte) {
+	if !clients[c] {
+		return
+	}
+	delete(clients, c)
+	c.closeFrame = closeFrame
+	close(c.send)
+}
+
+// writePump writes everything queued for c and pings it every
+// wsPingPeriod. It owns all writes to the connection.
+func (c *wsClient) writePump() {
+	t := time.NewTicker(wsPingPeriod)
+	defer func() {
+		t.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case v, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				if c.closeFrame != nil {
+					c.conn.WriteMessage(websocket.CloseMessage, c.closeFrame)
+				}
+				return
+			}
+			if err := c.conn.WriteJSON(v); err != nil {
+				slog.Debug("websocket write failed, dropping viewer", "err", err)
+				return
+			}
+		case <-t.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				slog.Debug("websocket ping failed, dropping viewer", "err", err)
+				return
+			}
+		}
+	}
+}
+```
+
+---
+
+### server_wssub.go
+```go
+package main
+
+// server_wssub.go
+// - WebSocket viewers choose which devices they hear about instead of
+//   receiving every device they may view and filtering in the browser
+// - On connect: /ws?phones=a,b (or ?phone=a); phones the caller may not
+//   view are refused with 403
+// - Later: {"type": "subscribe", "phones": [...]} and {"type":
+//   "unsubscribe", "phones": [...]}, answered with {"type": "subscribed",
+//   "phones": [...]} or {"type": "error", "error": ...}
+// - Connections that never subscribe keep receiving every device they may
+//   view
+// - Right after connecting, and after each subscribe, the viewer gets
+//   {"type": "snapshot", "locations": [...]}: the newest ?snapshot= (or
+//   "snapshot") points of each device it follows, default 1, 0 for none
+// - The connection, once the viewer is known, and each subscribe message
+//   are audited as live.subscribe, one entry per phone asked for
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultSnapshot = 1
+
+// wants reports whether the viewer should be sent phone's updates
+func (c *wsClient) wants(phone string) bool {
+	return c.who.canView(phone) && (c.phones == nil || c.phones[phone])
+}
+
+// wsSubscription is a subscribe or unsubscribe message from a viewer
+type wsSubscription struct {
+	Type     string   `json:"type"`
+	Phones   []string `json:"phones"`
+	Snapshot *int     `json:"snapshot,omitempty"`
+}
+
+// snapshotSize parses a requested snapshot size, capped at the retention
+func snapshotSize(v string) (int, error) {
+	if v == "" {
+		return defaultSnapshot, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("snapshot: want a number of points")
+	}
+	return min(n, maxHistory), nil
+}
+
+// sendSnapshot queues the newest n points of each of phones (every device
+// c follows when nil) that c may see. Only the hub calls it.
+func sendSnapshot(clients map[*wsClient]bool, c *wsClient, n int, phones []string) {
+	if n == 0 {
+		return
+	}
+	var locs []Location
+	stMutex.RLock()
+	if phones == nil {
+		for phone := range store {
+			phones = append(phones, phone)
+		}
+		sort.Strings(phones)
+	}
+	for _, phone := range phones {
+		if !c.wants(phone) || !devicePaired(phone) {
+			continue
+		}
+		h := store[phone]
+		locs = append(locs, h[max(0, len(h)-n):]...)
+	}
+	stMutex.RUnlock()
+	if len(locs) > 0 {
+		queue(clients, c, map[string]interface{}{"type": "snapshot", "seq": replay.seq, "locations": locs})
+	}
+}
+
+// initialSubscription reads ?phones= or ?phone= from the upgrade request
+func initialSubscription(r *http.Request) ([]string, bool) {
+	q := r.URL.Query()
+	raw := q.Get("phones")
+	if raw == "" {
+		raw = q.Get("phone")
+	}
+	if raw == "" {
+		return nil, false
+	}
+	var phones []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			phones = append(phones, p)
+		}
+	}
+	return phones, true
+}
+
+// checkSubscription makes sure who may view every phone asked for
+func checkSubscription(who *principal, phones []string) error {
+	if len(phones) == 0 {
+		return errors.New("phones is required")
+	}
+	for _, p := range phones {
+		if !who.canView(p) {
+			return errors.New("forbidden for phone " + p)
+		}
+	}
+	return nil
+}
+
+// handleSubscription applies msg to c's subscription and replies
+func handleSubscription(c *wsClient, msg wsSubscription) {
+	if msg.Type == "subscribe" {
+		// audited off the hub; applySubscription makes the same check
+		status := http.StatusOK
+		if checkSubscription(c.who, msg.Phones) != nil {
+			status = http.StatusForbidden
+		}
+		auditAccess("live.subscribe", "WS", apiPrefix+"/ws", c.ip, c.who, msg.Phones, status)
+	}
+	inHub(func(clients map[*wsClient]bool) {
+		if clients[c] {
+			applySubscription(clients, c, msg)
+		}
+	})
+}
+
+// applySubscription runs on the hub
+func applySubscription(clients map[*wsClient]bool, c *wsClient, msg wsSubscription) {
+	var err error
+	switch msg.Type {
+	case "subscribe":
+		if err = checkSubscription(c.who, msg.Phones); err == nil {
+			if c.phones == nil {
+				c.phones = map[string]bool{}
+			}
+			for _, p := range msg.Phones {
+				c.phones[p] = true
+			}
+		}
+	case "unsubscribe":
+		if c.phones == nil {
+			c.phones = map[string]bool{}
+		}
+		for _, p := range msg.Phones {
+			delete(c.phones, p)
+		}
+	default:
+		err = errors.New("unknown message type " + msg.Type)
+	}
+	if err != nil {
+		queue(clients, c, map[string]string{"type": "error", "error": err.Error()})
+		return
+	}
+	phones := make([]string, 0, len(c.phones))
+	for p := range c.phones {
+		phones = append(phones, p)
+	}
+	sort.Strings(phones)
+	queue(clients, c, map[string]interface{}{"type": "subscribed", "phones": phones})
+	if msg.Type == "subscribe" && clients[c] {
+		n := defaultSnapshot
+		if msg.Snapshot != nil {
+			n = min(max(*msg.Snapshot, 0), maxHistory)
+		}
+		sendSnapshot(clients, c, n, msg.Phones)
+	}
+}
+```
+
+---
+
+### server_wsreplay.go
+```go
+package main
+
+// server_wsreplay.go
+// - Every broadcast gets a sequence number, sent to viewers as "seq", and
+//   the hub keeps the last wsReplayBuffer of them
+// - A viewer reconnecting with /ws?since=<seq> is sent what it missed
+//   instead of a snapshot. When some of that is no longer kept, or there is
+//   more than fits its send buffer, it gets the usual snapshot instead
+// - Numbers are shared by all devices, so a viewer following a few sees
+//   gaps. They start from the clock at boot, so a restarted server never
+//   reuses one and old numbers fall back to a snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const wsReplayBuffer = 1024
+
+// replay is the hub's record of recent broadcasts. Only the hub touches it.
+var replay = struct {
+	seq    uint64
+	recent []hubMessage
+}{seq: uint64(time.Now().UnixMicro())}
+
+// sinceSeq parses ?since=, returning nil when the viewer sent none
+func sinceSeq(v string) (*uint64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, errors.New("since: want a sequence number")
+	}
+	return &n, nil
+}
+
+// record numbers m and keeps it for replay. Only the hub calls it.
+func record(m hubMessage) hubMessage {
+	replay.seq++
+	m.seq = replay.seq
+	replay.recent = append(replay.recent, m)
+	if len(replay.recent) > wsReplayBuffer {
+		replay.recent = replay.recent[len(replay.recent)-wsReplayBuffer:]
+	}
+	return m
+}
+
+// replaySince queues the broadcasts after since that c wants, reporting
+// false (and queueing nothing) when it cannot send all of them. Only the
+// hub calls it.
+func replaySince(clients map[*wsClient]bool, c *wsClient, since uint64) bool {
+	if since > replay.seq || replay.seq-since > uint64(len(replay.recent)) {
+		return false
+	}
+	var missed []hubMessage
+	for _, m := range replay.recent[len(replay.recent)-int(replay.seq-since):] {
+		if m.v != nil && c.wants(m.phone) {
+			missed = append(missed, m)
+		}
+	}
+	if len(missed) >= wsSendBuffer {
+		return false
+	}
+	for _, m := range missed {
+		queue(clients, c, sequenced{m.seq, m.v})
+	}
+	return true
+}
+
+// forgetBroadcasts blanks the kept broadcasts about phone so deleted
+// history is not replayed. Their numbers stay taken.
+func forgetBroadcasts(phone string) {
+	inHub(func(map[*wsClient]bool) {
+		for i := range replay.recent {
+			if replay.recent[i].phone == phone {
+				replay.recent[i].v = nil
+			}
+		}
+	})
+}
+
+// sequenced is a broadcast as viewers see it: v with "seq" added
+type sequenced struct {
+	seq uint64
+	v   interface{}
+}
+
+func (s sequenced) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(s.v)
+	if err != nil || len(b) < 2 || b[0] != '{' {
+		return b, err
+	}
+	head := fmt.Sprintf(`{"seq":%d`, s.seq)
+	if b[1] != '}' {
+		head += ","
+	}
+	return append([]byte(head), b[1:]...), nil
+}
+```
+
+---
+
+### server_sse.go
+```go
+package main
+
+// server_sse.go
+// - GET /events/{phone}: the live feed of one device as Server-Sent Events,
+//   for networks and proxies that block WebSockets. Browsers pass the key
+//   as ?token= since EventSource cannot set headers
+// - Locations arrive as "event: location" with the point's arrival number
+//   as id; geofence crossings as "event: geofence"
+// - On reconnect the browser sends Last-Event-ID and the stream first
+//   replays stored points that arrived after it, in arrival order, so
+//   nothing is missed while away, late points from batches and offline
+//   queues included. ?last_event_id= does the same for a first connection
+// - Points relayed from other replicas have no id and are not replayed
+// - A comment line every sseHeartbeat keeps idle proxies from closing the
+//   stream; subscribers that fall behind are disconnected and catch up by
+//   reconnecting
+// - The subscriber list here also feeds the gRPC Subscribe stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	sseHeartbeat   = 25 * time.Second
+	sseRetryMs     = 3000
+	liveBufferSize = 64
+)
+
+type liveSubscriber struct {
+	phone string
+	who   *principal
+	ch    chan interface{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (s *liveSubscriber) close() { s.once.Do(func() { close(s.done) }) }
+
+var (
+	liveSubscribers   = map[*liveSubscriber]bool{}
+	liveSubscribersMu = sync.Mutex{}
+)
+
+// subscribeLive registers a stream of phone's live updates for who; end it
+// with unsubscribeLive
+func subscribeLive(phone string, who *principal) *liveSubscriber {
+	sub := &liveSubscriber{phone: phone, who: who, ch: make(chan interface{}, liveBufferSize), done: make(chan struct{})}
+	liveSubscribersMu.Lock()
+	liveSubscribers[sub] = true
+	liveSubscribersMu.Unlock()
+	return sub
+}
+
+func unsubscribeLive(sub *liveSubscriber) {
+	liveSubscribersMu.Lock()
+	delete(liveSubscribers, sub)
+	liveSubscribersMu.Unlock()
+}
+
+// publishLive hands v to the live streams of phone
+func publishLive(phone string, v interface{}) {
+	liveSubscribersMu.Lock()
+	defer liveSubscribersMu.Unlock()
+	for s := range liveSubscribers {
+		if s.phone != phone || !s.who.canView(phone) {
+			continue
+		}
+		select {
+		case s.ch <- v:
+		default:
+			s.close()
+			delete(liveSubscribers, s)
+		}
+	}
+}
+
+// closeLiveStreams ends every live stream, SSE and gRPC, for shutdown
+func closeLiveStreams() {
+	liveSubscribersMu.Lock()
+	defer liveSubscribersMu.Unlock()
+	for s := range liveSubscribers {
+		s.close()
+		delete(liveSubscribers, s)
+	}
+}
+
+// kickEventStreams ends the streams of phone whose principal may only
+// view phone, mirroring kickViewers
+func kickEventStreams(phone string) int {
+	liveSubscribersMu.Lock()
+	defer liveSubscribersMu.Unlock()
+	n := 0
+	for s := range liveSubscribers {
+		if s.phone != phone || s.who == nil || s.who.Role == roleAdmin || len(s.who.Phones) != 1 {
+			continue
+		}
+		s.close()
+		delete(liveSubscribers, s)
+		n++
+	}
+	return n
+}
+
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !devicePaired(phone) {
+		http.Error(w, "device has not completed pairing", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var since uint64 // arrival number
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		n, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	// Subscribe before replaying so nothing falls between the two
+	sub := subscribeLive(phone, requestPrincipal(r))
+	defer unsubscribeLive(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stop nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+
+	// replayed is the last arrival sent from history; the history holds
+	// every point up to it, so live copies of those are skipped
+	replayed := since
+	if lastID != "" {
+		stMutex.RLock()
+		locs, last := store[phone], arrivalSeq
+		stMutex.RUnlock()
+		if since > last {
+			// not a number we gave out, e.g. a timestamp id from before
+			// arrival numbers: carry on from now
+			since, replayed = last, last
+		}
+		var missed []Location
+		for _, l := range locs {
+			if l.arrival > since {
+				missed = append(missed, l)
+			}
+		}
+		sort.Slice(missed, func(i, j int) bool { return missed[i].arrival < missed[j].arrival })
+		for _, l := range missed {
+			writeSSE(w, "location", l)
+			replayed = l.arrival
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case v := <-sub.ch:
+			if l, ok := v.(Location); ok {
+				if lastID != "" && l.arrival != 0 && l.arrival <= replayed {
+					continue
+				}
+				writeSSE(w, "location", l)
+			} else {
+				writeSSE(w, "geofence", v)
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-sub.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes one event; locations carry their arrival number as id
+func writeSSE(w http.ResponseWriter, event string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if l, ok := v.(Location); ok && l.arrival != 0 {
+		fmt.Fprintf(w, "id: %d\n", l.arrival)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
+```
+
+---
+
+### server_grpc.go
+```go
+package main
+
+// server_grpc.go
+// - gRPC API from nulocpb/nuloc.proto on GRPC_ADDR (e.g. ":50051"), off
+//   unless set. It uses TLS_CERT/TLS_KEY, and TLS_CLIENT_CA_FILE for mutual
+//   TLS, when configured and plaintext otherwise
+// - Every call is held to the IP_ALLOW/IP_DENY rules and per-IP rate limit
+//   of the HTTP endpoint it mirrors: /report, /get/{phone} or /ws
+// - Report runs checkReporter like POST /report: rate limit, lockout,
+//   client certificate, device token or reporter key, registration and
+//   consent. Signed reports are HTTP only, so REQUIRE_SIGNED_REPORTS
+//   refuses them
+// - ReportStream runs the same checks on each report of a long-lived
+//   stream and acknowledges it once stored; the first failure ends the
+//   stream with Report's error
+// - Query and Subscribe take a read key or session as "authorization:
+//   Bearer <key>" metadata, like /get and /ws; a bad key counts toward the
+//   caller's IP lockout
+// - Query and Subscribe are audited as history.read and live.subscribe,
+//   refusals included, with method "GRPC" and the RPC as the path
+// - Subscribe streams locations from the live feed behind /ws and /events;
+//   a subscriber that falls behind is ended with Unavailable
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"locationshare/nulocpb"
+)
+
+type trackerServer struct {
+	nulocpb.UnimplementedTrackerServer
+}
+
+// serveGRPC serves the gRPC API on addr until ctx is cancelled
+func serveGRPC(ctx context.Context, addr string) {
+	var opts []grpc.ServerOption
+	certPEM, err := secret("TLS_CERT")
+	if err != nil {
+		slog.Error("grpc TLS setup failed", "err", err)
+		return
+	}
+	keyPEM, err := secret("TLS_KEY")
+	if err != nil {
+		slog.Error("grpc TLS setup failed", "err", err)
+		return
+	}
+	if certPEM != "" || keyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			slog.Error("grpc TLS setup failed", "err", err)
+			return
+		}
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+		if err := applyClientCA(cfg); err != nil {
+			slog.Error("grpc TLS setup failed", "err", err)
+			return
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	} else {
+		slog.Warn("gRPC without TLS, tokens travel in plaintext")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("grpc listen failed", "err", err)
+		return
+	}
+	srv := grpc.NewServer(opts...)
+	nulocpb.RegisterTrackerServer(srv, trackerServer{})
+	go func() {
+		<-ctx.Done()
+		// Subscribe streams only end when their subscription does
+		closeLiveStreams()
+		srv.GracefulStop()
+	}()
+	slog.Info("gRPC listener", "addr", addr)
+	if err := srv.Serve(ln); err != nil {
+		slog.Error("grpc server failed", "err", err)
+	}
+}
+
+// grpcPrincipal authenticates the "authorization" metadata of ctx like
+// identify does for HTTP: nil without credentials, Unauthenticated for a
+// bad key, which counts toward the caller's lockout
+func grpcPrincipal(ctx context.Context) (*principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get("authorization")
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ip, _ := grpcPeer(ctx)
+	if lockedFor("ip:"+ip) > 0 {
+		return nil, status.Error(codes.ResourceExhausted, "too many failed attempts")
+	}
+	p, err := authenticateCharged(strings.TrimPrefix(keys[0], "Bearer "))
+	switch {
+	case errors.Is(err, errBadCredentials):
+		authFailed("ip:" + ip)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return p, nil
+}
+
+// grpcAllowPeer applies the IP rules and per-IP rate limit of the HTTP
+// endpoint at path to the caller
+func grpcAllowPeer(ctx context.Context, path string) error {
+	ip, _ := grpcPeer(ctx)
+	if !peerAllowed(path, ip) {
+		return status.Error(codes.PermissionDenied, "forbidden from this address")
+	}
+	if ok, _ := ipLimits.allow(ip); !ok {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return nil
+}
+
+// refusalCodes maps checkReporter's HTTP statuses onto gRPC codes
+var refusalCodes = map[int]codes.Code{
+	http.StatusTooManyRequests: codes.ResourceExhausted,
+	http.StatusUnauthorized:    codes.Unauthenticated,
+	http.StatusNotFound:        codes.NotFound,
+	http.StatusForbidden:       codes.PermissionDenied,
+}
+
+// grpcPeer returns the caller's IP and TLS state, if any
+func grpcPeer(ctx context.Context) (string, *tls.ConnectionState) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		ip = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		return ip, &info.State
+	}
+	return ip, nil
+}
+
+func (trackerServer) Report(ctx context.Context, req *nulocpb.ReportRequest) (*nulocpb.ReportResponse, error) {
+	phone := req.GetPhone()
+	if requireSigned {
+		return nil, status.Error(codes.FailedPrecondition, "signed reports are required, use POST /report")
+	}
+	if err := grpcAllowPeer(ctx, "/report"); err != nil {
+		return nil, err
+	}
+	p, err := grpcPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ip, cs := grpcPeer(ctx)
+	refusal := checkReporter(ip, phone, func() error {
+		if err := checkPeerCert(cs, phone); err != nil {
+			return err
+		}
+		if !p.canReport(phone) && !checkDeviceToken(phone, req.GetToken()) {
+			return errors.New("invalid device token")
+		}
+		return nil
+	})
+	if refusal != nil {
+		if refusal.status == http.StatusUnauthorized {
+			slog.Warn("report rejected", "device", phone, "err", refusal.msg, "transport", "grpc")
+		}
+		return nil, status.Error(refusalCodes[refusal.status], refusal.msg)
+	}
+
+	loc := reportFromPB(req)
+	if cerr := checkLocation(loc); cerr != nil {
+		return nil, status.Error(codes.InvalidArgument, cerr.Error())
+	}
+	if loc.When, err = reportTime(loc.When); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ingest(loc)
+	return &nulocpb.ReportResponse{}, nil
+}
+
+func (t trackerServer) ReportStream(stream nulocpb.Tracker_ReportStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := t.Report(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// auditGRPC records a Query or Subscribe under action, with the HTTP
+// status matching err
+func auditGRPC(ctx context.Context, action, phone string, p *principal, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+		for st, c := range refusalCodes {
+			if c == status.Code(err) {
+				code = st
+			}
+		}
+	}
+	method, _ := grpc.Method(ctx)
+	ip, _ := grpcPeer(ctx)
+	auditAccess(action, "GRPC", method, ip, p, []string{phone}, code)
+}
+
+// authorizeView checks that the caller, held to the IP rules of path, may
+// read phone's history. The caller is returned along with a refusal, for
+// the audit log.
+func authorizeView(ctx context.Context, path, phone string) (*principal, error) {
+	if err := grpcAllowPeer(ctx, path); err != nil {
+		return nil, err
+	}
+	p, err := grpcPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid credentials")
+	}
+	if !p.canView(phone) {
+		return p, status.Error(codes.PermissionDenied, "forbidden for this phone")
+	}
+	if !devicePaired(phone) {
+		return p, status.Error(codes.NotFound, "device has not completed pairing")
+	}
+	return p, nil
+}
+
+func (trackerServer) Query(ctx context.Context, req *nulocpb.QueryRequest) (*nulocpb.QueryResponse, error) {
+	p, err := authorizeView(ctx, "/get/"+req.GetPhone(), req.GetPhone())
+	auditGRPC(ctx, "history.read", req.GetPhone(), p, err)
+	if err != nil {
+		return nil, err
+	}
+	stMutex.RLock()
+	locs := store[req.GetPhone()]
+	stMutex.RUnlock()
+
+	resp := &nulocpb.QueryResponse{}
+	for _, l := range locs {
+		if req.Since != nil && !l.When.After(req.Since.AsTime()) {
+			continue
+		}
+		resp.Locations = append(resp.Locations, locationPB(l))
+	}
+	if n := int(req.GetLimit()); n > 0 && len(resp.Locations) > n {
+		resp.Locations = resp.Locations[len(resp.Locations)-n:]
+	}
+	return resp, nil
+}
+
+func (trackerServer) Subscribe(req *nulocpb.SubscribeRequest, stream nulocpb.Tracker_SubscribeServer) error {
+	p, err := authorizeView(stream.Context(), "/ws", req.GetPhone())
+	auditGRPC(stream.Context(), "live.subscribe", req.GetPhone(), p, err)
+	if err != nil {
+		return err
+	}
+	sub := subscribeLive(req.GetPhone(), p)
+	defer unsubscribeLive(sub)
+	for {
+		select {
+		case v := <-sub.ch:
+			l, ok := v.(Location)
+			if !ok {
+				continue
+			}
+			if err := stream.Send(locationPB(l)); err != nil {
+				return err
+			}
+		case <-sub.done:
+			return status.Error(codes.Unavailable, "subscription ended")
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func locationPB(l Location) *nulocpb.Location {
+	pb := &nulocpb.Location{
+		Phone:      l.Phone,
+		Lat:        l.Lat,
+		Lon:        l.Lon,
+		When:       timestamppb.New(l.When),
+		Ciphertext: l.Ciphertext,
+		Place:      l.Place,
+		Seq:        l.Seq,
+	}
+	if l.Received != nil {
+		pb.Received = timestamppb.New(*l.Received)
+	}
+	return pb
+}
+```
+
+---
+
+### server_protobuf.go
+```go
+package main
+
+// server_protobuf.go
+// - POST /report also takes Content-Type: application/x-protobuf with a
+//   nuloc.v1.ReportRequest body (nulocpb/nuloc.proto), about a third of the
+//   JSON size and cheaper to parse for high-frequency reporters
+// - Like JSON bodies, protobuf bodies with unknown fields are rejected.
+//   Signatures cover the raw body whatever its encoding
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+
+	"locationshare/nulocpb"
+)
+
+const protobufType = "application/x-protobuf"
+
+// isProtobuf reports whether the request body is protobuf
+func isProtobuf(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mt == protobufType || mt == "application/protobuf")
+}
+
+// unmarshalReportPB decodes a ReportRequest body
+func unmarshalReportPB(body []byte) (Location, error) {
+	var req nulocpb.ReportRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		return Location{}, err
+	}
+	if len(req.ProtoReflect().GetUnknown()) > 0 {
+		return Location{}, errors.New("unknown fields")
+	}
+	return reportFromPB(&req), nil
+}
+
+// reportFromPB converts a ReportRequest, token included
+func reportFromPB(req *nulocpb.ReportRequest) Location {
+	loc := Location{
+		Phone:      req.GetPhone(),
+		Token:      req.GetToken(),
+		Lat:        req.GetLat(),
+		Lon:        req.GetLon(),
+		Ciphertext: req.GetCiphertext(),
+		Accuracy:   req.GetAccuracy(),
+		Altitude:   req.Altitude,
+		Speed:      req.Speed,
+		Bearing:    req.Bearing,
+		Network:    req.GetNetwork(),
+		Hostname:   req.GetHostname(),
+		Uptime:     req.Uptime,
+		Interface:  req.GetInterface(),
+		Recoveries: int(req.GetRecoveries()),
+		Seq:        req.GetSeq(),
+	}
+	if req.Battery != nil {
+		b := int(*req.Battery)
+		loc.Battery = &b
+	}
+	if req.When != nil {
+		loc.When = req.When.AsTime()
+	}
+	return loc
+}
+```
+
+---
+
+### server_codec.go
+```go
+package main
+
+// server_codec.go
+// - MessagePack and CBOR as alternatives to JSON for embedded clients:
+//   request bodies of /report and /report/batch are decoded by
+//   Content-Type, and /report, /report/batch, /get, /latest and /stats
+//   answer in the encoding named by Accept, JSON otherwise
+// - Field names are the JSON ones; times are msgpack timestamps or
+//   RFC 3339 strings in CBOR. Unknown fields are rejected as for JSON
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	msgpackType = "application/msgpack"
+	cborType    = "application/cbor"
+)
+
+// codecError marks a decode error of a non-JSON body
+type codecError struct {
+	codec string
+	err   error
+}
+
+func (e *codecError) Error() string { return e.err.Error() }
+
+var (
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	cborDec, _ = cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode()
+)
+
+// codecOf maps a media type to "msgpack", "cbor" or "" for JSON
+func codecOf(mediaType string) string {
+	switch mediaType {
+	case msgpackType, "application/x-msgpack", "application/vnd.msgpack":
+		return "msgpack"
+	case cborType:
+		return "cbor"
+	}
+	return ""
+}
+
+// decodeBody decodes body into v according to the request's Content-Type
+func decodeBody(r *http.Request, body []byte, v interface{}) error {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch codecOf(mt) {
+	case "msgpack":
+		dec := msgpack.NewDecoder(bytes.NewReader(body))
+		dec.SetCustomStructTag("json")
+		dec.DisallowUnknownFields(true)
+		if err := dec.Decode(v); err != nil {
+			return &codecError{"msgpack", err}
+		}
+	case "cbor":
+		if err := cborDec.Unmarshal(body, v); err != nil {
+			return &codecError{"cbor", err}
+		}
+	default:
+		return strictUnmarshal(body, v)
+	}
+	return nil
+}
+
+// responseCodec picks the first msgpack or CBOR type in Accept, or "" for JSON
+func responseCodec(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mt == "application/json" {
+			return ""
+		}
+		if c := codecOf(mt); c != "" {
+			return c
+		}
+	}
+	return ""
+}
+
+// writeEncoded writes v in the encoding the client asked for
+func writeEncoded(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+	switch responseCodec(r) {
+	case "msgpack":
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		enc.SetOmitEmpty(true)
+		if err := enc.Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", msgpackType)
+		w.Write(buf.Bytes())
+	case "cbor":
+		b, err := cborEnc.Marshal(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", cborType)
+		w.Write(b)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+```
+
+---
+
+### server_mqtt.go
+```go
+package main
+
+// server_mqtt.go
+// - Subscribes to MQTT_BROKER (tcp://, ssl:// or ws:// URL) and ingests
+//   messages on MQTT_TOPIC (default "nuloc/+/location") as reports; the
+//   segment matched by "+" is the device
+// - Payloads are /report bodies: {"token", "lat", "lon", "when", "ct"}.
+//   "phone" may be left out and must match the topic when given
+// - The device token is checked like on /report unless MQTT_TRUST_BROKER is
+//   true, for brokers whose ACLs already tie topics to devices
+// - MQTT_USERNAME/MQTT_PASSWORD authenticate to the broker, MQTT_CLIENT_ID
+//   (default "nuloc-server") names us, MQTT_QOS (default 1) is the
+//   subscription QoS. The client reconnects and resubscribes on its own
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultMQTTTopic = "nuloc/+/location"
+
+var mqttConnected atomic.Bool
+
+// startMQTT connects to broker and starts ingesting; the connection is
+// closed when ctx is cancelled
+func startMQTT(ctx context.Context, broker string) error {
+	topic := setting("MQTT_TOPIC")
+	if topic == "" {
+		topic = defaultMQTTTopic
+	}
+	if !strings.Contains(topic, "+") {
+		return errors.New("MQTT_TOPIC needs a + segment for the device")
+	}
+	qos := byte(1)
+	if v := setting("MQTT_QOS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 2 {
+			return fmt.Errorf("MQTT_QOS: invalid value %q", v)
+		}
+		qos = byte(n)
+	}
+	trustBroker := setting("MQTT_TRUST_BROKER") == "true"
+	clientID := setting("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "nuloc-server"
+	}
+	password, err := secret("MQTT_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(setting("MQTT_USERNAME")).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second)
+	handler := func(_ mqtt.Client, m mqtt.Message) {
+		if err := ingestMQTT(topic, m.Topic(), m.Payload(), trustBroker); err != nil {
+			slog.Warn("mqtt report rejected", "topic", m.Topic(), "err", err)
+		}
+	}
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		mqttConnected.Store(true)
+		slog.Info("mqtt connected", "broker", broker, "topic", topic)
+		if t := c.Subscribe(topic, qos, handler); t.Wait() && t.Error() != nil {
+			slog.Error("mqtt subscribe failed", "topic", topic, "err", t.Error())
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		mqttConnected.Store(false)
+		slog.Warn("mqtt connection lost", "err", err)
+	})
+
+	client := mqtt.NewClient(opts)
+	// with ConnectRetry the token only fails on bad options; the
+	// connection itself is retried in the background
+	if t := client.Connect(); t.WaitTimeout(time.Second) && t.Error() != nil {
+		return t.Error()
+	}
+	registerReadyCheck("mqtt", func(context.Context) error {
+		if !mqttConnected.Load() {
+			return errors.New("not connected to broker")
+		}
+		return nil
+	})
+	go func() {
+		<-ctx.Done()
+		client.Disconnect(250)
+	}()
+	return nil
+}
+
+// mqttDevice returns the segment of topic matched by the first "+" of pattern
+func mqttDevice(pattern, topic string) string {
+	ps, ts := strings.Split(pattern, "/"), strings.Split(topic, "/")
+	for i, p := range ps {
+		if p == "+" && i < len(ts) {
+			return ts[i]
+		}
+	}
+	return ""
+}
+
+// ingestMQTT validates and stores one message
+func ingestMQTT(pattern, topic string, payload []byte, trustBroker bool) error {
+	phone := mqttDevice(pattern, topic)
+	if phone == "" {
+		return errors.New("no device in topic")
+	}
+	return ingestMessage(phone, payload, trustBroker)
+}
+
+// ingestMessage validates and stores a /report body that arrived through a
+// broker for phone, checking the device token unless trustBroker is set
+func ingestMessage(phone string, payload []byte, trustBroker bool) error {
+	if int64(len(payload)) > maxBodyBytes {
+		return errors.New("payload too large")
+	}
+	var loc Location
+	if err := strictUnmarshal(payload, &loc); err != nil {
+		return err
+	}
+	if loc.Phone != "" && loc.Phone != phone {
+		return fmt.Errorf("payload is for %q", loc.Phone)
+	}
+	loc.Phone = phone
+
+	var prove func() error
+	if !trustBroker {
+		prove = func() error {
+			if !checkDeviceToken(phone, loc.Token) {
+				return errors.New("invalid device token")
+			}
+			return nil
+		}
+	}
+	if refusal := checkReporter("", phone, prove); refusal != nil {
+		return refusal
+	}
+	if cerr := checkLocation(loc); cerr != nil {
+		return cerr
+	}
+	var err error
+	if loc.When, err = reportTime(loc.When); err != nil {
+		return err
+	}
+	ingest(loc)
+	return nil
+}
+```
+
+---
+
+### server_nats.go
+```go
+package main
+
+// server_nats.go
+// - NATS_URL (nats:// or tls://) plugs the tracker into a NATS mesh, in
+//   both directions
+// - Ingestion: messages on NATS_SUBJECT (default "nuloc.*.report") are
+//   stored as reports for the device named by the "*" token, with the same
+//   payloads and token rules as MQTT (NATS_TRUST_BROKER skips the token).
+//   Replicas share the NATS_QUEUE queue group (default "nuloc") so each
+//   report is stored once
+// - Fan-out: every accepted point is published as JSON on
+//   <NATS_PUBLISH_PREFIX>.<device>.location and every geofence event on
+//   <NATS_PUBLISH_PREFIX>.<device>.geofence (prefix default "nuloc").
+//   Devices whose names are not valid subject tokens are not published
+// - NATS_INGEST=false or NATS_PUBLISH=false turns a direction off.
+//   NATS_CREDS_FILE or NATS_TOKEN authenticate; the client reconnects on
+//   its own and /readyz reports it as nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultNATSSubject = "nuloc.*.report"
+	defaultNATSQueue   = "nuloc"
+	defaultNATSPrefix  = "nuloc"
+)
+
+// natsPublish sends one accepted point to the mesh; nil unless publishing
+var natsPublish func(loc Location)
+
+// startNATS connects to url and starts ingesting and publishing; the
+// connection is drained when ctx is cancelled
+func startNATS(ctx context.Context, url string) error {
+	subject := setting("NATS_SUBJECT")
+	if subject == "" {
+		subject = defaultNATSSubject
+	}
+	if !strings.Contains(subject, "*") {
+		return errors.New("NATS_SUBJECT needs a * token for the device")
+	}
+	queue := setting("NATS_QUEUE")
+	if queue == "" {
+		queue = defaultNATSQueue
+	}
+	prefix := setting("NATS_PUBLISH_PREFIX")
+	if prefix == "" {
+		prefix = defaultNATSPrefix
+	}
+	token, err := secret("NATS_TOKEN")
+	if err != nil {
+		return err
+	}
+
+	opts := []nats.Option{
+		nats.Name("nuloc-server"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("nats disconnected", "err", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("nats reconnected", "server", nc.ConnectedUrlRedacted())
+		}),
+	}
+	if token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+	if creds := setting("NATS_CREDS_FILE"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return err
+	}
+	slog.Info("nats connected", "server", nc.ConnectedUrlRedacted())
+
+	if setting("NATS_INGEST") != "false" {
+		trustBroker := setting("NATS_TRUST_BROKER") == "true"
+		_, err := nc.QueueSubscribe(subject, queue, func(m *nats.Msg) {
+			phone := natsDevice(subject, m.Subject)
+			if phone == "" {
+				slog.Warn("nats report rejected", "subject", m.Subject, "err", "no device in subject")
+				return
+			}
+			if err := ingestMessage(phone, m.Data, trustBroker); err != nil {
+				slog.Warn("nats report rejected", "subject", m.Subject, "err", err)
+			}
+		})
+		if err != nil {
+			nc.Close()
+			return err
+		}
+	}
+	if setting("NATS_PUBLISH") != "false" {
+		natsPublish = func(loc Location) {
+			natsSend(nc, prefix, loc.Phone, "location", loc)
+		}
+		onGeofenceEvent(func(ev GeofenceEvent) {
+			natsSend(nc, prefix, ev.Phone, "geofence", ev)
+		})
+	}
+	registerReadyCheck("nats", func(context.Context) error {
+		if !nc.IsConnected() {
+			return errors.New("not connected to server")
+		}
+		return nil
+	})
+	go func() {
+		<-ctx.Done()
+		nc.Drain()
+	}()
+	return nil
+}
+
+// natsDevice returns the token of subject matched by the first "*" of pattern
+func natsDevice(pattern, subject string) string {
+	ps, ss := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range ps {
+		if p == "*" && i < len(ss) {
+			return ss[i]
+		}
+	}
+	return ""
+}
+
+// natsSend publishes v on <prefix>.<phone>.<kind>
+func natsSend(nc *nats.Conn, prefix, phone, kind string, v interface{}) {
+	if phone == "" || strings.ContainsAny(phone, ".*> \t\r\n") {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("nats encode failed", "err", err)
+		return
+	}
+	if err := nc.Publish(prefix+"."+phone+"."+kind, data); err != nil {
+		slog.Warn("nats publish failed", "device", phone, "err", err)
+	}
+}
+```
+
+---
+
+### server_kafka.go
+```go
+package main
+
+// server_kafka.go
+// - KAFKA_BROKERS (host:port,...) writes every accepted point as JSON to
+//   KAFKA_TOPIC (default "nuloc.locations") for analytics pipelines
+// - KAFKA_KEY picks the message key: "phone" (default, so each device's
+//   points stay in order on one partition), "tenant" or "none"
+// - Writes are batched in the background and never hold up a report; a
+//   failed batch is logged and dropped. KAFKA_TLS=true and
+//   KAFKA_USERNAME/KAFKA_PASSWORD (SASL PLAIN) secure the connection, and
+//   /readyz reports the first broker as kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const defaultKafkaTopic = "nuloc.locations"
+
+// kafkaPublish queues one accepted point for Kafka; nil unless configured
+var kafkaPublish func(loc Location)
+
+// startKafka starts writing to brokers; buffered points are flushed when
+// ctx is cancelled
+func startKafka(ctx context.Context, brokers string) error {
+	addrs := strings.Split(brokers, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	topic := setting("KAFKA_TOPIC")
+	if topic == "" {
+		topic = defaultKafkaTopic
+	}
+	keyOf, err := kafkaKey(setting("KAFKA_KEY"))
+	if err != nil {
+		return err
+	}
+	password, err := secret("KAFKA_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	transport := &kafka.Transport{}
+	dialer := &kafka.Dialer{Timeout: 5 * time.Second}
+	if setting("KAFKA_TLS") == "true" {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		dialer.TLS = transport.TLS
+	}
+	if user := setting("KAFKA_USERNAME"); user != "" {
+		mechanism := plain.Mechanism{Username: user, Password: password}
+		transport.SASL = mechanism
+		dialer.SASLMechanism = mechanism
+	}
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(addrs...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		Transport:    transport,
+		RequiredAcks: kafka.RequireOne,
+		BatchTimeout: 100 * time.Millisecond,
+		Async:        true,
+		Completion: func(msgs []kafka.Message, err error) {
+			if err != nil {
+				slog.Warn("kafka write failed", "topic", topic, "messages", len(msgs), "err", err)
+			}
+		},
+	}
+	slog.Info("kafka sink enabled", "brokers", addrs, "topic", topic)
+
+	kafkaPublish = func(loc Location) {
+		value, err := json.Marshal(loc)
+		if err != nil {
+			slog.Error("kafka encode failed", "err", err)
+			return
+		}
+		// Async writes only fail on a closed writer
+		w.WriteMessages(context.Background(), kafka.Message{Key: keyOf(loc), Value: value, Time: loc.When})
+	}
+	registerReadyCheck("kafka", func(ctx context.Context) error {
+		conn, err := dialer.DialContext(ctx, "tcp", addrs[0])
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	go func() {
+		<-ctx.Done()
+		if err := w.Close(); err != nil {
+			slog.Warn("kafka flush failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// kafkaKey returns the message key function for a KAFKA_KEY setting
+func kafkaKey(v string) (func(Location) []byte, error) {
+	switch v {
+	case "", "phone":
+		return func(loc Location) []byte { return []byte(loc.Phone) }, nil
+	case "tenant":
+		return func(loc Location) []byte { return []byte(deviceTenant(loc.Phone)) }, nil
+	case "none":
+		return func(Location) []byte { return nil }, nil
+	}
+	return nil, fmt.Errorf("KAFKA_KEY: want phone, tenant or none, not %q", v)
+}
+```
+
+---
+
+### server_relay.go
+```go
+package main
+
+// server_relay.go
+// - Carries live updates between replicas so a viewer sees every report,
+//   whichever replica accepted it. The transport (server_redis.go) sets
+//   relayPublish and hands what it receives to relayReceive
+// - Messages are JSON: {"origin", "phone", "kind", "data"}, kind being
+//   "location" or "geofence". Each replica skips its own
+// - Publishing happens off the report path through a bounded queue; when
+//   the transport cannot keep up updates are dropped for other replicas
+//   rather than slowing down reports
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+const relayQueue = 256
+
+// instanceID tells this replica's relayed messages from the others'
+var instanceID = newID()
+
+// relayPublish sends one encoded message to the other replicas; nil when
+// running alone
+var relayPublish func(msg []byte) error
+
+var relayOut = make(chan []byte, relayQueue)
+
+type relayMessage struct {
+	Origin string          `json:"origin"`
+	Phone  string          `json:"phone"`
+	Kind   string          `json:"kind"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// startRelay sets publish as the transport and starts draining the queue
+func startRelay(publish func(msg []byte) error) {
+	relayPublish = publish
+	go func() {
+		for msg := range relayOut {
+			if err := publish(msg); err != nil {
+				slog.Warn("relay publish failed", "err", err)
+			}
+		}
+	}()
+}
+
+// relay queues a local broadcast for the other replicas
+func relay(phone string, v interface{}) {
+	if relayPublish == nil {
+		return
+	}
+	kind := "location"
+	if _, ok := v.(GeofenceEvent); ok {
+		kind = "geofence"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("relay encode failed", "err", err)
+		return
+	}
+	msg, _ := json.Marshal(relayMessage{Origin: instanceID, Phone: phone, Kind: kind, Data: data})
+	select {
+	case relayOut <- msg:
+	default:
+		slog.Warn("relay queue full, dropping update", "device", phone)
+	}
+}
+
+// relayReceive delivers another replica's broadcast to local viewers
+func relayReceive(msg []byte) {
+	var m relayMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		slog.Warn("relay message rejected", "err", err)
+		return
+	}
+	if m.Origin == instanceID {
+		return
+	}
+	v, err := decodeRelayed(m)
+	if err != nil {
+		slog.Warn("relay message rejected", "origin", m.Origin, "err", err)
+		return
+	}
+	deliver(m.Phone, v)
+}
+
+func decodeRelayed(m relayMessage) (interface{}, error) {
+	switch m.Kind {
+	case "location":
+		var loc Location
+		err := json.Unmarshal(m.Data, &loc)
+		return loc, err
+	case "geofence":
+		var ev GeofenceEvent
+		err := json.Unmarshal(m.Data, &ev)
+		return ev, err
+	}
+	return nil, fmt.Errorf("unknown kind %q", m.Kind)
+}
+```
+
+---
+
+### server_redis.go
+```go
+package main
+
+// server_redis.go
+// - REDIS_URL (redis:// or rediss://, password included) connects the
+//   replicas through Redis pub/sub on REDIS_CHANNEL (default "nuloc:live")
+// - The subscription reconnects on its own; /readyz reports the connection
+//   as redis
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultRedisChannel = "nuloc:live"
+
+// startRedis connects to url and starts relaying; the connection is closed
+// when ctx is cancelled
+func startRedis(ctx context.Context, url string) error {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	channel := setting("REDIS_CHANNEL")
+	if channel == "" {
+		channel = defaultRedisChannel
+	}
+	rdb := redis.NewClient(opts)
+	sub := rdb.Subscribe(ctx, channel)
+	// Receive waits for the subscription to be confirmed, so a bad address
+	// or password fails at startup
+	if _, err := sub.Receive(ctx); err != nil {
+		rdb.Close()
+		return err
+	}
+	slog.Info("redis relay connected", "addr", opts.Addr, "channel", channel)
+
+	startRelay(func(msg []byte) error {
+		return rdb.Publish(ctx, channel, msg).Err()
+	})
+	registerReadyCheck("redis", func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	})
+	go func() {
+		for m := range sub.Channel() {
+			relayReceive([]byte(m.Payload))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+		rdb.Close()
+	}()
+	return nil
+}
+```
+
+---
+
+### server_udp.go
+```go
+package main
+
+// server_udp.go
+// - Report listener on UDP_ADDR for trackers where TCP and HTTP cost too
+//   much battery or fail on lossy links. One datagram is one report and
+//   nothing is sent back
+// - The first byte selects the format:
+//   '{'   a /report JSON body with the device token
+//   0x01  binary, signed:
+//           version(1) | phone length(1) | phone | lat(4) | lon(4) |
+//           unix seconds(4) | tag(16)
+//         lat/lon are big-endian int32 in 1e-7 degrees
+//   0x02  signed JSON: 0x02 | /report JSON body with "when" | tag(16)
+// - tag is HMAC-SHA256 keyed with the device token over everything before
+//   it, truncated to 16 bytes. Signed datagrams must be within
+//   SIGNATURE_WINDOW of the server clock and are accepted once.
+//   UDP_REQUIRE_HMAC=true refuses unsigned JSON
+// - IP_ALLOW/IP_DENY apply as for /report; there is no per-IP rate limit
+//   or lockout, since a spoofed source could spend a real tracker's
+//   allowance or lock a real client out. Failures lock out the device only
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	udpMaxDatagram = 1024
+	udpTagSize     = 16
+
+	udpFormatBinary     = 0x01
+	udpFormatSignedJSON = 0x02
+)
+
+// serveUDP reads datagrams on addr until ctx is cancelled
+func serveUDP(ctx context.Context, addr string) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		slog.Error("udp listen failed", "err", err)
+		return
+	}
+	requireHMAC := setting("UDP_REQUIRE_HMAC") == "true"
+	slog.Info("UDP listener", "addr", addr)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	// one byte more than allowed, to notice oversized datagrams
+	buf := make([]byte, udpMaxDatagram+1)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("udp read failed", "err", err)
+			continue
+		}
+		if n > udpMaxDatagram {
+			slog.Debug("udp datagram too large", "from", from.String())
+			continue
+		}
+		ip, _, _ := net.SplitHostPort(from.String())
+		if !peerAllowed("/report", ip) {
+			slog.Debug("udp datagram from a refused address", "from", ip)
+			continue
+		}
+		if err := ingestUDP(buf[:n], requireHMAC); err != nil {
+			slog.Warn("udp report rejected", "from", ip, "err", err)
+		}
+	}
+}
+
+// ingestUDP decodes, authenticates and stores one datagram
+func ingestUDP(d []byte, requireHMAC bool) error {
+	if len(d) == 0 {
+		return errors.New("empty datagram")
+	}
+	var loc Location
+	var tag, signed []byte
+	switch d[0] {
+	case '{':
+		if requireHMAC {
+			return errors.New("unsigned datagram")
+		}
+		if err := strictUnmarshal(d, &loc); err != nil {
+			return err
+		}
+	case udpFormatBinary:
+		var err error
+		if loc, err = decodeUDPBinary(d); err != nil {
+			return err
+		}
+		signed, tag = d[:len(d)-udpTagSize], d[len(d)-udpTagSize:]
+	case udpFormatSignedJSON:
+		if len(d) < 1+udpTagSize {
+			return errors.New("short datagram")
+		}
+		signed, tag = d[:len(d)-udpTagSize], d[len(d)-udpTagSize:]
+		if err := strictUnmarshal(signed[1:], &loc); err != nil {
+			return err
+		}
+		if loc.When.IsZero() {
+			return errors.New("signed datagrams need when")
+		}
+	default:
+		return fmt.Errorf("unknown format 0x%02x", d[0])
+	}
+	// the source address can be forged, so failures lock out the device only
+	if refusal := checkReporter("", loc.Phone, func() error { return checkUDPAuth(loc, signed, tag) }); refusal != nil {
+		return refusal
+	}
+	if cerr := checkLocation(loc); cerr != nil {
+		return cerr
+	}
+	var err error
+	if loc.When, err = reportTime(loc.When); err != nil {
+		return err
+	}
+	ingest(loc)
+	return nil
+}
+
+// checkUDPAuth verifies the tag of a signed datagram, or the token of an
+// unsigned one
+func checkUDPAuth(loc Location, signed, tag []byte) error {
+	if tag == nil {
+		if !checkDeviceToken(loc.Phone, loc.Token) {
+			return errors.New("invalid device token")
+		}
+		return nil
+	}
+	key, ok := deviceToken(loc.Phone)
+	if !ok {
+		return errors.New("unknown device")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(signed)
+	if !hmac.Equal(tag, mac.Sum(nil)[:udpTagSize]) {
+		return errors.New("bad signature")
+	}
+	if skew := time.Since(loc.When); skew > signatureWindow || skew < -signatureWindow {
+		return errors.New("timestamp outside signature window")
+	}
+	if !rememberNonce(loc.Phone + "/udp/" + hex.EncodeToString(tag)) {
+		return errors.New("replayed datagram")
+	}
+	return nil
+}
+
+// decodeUDPBinary parses the fixed binary layout; the caller checks the tag
+func decodeUDPBinary(d []byte) (Location, error) {
+	if len(d) < 2 {
+		return Location{}, errors.New("short datagram")
+	}
+	n := int(d[1])
+	if n == 0 || len(d) != 2+n+12+udpTagSize {
+		return Location{}, errors.New("bad binary datagram length")
+	}
+	p := d[2+n:]
+	return Location{
+		Phone: string(d[2 : 2+n]),
+		Lat:   float64(int32(binary.BigEndian.Uint32(p[0:4]))) / 1e7,
+		Lon:   float64(int32(binary.BigEndian.Uint32(p[4:8]))) / 1e7,
+		When:  time.Unix(int64(binary.BigEndian.Uint32(p[8:12])), 0).UTC(),
+	}, nil
+}
+```
+
+---
+
+### server_geocode.go
+```go
+package main
+
+// server_geocode.go
+// - Optional reverse geocoding of live reports via Nominatim, enabled with
+//   GEOCODER=nominatim; NOMINATIM_URL points at a self-hosted instance
+//   (default the public one), GEOCODE_EMAIL identifies us to it
+// - Lookups run in the background so reports are never slowed down; the
+//   resolved address lands in the stored point's "place"
+// - Requests are rate limited to GEOCODE_RPS (default 1, the public
+//   server's policy) and results cached by ~10 m cell (GEOCODE_CACHE_SIZE
+//   entries, default 10000); when the queue is full points stay unresolved
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const geocodeQueueSize = 256
+
+type geocodeJob struct {
+	phone    string
+	when     time.Time
+	lat, lon float64
+}
+
+var (
+	geocodeQueue   chan geocodeJob
+	geocodeURL     = "https://nominatim.openstreetmap.org"
+	geocodeEmail   string
+	geocodeLimiter = rate.NewLimiter(1, 1)
+	geocodeClient  = &http.Client{Timeout: 10 * time.Second}
+
+	geocodeCache     = map[string]string{}
+	geocodeCacheKeys []string // insertion order, oldest first
+	geocodeCacheSize = 10000
+	geocodeCacheMu   = sync.Mutex{}
+)
+
+func setupGeocoder() error {
+	switch g := setting("GEOCODER"); g {
+	case "", "off":
+		return nil
+	case "nominatim":
+	default:
+		return fmt.Errorf("GEOCODER: unknown geocoder %q", g)
+	}
+	if v := setting("NOMINATIM_URL"); v != "" {
+		geocodeURL = v
+	}
+	geocodeEmail = setting("GEOCODE_EMAIL")
+	if v := setting("GEOCODE_RPS"); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil || rps <= 0 {
+			return fmt.Errorf("GEOCODE_RPS: invalid value %q", v)
+		}
+		geocodeLimiter = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+	if v := setting("GEOCODE_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("GEOCODE_CACHE_SIZE: invalid value %q", v)
+		}
+		geocodeCacheSize = n
+	}
+	geocodeQueue = make(chan geocodeJob, geocodeQueueSize)
+	go geocodeWorker()
+	slog.Info("reverse geocoding enabled", "url", geocodeURL)
+	return nil
+}
+
+// enqueueGeocode schedules loc for lookup without blocking the caller
+func enqueueGeocode(loc Location) {
+	if geocodeQueue == nil || loc.Ciphertext != "" {
+		return
+	}
+	select {
+	case geocodeQueue <- geocodeJob{loc.Phone, loc.When, loc.Lat, loc.Lon}:
+	default:
+		slog.Debug("geocode queue full, skipping point", "device", loc.Phone)
+	}
+}
+
+func geocodeWorker() {
+	for job := range geocodeQueue {
+		place, err := reverseGeocode(job.lat, job.lon)
+		if err != nil {
+			slog.Warn("reverse geocoding failed", "device", job.phone, "err", err)
+			continue
+		}
+		if place != "" {
+			setPlace(job.phone, job.when, place)
+		}
+	}
+}
+
+// setPlace records place on the stored point of phone taken at when. The
+// history is copied rather than changed in place: readers keep using the
+// slice they took under the lock after letting go of it.
+func setPlace(phone string, when time.Time, place string) {
+	stMutex.Lock()
+	defer stMutex.Unlock()
+	locs := store[phone]
+	for i := len(locs) - 1; i >= 0; i-- {
+		if locs[i].When.Equal(when) {
+			locs = append([]Location(nil), locs...)
+			locs[i].Place = place
+			store[phone] = locs
+			touchHistoryLocked(phone)
+			return
+		}
+	}
+}
+
+// reverseGeocode returns the address for a point, from cache if possible
+func reverseGeocode(lat, lon float64) (string, error) {
+	// four decimals is roughly a 10 m cell
+	key := fmt.Sprintf("%.4f,%.4f", lat, lon)
+	geocodeCacheMu.Lock()
+	place, ok := geocodeCache[key]
+	geocodeCacheMu.Unlock()
+	if ok {
+		return place, nil
+	}
+
+	if err := geocodeLimiter.Wait(context.Background()); err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"format": {"jsonv2"},
+		"lat":    {strconv.FormatFloat(lat, 'f', 6, 64)},
+		"lon":    {strconv.FormatFloat(lon, 'f', 6, 64)},
+		"zoom":   {"18"},
+	}
+	if geocodeEmail != "" {
+		q.Set("email", geocodeEmail)
+	}
+	req, err := http.NewRequest("GET", geocodeURL+"/reverse?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	// Nominatim's usage policy requires an identifying User-Agent
+	req.Header.Set("User-Agent", "nu-loc location tracker")
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nominatim: %s", resp.Status)
+	}
+	var body struct {
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("nominatim: %w", err)
+	}
+
+	geocodeCacheMu.Lock()
+	if _, ok := geocodeCache[key]; !ok {
+		geocodeCache[key] = body.DisplayName
+		geocodeCacheKeys = append(geocodeCacheKeys, key)
+		if len(geocodeCacheKeys) > geocodeCacheSize {
+			delete(geocodeCache, geocodeCacheKeys[0])
+			geocodeCacheKeys = geocodeCacheKeys[1:]
+		}
+	}
+	geocodeCacheMu.Unlock()
+	return body.DisplayName, nil
+}
+```
+
+---
+
+### server_secrets.go
+```go
+package main
+
+// server_secrets.go
+// - One place to resolve secrets (device tokens, admin token, JWT and OIDC
+//   secrets, TLS certificate and key) instead of scattered setting lookups
+// - For a secret NAME the providers are tried in order:
+//   env       the NAME setting (flag, environment or config file, see
+//             server_config.go)
+//   file      the contents of the file named by NAME_FILE (Docker/K8s secrets)
+//   vault     key NAME at VAULT_SECRET_PATH in HashiCorp Vault (KV v1 or v2),
+//             enabled by VAULT_ADDR with VAULT_TOKEN or VAULT_TOKEN_FILE
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretProvider resolves named secrets from one source
+type secretProvider interface {
+	name() string
+	lookup(key string) (string, bool, error)
+}
+
+var secretProviders = []secretProvider{envSecrets{}, fileSecrets{}}
+
+// setupSecrets adds the Vault provider when configured
+func setupSecrets() error {
+	addr := setting("VAULT_ADDR")
+	if addr == "" {
+		return nil
+	}
+	token := setting("VAULT_TOKEN")
+	if token == "" {
+		if path := setting("VAULT_TOKEN_FILE"); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	path := setting("VAULT_SECRET_PATH")
+	if token == "" || path == "" {
+		return fmt.Errorf("VAULT_ADDR needs VAULT_TOKEN (or VAULT_TOKEN_FILE) and VAULT_SECRET_PATH")
+	}
+	secretProviders = append(secretProviders, &vaultSecrets{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	})
+	return nil
+}
+
+// secret returns the first value found for key, or "" if no provider has it
+func secret(key string) (string, error) {
+	for _, p := range secretProviders {
+		v, ok, err := p.lookup(key)
+		if err != nil {
+			return "", fmt.Errorf("%s secret %s: %w", p.name(), key, err)
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+type envSecrets struct{}
+
+func (envSecrets) name() string { return "env" }
+
+func (envSecrets) lookup(key string) (string, bool, error) {
+	v := setting(key)
+	return v, v != "", nil
+}
+
+type fileSecrets struct{}
+
+func (fileSecrets) name() string { return "file" }
+
+func (fileSecrets) lookup(key string) (string, bool, error) {
+	path := setting(key + "_FILE")
+	if path == "" {
+		return "", false, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// vaultSecrets reads every key at one Vault path once and caches them
+type vaultSecrets struct {
+	addr, token, path string
+	client            *http.Client
+
+	once sync.Once
+	data map[string]interface{}
+	err  error
+}
+
+func (v *vaultSecrets) name() string { return "vault" }
+
+func (v *vaultSecrets) lookup(key string) (string, bool, error) {
+	v.once.Do(v.fetch)
+	if v.err != nil {
+		return "", false, v.err
+	}
+	val, ok := v.data[key].(string)
+	return val, ok, nil
+}
+
+func (v *vaultSecrets) fetch() {
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		v.err = err
+		return
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		v.err = err
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		v.err = fmt.Errorf("GET %s: %s", v.path, resp.Status)
+		return
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if v.err = json.NewDecoder(resp.Body).Decode(&body); v.err != nil {
+		return
+	}
+	// KV v2 nests the secret under data.data
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		v.data = inner
+		return
+	}
+	v.data = body.Data
+}
+```
+
+---
+
+### server_tenants.go
+```go
+package main
+
+// server_tenants.go
+// - Organizations (tenants) sharing one server: devices, API keys, viewer
+//   accounts and geofences each belong to one, and callers only see, and
+//   receive live updates for, devices of their own tenant
+// - The default tenant "" holds everything created before tenants existed
+// - ADMIN_TOKEN, and admin keys created with tenant "*", are operators:
+//   they act across tenants and manage them with GET and POST
+//   /admin/tenants and DELETE /admin/tenants/{id}
+// - Tenants persist in TENANTS_FILE (default tenants.json). Phone IDs stay
+//   unique across the whole server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTenantsFile = "tenants.json"
+	allTenants         = "*"
+)
+
+// Tenant is an organization hosted on the server
+type Tenant struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	tenants     = map[string]*Tenant{}
+	tenantsMu   = sync.RWMutex{}
+	tenantsFile = defaultTenantsFile
+
+	validTenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+)
+
+// loadTenants reads TENANTS_FILE. Run before anything that assigns tenants.
+func loadTenants() error {
+	if p := setting("TENANTS_FILE"); p != "" {
+		tenantsFile = p
+	}
+	var list []*Tenant
+	if err := loadJSON(tenantsFile, &list); err != nil {
+		return err
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	for _, t := range list {
+		tenants[t.ID] = t
+	}
+	return nil
+}
+
+// saveTenantsLocked persists tenants; callers hold tenantsMu
+func saveTenantsLocked() error {
+	list := make([]*Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return saveJSON(tenantsFile, list)
+}
+
+// tenantExists reports whether id names the default or a created tenant
+func tenantExists(id string) bool {
+	if id == "" {
+		return true
+	}
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	_, ok := tenants[id]
+	return ok
+}
+
+// inTenant reports whether p may act within tenant
+func (p *principal) inTenant(tenant string) bool {
+	return p != nil && (p.Tenant == allTenants || p.Tenant == tenant)
+}
+
+// isOperator reports whether p administers every tenant
+func (p *principal) isOperator() bool {
+	return p != nil && p.Role == roleAdmin && p.Tenant == allTenants
+}
+
+// assignTenant picks the tenant of something p creates: operators may name
+// any existing tenant, everyone else gets their own
+func assignTenant(p *principal, requested string) (string, error) {
+	if !p.isOperator() {
+		if requested != "" && requested != p.Tenant {
+			return "", errors.New("cannot create in another tenant")
+		}
+		return p.Tenant, nil
+	}
+	if !tenantExists(requested) {
+		return "", fmt.Errorf("unknown tenant %q", requested)
+	}
+	return requested, nil
+}
+
+// requireOperator admits only principals acting across tenants
+func requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestPrincipal(r).isOperator() {
+			http.Error(w, "operators only", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantsMu.RLock()
+	list := make([]*Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		list = append(list, t)
+	}
+	tenantsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tenants": list})
+}
+
+// createTenantHandler creates {"id", "name"}; the id is generated when omitted
+func createTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var t Tenant
+	if err := decodeJSON(w, r, &t); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if t.ID == "" {
+		t.ID = newID()
+	}
+	if !validTenantID.MatchString(t.ID) {
+		http.Error(w, "id must be lowercase letters, digits, - and _", http.StatusBadRequest)
+		return
+	}
+	if t.Name == "" {
+		t.Name = t.ID
+	}
+	t.Created = time.Now().UTC()
+
+	tenantsMu.Lock()
+	if _, exists := tenants[t.ID]; exists {
+		tenantsMu.Unlock()
+		http.Error(w, "tenant already exists", http.StatusConflict)
+		return
+	}
+	tenants[t.ID] = &t
+	err := saveTenantsLocked()
+	tenantsMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// deleteTenantHandler removes an empty tenant
+func deleteTenantHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !tenantExists(id) || id == "" {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+	if what := tenantInUse(id); what != "" {
+		http.Error(w, "tenant still has "+what, http.StatusConflict)
+		return
+	}
+	tenantsMu.Lock()
+	delete(tenants, id)
+	err := saveTenantsLocked()
+	tenantsMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tenantInUse names the first kind of record still assigned to tenant
+func tenantInUse(tenant string) string {
+	devicesMu.RLock()
+	for _, d := range devices {
+		if d.Tenant == tenant {
+			devicesMu.RUnlock()
+			return "devices"
+		}
+	}
+	devicesMu.RUnlock()
+
+	apiKeysMu.RLock()
+	for _, k := range apiKeys {
+		if k.Tenant == tenant && k.RevokedAt == nil {
+			apiKeysMu.RUnlock()
+			return "api keys"
+		}
+	}
+	apiKeysMu.RUnlock()
+
+	geofencesMu.RLock()
+	for _, f := range geofences {
+		if f.Tenant == tenant {
+			geofencesMu.RUnlock()
+			return "geofences"
+		}
+	}
+	geofencesMu.RUnlock()
+
+	for _, u := range viewerUsers {
+		if u.tenant == tenant {
+			return "viewer accounts"
+		}
+	}
+	return ""
+}
+```
+
+---
+
+### server_auth.go
+```go
+package main
+
+// server_auth.go
+// - Per-device report tokens from the DEVICE_TOKENS secret, either
+//   "phone:token,..." or a JSON object of phone -> token (the usual form when
+//   read from DEVICE_TOKENS_FILE)
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	deviceTokens   = map[string]string{}
+	deviceTokensMu = sync.RWMutex{}
+)
+
+// loadDeviceTokens fills the device token table from the DEVICE_TOKENS secret
+func loadDeviceTokens() error {
+	raw, err := secret("DEVICE_TOKENS")
+	if err != nil {
+		return err
+	}
+	tokens := map[string]string{}
+
+	if strings.HasPrefix(strings.TrimSpace(raw), "{") {
+		if err := json.Unmarshal([]byte(raw), &tokens); err != nil {
+			return fmt.Errorf("DEVICE_TOKENS: %w", err)
+		}
+		raw = ""
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		phone, token, ok := strings.Cut(pair, ":")
+		if !ok || phone == "" || token == "" {
+			return fmt.Errorf("DEVICE_TOKENS: bad entry %q, want phone:token", pair)
+		}
+		tokens[phone] = token
+	}
+
+	deviceTokensMu.Lock()
+	deviceTokens = tokens
+	deviceTokensMu.Unlock()
+	return nil
+}
+
+// checkDeviceToken reports whether token is the configured token for phone
+func checkDeviceToken(phone, token string) bool {
+	deviceTokensMu.RLock()
+	want, ok := deviceTokens[phone]
+	deviceTokensMu.RUnlock()
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1
+}
+
+// deviceToken returns the configured token for phone
+func deviceToken(phone string) (string, bool) {
+	deviceTokensMu.RLock()
+	defer deviceTokensMu.RUnlock()
+	t, ok := deviceTokens[phone]
+	return t, ok
+}
+
+// deviceKnown reports whether phone has a configured token
+func deviceKnown(phone string) bool {
+	deviceTokensMu.RLock()
+	defer deviceTokensMu.RUnlock()
+	_, ok := deviceTokens[phone]
+	return ok
+}
+```
+
+---
+
+### server_devices.go
+```go
+package main
+
+// server_devices.go
+// - Device registry: admins register a device with POST /devices
+//   ({"phone", "label", "color", "icon", "token"}; a token is generated when
+//   omitted) and change its label, color or icon with PATCH /devices/{phone}
+// - color is "#rrggbb" and icon a short name such as "car" or "laptop";
+//   both are for display only
+// - "hardware": true marks a tracker that cannot run the pairing handshake
+//   (e.g. a GT06 box); only those may be paired by an admin's confirmation
+// - Only registered devices, or those in DEVICE_TOKENS, may have history;
+//   reports and imports for unknown phones are rejected
+// - GET /devices lists the devices the caller may view with label, color,
+//   icon, pairing state, last-seen time and last position
+// - DELETE /devices/{phone} decommissions a registered device: its token,
+//   history, pairing and lockouts are removed and live viewers scoped to
+//   only that device are disconnected
+// - Registrations persist in DEVICES_FILE (default devices.json). The file
+//   holds device tokens, so keep it private
+// - Devices belong to the registering admin's tenant; operators may pick
+//   one with "tenant". Devices from DEVICE_TOKENS are in the default tenant
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const defaultDevicesFile = "devices.json"
+
+// Device is a registered device
+type Device struct {
+	Phone      string    `json:"phone"`
+	Label      string    `json:"label,omitempty"`
+	Color      string    `json:"color,omitempty"`
+	Icon       string    `json:"icon,omitempty"`
+	Token      string    `json:"token,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Hardware   bool      `json:"hardware,omitempty"`
+	Registered time.Time `json:"registered"`
+}
+
+const maxLabelLength = 64
+
+var (
+	// phones end up in URL paths, topics, lockout keys and IP rule
+	// prefixes, so they are kept to characters none of those treat specially
+	devicePhoneRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	deviceColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	deviceIconRe  = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+)
+
+// checkDeviceMeta validates display metadata; empty values are allowed
+func checkDeviceMeta(label, color, icon string) string {
+	switch {
+	case len([]rune(label)) > maxLabelLength:
+		return "label is too long"
+	case color != "" && !deviceColorRe.MatchString(color):
+		return "color must look like #1e90ff"
+	case icon != "" && !deviceIconRe.MatchString(icon):
+		return "icon must be a short lowercase name such as car"
+	}
+	return ""
+}
+
+// deviceMeta returns the registered label, color and icon of phone
+func deviceMeta(phone string) (label, color, icon string) {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	if d, ok := devices[phone]; ok {
+		return d.Label, d.Color, d.Icon
+	}
+	return "", "", ""
+}
+
+// registryVersion returns devicesVersion and devicesModified
+func registryVersion() (uint64, time.Time) {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	return devicesVersion, devicesModified
+}
+
+var (
+	devices     = map[string]*Device{}
+	devicesMu   = sync.RWMutex{}
+	devicesFile = defaultDevicesFile
+	// devicesVersion and devicesModified change with every change to the
+	// registry, so validators of responses showing labels, colors and icons
+	// follow them
+	devicesVersion  uint64
+	devicesModified time.Time
+)
+
+// loadDevices reads registered devices and adds their tokens to the device
+// token table. Run after loadDeviceTokens.
+func loadDevices() error {
+	if p := setting("DEVICES_FILE"); p != "" {
+		devicesFile = p
+	}
+	var list []*Device
+	if err := loadJSON(devicesFile, &list); err != nil {
+		return err
+	}
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	deviceTokensMu.Lock()
+	defer deviceTokensMu.Unlock()
+	for _, d := range list {
+		devices[d.Phone] = d
+		deviceTokens[d.Phone] = d.Token
+	}
+	if len(deviceTokens) == 0 {
+		slog.Warn("no devices configured, register them with POST /devices")
+	}
+	return nil
+}
+
+// saveDevicesLocked persists the registry; callers hold devicesMu. Every
+// change is saved, so this is also where devicesVersion moves on.
+func saveDevicesLocked() error {
+	devicesVersion++
+	devicesModified = time.Now()
+	list := make([]*Device, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	return saveJSON(devicesFile, list)
+}
+
+// hardwareTracker reports whether phone was registered as a hardware tracker
+func hardwareTracker(phone string) bool {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	d, ok := devices[phone]
+	return ok && d.Hardware
+}
+
+// deviceTenant returns the tenant phone belongs to
+func deviceTenant(phone string) string {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	if d, ok := devices[phone]; ok {
+		return d.Tenant
+	}
+	return ""
+}
+
+// registerDeviceHandler registers {"phone", "label", "token", "tenant",
+// "hardware"}. The token is only returned in this response.
+func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone    string `json:"phone"`
+		Label    string `json:"label"`
+		Color    string `json:"color"`
+		Icon     string `json:"icon"`
+		Token    string `json:"token"`
+		Tenant   string `json:"tenant"`
+		Hardware bool   `json:"hardware"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	switch {
+	case req.Phone == "":
+		http.Error(w, "phone is required", http.StatusBadRequest)
+		return
+	case !devicePhoneRe.MatchString(req.Phone):
+		http.Error(w, "phone must be 1-64 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	if msg := checkDeviceMeta(req.Label, req.Color, req.Icon); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	tenant, err := assignTenant(requestPrincipal(r), req.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		req.Token = newSecret()
+	}
+	d := &Device{Phone: req.Phone, Label: req.Label, Color: req.Color, Icon: req.Icon, Token: req.Token, Tenant: tenant, Hardware: req.Hardware, Registered: time.Now().UTC()}
+
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	deviceTokensMu.Lock()
+	if _, exists := deviceTokens[d.Phone]; exists {
+		deviceTokensMu.Unlock()
+		http.Error(w, "device already registered", http.StatusConflict)
+		return
+	}
+	deviceTokens[d.Phone] = d.Token
+	deviceTokensMu.Unlock()
+	devices[d.Phone] = d
+	if err := saveDevicesLocked(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// updateDeviceHandler changes the label, color or icon of a registered
+// device. Fields left out are kept; an empty string clears one.
+func updateDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	var req struct {
+		Label *string `json:"label"`
+		Color *string `json:"color"`
+		Icon  *string `json:"icon"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	d, ok := devices[phone]
+	if !ok {
+		if deviceKnown(phone) {
+			http.Error(w, "device is configured in DEVICE_TOKENS, register it to give it a label", http.StatusConflict)
+			return
+		}
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	updated := *d
+	for dst, src := range map[*string]*string{&updated.Label: req.Label, &updated.Color: req.Color, &updated.Icon: req.Icon} {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	if msg := checkDeviceMeta(updated.Label, updated.Color, updated.Icon); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	devices[phone] = &updated
+	if err := saveDevicesLocked(); err != nil {
+		devices[phone] = d
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated.Token = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// deleteDeviceHandler removes a registered device and everything stored
+// for it. Devices from DEVICE_TOKENS must be removed from the config instead,
+// or they would come back on restart.
+func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+
+	devicesMu.Lock()
+	if _, ok := devices[phone]; !ok {
+		devicesMu.Unlock()
+		if deviceKnown(phone) {
+			http.Error(w, "device is configured in DEVICE_TOKENS, remove it there", http.StatusConflict)
+			return
+		}
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	delete(devices, phone)
+	deviceTokensMu.Lock()
+	delete(deviceTokens, phone)
+	deviceTokensMu.Unlock()
+	err := saveDevicesLocked()
+	devicesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stMutex.Lock()
+	removed := len(store[phone])
+	delete(store, phone)
+	touchHistoryLocked(phone)
+	stMutex.Unlock()
+
+	pairingsMu.Lock()
+	if _, ok := pairings[phone]; ok {
+		delete(pairings, phone)
+		if err := savePairingsLocked(); err != nil {
+			slog.Error("saving pairings failed", "err", err)
+		}
+	}
+	pairingsMu.Unlock()
+
+	authSucceeded(deviceKey(phone))
+	forgetGeofenceState(phone)
+	forgetSummaries(phone)
+	forgetTrash(phone)
+	forgetClientConfig(phone)
+	kicked := kickViewers(phone)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"phone": phone, "removed_points": removed, "disconnected": kicked})
+}
+
+// kickViewers closes live connections whose principal may only view phone
+func kickViewers(phone string) int {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "device deleted")
+	n := 0
+	inHub(func(clients map[*wsClient]bool) {
+		for c := range clients {
+			if p := c.who; p == nil || p.Role == roleAdmin || len(p.Phones) != 1 || p.Phones[0] != phone {
+				continue
+			}
+			dropClient(clients, c, msg)
+			n++
+		}
+	})
+	return n + kickEventStreams(phone)
+}
+
+// deviceSummary is one entry of GET /devices
+type deviceSummary struct {
+	Phone    string     `json:"phone"`
+	Label    string     `json:"label,omitempty"`
+	Color    string     `json:"color,omitempty"`
+	Icon     string     `json:"icon,omitempty"`
+	Paired   bool       `json:"paired"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Last     *Location  `json:"last,omitempty"`
+}
+
+// listDevicesHandler returns the devices the caller may view
+func listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	deviceTokensMu.RLock()
+	all := make([]string, 0, len(deviceTokens))
+	for phone := range deviceTokens {
+		all = append(all, phone)
+	}
+	deviceTokensMu.RUnlock()
+	// canView takes devicesMu, which is locked before deviceTokensMu
+	// elsewhere, so filter only once the token table is released
+	phones := all[:0]
+	for _, phone := range all {
+		if p.canView(phone) {
+			phones = append(phones, phone)
+		}
+	}
+	sort.Strings(phones)
+
+	list := make([]deviceSummary, 0, len(phones))
+	for _, phone := range phones {
+		d := deviceSummary{Phone: phone, Paired: devicePaired(phone)}
+		d.Label, d.Color, d.Icon = deviceMeta(phone)
+		if d.Paired {
+			stMutex.RLock()
+			if locs := store[phone]; len(locs) > 0 {
+				last := locs[len(locs)-1]
+				d.Last = &last
+				d.LastSeen = &last.When
+			}
+			stMutex.RUnlock()
+		}
+		list = append(list, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"devices": list})
+}
+```
+
+---
+
+### server_apikeys.go
+```go
+package main
+
+// server_apikeys.go
+// - API keys carrying a role and phone list (see server_rbac.go), persisted
+//   to API_KEYS_FILE
+// - Keys are sent as "Authorization: Bearer <key>", "X-API-Key: <key>" or a
+//   ?token= query parameter (for browsers opening /ws)
+// - ADMIN_TOKEN, if set, acts as a bootstrap admin key for every tenant
+// - Keys belong to the creating admin's tenant; operators may pick one with
+//   "tenant", or "*" for another operator key
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKey is a stored key. Only the SHA-256 of the secret is kept.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	Phones    []string   `json:"phones,omitempty"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"` // keys created before roles; converted on load
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Requests allowed per UTC day and month; 0 is unlimited
+	DailyQuota   int `json:"daily_quota,omitempty"`
+	MonthlyQuota int `json:"monthly_quota,omitempty"`
+}
+
+var (
+	apiKeys     = map[string]*APIKey{} // by ID
+	apiKeysMu   = sync.RWMutex{}
+	apiKeysFile = ""
+	adminToken  = ""
+)
+
+// loadAPIKeys reads the ADMIN_TOKEN secret and persisted keys from
+// API_KEYS_FILE if configured
+func loadAPIKeys() error {
+	var err error
+	if adminToken, err = secret("ADMIN_TOKEN"); err != nil {
+		return err
+	}
+	apiKeysFile = setting("API_KEYS_FILE")
+	if apiKeysFile == "" {
+		return nil
+	}
+	var keys []*APIKey
+	if err := loadJSON(apiKeysFile, &keys); err != nil {
+		return err
+	}
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	for _, k := range keys {
+		if k.Role == "" {
+			k.Role, k.Phones = roleFromScopes(k.Scopes)
+			k.Scopes = nil
+		}
+		apiKeys[k.ID] = k
+	}
+	return nil
+}
+
+// roleFromScopes maps the scopes of keys created before roles existed to the
+// closest role, preserving their access to every phone
+func roleFromScopes(scopes []string) (string, []string) {
+	role := roleReporter
+	for _, sc := range scopes {
+		switch {
+		case sc == "admin":
+			return roleAdmin, nil
+		case sc == "read":
+			role = roleViewer
+		}
+	}
+	return role, []string{"*"}
+}
+
+// saveAPIKeysLocked persists keys; callers hold apiKeysMu
+func saveAPIKeysLocked() error {
+	if apiKeysFile == "" {
+		return nil
+	}
+	keys := make([]*APIKey, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		keys = append(keys, k)
+	}
+	return saveJSON(apiKeysFile, keys)
+}
+
+// identify attaches the principal for any presented API key or viewer
+// session token to the request.
+// Requests without credentials pass through anonymously; requests with
+// unknown or revoked keys are rejected.
+func identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := requestKey(r)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if authBlocked(w, ipKey(r)) {
+			return
+		}
+		p, err := authenticateCharged(secret)
+		var quota *quotaError
+		switch {
+		case errors.As(err, &quota):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quota.Wait.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			authFailed(ipKey(r))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+// requestKey extracts the presented API key, if any
+func requestKey(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate resolves an API key or viewer session token
+func authenticate(secret string) (*principal, bool) {
+	if looksLikeJWT(secret) {
+		return parseSession(secret)
+	}
+	return lookupKey(secret)
+}
+
+// lookupKey resolves a secret to the principal it authenticates
+func lookupKey(secret string) (*principal, bool) {
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(adminToken), []byte(secret)) == 1 {
+		return &principal{Name: "admin-token", Role: roleAdmin, Tenant: allTenants}, true
+	}
+	hash := hashKey(secret)
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	for _, k := range apiKeys {
+		if k.RevokedAt == nil && subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			return &principal{Name: k.Name, Role: k.Role, Phones: k.Phones, Tenant: k.Tenant, KeyID: k.ID}, true
+		}
+	}
+	return nil, false
+}
+
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	apiKeysMu.RLock()
+	keys := make([]APIKey, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		if !p.inTenant(k.Tenant) {
+			continue
+		}
+		c := *k
+		c.Hash = ""
+		keys = append(keys, c)
+	}
+	apiKeysMu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// createKeyHandler creates a key from {"name": ..., "role": ..., "phones":
+// [...], "tenant": ..., "daily_quota": ..., "monthly_quota": ...}. The
+// secret is only ever returned in this response.
+func createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name         string   `json:"name"`
+		Role         string   `json:"role"`
+		Phones       []string `json:"phones"`
+		Tenant       string   `json:"tenant"`
+		DailyQuota   int      `json:"daily_quota"`
+		MonthlyQuota int      `json:"monthly_quota"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if !validRoles[req.Role] {
+		http.Error(w, "role must be admin, viewer or reporter", http.StatusBadRequest)
+		return
+	}
+	if req.Role != roleAdmin && len(req.Phones) == 0 {
+		http.Error(w, "viewer and reporter keys need phones", http.StatusBadRequest)
+		return
+	}
+	if req.DailyQuota < 0 || req.MonthlyQuota < 0 {
+		http.Error(w, "quotas cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	tenant := req.Tenant
+	if p := requestPrincipal(r); tenant != allTenants || !p.isOperator() || req.Role != roleAdmin {
+		var err error
+		if tenant, err = assignTenant(p, req.Tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret := newSecret()
+	k := &APIKey{ID: newID(), Name: req.Name, Role: req.Role, Phones: req.Phones, Tenant: tenant, Hash: hashKey(secret),
+		DailyQuota: req.DailyQuota, MonthlyQuota: req.MonthlyQuota, CreatedAt: time.Now().UTC()}
+
+	apiKeysMu.Lock()
+	apiKeys[k.ID] = k
+	err := saveAPIKeysLocked()
+	apiKeysMu.Unlock()
+	if err != nil {
+		http.Error(w, "persist keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeKeySecret(w, http.StatusCreated, k, secret)
+}
+
+// rotateKeyHandler replaces a key's secret, invalidating the old one
+func rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	secret := newSecret()
+	now := time.Now().UTC()
+
+	apiKeysMu.Lock()
+	k, ok := apiKeys[id]
+	ok = ok && requestPrincipal(r).inTenant(k.Tenant)
+	// a copy taken under the lock, since k may change once it is released
+	var key APIKey
+	var err error
+	if ok {
+		if k.RevokedAt == nil {
+			k.Hash = hashKey(secret)
+			k.RotatedAt = &now
+			err = saveAPIKeysLocked()
+		}
+		key = *k
+	}
+	apiKeysMu.Unlock()
+
+	switch {
+	case !ok:
+		http.Error(w, "no such key", http.StatusNotFound)
+	case key.RevokedAt != nil:
+		http.Error(w, "key is revoked", http.StatusConflict)
+	case err != nil:
+		http.Error(w, "persist keys: "+err.Error(), http.StatusInternalServerError)
+	default:
+		writeKeySecret(w, http.StatusOK, &key, secret)
+	}
+}
+
+// revokeKeyHandler permanently disables a key. The record is kept.
+func revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	now := time.Now().UTC()
+
+	apiKeysMu.Lock()
+	k, ok := apiKeys[id]
+	ok = ok && requestPrincipal(r).inTenant(k.Tenant)
+	var err error
+	if ok {
+		if k.RevokedAt == nil {
+			k.RevokedAt = &now
+		}
+		err = saveAPIKeysLocked()
+	}
+	apiKeysMu.Unlock()
+
+	if !ok {
+		http.Error(w, "no such key", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "persist keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeKeySecret(w http.ResponseWriter, status int, k *APIKey, secret string) {
+	c := *k
+	c.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": c, "secret": secret})
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret returns a random 256-bit key secret
+func newSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newID returns a short random identifier
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+```
+
+---
+
+### server_quota.go
+```go
+package main
+
+// server_quota.go
+// - Counts the requests made with each stored API key per UTC day and
+//   month, whichever way they come in: HTTP, a WebSocket's auth message or
+//   gRPC (each report on a stream counts). Once a key's daily_quota or
+//   monthly_quota (0: unlimited) is used up its requests get 429 (gRPC:
+//   ResourceExhausted), with Retry-After set to the end of the period
+// - Counts persist to USAGE_FILE (default usage.json) every minute and at
+//   shutdown, so a restart forgets at most a minute of them
+// - GET /usage shows the calling key its own quotas and usage; GET
+//   /admin/usage lists the keys of the admin's tenant, and PUT
+//   /admin/keys/{id}/quota changes a key's quotas
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultUsageFile = "usage.json"
+
+// KeyUsage is one key's request counts. Day and month are UTC and roll
+// over on the first request of a new period.
+type KeyUsage struct {
+	Day        string    `json:"day"` // 2006-01-02
+	DayCount   int       `json:"day_count"`
+	Month      string    `json:"month"` // 2006-01
+	MonthCount int       `json:"month_count"`
+	Total      int64     `json:"total"`
+	LastUsed   time.Time `json:"last_used"`
+}
+
+var (
+	usage      = map[string]*KeyUsage{} // by key ID
+	usageMu    = sync.Mutex{}
+	usageDirty = false
+	usageFile  = defaultUsageFile
+)
+
+// loadUsage reads USAGE_FILE and starts saving it every minute
+func loadUsage() error {
+	if p := setting("USAGE_FILE"); p != "" {
+		usageFile = p
+	}
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if err := loadJSON(usageFile, &usage); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			saveUsage()
+		}
+	}()
+	return nil
+}
+
+// saveUsage writes the counts if they changed since the last save
+func saveUsage() {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if !usageDirty {
+		return
+	}
+	if err := saveJSON(usageFile, usage); err != nil {
+		slog.Error("saving usage failed", "err", err)
+		return
+	}
+	usageDirty = false
+}
+
+// roll starts new day and month counts once now is past the stored ones
+func (u *KeyUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+}
+
+// keyQuotas returns the quotas of key id
+func keyQuotas(id string) (daily, monthly int) {
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	if k, ok := apiKeys[id]; ok {
+		return k.DailyQuota, k.MonthlyQuota
+	}
+	return 0, 0
+}
+
+// errBadCredentials is a secret that authenticates no one
+var errBadCredentials = errors.New("invalid or expired credentials")
+
+// quotaError is a key that has used up a quota; Wait is until the period ends
+type quotaError struct {
+	Wait time.Duration
+	err  error
+}
+
+func (e *quotaError) Error() string { return e.err.Error() }
+
+// authenticateCharged resolves secret like authenticate and charges a
+// stored key one request. Every way of presenting credentials goes through
+// it, so no transport gets around the quotas.
+func authenticateCharged(secret string) (*principal, error) {
+	p, ok := authenticate(secret)
+	if !ok {
+		return nil, errBadCredentials
+	}
+	if p.KeyID != "" {
+		if wait, err := chargeKey(p.KeyID, time.Now().UTC()); err != nil {
+			return nil, &quotaError{wait, err}
+		}
+	}
+	return p, nil
+}
+
+// chargeKey counts one request for key id, or returns how long until it
+// may make another when a quota is used up
+func chargeKey(id string, now time.Time) (time.Duration, error) {
+	daily, monthly := keyQuotas(id)
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	u, ok := usage[id]
+	if !ok {
+		u = &KeyUsage{}
+		usage[id] = u
+	}
+	u.roll(now)
+	if daily > 0 && u.DayCount >= daily {
+		y, m, d := now.Date()
+		return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now), errors.New("daily quota exceeded")
+	}
+	if monthly > 0 && u.MonthCount >= monthly {
+		y, m, _ := now.Date()
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC).Sub(now), errors.New("monthly quota exceeded")
+	}
+	u.DayCount++
+	u.MonthCount++
+	u.Total++
+	u.LastUsed = now
+	usageDirty = true
+	return 0, nil
+}
+
+// keyUsageReport is a key's quotas next to its current usage
+type keyUsageReport struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	DailyQuota   int    `json:"daily_quota,omitempty"`
+	MonthlyQuota int    `json:"monthly_quota,omitempty"`
+	KeyUsage
+}
+
+// usageReport describes k's usage as of now
+func usageReport(k *APIKey, now time.Time) keyUsageReport {
+	rep := keyUsageReport{ID: k.ID, Name: k.Name, DailyQuota: k.DailyQuota, MonthlyQuota: k.MonthlyQuota}
+	usageMu.Lock()
+	if u, ok := usage[k.ID]; ok {
+		rep.KeyUsage = *u
+	}
+	usageMu.Unlock()
+	rep.roll(now)
+	return rep
+}
+
+// usageHandler shows the calling key its own usage
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	if p == nil || p.KeyID == "" {
+		http.Error(w, "usage is tracked for API keys only", http.StatusBadRequest)
+		return
+	}
+	apiKeysMu.RLock()
+	k, ok := apiKeys[p.KeyID]
+	apiKeysMu.RUnlock()
+	if !ok {
+		http.Error(w, "no such key", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageReport(k, time.Now().UTC()))
+}
+
+// listUsageHandler lists the usage of every key in the admin's tenant
+func listUsageHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	now := time.Now().UTC()
+	apiKeysMu.RLock()
+	keys := make([]*APIKey, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		if p.inTenant(k.Tenant) {
+			keys = append(keys, k)
+		}
+	}
+	apiKeysMu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	reports := make([]keyUsageReport, 0, len(keys))
+	for _, k := range keys {
+		reports = append(reports, usageReport(k, now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": reports})
+}
+
+// setQuotaHandler replaces a key's quotas from {"daily_quota": ...,
+// "monthly_quota": ...}
+func setQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DailyQuota   int `json:"daily_quota"`
+		MonthlyQuota int `json:"monthly_quota"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if req.DailyQuota < 0 || req.MonthlyQuota < 0 {
+		http.Error(w, "quotas cannot be negative", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	apiKeysMu.Lock()
+	k, ok := apiKeys[id]
+	ok = ok && requestPrincipal(r).inTenant(k.Tenant)
+	var err error
+	if ok {
+		k.DailyQuota, k.MonthlyQuota = req.DailyQuota, req.MonthlyQuota
+		err = saveAPIKeysLocked()
+	}
+	apiKeysMu.Unlock()
+
+	if !ok {
+		http.Error(w, "no such key", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "persist keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageReport(k, time.Now().UTC()))
+}
+```
+
+---
+
+### server_persist.go
+```go
+package main
+
+// server_persist.go
+// - Small helpers for persisting server state as JSON files
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// loadJSON decodes path into v. A missing file leaves v untouched.
+func loadJSON(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON atomically replaces path with the JSON encoding of v
+func saveJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+```
+
+---
+
+### server_session.go
+```go
+package main
+
+// server_session.go
+// - Short-lived JWT viewer sessions issued by POST /auth/login
+// - Viewer accounts come from VIEWER_USERS
+//   ("name:bcrypt-hash[:phone|phone[:tenant]],..."); without a phone list a
+//   viewer may see every phone of its tenant
+// - Tokens are HS256-signed with JWT_SECRET and live for JWT_TTL (default 15m)
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	viewerUsers = map[string]viewerUser{}
+	dummyHash   []byte // compared for unknown users to hide which names exist
+	jwtSecret   []byte
+	jwtTTL      = 15 * time.Minute
+)
+
+// viewerUser is a configured viewer account
+type viewerUser struct {
+	hash   []byte
+	phones []string
+	tenant string
+}
+
+// sessionClaims are the claims carried by a viewer session token
+type sessionClaims struct {
+	Role   string   `json:"role"`
+	Phones []string `json:"phones,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// loadViewerUsers reads viewer accounts and session settings from the
+// environment. Without JWT_SECRET a random key is used, so sessions do not
+// survive a restart.
+func loadViewerUsers() error {
+	for _, pair := range strings.Split(setting("VIEWER_USERS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || !strings.HasPrefix(parts[1], "$2") {
+			return fmt.Errorf("VIEWER_USERS: bad entry for %q, want name:bcrypt-hash[:phones[:tenant]]", parts[0])
+		}
+		u := viewerUser{hash: []byte(parts[1]), phones: []string{"*"}}
+		if len(parts) >= 3 && parts[2] != "" {
+			u.phones = strings.Split(parts[2], "|")
+		}
+		if len(parts) == 4 {
+			if u.tenant = parts[3]; !tenantExists(u.tenant) {
+				return fmt.Errorf("VIEWER_USERS: %q: unknown tenant %q", parts[0], u.tenant)
+			}
+		}
+		viewerUsers[parts[0]] = u
+	}
+	var err error
+	if dummyHash, err = bcrypt.GenerateFromPassword([]byte("unused"), bcrypt.DefaultCost); err != nil {
+		return err
+	}
+
+	if ttl := setting("JWT_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return fmt.Errorf("JWT_TTL: %w", err)
+		}
+		jwtTTL = d
+	}
+
+	js, err := secret("JWT_SECRET")
+	if err != nil {
+		return err
+	}
+	jwtSecret = []byte(js)
+	if len(jwtSecret) == 0 {
+		slog.Warn("JWT_SECRET not set, using a random key; sessions end on restart")
+		jwtSecret = make([]byte, 32)
+		if _, err := rand.Read(jwtSecret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginHandler exchanges {"username", "password"} for a session token
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	lockKeys := []string{ipKey(r), userKey(req.Username)}
+	if authBlocked(w, lockKeys...) {
+		return
+	}
+	user, ok := viewerUsers[req.Username]
+	hash := user.hash
+	if !ok {
+		// compare anyway so unknown users take as long as wrong passwords
+		hash = dummyHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || !ok {
+		authFailed(lockKeys...)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	authSucceeded(lockKeys...)
+
+	token, exp, err := issueSession(&principal{Name: req.Username, Role: roleViewer, Phones: user.phones, Tenant: user.tenant})
+	if err != nil {
+		http.Error(w, "issue token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": exp})
+}
+
+// issueSession signs a session token for p
+func issueSession(p *principal) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(jwtTTL)
+	claims := sessionClaims{
+		Role:   p.Role,
+		Phones: p.Phones,
+		Tenant: p.Tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   p.Name,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	return token, exp, err
+}
+
+// parseSession validates a session token and returns its principal
+func parseSession(token string) (*principal, bool) {
+	var claims sessionClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, false
+	}
+	return &principal{Name: claims.Subject, Role: claims.Role, Phones: claims.Phones, Tenant: claims.Tenant}, true
+}
+
+// looksLikeJWT distinguishes session tokens from API key secrets
+func looksLikeJWT(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+```
+
+---
+
+### server_oidc.go
+```go
+package main
+
+// server_oidc.go
+// - OpenID Connect login for the viewer (Keycloak, Auth0, Google, ...)
+// - Enabled by OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and
+//   OIDC_REDIRECT_URL (pointing at /v1/auth/oidc/callback)
+// - IdP groups (from the OIDC_GROUPS_CLAIM claim, default "groups") map to
+//   visible phones via OIDC_GROUP_PHONES ("group:phone|phone,ops:*");
+//   members of OIDC_ADMIN_GROUP become admins
+// - OIDC_GROUP_TENANTS ("group:tenant,...") places members of a group in a
+//   tenant; users in no listed group stay in the default tenant
+// - A successful login ends in a normal viewer session token handed to the
+//   viewer in the URL fragment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	oidcVerifier     *oidc.IDTokenVerifier
+	oidcConfig       *oauth2.Config
+	oidcGroupsClaim  = "groups"
+	oidcAdminGroup   = ""
+	oidcGroupPhones  = map[string][]string{}
+	oidcGroupTenants = map[string]string{}
+)
+
+const oidcStateCookie = "oidc_state"
+
+// setupOIDC discovers the issuer when OIDC is configured
+func setupOIDC() error {
+	issuer := setting("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return err
+	}
+
+	clientSecret, err := secret("OIDC_CLIENT_SECRET")
+	if err != nil {
+		return err
+	}
+	clientID := setting("OIDC_CLIENT_ID")
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: clientID})
+	oidcConfig = &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  setting("OIDC_REDIRECT_URL"),
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+	}
+
+	if c := setting("OIDC_GROUPS_CLAIM"); c != "" {
+		oidcGroupsClaim = c
+	}
+	oidcAdminGroup = setting("OIDC_ADMIN_GROUP")
+	for _, pair := range strings.Split(setting("OIDC_GROUP_PHONES"), ",") {
+		group, phones, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && group != "" && phones != "" {
+			oidcGroupPhones[group] = append(oidcGroupPhones[group], strings.Split(phones, "|")...)
+		}
+	}
+	for _, pair := range strings.Split(setting("OIDC_GROUP_TENANTS"), ",") {
+		group, tenant, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || group == "" {
+			continue
+		}
+		if !tenantExists(tenant) {
+			return fmt.Errorf("OIDC_GROUP_TENANTS: unknown tenant %q", tenant)
+		}
+		oidcGroupTenants[group] = tenant
+	}
+	return nil
+}
+
+// authMethodsHandler tells the viewer which login methods are available
+func authMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"password": len(viewerUsers) > 0,
+		"oidc":     oidcConfig != nil,
+	})
+}
+
+// oidcLoginHandler starts the authorization code flow
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcConfig == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state := newSecret()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, oidcConfig.AuthCodeURL(state), http.StatusFound)
+}
+
+// oidcCallbackHandler completes the flow and issues a viewer session
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcConfig == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || c.Value == "" || c.Value != r.URL.Query().Get("state") {
+		http.Error(w, "invalid oidc state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+
+	tok, err := oidcConfig.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, "code exchange failed", http.StatusUnauthorized)
+		return
+	}
+	rawID, ok := tok.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "no id_token in response", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := oidcVerifier.Verify(r.Context(), rawID)
+	if err != nil {
+		http.Error(w, "invalid id_token", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "bad id_token claims", http.StatusUnauthorized)
+		return
+	}
+
+	p := oidcPrincipal(idToken.Subject, claims)
+	if p == nil {
+		http.Error(w, "no device access for your groups", http.StatusForbidden)
+		return
+	}
+	session, _, err := issueSession(p)
+	if err != nil {
+		http.Error(w, "issue token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/#session="+url.QueryEscape(session), http.StatusFound)
+}
+
+// oidcPrincipal maps the IdP groups in claims to a role and phone list. It
+// returns nil when the user's groups grant nothing.
+func oidcPrincipal(subject string, claims map[string]interface{}) *principal {
+	name := subject
+	if email, ok := claims["email"].(string); ok && email != "" {
+		name = email
+	}
+	groups, _ := claims[oidcGroupsClaim].([]interface{})
+
+	tenant := ""
+	for _, g := range groups {
+		group, _ := g.(string)
+		if t, ok := oidcGroupTenants[group]; ok {
+			tenant = t
+			break
+		}
+	}
+
+	p := &principal{Name: name, Role: roleViewer, Tenant: tenant}
+	for _, g := range groups {
+		group, _ := g.(string)
+		if oidcAdminGroup != "" && group == oidcAdminGroup {
+			return &principal{Name: name, Role: roleAdmin, Tenant: tenant}
+		}
+		p.Phones = append(p.Phones, oidcGroupPhones[group]...)
+	}
+	if len(p.Phones) == 0 {
+		return nil
+	}
+	return p
+}
+```
+
+---
+
+### server_rbac.go
+```go
+package main
+
+// server_rbac.go
+// - Roles carried by API keys and viewer sessions:
+//   admin     manages the server and reads every device
+//   viewer    reads only the phones listed on its token ("*" for all)
+//   reporter  posts reports only for the phones listed on its token
+// - Device tokens from DEVICE_TOKENS act as reporters for their own phone
+// - Every role is confined to its tenant's devices (see server_tenants.go)
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	roleAdmin    = "admin"
+	roleViewer   = "viewer"
+	roleReporter = "reporter"
+)
+
+var validRoles = map[string]bool{roleAdmin: true, roleViewer: true, roleReporter: true}
+
+// principal is the authenticated caller attached to a request context
+type principal struct {
+	Name   string
+	Role   string
+	Phones []string
+	Tenant string // "*" for operators
+	KeyID  string // set when authenticated by a stored API key
+}
+
+type principalKey struct{}
+
+// hasPhone reports whether phone is on the principal's list
+func (p *principal) hasPhone(phone string) bool {
+	for _, ph := range p.Phones {
+		if ph == "*" || ph == phone {
+			return true
+		}
+	}
+	return false
+}
+
+// canView reports whether p may read phone's locations
+func (p *principal) canView(phone string) bool {
+	if p == nil || !p.inTenant(deviceTenant(phone)) {
+		return false
+	}
+	return p.Role == roleAdmin || (p.Role == roleViewer && p.hasPhone(phone))
+}
+
+// canReport reports whether p may post locations for phone
+func (p *principal) canReport(phone string) bool {
+	if p == nil || !p.inTenant(deviceTenant(phone)) {
+		return false
+	}
+	return p.Role == roleAdmin || (p.Role == roleReporter && p.hasPhone(phone))
+}
+
+// withPrincipal returns a copy of r carrying p
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// requestPrincipal returns the authenticated caller, or nil if anonymous
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// canReport reports whether the request's principal may report for phone
+func canReport(r *http.Request, phone string) bool {
+	return requestPrincipal(r).canReport(phone)
+}
+
+// requireRole is middleware admitting only principals holding one of roles
+func requireRole(roles ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := requestPrincipal(r)
+			if p == nil {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if p.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "forbidden for role "+p.Role, http.StatusForbidden)
+		})
+	}
+}
+
+// withRole wraps a single handler with requireRole
+func withRole(h http.HandlerFunc, roles ...string) http.Handler {
+	return requireRole(roles...)(h)
+}
+
+// requirePhone rejects principals that may not view the {phone} path variable
+func requirePhone(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestPrincipal(r).canView(mux.Vars(r)["phone"]) {
+			http.Error(w, "forbidden for this phone", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+```
+
+---
+
+### server_audit.go
+```go
+package main
+
+// server_audit.go
+// - Append-only audit log of history reads, live subscriptions, imports and
+//   admin actions: who, what, when and from where
+// - Entries are JSON lines in AUDIT_LOG_FILE (default audit.jsonl) and can
+//   be queried with GET /admin/audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry is one audited request
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Role     string    `json:"role,omitempty"`
+	Action   string    `json:"action"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Phone    string    `json:"phone,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	RemoteIP string    `json:"remote_ip"`
+	Status   int       `json:"status"`
+}
+
+var (
+	auditPath = "audit.jsonl"
+	auditFile *os.File
+	auditMu   = sync.Mutex{}
+)
+
+func openAuditLog() error {
+	if p := setting("AUDIT_LOG_FILE"); p != "" {
+		auditPath = p
+	}
+	f, err := os.OpenFile(auditPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// closeAuditLog flushes and closes the audit log on shutdown
+func closeAuditLog() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if err := auditFile.Sync(); err != nil {
+		slog.Error("audit log sync failed", "err", err)
+	}
+	auditFile.Close()
+	auditFile = nil
+}
+
+// recordAudit appends e to the audit log
+func recordAudit(e AuditEntry) {
+	b, _ := json.Marshal(e)
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if _, err := auditFile.Write(append(b, '\n')); err != nil {
+		// an unwritable audit log is worth shouting about but not worth an outage
+		slog.Error("audit log write failed", "err", err)
+	}
+}
+
+// audited is middleware recording each request under action, including
+// requests later refused by authorization
+func audited(action string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now().UTC()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status == http.StatusSwitchingProtocols {
+				// upgraded connections are recorded by their handler as
+				// soon as it knows the viewer, not when they close
+				return
+			}
+
+			e := AuditEntry{
+				Time:     start,
+				Actor:    "anonymous",
+				Action:   action,
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Phone:    mux.Vars(r)["phone"],
+				RemoteIP: clientIP(r),
+				Status:   rec.status,
+			}
+			if p := requestPrincipal(r); p != nil {
+				e.Actor, e.Role, e.Tenant = p.Name, p.Role, p.Tenant
+			}
+			recordAudit(e)
+		})
+	}
+}
+
+// auditAccess records a read by who outside the audited middleware, for
+// transports that are not plain HTTP requests or only learn the viewer
+// once under way: one entry per phone, or one without a phone for the
+// whole live feed
+func auditAccess(action, method, path, ip string, who *principal, phones []string, status int) {
+	e := AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    "anonymous",
+		Action:   action,
+		Method:   method,
+		Path:     path,
+		RemoteIP: ip,
+		Status:   status,
+	}
+	if who != nil {
+		e.Actor, e.Role, e.Tenant = who.Name, who.Role, who.Tenant
+	}
+	if len(phones) == 0 {
+		recordAudit(e)
+		return
+	}
+	for _, phone := range phones {
+		e.Phone = phone
+		recordAudit(e)
+	}
+}
+
+// auditQueryHandler returns the newest matching entries. Filters: phone,
+// actor, action, since (RFC3339) and limit (default 100). Tenant admins only
+// see entries made within their tenant.
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad since, want RFC3339", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	entries, err := readAudit(func(e AuditEntry) bool {
+		return p.inTenant(e.Tenant) &&
+			(q.Get("phone") == "" || e.Phone == q.Get("phone")) &&
+			(q.Get("actor") == "" || e.Actor == q.Get("actor")) &&
+			(q.Get("action") == "" || e.Action == q.Get("action")) &&
+			!e.Time.Before(since)
+	})
+	if err != nil {
+		http.Error(w, "read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
+
+// readAudit scans the audit log returning entries accepted by match, oldest first
+func readAudit(match func(AuditEntry) bool) ([]AuditEntry, error) {
+	f, err := os.Open(auditPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+// statusRecorder captures the status code written by a handler. It passes
+// Hijack through so websocket upgrades keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+```
+
+---
+
+### server_signature.go
+```go
+package main
+
+// server_signature.go
+// - Optional HMAC-SHA256 signatures on /report using the device token as key
+// - The client sends X-Signature (hex), X-Timestamp (unix seconds) and
+//   X-Nonce; the signature covers "timestamp\nnonce\nbody"
+// - Timestamps outside SIGNATURE_WINDOW (default 5m) and reused nonces are
+//   rejected; REQUIRE_SIGNED_REPORTS=true refuses unsigned reports
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	signatureWindow = 5 * time.Minute
+	requireSigned   = false
+
+	nonces   = map[string]time.Time{} // nonce -> when it can be forgotten
+	noncesMu = sync.Mutex{}
+)
+
+func loadSignatureConfig() error {
+	if v := setting("SIGNATURE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("SIGNATURE_WINDOW: %w", err)
+		}
+		signatureWindow = d
+	}
+	if v := setting("REQUIRE_SIGNED_REPORTS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("REQUIRE_SIGNED_REPORTS: %w", err)
+		}
+		requireSigned = b
+	}
+	return nil
+}
+
+// verifyReportSignature checks the signature headers on a report for phone.
+// It returns false with no error for unsigned reports when signing is
+// optional, so the caller can fall back to token authentication.
+func verifyReportSignature(r *http.Request, body []byte, phone string) (bool, error) {
+	sig := r.Header.Get("X-Signature")
+	if sig == "" {
+		if requireSigned {
+			return false, errors.New("signature required")
+		}
+		return false, nil
+	}
+	ts, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+	if ts == "" || nonce == "" {
+		return false, errors.New("missing X-Timestamp or X-Nonce")
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false, errors.New("bad X-Timestamp")
+	}
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > signatureWindow || skew < -signatureWindow {
+		return false, errors.New("timestamp outside signature window")
+	}
+
+	key, ok := deviceToken(phone)
+	if !ok {
+		return false, errors.New("unknown device")
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signReport([]byte(key), ts, nonce, body)) {
+		return false, errors.New("bad signature")
+	}
+
+	if !rememberNonce(phone + "/" + nonce) {
+		return false, errors.New("replayed nonce")
+	}
+	return true, nil
+}
+
+// signReport computes the HMAC a client must send for body
+func signReport(key []byte, ts, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n", ts, nonce)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// rememberNonce records a nonce for twice the signature window, the longest
+// it could be replayed within, and reports whether it was unseen.
+func rememberNonce(nonce string) bool {
+	now := time.Now()
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	for n, exp := range nonces {
+		if now.After(exp) {
+			delete(nonces, n)
+		}
+	}
+	if _, seen := nonces[nonce]; seen {
+		return false
+	}
+	nonces[nonce] = now.Add(2 * signatureWindow)
+	return true
+}
+```
+
+---
+
+### server_tls.go
+```go
+package main
+
+// server_tls.go
+// - Native HTTPS, either from the TLS_CERT/TLS_KEY secrets (PEM, usually via
+//   TLS_CERT_FILE/TLS_KEY_FILE, see server_secrets.go) or via Let's Encrypt
+//   for the hostnames in AUTOCERT_HOSTS (certificates cached in AUTOCERT_CACHE)
+// - With TLS on, HTTP_REDIRECT_ADDR (default :80 for autocert) redirects plain
+//   HTTP to HTTPS and answers ACME challenges
+// - When ctx is cancelled (SIGINT/SIGTERM) the listeners stop accepting,
+//   live WebSocket viewers get a close frame and in-flight requests have
+//   SHUTDOWN_TIMEOUT (default 15s) to finish
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve runs h on addr with whichever TLS mode is configured until ctx is
+// cancelled, then shuts down gracefully
+func serve(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h}
+	// hijacked websocket connections are not tracked by Shutdown
+	srv.RegisterOnShutdown(closeWebSockets)
+	// nor do event streams end on their own
+	srv.RegisterOnShutdown(closeLiveStreams)
+	certPEM, err := secret("TLS_CERT")
+	if err != nil {
+		return err
+	}
+	keyPEM, err := secret("TLS_KEY")
+	if err != nil {
+		return err
+	}
+	redirectAddr := setting("HTTP_REDIRECT_ADDR")
+
+	if hosts := setting("AUTOCERT_HOSTS"); hosts != "" {
+		cache := setting("AUTOCERT_CACHE")
+		if cache == "" {
+			cache = "certs"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(hosts, ",")...),
+			Cache:      autocert.DirCache(cache),
+			Email:      setting("AUTOCERT_EMAIL"),
+		}
+		if redirectAddr == "" {
+			redirectAddr = ":80"
+		}
+		go serveRedirect(ctx, redirectAddr, m.HTTPHandler(nil))
+		srv.TLSConfig = m.TLSConfig()
+		if err := applyClientCA(srv.TLSConfig); err != nil {
+			return err
+		}
+		slog.Info("TLS via Let's Encrypt", "hosts", hosts)
+		return runServer(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+	}
+
+	if certPEM != "" || keyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return err
+		}
+		if redirectAddr != "" {
+			go serveRedirect(ctx, redirectAddr, redirectHTTPS(addr))
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+		if err := applyClientCA(srv.TLSConfig); err != nil {
+			return err
+		}
+		slog.Info("TLS with configured certificate")
+		return runServer(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+	}
+
+	if setting("TLS_CLIENT_CA_FILE") != "" {
+		return errors.New("TLS_CLIENT_CA_FILE requires TLS to be enabled")
+	}
+	return runServer(ctx, srv, srv.ListenAndServe)
+}
+
+// runServer runs listen until it fails or ctx is cancelled, in which case
+// srv is shut down within the configured deadline
+func runServer(ctx context.Context, srv *http.Server, listen func() error) error {
+	errc := make(chan error, 1)
+	go func() { errc <- listen() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := 15 * time.Second
+	if v := setting("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("SHUTDOWN_TIMEOUT: %w", err)
+		}
+		timeout = d
+	}
+	slog.Info("shutting down, waiting for requests to finish", "timeout", timeout.String())
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
+func serveRedirect(ctx context.Context, addr string, h http.Handler) {
+	slog.Info("HTTP redirect listener", "addr", addr)
+	srv := &http.Server{Addr: addr, Handler: h}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("redirect listener failed", "err", err)
+	}
+}
+
+// redirectHTTPS sends plain HTTP requests to the same path over HTTPS on the
+// port of tlsAddr
+func redirectHTTPS(tlsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+```
+
+---
+
+### server_mtls.go
+```go
+package main
+
+// server_mtls.go
+// - Mutual TLS for reporting devices: with TLS_CLIENT_CA_FILE set, reports
+//   must come with a client certificate issued by that CA whose common name
+//   is the reporting phone ID. Viewers are not asked for certificates.
+// - "mtls-ca" and "mtls-client" subcommands generate the CA and device certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// applyClientCA makes cfg verify client certificates against
+// TLS_CLIENT_CA_FILE when one is configured
+func applyClientCA(cfg *tls.Config) error {
+	path := setting("TLS_CLIENT_CA_FILE")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("%s: no certificates found", path)
+	}
+	cfg.ClientCAs = pool
+	// certificates are checked per route so browsers can still reach the viewer
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// checkClientCert requires a verified client certificate for phone when
+// mutual TLS is enabled
+func checkClientCert(r *http.Request, phone string) error {
+	return checkPeerCert(r.TLS, phone)
+}
+
+// checkPeerCert is checkClientCert for any TLS connection
+func checkPeerCert(cs *tls.ConnectionState, phone string) error {
+	if setting("TLS_CLIENT_CA_FILE") == "" {
+		return nil
+	}
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return errors.New("client certificate required")
+	}
+	if cn := cs.VerifiedChains[0][0].Subject.CommonName; cn != phone {
+		return fmt.Errorf("client certificate is for %q", cn)
+	}
+	return nil
+}
+
+// runCommand handles server subcommands:
+//
+//	mtls-ca <dir>              create ca.pem and ca-key.pem
+//	mtls-client <dir> <phone>  create <phone>.pem and <phone>-key.pem signed by the CA in dir
+func runCommand(args []string) {
+	var err error
+	switch {
+	case args[0] == "mtls-ca" && len(args) == 2:
+		err = generateCA(args[1])
+	case args[0] == "mtls-client" && len(args) == 3:
+		err = generateClientCert(args[1], args[2])
+	default:
+		fmt.Fprintln(os.Stderr, "usage: server [flags] [mtls-ca <dir> | mtls-client <dir> <phone>]")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generateCA(dir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "nu-loc device CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return writeCertPair(dir, "ca", der, key)
+}
+
+func generateClientCert(dir, phone string) error {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: phone},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, pair.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return writeCertPair(dir, phone, der, key)
+}
+
+// writeCertPair writes <name>.pem and <name>-key.pem into dir
+func writeCertPair(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600)
+}
+
+func newSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+```
+
+---
+
+### server_limits.go
+```go
+package main
+
+// server_limits.go
+// - Request bodies are capped with http.MaxBytesReader: MAX_BODY_BYTES
+//   (default 1 MiB) for API calls, MAX_IMPORT_BYTES (default 64 MiB) for
+//   Takeout and GPX/TCX imports; larger bodies get 413
+// - Our own JSON bodies are decoded strictly: unknown fields and trailing
+//   data are rejected. Third-party formats (OwnTracks, Takeout) are only
+//   size-limited since they carry fields we don't use
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+var (
+	maxBodyBytes   int64 = 1 << 20
+	maxImportBytes int64 = 64 << 20
+)
+
+func loadBodyLimits() error {
+	for env, dst := range map[string]*int64{"MAX_BODY_BYTES": &maxBodyBytes, "MAX_IMPORT_BYTES": &maxImportBytes} {
+		if v := setting(env); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("%s: invalid value %q", env, v)
+			}
+			*dst = n
+		}
+	}
+	return nil
+}
+
+// readBody reads at most limit bytes of the request body
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+}
+
+// decodeJSON strictly decodes a size-limited request body into v
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := readBody(w, r, maxBodyBytes)
+	if err != nil {
+		return err
+	}
+	return strictUnmarshal(body, v)
+}
+
+// strictUnmarshal is json.Unmarshal that rejects unknown fields and
+// anything after the first value
+func strictUnmarshal(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after json value")
+	}
+	return nil
+}
+
+func isTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// bodyError reports a read or decode error as 413 or 400
+func bodyError(w http.ResponseWriter, err error) {
+	if isTooLarge(err) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var ce *codecError
+	if errors.As(err, &ce) {
+		http.Error(w, "invalid body: "+ce.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+}
+
+// finite reports whether no value is NaN or Inf
+func finite(vs ...float64) bool {
+	for _, v := range vs {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+```
+
+---
+
+### server_validate.go
+```go
+package main
+
+// server_validate.go
+// - Coordinate checks applied to every ingestion path: latitude must be in
+//   [-90, 90], longitude in [-180, 180], and both finite
+// - 0,0 ("null island") is what broken GPS stacks report without a fix and
+//   is rejected unless ALLOW_NULL_ISLAND=true
+// - Encrypted reports carry no plaintext coordinates and are not checked
+// - accuracy, when given, must be a finite number of metres; with
+//   MAX_ACCURACY set, reports less accurate than that are refused (IP
+//   geolocation can be kilometres off)
+// - Telemetry, all optional: altitude -1000 to 100000 m, speed 0 to 2000
+//   m/s, bearing 0 to under 360 degrees, battery 0 to 100 percent and a
+//   network type from networkTypes; hostname and interface are printable
+//   text of at most 253 and 64 bytes, uptime whole seconds
+// - HTTP reports failing a check get a structured 422; imports and GT06
+//   trackers skip the point
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	allowNullIsland = false
+	maxAccuracy     = 0.0 // metres; 0 accepts any
+)
+
+func loadCoordRules() error {
+	if v := setting("ALLOW_NULL_ISLAND"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("ALLOW_NULL_ISLAND: %w", err)
+		}
+		allowNullIsland = b
+	}
+	if v := setting("MAX_ACCURACY"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 || !finite(n) {
+			return fmt.Errorf("MAX_ACCURACY: want metres, got %q", v)
+		}
+		maxAccuracy = n
+	}
+	return nil
+}
+
+// coordError says which coordinate was rejected and why
+type coordError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *coordError) Error() string { return e.Field + ": " + e.Message }
+
+// checkCoords validates a point, returning nil when it may be stored
+func checkCoords(lat, lon float64, encrypted bool) *coordError {
+	if encrypted {
+		return nil
+	}
+	switch {
+	case !finite(lat):
+		return &coordError{"lat", "must be a finite number"}
+	case !finite(lon):
+		return &coordError{"lon", "must be a finite number"}
+	case lat < -90 || lat > 90:
+		return &coordError{"lat", "must be between -90 and 90"}
+	case lon < -180 || lon > 180:
+		return &coordError{"lon", "must be between -180 and 180"}
+	case lat == 0 && lon == 0 && !allowNullIsland:
+		return &coordError{"lat,lon", "0,0 is not accepted (no GPS fix?)"}
+	}
+	return nil
+}
+
+// checkLocation validates a report's coordinates and accuracy
+func checkLocation(loc Location) *coordError {
+	if e := checkCoords(loc.Lat, loc.Lon, loc.Ciphertext != ""); e != nil {
+		return e
+	}
+	switch {
+	case !finite(loc.Accuracy) || loc.Accuracy < 0:
+		return &coordError{"accuracy", "must be a finite number of metres"}
+	case maxAccuracy > 0 && loc.Accuracy > maxAccuracy:
+		return &coordError{"accuracy", fmt.Sprintf("worse than the %g m accepted", maxAccuracy)}
+	}
+	return checkTelemetry(loc)
+}
+
+// networkTypes are the accepted values of Location.Network
+var networkTypes = map[string]bool{"wifi": true, "cellular": true, "ethernet": true, "offline": true, "other": true}
+
+// checkTelemetry validates the optional telemetry fields
+func checkTelemetry(loc Location) *coordError {
+	outside := func(v *float64, min, max float64) bool {
+		return v != nil && (!finite(*v) || *v < min || *v > max)
+	}
+	switch {
+	case outside(loc.Altitude, -1000, 100000):
+		return &coordError{"altitude", "must be between -1000 and 100000 metres"}
+	case outside(loc.Speed, 0, 2000):
+		return &coordError{"speed", "must be between 0 and 2000 m/s"}
+	case outside(loc.Bearing, 0, 360) || loc.Bearing != nil && *loc.Bearing == 360:
+		return &coordError{"bearing", "must be at least 0 and under 360 degrees"}
+	case loc.Battery != nil && (*loc.Battery < 0 || *loc.Battery > 100):
+		return &coordError{"battery", "must be between 0 and 100 percent"}
+	case loc.Network != "" && !networkTypes[loc.Network]:
+		return &coordError{"network", "must be wifi, cellular, ethernet, offline or other"}
+	case !printable(loc.Hostname, 253):
+		return &coordError{"hostname", "must be printable and at most 253 bytes"}
+	case loc.Uptime != nil && *loc.Uptime < 0:
+		return &coordError{"uptime", "must be 0 or more seconds"}
+	case !printable(loc.Interface, 64):
+		return &coordError{"interface", "must be printable and at most 64 bytes"}
+	case loc.Recoveries < 0:
+		return &coordError{"recoveries", "must be 0 or more"}
+	}
+	return nil
+}
+
+func printable(s string, max int) bool {
+	if len(s) > max || !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeCoordError(w http.ResponseWriter, e *coordError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid coordinates", "details": e})
+}
+```
+
+---
+
+### server_ratelimit.go
+```go
+package main
+
+// server_ratelimit.go
+// - Token bucket rate limits per client IP and per device on /report and /get;
+//   reports and reads of a device are counted separately
+// - RATE_IP_RPS/RATE_IP_BURST and RATE_DEVICE_RPS/RATE_DEVICE_BURST configure
+//   the buckets; an RPS of 0 disables that limit
+// - Limited requests get 429 with Retry-After
+// - TRUST_PROXY_HEADERS=true takes the client IP from X-Forwarded-For,
+//   counting TRUSTED_PROXY_HOPS (default 1) entries in from the right: each
+//   proxy appends the address it saw, so entries further left are whatever
+//   the client sent and could be rotated to dodge limits and lockouts
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// limiterSet holds one token bucket per key, forgetting idle keys
+type limiterSet struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	ipLimits     = newLimiterSet(10, 20)
+	deviceLimits = newLimiterSet(2, 10)
+
+	// trustedProxyHops is how many proxies in front of us append to
+	// X-Forwarded-For
+	trustedProxyHops = 1
+)
+
+func newLimiterSet(rps float64, burst int) *limiterSet {
+	return &limiterSet{limit: rate.Limit(rps), burst: burst, limiters: map[string]*limiterEntry{}}
+}
+
+// loadRateLimits applies environment overrides and starts idle cleanup
+func loadRateLimits() error {
+	for _, c := range []struct {
+		prefix string
+		set    *limiterSet
+	}{{"RATE_IP", ipLimits}, {"RATE_DEVICE", deviceLimits}} {
+		if v := setting(c.prefix + "_RPS"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 {
+				return fmt.Errorf("%s_RPS: invalid rate %q", c.prefix, v)
+			}
+			c.set.limit = rate.Limit(f)
+		}
+		if v := setting(c.prefix + "_BURST"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%s_BURST: invalid burst %q", c.prefix, v)
+			}
+			c.set.burst = n
+		}
+		go c.set.cleanup(10 * time.Minute)
+	}
+	if v := setting("TRUSTED_PROXY_HOPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("TRUSTED_PROXY_HOPS: invalid value %q", v)
+		}
+		trustedProxyHops = n
+	}
+	return nil
+}
+
+// allow takes a token for key, returning how long to wait if none is left
+func (s *limiterSet) allow(key string) (bool, time.Duration) {
+	if s.limit == 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	e, ok := s.limiters[key]
+	if !ok {
+		e = &limiterEntry{lim: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[key] = e
+	}
+	e.lastSeen = time.Now()
+	s.mu.Unlock()
+
+	res := e.lim.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// cleanup periodically drops buckets unused for idle
+func (s *limiterSet) cleanup(idle time.Duration) {
+	for range time.Tick(idle) {
+		s.mu.Lock()
+		for k, e := range s.limiters {
+			if time.Since(e.lastSeen) > idle {
+				delete(s.limiters, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// tooManyRequests writes a 429 telling the client when to retry
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// rateLimitIP is middleware limiting requests per client IP
+func rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := ipLimits.allow(clientIP(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitPhone limits reads per {phone} path variable. Reads have their
+// own bucket, so a busy dashboard cannot get the device's reports refused.
+func rateLimitPhone(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := deviceLimits.allow("read:" + mux.Vars(r)["phone"]); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the caller's IP address
+func clientIP(r *http.Request) string {
+	if setting("TRUST_PROXY_HEADERS") == "true" {
+		var hops []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(h, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					hops = append(hops, ip)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			// the entry our outermost trusted proxy added
+			return hops[max(len(hops)-trustedProxyHops, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+```
+
+---
+
+### server_lockout.go
+```go
+package main
+
+// server_lockout.go
+// - Brute-force protection: failed token, key, password and pairing attempts
+//   are counted per client IP, device and viewer account
+// - After LOCKOUT_THRESHOLD (default 5) failures the key is locked for
+//   LOCKOUT_BASE (default 30s), doubling with each further failure up to
+//   LOCKOUT_MAX (default 1h); a success resets the count
+// - Keys with no failure for a day are forgotten, swept at most once a
+//   minute as failures come in so the table cannot grow without bound
+// - Admins inspect and clear blocks under /admin/lockouts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// lockoutState tracks failures for one key such as "ip:10.0.0.1"
+type lockoutState struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+var (
+	lockouts     = map[string]*lockoutState{}
+	lockoutsMu   = sync.Mutex{}
+	lockoutSwept time.Time
+
+	lockoutThreshold = 5
+	lockoutBase      = 30 * time.Second
+	lockoutMax       = time.Hour
+)
+
+const (
+	// failures older than this are forgotten
+	lockoutMemory = 24 * time.Hour
+	// how often authFailed looks for forgotten keys
+	lockoutSweep = time.Minute
+)
+
+func loadLockoutConfig() error {
+	if v := setting("LOCKOUT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("LOCKOUT_THRESHOLD: invalid value %q", v)
+		}
+		lockoutThreshold = n
+	}
+	for env, dst := range map[string]*time.Duration{"LOCKOUT_BASE": &lockoutBase, "LOCKOUT_MAX": &lockoutMax} {
+		if v := setting(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*dst = d
+		}
+	}
+	return nil
+}
+
+func ipKey(r *http.Request) string  { return "ip:" + clientIP(r) }
+func deviceKey(phone string) string { return "device:" + phone }
+func userKey(name string) string    { return "user:" + name }
+
+// authBlocked writes a 429 and returns true if any of keys is locked out
+func authBlocked(w http.ResponseWriter, keys ...string) bool {
+	if wait := lockedFor(keys...); wait > 0 {
+		tooManyRequests(w, wait)
+		return true
+	}
+	return false
+}
+
+// lockedFor returns how long the longest lockout among keys still lasts
+func lockedFor(keys ...string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	for _, k := range keys {
+		if st, ok := lockouts[k]; ok && st.LockedUntil.After(now) {
+			if d := st.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// authFailed records a failed attempt against each key
+func authFailed(keys ...string) {
+	now := time.Now()
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	if now.Sub(lockoutSwept) >= lockoutSweep {
+		forgetLockouts(now)
+		lockoutSwept = now
+	}
+	for _, k := range keys {
+		st, ok := lockouts[k]
+		if !ok || now.Sub(st.LastFailure) > lockoutMemory {
+			st = &lockoutState{Key: k}
+			lockouts[k] = st
+		}
+		st.Failures++
+		st.LastFailure = now
+		if over := st.Failures - lockoutThreshold; over >= 0 {
+			d := lockoutBase << uint(over)
+			if d > lockoutMax || d <= 0 {
+				d = lockoutMax
+			}
+			st.LockedUntil = now.Add(d)
+		}
+	}
+}
+
+// forgetLockouts drops keys with no recent failure; lockoutsMu must be held
+func forgetLockouts(now time.Time) {
+	for k, st := range lockouts {
+		if now.Sub(st.LastFailure) > lockoutMemory && !st.LockedUntil.After(now) {
+			delete(lockouts, k)
+		}
+	}
+}
+
+// authSucceeded clears the failure count of each key
+func authSucceeded(keys ...string) {
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	for _, k := range keys {
+		delete(lockouts, k)
+	}
+}
+
+func listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	lockoutsMu.Lock()
+	forgetLockouts(now)
+	list := make([]lockoutState, 0, len(lockouts))
+	for _, st := range lockouts {
+		list = append(list, *st)
+	}
+	lockoutsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"lockouts": list})
+}
+
+// clearLockoutsHandler clears one key, or every key when none is given
+func clearLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	lockoutsMu.Lock()
+	if key == "" {
+		lockouts = map[string]*lockoutState{}
+	} else {
+		delete(lockouts, key)
+	}
+	lockoutsMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+```
+
+---
+
+### server_csrf.go
+```go
+package main
+
+// server_csrf.go
+// - CSRF protection (gorilla/csrf) for state-changing requests made by a
+//   browser, i.e. carrying an Origin, Sec-Fetch-Site or Cookie header;
+//   devices and scripts are unaffected
+// - GET /auth/csrf issues a token and sets its cookie; the viewer echoes the
+//   token in the X-CSRF-Token header
+// - Tokens are signed with CSRF_KEY (at least 32 bytes); hosts in
+//   ALLOWED_ORIGINS are trusted alongside the server's own origin
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/csrf"
+)
+
+var (
+	csrfKey     []byte
+	csrfTrusted []string
+)
+
+// setupCSRF loads the signing key. Without CSRF_KEY a random key is used, so
+// open viewer pages need a new token after a restart.
+func setupCSRF() error {
+	key, err := secret("CSRF_KEY")
+	if err != nil {
+		return err
+	}
+	csrfKey = []byte(key)
+	switch {
+	case len(csrfKey) == 0:
+		slog.Warn("CSRF_KEY not set, using a random key")
+		csrfKey = make([]byte, 32)
+		if _, err := rand.Read(csrfKey); err != nil {
+			return err
+		}
+	case len(csrfKey) < 32:
+		return errors.New("CSRF_KEY must be at least 32 bytes")
+	}
+
+	for _, o := range strings.Split(setting("ALLOWED_ORIGINS"), ",") {
+		if u, err := url.Parse(strings.TrimSpace(o)); err == nil && u.Host != "" {
+			csrfTrusted = append(csrfTrusted, u.Host)
+		}
+	}
+	return nil
+}
+
+// withCSRF runs h behind the CSRF protector for the request's scheme, so the
+// cookie is only marked Secure when served over HTTPS
+func withCSRF(h http.Handler) http.Handler {
+	opts := []csrf.Option{
+		csrf.Path("/"),
+		csrf.SameSite(csrf.SameSiteStrictMode),
+		csrf.RequestHeader("X-CSRF-Token"),
+		csrf.TrustedOrigins(csrfTrusted),
+		csrf.ErrorHandler(http.HandlerFunc(csrfFailed)),
+	}
+	secure := csrf.Protect(csrfKey, append(opts, csrf.Secure(true))...)(h)
+	plain := csrf.Protect(csrfKey, append(opts, csrf.Secure(false))...)(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestIsHTTPS(r) {
+			secure.ServeHTTP(w, r)
+			return
+		}
+		plain.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+	})
+}
+
+// csrfCheck is middleware applying withCSRF to state-changing browser requests
+func csrfCheck(next http.Handler) http.Handler {
+	protected := withCSRF(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !fromBrowser(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+// fromBrowser reports whether r carries headers only browsers send; forged
+// cross-site requests always do
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Cookie") != ""
+}
+
+func requestIsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return setting("TRUST_PROXY_HEADERS") == "true" && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	tok := csrf.Token(r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-CSRF-Token", tok)
+	json.NewEncoder(w).Encode(map[string]string{"token": tok})
+}
+
+func csrfFailed(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "csrf check failed: "+csrf.FailureReason(r).Error(), http.StatusForbidden)
+}
+```
+
+---
+
+### server_ipfilter.go
+```go
+package main
+
+// server_ipfilter.go
+// - CIDR allow and deny lists applied by path prefix
+// - IP_ALLOW and IP_DENY hold comma-separated "prefix=cidr" entries, e.g.
+//   IP_ALLOW="/admin/=10.8.0.0/24,/get/=10.8.0.0/24" IP_DENY="/=203.0.113.0/24"
+// - A request is refused if its IP is in any deny entry whose prefix matches
+//   the path. If allow entries match the path, the longest matching prefix
+//   wins and the IP must be in one of its ranges.
+// - Prefixes are matched without the API version, so "/admin/" also covers
+//   "/v1/admin/"
+// - The gRPC and UDP listeners apply the rules of the HTTP endpoint each
+//   call stands in for, e.g. "/report" for reports
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipRule is a CIDR attached to a path prefix
+type ipRule struct {
+	prefix string
+	net    netip.Prefix
+}
+
+var allowRules, denyRules []ipRule
+
+func loadIPRules() error {
+	var err error
+	if allowRules, err = parseIPRules("IP_ALLOW"); err != nil {
+		return err
+	}
+	denyRules, err = parseIPRules("IP_DENY")
+	return err
+}
+
+func parseIPRules(env string) ([]ipRule, error) {
+	var rules []ipRule
+	for _, entry := range strings.Split(setting(env), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, cidr, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%s: bad entry %q, want /path/prefix=cidr", env, entry)
+		}
+		n, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", env, err)
+		}
+		rules = append(rules, ipRule{prefix: prefix, net: n.Masked()})
+	}
+	return rules, nil
+}
+
+// ipAllowed applies the rules to a request path and client address
+func ipAllowed(path string, addr netip.Addr) bool {
+	for _, rule := range denyRules {
+		if strings.HasPrefix(path, rule.prefix) && rule.net.Contains(addr) {
+			return false
+		}
+	}
+	longest := ""
+	for _, rule := range allowRules {
+		if strings.HasPrefix(path, rule.prefix) && len(rule.prefix) > len(longest) {
+			longest = rule.prefix
+		}
+	}
+	if longest == "" {
+		return true
+	}
+	for _, rule := range allowRules {
+		if rule.prefix == longest && rule.net.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAllowed applies the rules to a path and textual client IP
+func peerAllowed(path, ip string) bool {
+	if len(allowRules) == 0 && len(denyRules) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && ipAllowed(path, addr.Unmap())
+}
+
+// ipFilter is middleware enforcing the allow and deny lists
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !peerAllowed(unversionedPath(r.URL.Path), clientIP(r)) {
+			http.Error(w, "forbidden from this address", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+```
+
+---
+
+### server_pairing.go
+```go
+package main
+
+// server_pairing.go
+// - Explicit consent handshake before a device's reports are accepted or
+//   its history is viewable:
+//   1. an admin issues a pairing code for the phone (POST /admin/pairings)
+//   2. the device confirms with its token, the code and "consent": true
+//      (POST /pair); it can withdraw consent later with DELETE /pair
+// - Hardware trackers that cannot run the handshake are confirmed by an admin
+//   (POST /admin/pairings/{phone}/confirm); that is refused for devices not
+//   registered as hardware, which must consent themselves
+// - Consent records persist in PAIRINGS_FILE; REQUIRE_CONSENT=false disables
+//   the check
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	pairingCodeTTL      = 15 * time.Minute
+	pairingMaxAttempts  = 5
+	consentByDevice     = "device"
+	consentByOperator   = "operator"
+	defaultPairingsFile = "pairings.json"
+)
+
+// Pairing is the consent state of one device
+type Pairing struct {
+	Phone       string     `json:"phone"`
+	Code        string     `json:"code,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	ConsentedAt *time.Time `json:"consented_at,omitempty"`
+	ConsentBy   string     `json:"consent_by,omitempty"`
+}
+
+var (
+	pairings       = map[string]*Pairing{}
+	pairingsMu     = sync.RWMutex{}
+	pairingsFile   = defaultPairingsFile
+	requireConsent = true
+)
+
+func loadPairings() error {
+	if v := setting("REQUIRE_CONSENT"); v == "false" {
+		requireConsent = false
+	}
+	if p := setting("PAIRINGS_FILE"); p != "" {
+		pairingsFile = p
+	}
+	var list []*Pairing
+	if err := loadJSON(pairingsFile, &list); err != nil {
+		return err
+	}
+	pairingsMu.Lock()
+	defer pairingsMu.Unlock()
+	for _, p := range list {
+		pairings[p.Phone] = p
+	}
+	return nil
+}
+
+// savePairingsLocked persists pairings; callers hold pairingsMu
+func savePairingsLocked() error {
+	list := make([]*Pairing, 0, len(pairings))
+	for _, p := range pairings {
+		list = append(list, p)
+	}
+	return saveJSON(pairingsFile, list)
+}
+
+// devicePaired reports whether phone has given consent
+func devicePaired(phone string) bool {
+	if !requireConsent {
+		return true
+	}
+	pairingsMu.RLock()
+	defer pairingsMu.RUnlock()
+	p, ok := pairings[phone]
+	return ok && p.ConsentedAt != nil
+}
+
+// issuePairingHandler creates a fresh pairing code for {"phone": ...}
+func issuePairingHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone string `json:"phone"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if req.Phone == "" {
+		http.Error(w, "phone is required", http.StatusBadRequest)
+		return
+	}
+	if !deviceKnown(req.Phone) || !requestPrincipal(r).canView(req.Phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	exp := time.Now().Add(pairingCodeTTL).UTC()
+
+	pairingsMu.Lock()
+	p, ok := pairings[req.Phone]
+	if !ok {
+		p = &Pairing{Phone: req.Phone}
+		pairings[req.Phone] = p
+	}
+	p.Code, p.ExpiresAt, p.Attempts = code, &exp, 0
+	err = savePairingsLocked()
+	pairingsMu.Unlock()
+	if err != nil {
+		http.Error(w, "persist pairings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"phone": req.Phone, "code": code, "expires_at": exp})
+}
+
+// pairHandler completes pairing for a device presenting its token, the code
+// and explicit consent
+func pairHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone   string `json:"phone"`
+		Token   string `json:"token"`
+		Code    string `json:"code"`
+		Consent bool   `json:"consent"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	lockKeys := []string{ipKey(r), deviceKey(req.Phone)}
+	if authBlocked(w, lockKeys...) {
+		return
+	}
+	if !checkDeviceToken(req.Phone, req.Token) {
+		authFailed(lockKeys...)
+		http.Error(w, "invalid device token", http.StatusUnauthorized)
+		return
+	}
+	if !req.Consent {
+		http.Error(w, "consent must be given explicitly", http.StatusBadRequest)
+		return
+	}
+
+	pairingsMu.Lock()
+	defer pairingsMu.Unlock()
+	p, ok := pairings[req.Phone]
+	if !ok || p.Code == "" || p.ExpiresAt == nil || time.Now().After(*p.ExpiresAt) {
+		http.Error(w, "no pending pairing code", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(p.Code), []byte(req.Code)) != 1 {
+		authFailed(lockKeys...)
+		p.Attempts++
+		if p.Attempts >= pairingMaxAttempts {
+			p.Code, p.ExpiresAt = "", nil
+		}
+		savePairingsLocked()
+		http.Error(w, "wrong pairing code", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now().UTC()
+	p.Code, p.ExpiresAt, p.Attempts = "", nil, 0
+	p.ConsentedAt, p.ConsentBy = &now, consentByDevice
+	if err := savePairingsLocked(); err != nil {
+		http.Error(w, "persist pairings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "paired"})
+}
+
+// unpairHandler withdraws a device's consent; {"phone", "token"}
+func unpairHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone string `json:"phone"`
+		Token string `json:"token"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	lockKeys := []string{ipKey(r), deviceKey(req.Phone)}
+	if authBlocked(w, lockKeys...) {
+		return
+	}
+	if !checkDeviceToken(req.Phone, req.Token) {
+		authFailed(lockKeys...)
+		http.Error(w, "invalid device token", http.StatusUnauthorized)
+		return
+	}
+	pairingsMu.Lock()
+	delete(pairings, req.Phone)
+	err := savePairingsLocked()
+	pairingsMu.Unlock()
+	if err != nil {
+		http.Error(w, "persist pairings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmPairingHandler records operator-attested consent for devices that
+// cannot run the handshake themselves. Anything else must consent itself,
+// or an admin could track a laptop without its owner knowing.
+func confirmPairingHandler(w http.ResponseWriter, r *http.Request) {
+	phone := mux.Vars(r)["phone"]
+	if !deviceKnown(phone) {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	if !hardwareTracker(phone) {
+		http.Error(w, "only devices registered with \"hardware\": true may be confirmed; others pair with a pairing code", http.StatusConflict)
+		return
+	}
+	now := time.Now().UTC()
+	pairingsMu.Lock()
+	pairings[phone] = &Pairing{Phone: phone, ConsentedAt: &now, ConsentBy: consentByOperator}
+	err := savePairingsLocked()
+	pairingsMu.Unlock()
+	if err != nil {
+		http.Error(w, "persist pairings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listPairingsHandler(w http.ResponseWriter, r *http.Request) {
+	who := requestPrincipal(r)
+	var phones []string
+	pairingsMu.RLock()
+	for phone := range pairings {
+		phones = append(phones, phone)
+	}
+	pairingsMu.RUnlock()
+	visible := map[string]bool{}
+	for _, phone := range phones {
+		visible[phone] = who.canView(phone)
+	}
+
+	pairingsMu.RLock()
+	list := make([]Pairing, 0, len(pairings))
+	for _, p := range pairings {
+		if !visible[p.Phone] {
+			continue
+		}
+		c := *p
+		c.Code = ""
+		list = append(list, c)
+	}
+	pairingsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Phone < list[j].Phone })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pairings": list})
+}
+
+// newPairingCode returns a random six digit code
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+```
+
+---
+
+### server_owntracks.go
+```go
+package main
+
+// server_owntracks.go
+// - OwnTracks HTTP mode compatibility so the OwnTracks mobile apps can report
+//   without a custom client
+// - The device token is the basic auth password; the message then goes
+//   through the same checks as POST /report (rate limits, lockout,
+//   registration, consent, a "tst" no more than a minute in the future)
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// owntracksMessage is the subset of the OwnTracks JSON payload we understand
+type owntracksMessage struct {
+	Type  string   `json:"_type"`
+	Lat   float64  `json:"lat"`
+	Lon   float64  `json:"lon"`
+	Tst   int64    `json:"tst"`
+	Acc   float64  `json:"acc"`
+	Alt   *float64 `json:"alt"`
+	Vel   *float64 `json:"vel"` // km/h
+	Cog   *float64 `json:"cog"`
+	Batt  *int     `json:"batt"`
+	Conn  string   `json:"conn"` // w, m or o
+	Tid   string   `json:"tid"`
+	Topic string   `json:"topic"`
+}
+
+// location converts the message's position and telemetry
+func (msg owntracksMessage) location() Location {
+	loc := Location{Lat: msg.Lat, Lon: msg.Lon, Accuracy: msg.Acc, Altitude: msg.Alt, Bearing: msg.Cog, Battery: msg.Batt}
+	if msg.Vel != nil {
+		mps := *msg.Vel / 3.6
+		loc.Speed = &mps
+	}
+	switch msg.Conn {
+	case "w":
+		loc.Network = "wifi"
+	case "m":
+		loc.Network = "cellular"
+	case "o":
+		loc.Network = "offline"
+	}
+	return loc
+}
+
+// owntracksHandler accepts OwnTracks messages. Only "_type":"location" is
+// stored; other message types are acknowledged and ignored. The app expects
+// a JSON array in the response body.
+func owntracksHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, maxBodyBytes)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	// the app sends many fields we don't use, so they are not refused
+	var msg owntracksMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if msg.Type != "location" {
+		w.Write([]byte("[]"))
+		return
+	}
+	loc := msg.location()
+	if cerr := checkLocation(loc); cerr != nil {
+		writeCoordError(w, cerr)
+		return
+	}
+
+	phone := owntracksDevice(r, msg)
+	if phone == "" {
+		http.Error(w, "cannot determine device", http.StatusBadRequest)
+		return
+	}
+	_, pass, _ := r.BasicAuth()
+	if !authorizeReport(w, r, body, phone, pass) {
+		return
+	}
+
+	loc.Phone, loc.Token = phone, pass
+	if msg.Tst > 0 {
+		loc.When = time.Unix(msg.Tst, 0)
+	}
+	if loc.When, err = reportTime(loc.When); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ingest(loc)
+
+	w.Write([]byte("[]"))
+}
+
+// owntracksDevice picks the device ID from the X-Limit-D header, the last
+// segment of the message topic (owntracks/user/device), the basic auth user
+// or the tracker ID, in that order.
+func owntracksDevice(r *http.Request, msg owntracksMessage) string {
+	if d := r.Header.Get("X-Limit-D"); d != "" {
+		return d
+	}
+	if parts := strings.Split(msg.Topic, "/"); len(parts) >= 3 && parts[len(parts)-1] != "" {
+		return parts[len(parts)-1]
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return msg.Tid
+}
+```
+
+---
+
+### server_gt06.go
+```go
+package main
+
+// server_gt06.go
+// - TCP listener for the GT06 binary protocol spoken by many cheap hardware
+//   GPS trackers (also supported by Traccar)
+// - The device IMEI from the login packet is used as the phone ID
+// - Registration and consent are checked again on every location packet, so
+//   deleting or unpairing a device cuts off a tracker already connected;
+//   points also get the per-device rate limit and the clock check of
+//   POST /report
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// GT06 protocol numbers we handle
+const (
+	gt06Login     = 0x01
+	gt06Location  = 0x12
+	gt06Heartbeat = 0x13
+	gt06Location2 = 0x22
+)
+
+// serveGT06 accepts tracker connections on addr until the listener fails
+func serveGT06(ctx context.Context, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("gt06 listen failed", "err", err)
+		return
+	}
+	slog.Info("GT06 listener", "addr", addr)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("gt06 accept failed", "err", err)
+			continue
+		}
+		go handleGT06(conn)
+	}
+}
+
+// handleGT06 reads frames from one tracker connection. Frames look like
+// 0x78 0x78 | len | proto | payload | serial(2) | crc(2) | 0x0D 0x0A
+// where len counts proto through crc.
+func handleGT06(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	imei := ""
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		if err := gt06SyncStart(br); err != nil {
+			return
+		}
+		n, err := br.ReadByte()
+		if err != nil || n < 5 {
+			return
+		}
+		frame := make([]byte, int(n)+2)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return
+		}
+		body := frame[:n] // proto .. crc
+		if gt06CRC(append([]byte{n}, body[:n-2]...)) != binary.BigEndian.Uint16(body[n-2:]) {
+			slog.Warn("gt06 bad crc", "remote_ip", conn.RemoteAddr().String())
+			continue
+		}
+		proto := body[0]
+		payload := body[1 : n-4]
+		serial := binary.BigEndian.Uint16(body[n-4 : n-2])
+
+		switch proto {
+		case gt06Login:
+			if len(payload) < 8 {
+				return
+			}
+			imei = strings.TrimLeft(hex.EncodeToString(payload[:8]), "0")
+			if !deviceKnown(imei) || !devicePaired(imei) {
+				// hardware trackers cannot send tokens or pair themselves, so only
+				// listed IMEIs confirmed by an admin may log in
+				slog.Warn("gt06 unknown or unpaired device", "device", imei, "remote_ip", conn.RemoteAddr().String())
+				return
+			}
+			conn.Write(gt06Ack(proto, serial))
+		case gt06Heartbeat:
+			conn.Write(gt06Ack(proto, serial))
+		case gt06Location, gt06Location2:
+			if imei == "" {
+				// trackers must log in before reporting
+				continue
+			}
+			if !deviceKnown(imei) || !devicePaired(imei) {
+				slog.Warn("gt06 device deleted or unpaired, closing", "device", imei, "remote_ip", conn.RemoteAddr().String())
+				return
+			}
+			loc, ok := gt06DecodeLocation(imei, payload)
+			if !ok || checkCoords(loc.Lat, loc.Lon, false) != nil {
+				continue
+			}
+			if allowed, _ := deviceLimits.allow(imei); !allowed {
+				continue
+			}
+			if loc.When, err = reportTime(loc.When); err != nil {
+				// a tracker whose clock is off would pin its latest point
+				slog.Warn("gt06 point dropped", "device", imei, "err", err)
+				continue
+			}
+			ingest(loc)
+		}
+	}
+}
+
+// gt06SyncStart discards bytes until the 0x78 0x78 start marker
+func gt06SyncStart(br *bufio.Reader) error {
+	prev := byte(0)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if prev == 0x78 && b == 0x78 {
+			return nil
+		}
+		prev = b
+	}
+}
+
+// gt06DecodeLocation parses the GPS block shared by location packets:
+// datetime(6) sats(1) lat(4) lon(4) speed(1) course/status(2)
+func gt06DecodeLocation(imei string, p []byte) (Location, bool) {
+	if len(p) < 18 {
+		return Location{}, false
+	}
+	when := time.Date(2000+int(p[0]), time.Month(p[1]), int(p[2]), int(p[3]), int(p[4]), int(p[5]), 0, time.UTC)
+	lat := float64(binary.BigEndian.Uint32(p[7:11])) / 30000 / 60
+	lon := float64(binary.BigEndian.Uint32(p[11:15])) / 30000 / 60
+	flags := binary.BigEndian.Uint16(p[16:18])
+	if flags&(1<<12) == 0 {
+		// no GPS fix
+		return Location{}, false
+	}
+	if flags&(1<<10) == 0 {
+		lat = -lat
+	}
+	if flags&(1<<11) != 0 {
+		lon = -lon
+	}
+	speed := float64(p[15]) / 3.6 // km/h
+	bearing := float64(flags & 0x3FF)
+	if bearing >= 360 {
+		bearing = 0
+	}
+	return Location{Phone: imei, Lat: lat, Lon: lon, Speed: &speed, Bearing: &bearing, When: when.UTC()}, true
+}
+
+// gt06Ack builds the server response echoing the protocol number and serial
+func gt06Ack(proto byte, serial uint16) []byte {
+	b := []byte{0x78, 0x78, 0x05, proto, byte(serial >> 8), byte(serial)}
+	crc := gt06CRC(b[2:])
+	return append(b, byte(crc>>8), byte(crc), 0x0D, 0x0A)
+}
+
+// gt06CRC is CRC-16/X-25 (CRC-ITU) as used by the protocol
+func gt06CRC(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+```
+
+---
+
+### nulocpb/nuloc.proto
+```protobuf
+syntax = "proto3";
+
+// nuloc.proto
+// - Typed API for Go and mobile clients, served on GRPC_ADDR
+// - Regenerate after editing:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative nulocpb/nuloc.proto
+
+package nuloc.v1;
+
+import "google/protobuf/timestamp.proto";
+
+option go_package = "locationshare/nulocpb";
+
+service Tracker {
+  // Report stores one location. Authenticate with the device token in the
+  // request or a reporter key in the "authorization" metadata.
+  rpc Report(ReportRequest) returns (ReportResponse);
+  // Query returns stored history. Needs a read key in "authorization".
+  rpc Query(QueryRequest) returns (QueryResponse);
+  // Subscribe streams new locations of a device as they arrive, the typed
+  // counterpart of /ws and /events/{phone}.
+  rpc Subscribe(SubscribeRequest) returns (stream Location);
+  // ReportStream stores locations sent over one long-lived stream, for
+  // clients that report often. Each request is checked like Report and
+  // answered once stored; a rejected one ends the stream with its error.
+  rpc ReportStream(stream ReportRequest) returns (stream ReportResponse);
+}
+
+message Location {
+  string phone = 1;
+  double lat = 2;
+  double lon = 3;
+  google.protobuf.Timestamp when = 4;
+  // End-to-end encrypted coordinates; lat and lon are then zero
+  string ciphertext = 5;
+  // Reverse-geocoded address, when the server resolves one
+  string place = 6;
+  // The client's report counter, and when the server received the report
+  uint64 seq = 7;
+  google.protobuf.Timestamp received = 8;
+}
+
+message ReportRequest {
+  string phone = 1;
+  string token = 2;
+  double lat = 3;
+  double lon = 4;
+  // Defaults to the time the server receives the report
+  google.protobuf.Timestamp when = 5;
+  string ciphertext = 6;
+  // Uncertainty radius in metres; 0 is unknown
+  double accuracy = 7;
+  // Optional telemetry, with the units and limits of POST /report
+  optional double altitude = 8;
+  optional double speed = 9;
+  optional double bearing = 10;
+  optional int32 battery = 11;
+  string network = 12;
+  string hostname = 13;
+  optional int64 uptime = 14;
+  string interface = 15;
+  int32 recoveries = 16;
+  // Rises by one with each report the client sends
+  uint64 seq = 17;
+}
+
+message ReportResponse {}
+
+message QueryRequest {
+  string phone = 1;
+  // Only points after since, when set
+  google.protobuf.Timestamp since = 2;
+  // At most the newest limit points, when positive
+  int32 limit = 3;
+}
+
+message QueryResponse {
+  repeated Location locations = 1;
+}
+
+message SubscribeRequest {
+  string phone = 1;
+}
+```
+
+---
+
+### nulocpb/nuloc.pb.go
+```go
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        (unknown)
+// source: nulocpb/nuloc.proto
+
+// nuloc.proto
+// - Typed API for Go and mobile clients, served on GRPC_ADDR
+// - Regenerate after editing:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative nulocpb/nuloc.proto
+
+package nulocpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Location struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phone string                 `protobuf:"bytes,1,opt,name=phone,proto3" json:"phone,omitempty"`
+	Lat   float64                `protobuf:"fixed64,2,opt,name=lat,proto3" json:"lat,omitempty"`
+	Lon   float64                `protobuf:"fixed64,3,opt,name=lon,proto3" json:"lon,omitempty"`
+	When  *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=when,proto3" json:"when,omitempty"`
+	// End-to-end encrypted coordinates; lat and lon are then zero
+	Ciphertext string `protobuf:"bytes,5,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	// Reverse-geocoded address, when the server resolves one
+	Place string `protobuf:"bytes,6,opt,name=place,proto3" json:"place,omitempty"`
+	// The client's report counter, and when the server received the report
+	Seq      uint64                 `protobuf:"varint,7,opt,name=seq,proto3" json:"seq,omitempty"`
+	Received *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=received,proto3" json:"received,omitempty"`
+}
+
+func (x *Location) Reset() {
+	*x = Location{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Location) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Location) ProtoMessage() {}
+
+func (x *Location) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Location.ProtoReflect.Descriptor instead.
+func (*Location) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Location) GetPhone() string {
+	if x != nil {
+		return x.Phone
+	}
+	return ""
+}
+
+func (x *Location) GetLat() float64 {
+	if x != nil {
+		return x.Lat
+	}
+	return 0
+}
+
+func (x *Location) GetLon() float64 {
+	if x != nil {
+		return x.Lon
+	}
+	return 0
+}
+
+func (x *Location) GetWhen() *timestamppb.Timestamp {
+	if x != nil {
+		return x.When
+	}
+	return nil
+}
+
+func (x *Location) GetCiphertext() string {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return ""
+}
+
+func (x *Location) GetPlace() string {
+	if x != nil {
+		return x.Place
+	}
+	return ""
+}
+
+func (x *Location) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Location) GetReceived() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Received
+	}
+	return nil
+}
+
+type ReportRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phone string  `protobuf:"bytes,1,opt,name=phone,proto3" json:"phone,omitempty"`
+	Token string  `protobuf:"bytes,2,opt,name=token,proto3" json:"token,omitempty"`
+	Lat   float64 `protobuf:"fixed64,3,opt,name=lat,proto3" json:"lat,omitempty"`
+	Lon   float64 `protobuf:"fixed64,4,opt,name=lon,proto3" json:"lon,omitempty"`
+	// Defaults to the time the server receives the report
+	When       *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=when,proto3" json:"when,omitempty"`
+	Ciphertext string                 `protobuf:"bytes,6,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	// Uncertainty radius in metres; 0 is unknown
+	Accuracy float64 `protobuf:"fixed64,7,opt,name=accuracy,proto3" json:"accuracy,omitempty"`
+	// Optional telemetry, with the units and limits of POST /report
+	Altitude   *float64 `protobuf:"fixed64,8,opt,name=altitude,proto3,oneof" json:"altitude,omitempty"`
+	Speed      *float64 `protobuf:"fixed64,9,opt,name=speed,proto3,oneof" json:"speed,omitempty"`
+	Bearing    *float64 `protobuf:"fixed64,10,opt,name=bearing,proto3,oneof" json:"bearing,omitempty"`
+	Battery    *int32   `protobuf:"varint,11,opt,name=battery,proto3,oneof" json:"battery,omitempty"`
+	Network    string   `protobuf:"bytes,12,opt,name=network,proto3" json:"network,omitempty"`
+	Hostname   string   `protobuf:"bytes,13,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Uptime     *int64   `protobuf:"varint,14,opt,name=uptime,proto3,oneof" json:"uptime,omitempty"`
+	Interface  string   `protobuf:"bytes,15,opt,name=interface,proto3" json:"interface,omitempty"`
+	Recoveries int32    `protobuf:"varint,16,opt,name=recoveries,proto3" json:"recoveries,omitempty"`
+	// Rises by one with each report the client sends
+	Seq uint64 `protobuf:"varint,17,opt,name=seq,proto3" json:"seq,omitempty"`
+}
+
+func (x *ReportRequest) Reset() {
+	*x = ReportRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ReportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportRequest) ProtoMessage() {}
+
+func (x *ReportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportRequest.ProtoReflect.Descriptor instead.
+func (*ReportRequest) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ReportRequest) GetPhone() string {
+	if x != nil {
+		return x.Phone
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetLat() float64 {
+	if x != nil {
+		return x.Lat
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetLon() float64 {
+	if x != nil {
+		return x.Lon
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetWhen() *timestamppb.Timestamp {
+	if x != nil {
+		return x.When
+	}
+	return nil
+}
+
+func (x *ReportRequest) GetCiphertext() string {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetAccuracy() float64 {
+	if x != nil {
+		return x.Accuracy
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetAltitude() float64 {
+	if x != nil && x.Altitude != nil {
+		return *x.Altitude
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetSpeed() float64 {
+	if x != nil && x.Speed != nil {
+		return *x.Speed
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetBearing() float64 {
+	if x != nil && x.Bearing != nil {
+		return *x.Bearing
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetBattery() int32 {
+	if x != nil && x.Battery != nil {
+		return *x.Battery
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetNetwork() string {
+	if x != nil {
+		return x.Network
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetUptime() int64 {
+	if x != nil && x.Uptime != nil {
+		return *x.Uptime
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetInterface() string {
+	if x != nil {
+		return x.Interface
+	}
+	return ""
+}
+
+func (x *ReportRequest) GetRecoveries() int32 {
+	if x != nil {
+		return x.Recoveries
+	}
+	return 0
+}
+
+func (x *ReportRequest) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+type ReportResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *ReportResponse) Reset() {
+	*x = ReportResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ReportResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportResponse) ProtoMessage() {}
+
+func (x *ReportResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportResponse.ProtoReflect.Descriptor instead.
+func (*ReportResponse) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{2}
+}
+
+type QueryRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phone string `protobuf:"bytes,1,opt,name=phone,proto3" json:"phone,omitempty"`
+	// Only points after since, when set
+	Since *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=since,proto3" json:"since,omitempty"`
+	// At most the newest limit points, when positive
+	Limit int32 `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (x *QueryRequest) Reset() {
+	*x = QueryRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *QueryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryRequest) ProtoMessage() {}
+
+func (x *QueryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryRequest.ProtoReflect.Descriptor instead.
+func (*QueryRequest) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *QueryRequest) GetPhone() string {
+	if x != nil {
+		return x.Phone
+	}
+	return ""
+}
+
+func (x *QueryRequest) GetSince() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Since
+	}
+	return nil
+}
+
+func (x *QueryRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type QueryResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Locations []*Location `protobuf:"bytes,1,rep,name=locations,proto3" json:"locations,omitempty"`
+}
+
+func (x *QueryResponse) Reset() {
+	*x = QueryResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *QueryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryResponse) ProtoMessage() {}
+
+func (x *QueryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryResponse.ProtoReflect.Descriptor instead.
+func (*QueryResponse) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *QueryResponse) GetLocations() []*Location {
+	if x != nil {
+		return x.Locations
+	}
+	return nil
+}
+
+type SubscribeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phone string `protobuf:"bytes,1,opt,name=phone,proto3" json:"phone,omitempty"`
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_nulocpb_nuloc_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_nulocpb_nuloc_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_nulocpb_nuloc_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SubscribeRequest) GetPhone() string {
+	if x != nil {
+		return x.Phone
+	}
+	return ""
+}
+
+var File_nulocpb_nuloc_proto protoreflect.FileDescriptor
+
+var file_nulocpb_nuloc_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x70, 0x62, 0x2f, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x08, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x1a,
+	0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x22, 0xf4, 0x01, 0x0a, 0x08, 0x4c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a,
+	0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70, 0x68,
+	0x6f, 0x6e, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x6c, 0x61, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01,
+	0x52, 0x03, 0x6c, 0x61, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x6c, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x03, 0x6c, 0x6f, 0x6e, 0x12, 0x2e, 0x0a, 0x04, 0x77, 0x68, 0x65, 0x6e, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x52, 0x04, 0x77, 0x68, 0x65, 0x6e, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x69, 0x70, 0x68, 0x65,
+	0x72, 0x74, 0x65, 0x78, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x63, 0x69, 0x70,
+	0x68, 0x65, 0x72, 0x74, 0x65, 0x78, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x6c, 0x61, 0x63, 0x65,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x12, 0x10, 0x0a,
+	0x03, 0x73, 0x65, 0x71, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12,
+	0x36, 0x0a, 0x08, 0x72, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x64, 0x18, 0x08, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x08, 0x72,
+	0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x64, 0x22, 0xa2, 0x04, 0x0a, 0x0d, 0x52, 0x65, 0x70, 0x6f,
+	0x72, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x68, 0x6f,
+	0x6e, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x12,
+	0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x6c, 0x61, 0x74, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x03, 0x6c, 0x61, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x6c, 0x6f, 0x6e, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x03, 0x6c, 0x6f, 0x6e, 0x12, 0x2e, 0x0a, 0x04, 0x77, 0x68, 0x65,
+	0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x52, 0x04, 0x77, 0x68, 0x65, 0x6e, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x69, 0x70,
+	0x68, 0x65, 0x72, 0x74, 0x65, 0x78, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x63,
+	0x69, 0x70, 0x68, 0x65, 0x72, 0x74, 0x65, 0x78, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x61, 0x63, 0x63,
+	0x75, 0x72, 0x61, 0x63, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01, 0x52, 0x08, 0x61, 0x63, 0x63,
+	0x75, 0x72, 0x61, 0x63, 0x79, 0x12, 0x1f, 0x0a, 0x08, 0x61, 0x6c, 0x74, 0x69, 0x74, 0x75, 0x64,
+	0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x01, 0x48, 0x00, 0x52, 0x08, 0x61, 0x6c, 0x74, 0x69, 0x74,
+	0x75, 0x64, 0x65, 0x88, 0x01, 0x01, 0x12, 0x19, 0x0a, 0x05, 0x73, 0x70, 0x65, 0x65, 0x64, 0x18,
+	0x09, 0x20, 0x01, 0x28, 0x01, 0x48, 0x01, 0x52, 0x05, 0x73, 0x70, 0x65, 0x65, 0x64, 0x88, 0x01,
+	0x01, 0x12, 0x1d, 0x0a, 0x07, 0x62, 0x65, 0x61, 0x72, 0x69, 0x6e, 0x67, 0x18, 0x0a, 0x20, 0x01,
+	0x28, 0x01, 0x48, 0x02, 0x52, 0x07, 0x62, 0x65, 0x61, 0x72, 0x69, 0x6e, 0x67, 0x88, 0x01, 0x01,
+	0x12, 0x1d, 0x0a, 0x07, 0x62, 0x61, 0x74, 0x74, 0x65, 0x72, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28,
+	0x05, 0x48, 0x03, 0x52, 0x07, 0x62, 0x61, 0x74, 0x74, 0x65, 0x72, 0x79, 0x88, 0x01, 0x01, 0x12,
+	0x18, 0x0a, 0x07, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73,
+	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73,
+	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x06, 0x75, 0x70, 0x74, 0x69, 0x6d, 0x65, 0x18,
+	0x0e, 0x20, 0x01, 0x28, 0x03, 0x48, 0x04, 0x52, 0x06, 0x75, 0x70, 0x74, 0x69, 0x6d, 0x65, 0x88,
+	0x01, 0x01, 0x12, 0x1c, 0x0a, 0x09, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x66, 0x61, 0x63, 0x65, 0x18,
+	0x0f, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x66, 0x61, 0x63, 0x65,
+	0x12, 0x1e, 0x0a, 0x0a, 0x72, 0x65, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x69, 0x65, 0x73, 0x18, 0x10,
+	0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x72, 0x65, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x69, 0x65, 0x73,
+	0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71, 0x18, 0x11, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73,
+	0x65, 0x71, 0x42, 0x0b, 0x0a, 0x09, 0x5f, 0x61, 0x6c, 0x74, 0x69, 0x74, 0x75, 0x64, 0x65, 0x42,
+	0x08, 0x0a, 0x06, 0x5f, 0x73, 0x70, 0x65, 0x65, 0x64, 0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x62, 0x65,
+	0x61, 0x72, 0x69, 0x6e, 0x67, 0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x62, 0x61, 0x74, 0x74, 0x65, 0x72,
+	0x79, 0x42, 0x09, 0x0a, 0x07, 0x5f, 0x75, 0x70, 0x74, 0x69, 0x6d, 0x65, 0x22, 0x10, 0x0a, 0x0e,
+	0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x6c,
+	0x0a, 0x0c, 0x51, 0x75, 0x65, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x14,
+	0x0a, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70,
+	0x68, 0x6f, 0x6e, 0x65, 0x12, 0x30, 0x0a, 0x05, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52,
+	0x05, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x41, 0x0a, 0x0d,
+	0x51, 0x75, 0x65, 0x72, 0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x30, 0x0a,
+	0x09, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x12, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x6f, 0x63, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x22,
+	0x28, 0x0a, 0x10, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x32, 0x86, 0x02, 0x0a, 0x07, 0x54, 0x72,
+	0x61, 0x63, 0x6b, 0x65, 0x72, 0x12, 0x3b, 0x0a, 0x06, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12,
+	0x17, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72,
+	0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63,
+	0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x38, 0x0a, 0x05, 0x51, 0x75, 0x65, 0x72, 0x79, 0x12, 0x16, 0x2e, 0x6e, 0x75,
+	0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e, 0x51, 0x75, 0x65, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x17, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e, 0x51,
+	0x75, 0x65, 0x72, 0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3d, 0x0a, 0x09,
+	0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x12, 0x1a, 0x2e, 0x6e, 0x75, 0x6c, 0x6f,
+	0x63, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x12, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31,
+	0x2e, 0x4c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x30, 0x01, 0x12, 0x45, 0x0a, 0x0c, 0x52,
+	0x65, 0x70, 0x6f, 0x72, 0x74, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x12, 0x17, 0x2e, 0x6e, 0x75,
+	0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x2e, 0x76, 0x31, 0x2e,
+	0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01,
+	0x30, 0x01, 0x42, 0x17, 0x5a, 0x15, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x68,
+	0x61, 0x72, 0x65, 0x2f, 0x6e, 0x75, 0x6c, 0x6f, 0x63, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
+}
+
+var (
+	file_nulocpb_nuloc_proto_rawDescOnce sync.Once
+	file_nulocpb_nuloc_proto_rawDescData = file_nulocpb_nuloc_proto_rawDesc
+)
+
+func file_nulocpb_nuloc_proto_rawDescGZIP() []byte {
+	file_nulocpb_nuloc_proto_rawDescOnce.Do(func() {
+		file_nulocpb_nuloc_proto_rawDescData = protoimpl.X.CompressGZIP(file_nulocpb_nuloc_proto_rawDescData)
+	})
+	return file_nulocpb_nuloc_proto_rawDescData
+}
+
+var file_nulocpb_nuloc_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_nulocpb_nuloc_proto_goTypes = []any{
+	(*Location)(nil),              // 0: nuloc.v1.Location
+	(*ReportRequest)(nil),         // 1: nuloc.v1.ReportRequest
+	(*ReportResponse)(nil),        // 2: nuloc.v1.ReportResponse
+	(*QueryRequest)(nil),          // 3: nuloc.v1.QueryRequest
+	(*QueryResponse)(nil),         // 4: nuloc.v1.QueryResponse
+	(*SubscribeRequest)(nil),      // 5: nuloc.v1.SubscribeRequest
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+}
+var file_nulocpb_nuloc_proto_depIdxs = []int32{
+	6, // 0: nuloc.v1.Location.when:type_name -> google.protobuf.Timestamp
+	6, // 1: nuloc.v1.Location.received:type_name -> google.protobuf.Timestamp
+	6, // 2: nuloc.v1.ReportRequest.when:type_name -> google.protobuf.Timestamp
+	6, // 3: nuloc.v1.QueryRequest.since:type_name -> google.protobuf.Timestamp
+	0, // 4: nuloc.v1.QueryResponse.locations:type_name -> nuloc.v1.Location
+	1, // 5: nuloc.v1.Tracker.Report:input_type -> nuloc.v1.ReportRequest
+	3, // 6: nuloc.v1.Tracker.Query:input_type -> nuloc.v1.QueryRequest
+	5, // 7: nuloc.v1.Tracker.Subscribe:input_type -> nuloc.v1.SubscribeRequest
+	1, // 8: nuloc.v1.Tracker.ReportStream:input_type -> nuloc.v1.ReportRequest
+	2, // 9: nuloc.v1.Tracker.Report:output_type -> nuloc.v1.ReportResponse
+	4, // 10: nuloc.v1.Tracker.Query:output_type -> nuloc.v1.QueryResponse
+	0, // 11: nuloc.v1.Tracker.Subscribe:output_type -> nuloc.v1.Location
+	2, // 12: nuloc.v1.Tracker.ReportStream:output_type -> nuloc.v1.ReportResponse
+	9, // [9:13] is the sub-list for method output_type
+	5, // [5:9] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_nulocpb_nuloc_proto_init() }
+func file_nulocpb_nuloc_proto_init() {
+	if File_nulocpb_nuloc_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_nulocpb_nuloc_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*Location); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_nulocpb_nuloc_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*ReportRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_nulocpb_nuloc_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*ReportResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_nulocpb_nuloc_proto_msgTypes[3].Exporter = func(v any, i int) any {
+			switch v := v.(*QueryRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_nulocpb_nuloc_proto_msgTypes[4].Exporter = func(v any, i int) any {
+			switch v := v.(*QueryResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_nulocpb_nuloc_proto_msgTypes[5].Exporter = func(v any, i int) any {
+			switch v := v.(*SubscribeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_nulocpb_nuloc_proto_msgTypes[1].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_nulocpb_nuloc_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_nulocpb_nuloc_proto_goTypes,
+		DependencyIndexes: file_nulocpb_nuloc_proto_depIdxs,
+		MessageInfos:      file_nulocpb_nuloc_proto_msgTypes,
+	}.Build()
+	File_nulocpb_nuloc_proto = out.File
+	file_nulocpb_nuloc_proto_rawDesc = nil
+	file_nulocpb_nuloc_proto_goTypes = nil
+	file_nulocpb_nuloc_proto_depIdxs = nil
+}
+```
+
+---
+
+### nulocpb/nuloc_grpc.pb.go
+```go
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: nulocpb/nuloc.proto
+
+// nuloc.proto
+// - Typed API for Go and mobile clients, served on GRPC_ADDR
+// - Regenerate after editing:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative nulocpb/nuloc.proto
+
+package nulocpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Tracker_Report_FullMethodName       = "/nuloc.v1.Tracker/Report"
+	Tracker_Query_FullMethodName        = "/nuloc.v1.Tracker/Query"
+	Tracker_Subscribe_FullMethodName    = "/nuloc.v1.Tracker/Subscribe"
+	Tracker_ReportStream_FullMethodName = "/nuloc.v1.Tracker/ReportStream"
+)
+
+// TrackerClient is the client API for Tracker service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TrackerClient interface {
+	// Report stores one location. Authenticate with the device token in the
+	// request or a reporter key in the "authorization" metadata.
+	Report(ctx context.Context, in *ReportRequest, opts ...grpc.CallOption) (*ReportResponse, error)
+	// Query returns stored history. Needs a read key in "authorization".
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+	// Subscribe streams new locations of a device as they arrive, the typed
+	// counterpart of /ws and /events/{phone}.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Location], error)
+	// ReportStream stores locations sent over one long-lived stream, for
+	// clients that report often. Each request is checked like Report and
+	// answered once stored; a rejected one ends the stream with its error.
+	ReportStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ReportRequest, ReportResponse], error)
+}
+
+type trackerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTrackerClient(cc grpc.ClientConnInterface) TrackerClient {
+	return &trackerClient{cc}
+}
+
+func (c *trackerClient) Report(ctx context.Context, in *ReportRequest, opts ...grpc.CallOption) (*ReportResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReportResponse)
+	err := c.cc.Invoke(ctx, Tracker_Report_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryResponse)
+	err := c.cc.Invoke(ctx, Tracker_Query_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Location], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Tracker_ServiceDesc.Streams[0], Tracker_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, Location]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tracker_SubscribeClient = grpc.ServerStreamingClient[Location]
+
+func (c *trackerClient) ReportStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ReportRequest, ReportResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Tracker_ServiceDesc.Streams[1], Tracker_ReportStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReportRequest, ReportResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tracker_ReportStreamClient = grpc.BidiStreamingClient[ReportRequest, ReportResponse]
+
+// TrackerServer is the server API for Tracker service.
+// All implementations must embed UnimplementedTrackerServer
+// for forward compatibility.
+type TrackerServer interface {
+	// Report stores one location. Authenticate with the device token in the
+	// request or a reporter key in the "authorization" metadata.
+	Report(context.Context, *ReportRequest) (*ReportResponse, error)
+	// Query returns stored history. Needs a read key in "authorization".
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	// Subscribe streams new locations of a device as they arrive, the typed
+	// counterpart of /ws and /events/{phone}.
+	Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Location]) error
+	// ReportStream stores locations sent over one long-lived stream, for
+	// clients that report often. Each request is checked like Report and
+	// answered once stored; a rejected one ends the stream with its error.
+	ReportStream(grpc.BidiStreamingServer[ReportRequest, ReportResponse]) error
+	mustEmbedUnimplementedTrackerServer()
+}
+
+// UnimplementedTrackerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTrackerServer struct{}
+
+func (UnimplementedTrackerServer) Report(context.Context, *ReportRequest) (*ReportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Report not implemented")
+}
+func (UnimplementedTrackerServer) Query(context.Context, *QueryRequest) (*QueryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedTrackerServer) Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Location]) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedTrackerServer) ReportStream(grpc.BidiStreamingServer[ReportRequest, ReportResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ReportStream not implemented")
+}
+func (UnimplementedTrackerServer) mustEmbedUnimplementedTrackerServer() {}
+func (UnimplementedTrackerServer) testEmbeddedByValue()                 {}
+
+// UnsafeTrackerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TrackerServer will
+// result in compilation errors.
+type UnsafeTrackerServer interface {
+	mustEmbedUnimplementedTrackerServer()
+}
+
+func RegisterTrackerServer(s grpc.ServiceRegistrar, srv TrackerServer) {
+	// If the following call pancis, it indicates UnimplementedTrackerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Tracker_ServiceDesc, srv)
+}
+
+func _Tracker_Report_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServer).Report(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tracker_Report_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServer).Report(ctx, req.(*ReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tracker_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tracker_Query_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tracker_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TrackerServer).Subscribe(m, &grpc.GenericServerStream[SubscribeRequest, Location]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tracker_SubscribeServer = grpc.ServerStreamingServer[Location]
+
+func _Tracker_ReportStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TrackerServer).ReportStream(&grpc.GenericServerStream[ReportRequest, ReportResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tracker_ReportStreamServer = grpc.BidiStreamingServer[ReportRequest, ReportResponse]
+
+// Tracker_ServiceDesc is the grpc.ServiceDesc for Tracker service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Tracker_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nuloc.v1.Tracker",
+	HandlerType: (*TrackerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Report",
+			Handler:    _Tracker_Report_Handler,
+		},
+		{
+			MethodName: "Query",
+			Handler:    _Tracker_Query_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Tracker_Subscribe_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ReportStream",
+			Handler:       _Tracker_ReportStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "nulocpb/nuloc.proto",
+}
+```
+
+---
+
+### reporter/reporter.go
+```go
+// Package reporter is the bundled client's reporting loop as a library, for
+// Go programs that want to report their position to a nuloc server without
+// running the client binary:
+//
+//	r, err := reporter.New(reporter.Config{
+//		Server:  "https://nuloc.example.com",
+//		Phone:   "van-3",
+//		Token:   token,
+//		Sources: []reporter.Source{gps},
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(r.Run(ctx))
+//
+// Sources and the Transport are interfaces, so a program can plug in its
+// own positioning or delivery; reports go over HTTP by default. Batching,
+// the offline queue, backoff, the adaptive interval, duplicate filtering,
+// the watchdog and remote config behave as in the client, and each is off
+// or at the client's default when its Config fields are left zero.
+package reporter
+
+// reporter.go
+// - Config, New and the loop Run drives: find a fix, decide whether it is
+//   worth sending, build the report and deliver it, then sleep
+// - Run returns when its context is done; calls into sources and
+//   transports are not interrupted, so that can take up to one of them
+// - Stats counts lookups and deliveries for health monitoring; it is safe
+//   to call while Run is going
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+	maxInterval     = 24 * time.Hour
+)
+
+// Fix is one position from a location source
+type Fix struct {
+	Lat, Lon float64
+	Accuracy float64 // metres, 0 when unknown
+	Altitude *float64
+	Speed    *float64
+	Bearing  *float64
+	IP       string
+}
+
+// Source is somewhere the device can learn its position
+type Source interface {
+	Name() string
+	Locate() (Fix, error)
+}
+
+// Payload is one report as POST /report takes it
+type Payload struct {
+	Phone      string   `json:"phone"`
+	Token      string   `json:"token,omitempty"`
+	Lat        float64  `json:"lat"`
+	Lon        float64  `json:"lon"`
+	Accuracy   float64  `json:"accuracy,omitempty"`
+	Altitude   *float64 `json:"altitude,omitempty"`
+	Speed      *float64 `json:"speed,omitempty"`
+	Bearing    *float64 `json:"bearing,omitempty"`
+	IP         string   `json:"ip,omitempty"`
+	Ciphertext string   `json:"ct,omitempty"`
+	When       string   `json:"when,omitempty"` // RFC 3339 UTC, when the fix was taken
+	Hostname   string   `json:"hostname,omitempty"`
+	Uptime     *int64   `json:"uptime,omitempty"`
+	Battery    *int     `json:"battery,omitempty"`
+	Network    string   `json:"network,omitempty"`
+	Interface  string   `json:"interface,omitempty"`
+	Recoveries int      `json:"recoveries,omitempty"`
+	Seq        uint64   `json:"seq,omitempty"`
+}
+
+// Transport hands reports to the server. A ServerError tells the loop
+// whether to queue a failed batch and how long to wait; any other error
+// counts as the server being unreachable. A transport that sends a batch
+// one report at a time wraps its error in a PartialError, so the reports
+// already delivered are not sent again. Transports that keep a connection
+// may also have a Reset method, which the watchdog calls.
+type Transport interface {
+	Send(batch []Payload) error
+}
+
+// Config is what New needs; only Phone and Sources are required
+type Config struct {
+	// Server is the base URL of the nuloc server, for the default
+	// transport and remote config
+	Server string
+	// Client makes requests to Server; http.DefaultClient when nil
+	Client *http.Client
+	Phone  string
+	Token  string
+
+	// Sources are tried in order until one gives a fix. NewSources builds
+	// sources from a list of names such as "gpsd,geoip" when remote config
+	// asks for different ones; without it such a config is refused
+	Sources    []Source
+	NewSources func(names string) ([]Source, error)
+
+	// Transport delivers reports; HTTP to Server when nil, with each
+	// request signed by Token instead of carrying it if Sign is set
+	Transport Transport
+	Sign      bool
+
+	// Interval between reports, 10s when zero. Setting IntervalMin and/or
+	// IntervalMax makes it adaptive between the two
+	Interval    time.Duration
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+
+	// MinDistance holds back fixes less than that many metres from the
+	// last report. Dedupe holds back fixes within that many metres of it
+	// and from the same IP; negative sends them. Held-back fixes still go
+	// out every Heartbeat, 1h when zero and never when negative
+	MinDistance float64
+	Dedupe      float64
+	Heartbeat   time.Duration
+
+	// RetryMax caps the backoff after failures, 5m when zero. The first
+	// wait after a failed delivery is at least SendRetryMin
+	RetryMax     time.Duration
+	SendRetryMin time.Duration
+
+	// BatchSize reports (at most MaxBatch), or as many as BatchWait brings
+	// (1m when zero), go out together
+	BatchSize int
+	BatchWait time.Duration
+
+	// QueueFile keeps reports the server could not take, up to QueueMax
+	// (10000 when zero), until it can; none are kept when empty
+	QueueFile string
+	QueueMax  int
+	// SeqFile keeps report sequence numbers rising across restarts; they
+	// start again at 1 each run when empty
+	SeqFile string
+
+	// Telemetry adds the hostname, uptime, battery and network to reports
+	Telemetry bool
+	// E2EKey, 32 bytes, encrypts coordinates so only the viewer can read them
+	E2EKey []byte
+
+	// ConfigPoll is how often to ask Server for remote config; never when zero
+	ConfigPoll time.Duration
+
+	// Watchdog is how many intervals the loop may go without progress
+	// before connections are reset; off when zero. Stuck is called, from
+	// the watchdog's goroutine, if it is still stuck as long again
+	Watchdog int
+	Stuck    func()
+
+	// SendFailed is called after each failed delivery
+	SendFailed func(error)
+}
+
+// Reporter sends a device's position until its context is done
+type Reporter struct {
+	cfg       Config
+	out       Transport
+	retry     *backoff
+	sendRetry *backoff
+	queue     *reportQueue
+	seq       *sequence
+	batcher   *batcher
+	moved     *moveFilter
+	pace      *pacer
+	dog       *watchdog
+
+	lookups, lookupFailures atomic.Int64
+	posts, postFailures     atomic.Int64
+	queued                  atomic.Int64
+	lastPost                atomic.Int64 // unix nanoseconds
+}
+
+// Stats are a Reporter's counters since New
+type Stats struct {
+	Lookups        int64 // location lookups, failed ones included
+	LookupFailures int64
+	Posts          int64 // deliveries through the Transport, failed ones included
+	PostFailures   int64
+	Queued         int       // reports waiting in the queue
+	Recoveries     int       // watchdog resets
+	LastPost       time.Time // last successful delivery, zero before one
+}
+
+func (r *Reporter) Stats() Stats {
+	st := Stats{
+		Lookups:        r.lookups.Load(),
+		LookupFailures: r.lookupFailures.Load(),
+		Posts:          r.posts.Load(),
+		PostFailures:   r.postFailures.Load(),
+		Queued:         int(r.queued.Load()),
+		Recoveries:     r.dog.recoveries(),
+	}
+	if t := r.lastPost.Load(); t != 0 {
+		st.LastPost = time.Unix(0, t)
+	}
+	return st
+}
+
+// New checks cfg, fills in its defaults and loads any queued reports
+func New(cfg Config) (*Reporter, error) {
+	switch {
+	case cfg.Phone == "":
+		return nil, errors.New("reporter: Phone is required")
+	case len(cfg.Sources) == 0:
+		return nil, errors.New("reporter: no Sources")
+	case cfg.E2EKey != nil && len(cfg.E2EKey) != 32:
+		return nil, fmt.Errorf("reporter: E2EKey is %d bytes, want 32", len(cfg.E2EKey))
+	case cfg.BatchSize > MaxBatch:
+		return nil, fmt.Errorf("reporter: BatchSize %d is over %d", cfg.BatchSize, MaxBatch)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultInterval
+	}
+	r := &Reporter{cfg: cfg, out: cfg.Transport}
+	switch {
+	case r.out != nil && cfg.Sign:
+		return nil, errors.New("reporter: Sign only applies to the default transport")
+	case r.out == nil && cfg.Server == "":
+		return nil, errors.New("reporter: Server is required without a Transport")
+	case r.out == nil:
+		h := HTTPTransport{Client: cfg.Client, Server: cfg.Server}
+		if cfg.Sign {
+			if cfg.Token == "" {
+				return nil, errors.New("reporter: Sign needs the Token to sign with")
+			}
+			h.Key = []byte(cfg.Token)
+		}
+		r.out = h
+	}
+	var err error
+	if r.pace, err = newPacer(cfg.Interval, cfg.IntervalMin, cfg.IntervalMax); err != nil {
+		return nil, err
+	}
+	if r.queue, err = openQueue(cfg.QueueFile, cfg.QueueMax); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	r.queued.Store(int64(r.queue.len()))
+	if r.seq, err = openSequence(cfg.SeqFile); err != nil {
+		return nil, fmt.Errorf("sequence: %w", err)
+	}
+	r.retry = newBackoff(cfg.Interval, cfg.RetryMax)
+	r.sendRetry = newBackoff(max(cfg.Interval, cfg.SendRetryMin), cfg.RetryMax)
+	r.batcher = newBatcher(cfg.BatchSize, cfg.BatchWait)
+	r.moved = newMoveFilter(cfg.MinDistance, cfg.Dedupe, cfg.Heartbeat)
+	r.dog = newWatchdog(cfg.Watchdog, cfg.Stuck, cfg.Client, cfg.Interval)
+	return r, nil
+}
+
+// Run reports until ctx is done, returning its error
+func (r *Reporter) Run(ctx context.Context) error {
+	remote := &configWatch{client: r.cfg.Client, server: r.cfg.Server, phone: r.cfg.Phone, token: r.cfg.Token}
+	if r.cfg.ConfigPoll > 0 {
+		go remote.run(ctx, r.cfg.ConfigPoll)
+	}
+	go r.dog.run(ctx)
+	sources, pace := r.cfg.Sources, r.pace
+	var applied remoteConfig
+	for ctx.Err() == nil {
+		r.dog.setInterval(pace.interval())
+		if r.dog.takeReset() {
+			if t, ok := r.out.(interface{ Reset() }); ok {
+				t.Reset()
+			}
+		}
+		if cfg := remote.current(); cfg != applied {
+			if s, p, err := r.settings(cfg); err != nil {
+				log.Println("remote config err:", err)
+			} else {
+				sources, pace = s, p
+				log.Printf("using remote config %+v", cfg)
+			}
+			if cfg.Paused && !applied.Paused {
+				log.Println("reporting paused by the server")
+			} else if !cfg.Paused && applied.Paused {
+				log.Println("reporting resumed")
+			}
+			applied = cfg
+		}
+		if applied.Paused {
+			r.dog.ok()
+			sleep(ctx, pace.interval())
+			continue
+		}
+		if batch := r.batcher.due(); batch != nil && r.send(ctx, batch) != nil {
+			continue
+		}
+
+		f, err := locate(sources)
+		r.lookups.Add(1)
+		if err != nil {
+			r.lookupFailures.Add(1)
+			r.retry.wait(ctx, "location err", err)
+			continue
+		}
+		pace.observe(f)
+		if !r.moved.pass(f, time.Now()) {
+			r.retry.reset()
+			r.dog.ok()
+			sleep(ctx, pace.interval())
+			continue
+		}
+
+		p := Payload{Phone: r.cfg.Phone, Token: r.cfg.Token, Lat: f.Lat, Lon: f.Lon, Accuracy: f.Accuracy,
+			Altitude: f.Altitude, Speed: f.Speed, Bearing: f.Bearing, IP: f.IP,
+			When: time.Now().UTC().Format(time.RFC3339Nano)}
+		if p.Seq, err = r.seq.next(); err != nil {
+			log.Println("sequence err:", err)
+		}
+		if r.cfg.Telemetry {
+			t := readTelemetry()
+			p.Hostname, p.Uptime, p.Battery, p.Network, p.Interface = t.Hostname, t.Uptime, t.Battery, t.Network, t.Interface
+			p.Recoveries = r.dog.recoveries()
+		}
+		if r.cfg.E2EKey != nil {
+			if p.Ciphertext, err = encryptCoords(r.cfg.E2EKey, f.Lat, f.Lon); err != nil {
+				r.retry.wait(ctx, "encrypt err", err)
+				continue
+			}
+			// the server would see these in the clear
+			p.Lat, p.Lon, p.Altitude, p.Speed, p.Bearing = 0, 0, nil, nil, nil
+		}
+		batch := r.batcher.add(p)
+		if batch == nil {
+			r.dog.ok()
+			sleep(ctx, pace.interval())
+			continue
+		}
+		if r.send(ctx, batch) != nil {
+			continue
+		}
+		r.retry.reset()
+		r.dog.ok()
+		sleep(ctx, pace.interval())
+	}
+	r.stop()
+	return ctx.Err()
+}
+
+// send delivers a batch, waiting out the backoff if it fails
+func (r *Reporter) send(ctx context.Context, batch []Payload) error {
+	err := deliver(r.out, r.cfg.Token, r.queue, batch)
+	r.posts.Add(1)
+	r.queued.Store(int64(r.queue.len()))
+	if err != nil {
+		r.postFailures.Add(1)
+		if r.cfg.SendFailed != nil {
+			r.cfg.SendFailed(err)
+		}
+		r.sendRetry.wait(ctx, "post err", err)
+		return err
+	}
+	r.lastPost.Store(time.Now().UnixNano())
+	r.sendRetry.reset()
+	return nil
+}
+
+// stop saves the reports still collecting in a batch: to the queue for
+// the next run, or straight to the server if there is no queue
+func (r *Reporter) stop() {
+	batch := r.batcher.take()
+	if len(batch) == 0 {
+		return
+	}
+	if r.queue != nil {
+		queueAll(r.queue, batch)
+		return
+	}
+	if err := r.out.Send(batch); err != nil {
+		log.Printf("dropped %d unsent report(s): %v", len(batch), err)
+	}
+}
+
+// locate returns the first fix any source gives
+func locate(sources []Source) (Fix, error) {
+	var errs []error
+	for _, src := range sources {
+		f, err := src.Locate()
+		if err == nil {
+			return f, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src.Name(), err))
+	}
+	return Fix{}, errors.Join(errs...)
+}
+
+// sleep waits d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// ParseInterval reads a report interval such as "30s", "5m" or plain
+// seconds ("30"); "" is the default of 10s. Sub-second cadences are
+// refused: they would only flood the server with near-identical points.
+func ParseInterval(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.Atoi(v); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("bad interval %q, want e.g. 30s or 5m", v)
+	case d%time.Second != 0:
+		return 0, fmt.Errorf("interval %s: whole seconds only", d)
+	case d < time.Second || d > maxInterval:
+		return 0, fmt.Errorf("interval %s: must be between 1s and %s", d, maxInterval)
+	}
+	return d, nil
+}
+```
+### reporter/batch.go
+```go
+package reporter
+
+// batch.go
+// - With BatchSize above 1 reports are collected until there are that
+//   many, or BatchWait (default 1m) has passed, and sent together, which
+//   saves requests with a fast GPS source
+// - The age is checked every loop, so a batch still goes out on time
+//   when the movement filter holds new fixes back
+// - Reports still collecting when the reporter stops are queued, or sent
+//   if there is no queue; a failed batch goes to the offline queue like a
+//   single report would
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultBatchWait = time.Minute
+
+type batcher struct {
+	size    int
+	wait    time.Duration
+	pending []Payload
+	first   time.Time
+}
+
+func newBatcher(size int, wait time.Duration) *batcher {
+	if size < 1 {
+		size = 1
+	}
+	if wait <= 0 {
+		wait = defaultBatchWait
+	}
+	return &batcher{size: size, wait: wait}
+}
+
+// add collects p, returning the batch once it is full or old enough
+func (b *batcher) add(p Payload) []Payload {
+	if len(b.pending) == 0 {
+		b.first = time.Now()
+	}
+	b.pending = append(b.pending, p)
+	if len(b.pending) < b.size && time.Since(b.first) < b.wait {
+		return nil
+	}
+	return b.take()
+}
+
+// due returns the batch if it has waited long enough, with no new fix
+func (b *batcher) due() []Payload {
+	if len(b.pending) == 0 || time.Since(b.first) < b.wait {
+		return nil
+	}
+	return b.take()
+}
+
+// take empties the batcher, returning what it held
+func (b *batcher) take() []Payload {
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// deliver sends reports behind anything already queued, queueing them
+// when the server cannot take them now
+func deliver(out Transport, token string, queue *reportQueue, batch []Payload) error {
+	if !queue.empty() {
+		// behind older reports, so history stays in order
+		queueAll(queue, batch)
+		return queue.flush(out, token)
+	}
+	err := out.Send(batch)
+	if err != nil && queue != nil {
+		switch rest := batch[sentOf(err):]; {
+		case worthQueueing(err):
+			queueAll(queue, rest)
+		case onlyOneFailed(err):
+			// the reports after the refused one were never tried
+			queueAll(queue, rest[1:])
+		}
+	}
+	return err
+}
+
+func queueAll(queue *reportQueue, batch []Payload) {
+	if err := queue.addAll(batch); err != nil {
+		log.Println("queue err:", err)
+	}
+}
+
+// worthQueueing reports whether a failed report could succeed later: the
+// server was unreachable, failing or busy, rather than refusing the point
+func worthQueueing(err error) bool {
+	var se ServerError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+}
+```
+### reporter/control.go
+```go
+package reporter
+
+// control.go
+// - Every Config.ConfigPoll the reporter asks the server for central
+//   settings: interval, interval_min, interval_max and source override
+//   the Config's, and paused stops reporting until it is cleared
+// - Settings the server leaves empty keep the Config's value, so an empty
+//   config is the same as none
+// - A config the reporter cannot use (say, a source it has no device for)
+//   is logged and the previous settings stay in force
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// remoteConfig mirrors the server's clientConfig
+type remoteConfig struct {
+	Interval    string `json:"interval"`
+	IntervalMin string `json:"interval_min"`
+	IntervalMax string `json:"interval_max"`
+	Source      string `json:"source"`
+	Paused      bool   `json:"paused"`
+}
+
+// settings builds the sources and pacing c asks for, falling back to the
+// Config
+func (r *Reporter) settings(c remoteConfig) ([]Source, *pacer, error) {
+	interval, min, max := r.cfg.Interval, r.cfg.IntervalMin, r.cfg.IntervalMax
+	for _, s := range []struct {
+		name, v string
+		to      *time.Duration
+	}{{"interval", c.Interval, &interval}, {"interval_min", c.IntervalMin, &min}, {"interval_max", c.IntervalMax, &max}} {
+		if s.v == "" {
+			continue
+		}
+		d, err := ParseInterval(s.v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.name, err)
+		}
+		*s.to = d
+	}
+	sources := r.cfg.Sources
+	if c.Source != "" {
+		if r.cfg.NewSources == nil {
+			return nil, nil, errors.New("source: cannot be changed here")
+		}
+		var err error
+		if sources, err = r.cfg.NewSources(c.Source); err != nil {
+			return nil, nil, fmt.Errorf("source: %w", err)
+		}
+	}
+	pace, err := newPacer(interval, min, max)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sources, pace, nil
+}
+
+// configWatch holds the latest config fetched from the server
+type configWatch struct {
+	client               *http.Client
+	server, phone, token string
+
+	mu   sync.Mutex
+	cfg  remoteConfig
+	etag string
+}
+
+func (w *configWatch) current() remoteConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cfg
+}
+
+// run polls every interval until ctx is done or the server turns out not
+// to offer configs
+func (w *configWatch) run(ctx context.Context, every time.Duration) {
+	for ctx.Err() == nil {
+		if err := w.fetch(); err != nil {
+			if e, ok := err.(ServerError); ok && e.Code == http.StatusNotFound {
+				log.Println("server has no client config endpoint, not asking again")
+				return
+			}
+			log.Println("config err:", err)
+		}
+		sleep(ctx, every)
+	}
+}
+
+func (w *configWatch) fetch() error {
+	b, _ := json.Marshal(map[string]string{"phone": w.phone, "token": w.token})
+	req, err := http.NewRequest("POST", w.server+"/v1/client/config", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w.mu.Lock()
+	if w.etag != "" {
+		req.Header.Set("If-None-Match", w.etag)
+	}
+	w.mu.Unlock()
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil
+	case resp.StatusCode/100 != 2:
+		return responseError(resp, body)
+	}
+	var cfg remoteConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return fmt.Errorf("bad config from server: %w", err)
+	}
+	w.mu.Lock()
+	w.cfg, w.etag = cfg, resp.Header.Get("ETag")
+	w.mu.Unlock()
+	return nil
+}
+```
+### reporter/e2e.go
+```go
+package reporter
+
+// e2e.go
+// - Optional end-to-end encryption of coordinates. With Config.E2EKey set
+//   only ciphertext is sent; the server stores and relays it, and the
+//   viewer decrypts with the same key passed in the URL fragment
+//   (#key=...), which browsers never send to the server.
+// - Format: base64(nonce(12) || AES-256-GCM(json {"lat","lon"}))
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// encryptCoords seals lat/lon for the viewer
+func encryptCoords(key []byte, lat, lon float64) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plain, _ := json.Marshal(map[string]float64{"lat": lat, "lon": lon})
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+```
+### reporter/filter.go
+```go
+package reporter
+
+// filter.go
+// - With MinDistance set (metres), a fix is only reported once the device
+//   is that far from the last reported one, which cuts noise and traffic
+//   for machines that mostly sit still
+// - A fix within Dedupe metres of the last reported one and from the same
+//   public IP is a repeat and is skipped, so IP geolocation doesn't write
+//   the same point every interval forever
+// - A report still goes out every Heartbeat (default 1h) so the server can
+//   tell a parked device from a dead one
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultHeartbeat = time.Hour
+	earthRadius      = 6371000.0 // metres
+)
+
+type moveFilter struct {
+	min       float64
+	epsilon   float64       // negative when repeats are reported
+	heartbeat time.Duration // negative for never
+
+	sent     bool
+	lat, lon float64
+	ip       string
+	at       time.Time
+}
+
+func newMoveFilter(min, epsilon float64, heartbeat time.Duration) *moveFilter {
+	if heartbeat == 0 {
+		heartbeat = defaultHeartbeat
+	}
+	return &moveFilter{min: min, epsilon: epsilon, heartbeat: heartbeat}
+}
+
+// pass reports whether f should be sent, remembering it if so
+func (m *moveFilter) pass(f Fix, now time.Time) bool {
+	if m.sent && (m.heartbeat < 0 || now.Sub(m.at) < m.heartbeat) {
+		d := distance(m.lat, m.lon, f.Lat, f.Lon)
+		if d < m.min || (d <= m.epsilon && f.IP == m.ip) {
+			return false
+		}
+	}
+	m.sent, m.lat, m.lon, m.ip, m.at = true, f.Lat, f.Lon, f.IP, now
+	return true
+}
+
+// distance is the great-circle distance in metres
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+```
+### reporter/http.go
+```go
+package reporter
+
+// http.go
+// - The default transport: a single report goes to POST /v1/report, more
+//   to POST /v1/report/batch
+// - Points the server rejects from a batch are logged and dropped, since
+//   sending them again would not help
+// - With a Key, each request carries X-Signature, the hex HMAC-SHA256 of
+//   "timestamp\nnonce\nbody" under the key, with X-Timestamp (unix
+//   seconds) and a fresh X-Nonce, as the server's signed reports expect.
+//   The token then stays out of the body
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPTransport posts reports to the server's JSON API
+type HTTPTransport struct {
+	Client *http.Client
+	Server string
+	Key    []byte // signs reports when set, normally the device token
+}
+
+func (h HTTPTransport) Send(batch []Payload) error {
+	if h.Key != nil {
+		// the signature proves who sent it
+		batch = append([]Payload(nil), batch...)
+		for i := range batch {
+			batch[i].Token = ""
+		}
+	}
+	if len(batch) == 1 {
+		return h.post(batch[0])
+	}
+	if err := h.postBatch(batch); err != nil {
+		return err
+	}
+	log.Printf("sent a batch of %d reports", len(batch))
+	return nil
+}
+
+// post sends one report, failing unless the server accepts it
+func (h HTTPTransport) post(p Payload) error {
+	_, err := h.postJSON("/v1/report", p)
+	return err
+}
+
+func (h HTTPTransport) postBatch(batch []Payload) error {
+	body, err := h.postJSON("/v1/report/batch", batch)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Rejected []struct {
+			Index int    `json:"index"`
+			Error string `json:"error"`
+		} `json:"rejected"`
+	}
+	if json.Unmarshal(body, &result) == nil {
+		for _, r := range result.Rejected {
+			if r.Index < 0 || r.Index >= len(batch) {
+				log.Printf("server rejected report %d of a batch of %d: %s", r.Index, len(batch), r.Error)
+				continue
+			}
+			log.Printf("queued report from %s rejected: %s", batch[r.Index].When, r.Error)
+		}
+	}
+	return nil
+}
+
+// postJSON posts v to path, signed if there is a key, and returns the
+// body of a 2xx answer
+func (h HTTPTransport) postJSON(path string, v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", h.Server+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Key != nil {
+		if err := sign(req, h.Key, b); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, responseError(resp, body)
+	}
+	return body, nil
+}
+
+// sign adds the signature headers for body to req
+func sign(req *http.Request, key, body []byte) error {
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return err
+	}
+	ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(n)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n", ts, nonce)
+	mac.Write(body)
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// ServerError is a request the server refused. Code is an HTTP status;
+// transports over other protocols map their refusals onto one
+type ServerError struct {
+	Code       int
+	Status     string
+	Body       string
+	RetryAfter time.Duration // never retry sooner than this
+}
+
+func (e ServerError) Error() string { return fmt.Sprintf("server said %s: %s", e.Status, e.Body) }
+
+// PartialError is a batch sent one report at a time that failed on
+// report Sent, after the ones before it got through
+type PartialError struct {
+	Sent int
+	Err  error
+}
+
+func (e PartialError) Error() string {
+	if e.Sent == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (after %d sent)", e.Err, e.Sent)
+}
+func (e PartialError) Unwrap() error { return e.Err }
+
+// sentOf is how many reports of a batch got through before err
+func sentOf(err error) int {
+	var pe PartialError
+	if errors.As(err, &pe) {
+		return pe.Sent
+	}
+	return 0
+}
+
+// onlyOneFailed reports whether err came from a transport sending one
+// report at a time, so only the report after those sent was refused
+func onlyOneFailed(err error) bool {
+	var pe PartialError
+	return errors.As(err, &pe)
+}
+
+func responseError(resp *http.Response, body []byte) ServerError {
+	return ServerError{Code: resp.StatusCode, Status: resp.Status, Body: string(bytes.TrimSpace(body)), RetryAfter: retryAfter(resp)}
+}
+
+// retryAfter reads a Retry-After header given in seconds
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+```
+### reporter/pace.go
+```go
+package reporter
+
+// pace.go
+// - With IntervalMin and/or IntervalMax set the report interval adapts:
+//   it drops straight to IntervalMin once the device is seen moving and
+//   doubles back towards IntervalMax while it sits still, so a moving
+//   device stays fresh and a parked one costs little bandwidth or quota
+// - Moving means a reported speed of at least movingSpeed, or a jump from
+//   the previous fix larger than both fixes' accuracy and moveSlack
+// - Without either setting the interval stays fixed
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	movingSpeed = 0.5  // m/s, ~1.8 km/h
+	moveSlack   = 25.0 // metres of jitter ignored between fixes without an accuracy
+)
+
+type pacer struct {
+	min, max, cur time.Duration
+	adaptive      bool
+
+	prev *Fix
+}
+
+// newPacer starts at interval, clamped to min and max where those are set
+func newPacer(interval, min, max time.Duration) (*pacer, error) {
+	p := &pacer{min: interval, max: interval, cur: interval, adaptive: min > 0 || max > 0}
+	if min > 0 {
+		p.min = min
+	}
+	if max > 0 {
+		p.max = max
+	}
+	if p.min > p.max {
+		return nil, fmt.Errorf("minimum interval %s is longer than the maximum %s", p.min, p.max)
+	}
+	p.cur = clampDuration(p.cur, p.min, p.max)
+	return p, nil
+}
+
+// observe adjusts the interval to whether f shows the device moving
+func (p *pacer) observe(f Fix) {
+	if !p.adaptive {
+		return
+	}
+	prev := p.prev
+	p.prev = &f
+	if prev == nil {
+		return
+	}
+	next := p.cur * 2
+	if moving(*prev, f) {
+		next = p.min
+	}
+	next = clampDuration(next, p.min, p.max)
+	if next != p.cur {
+		log.Println("report interval now", next)
+	}
+	p.cur = next
+}
+
+func (p *pacer) interval() time.Duration {
+	return p.cur
+}
+
+func moving(prev, f Fix) bool {
+	if f.Speed != nil {
+		return *f.Speed >= movingSpeed
+	}
+	slack := math.Max(moveSlack, math.Max(prev.Accuracy, f.Accuracy))
+	return distance(prev.Lat, prev.Lon, f.Lat, f.Lon) > slack
+}
+
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
+```
+### reporter/queue.go
+```go
+package reporter
+
+// queue.go
+// - Reports that cannot be delivered because the server is unreachable,
+//   overloaded or rate-limiting are kept in QueueFile instead of being
+//   lost, and sent in batches once it answers again, oldest first, so
+//   history has no gap
+// - While anything is queued new reports join the end of the queue, which
+//   keeps the history in order
+// - At most QueueMax reports (default 10000) are kept; the oldest go
+//   first. The device token is not written to the file
+// - A queued batch the server refuses outright (a 4xx other than 429) is
+//   moved to QueueFile.rejected, one JSON report per line, so it cannot
+//   hold up everything behind it; the reports are kept there for a look
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultQueueMax = 10000
+	// MaxBatch is the most reports sent at once, well under the server's
+	// batch limit of 1000
+	MaxBatch = 500
+)
+
+type reportQueue struct {
+	path  string
+	max   int
+	items []Payload
+}
+
+// openQueue loads the queue left by a previous run; nil means queueing is off
+func openQueue(path string, max int) (*reportQueue, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if max <= 0 {
+		max = defaultQueueMax
+	}
+	q := &reportQueue{path: path, max: max}
+	b, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.items); err != nil {
+		return nil, fmt.Errorf("%s: %w", q.path, err)
+	}
+	if len(q.items) > 0 {
+		log.Printf("%d queued reports from an earlier run", len(q.items))
+	}
+	return q, nil
+}
+
+func (q *reportQueue) empty() bool { return q.len() == 0 }
+
+func (q *reportQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.items)
+}
+
+// addAll queues batch, dropping the oldest reports beyond the limit. The
+// file is written once for the whole batch.
+func (q *reportQueue) addAll(batch []Payload) error {
+	for _, p := range batch {
+		p.Token = ""
+		q.items = append(q.items, p)
+	}
+	if over := len(q.items) - q.max; over > 0 {
+		log.Printf("queue full, dropping the %d oldest reports", over)
+		q.items = q.items[over:]
+	}
+	return q.save()
+}
+
+// save writes the queue through a temporary file so a crash never leaves
+// half of it
+func (q *reportQueue) save() error {
+	b, err := json.Marshal(q.items)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".queue-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
+
+func (q *reportQueue) rejectedPath() string { return q.path + ".rejected" }
+
+// reject appends reports the server will never take to the rejected file
+func (q *reportQueue) reject(batch []Payload) error {
+	f, err := os.OpenFile(q.rejectedPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, p := range batch {
+		p.Token = ""
+		if err := enc.Encode(p); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// flush sends the queue in batches, removing each batch the server takes
+// or refuses for good
+func (q *reportQueue) flush(out Transport, token string) error {
+	for len(q.items) > 0 {
+		n := len(q.items)
+		if n > MaxBatch {
+			n = MaxBatch
+		}
+		batch := make([]Payload, n)
+		copy(batch, q.items[:n])
+		for i := range batch {
+			batch[i].Token = token
+		}
+		err := out.Send(batch)
+		done := n
+		if err != nil {
+			sent := sentOf(err)
+			if worthQueueing(err) {
+				if sent > 0 {
+					q.items = q.items[sent:]
+					if serr := q.save(); serr != nil {
+						log.Println("queue err:", serr)
+					}
+				}
+				return err
+			}
+			if onlyOneFailed(err) {
+				done = sent + 1
+			}
+			log.Printf("server refused %d queued reports, moving them to %s: %v", done-sent, q.rejectedPath(), err)
+			if rerr := q.reject(batch[sent:done]); rerr != nil {
+				return rerr
+			}
+		}
+		q.items = q.items[done:]
+		if err := q.save(); err != nil {
+			return err
+		}
+		if err == nil {
+			log.Printf("sent %d queued reports, %d left", n, len(q.items))
+		}
+	}
+	return nil
+}
+```
+### reporter/retry.go
+```go
+package reporter
+
+// retry.go
+// - When a location lookup or a report fails, the reporter waits the
+//   report interval, then twice that, and so on up to RetryMax (default
+//   5m), with jitter so a fleet knocked off by the same outage does not
+//   come back in step. Each wait is logged. A successful report resets it
+// - A ServerError with RetryAfter is never retried sooner than asked
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const defaultRetryMax = 5 * time.Minute
+
+// backoff spaces out retries after consecutive failures
+type backoff struct {
+	base, max time.Duration
+	failures  int
+}
+
+// newBackoff starts at base and doubles up to max
+func newBackoff(base, max time.Duration) *backoff {
+	if max == 0 {
+		max = defaultRetryMax
+	}
+	if max < base {
+		max = base
+	}
+	return &backoff{base: base, max: max}
+}
+
+// next returns the wait after one more failure: between half and all of
+// base doubled per failure, capped at max
+func (b *backoff) next() time.Duration {
+	b.failures++
+	d := b.max
+	if shift := b.failures - 1; shift < 32 && b.base<<shift < b.max {
+		d = b.base << shift
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait logs err with the retry schedule and sleeps
+func (b *backoff) wait(ctx context.Context, what string, err error) {
+	d := b.next()
+	var se ServerError
+	if errors.As(err, &se) && se.RetryAfter > d {
+		d = se.RetryAfter
+	}
+	log.Printf("%s: %v; retry %d in %s", what, err, b.failures, d.Round(time.Second))
+	sleep(ctx, d)
+}
+
+// reset forgets past failures
+func (b *backoff) reset() {
+	if b.failures > 0 {
+		log.Printf("recovered after %d failed attempts", b.failures)
+	}
+	b.failures = 0
+}
+```
+### reporter/seq.go
+```go
+package reporter
+
+// seq.go
+// - Each report carries a sequence number one above the last, so the
+//   server can order points whatever the box's clock says and spot gaps
+// - With SeqFile set the numbers keep rising across restarts: the file
+//   holds a ceiling reserved seqBlock numbers ahead, so it is written once
+//   per block rather than per report, and a restart carries on above it
+// - Without it numbering starts again at 1 each run
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const seqBlock = 1000
+
+type sequence struct {
+	path           string
+	last, reserved uint64
+}
+
+// openSequence picks up where the numbering in path left off, if anywhere
+func openSequence(path string) (*sequence, error) {
+	q := &sequence{path: path}
+	if path == "" {
+		return q, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.last, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	q.reserved = q.last
+	return q, nil
+}
+
+// next returns the next number, reserving another block first when the
+// last one is used up. The number is good even if saving fails.
+func (q *sequence) next() (uint64, error) {
+	q.last++
+	if q.path == "" || q.last <= q.reserved {
+		return q.last, nil
+	}
+	q.reserved = q.last + seqBlock - 1
+	return q.last, q.save()
+}
+
+// save writes the ceiling through a temporary file, like the queue
+func (q *sequence) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".seq-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatUint(q.reserved, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
+```
+### reporter/telemetry.go
+```go
+package reporter
+
+// telemetry.go
+// - Each report carries the hostname, uptime, battery level and the
+//   interface of the default route, so an operator can tell which box a
+//   point came from and how it is doing
+// - Battery is the mean capacity of /sys/class/power_supply batteries and
+//   is left out on mains-only machines
+// - The interface's kind (wifi, cellular, ethernet) goes in network; with
+//   no default route network is "offline"
+// - Only sent with Config.Telemetry set
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	powerSupplyDir = "/sys/class/power_supply"
+	netClassDir    = "/sys/class/net"
+)
+
+// telemetry is what a report says about the machine itself
+type telemetry struct {
+	Hostname  string
+	Uptime    *int64
+	Battery   *int
+	Network   string
+	Interface string
+}
+
+// readTelemetry gathers what it can; anything unreadable is left out
+func readTelemetry() telemetry {
+	var t telemetry
+	t.Hostname, _ = os.Hostname()
+	if b, err := os.ReadFile("/proc/uptime"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 0 {
+			if secs, err := strconv.ParseFloat(f[0], 64); err == nil {
+				n := int64(secs)
+				t.Uptime = &n
+			}
+		}
+	}
+	t.Battery = batteryLevel()
+	t.Interface = defaultRouteInterface()
+	t.Network = interfaceKind(t.Interface)
+	return t
+}
+
+func batteryLevel() *int {
+	dirs, _ := filepath.Glob(filepath.Join(powerSupplyDir, "*"))
+	sum, n := 0, 0
+	for _, dir := range dirs {
+		if readSys(filepath.Join(dir, "type")) != "Battery" {
+			continue
+		}
+		pct, err := strconv.Atoi(readSys(filepath.Join(dir, "capacity")))
+		if err != nil || pct < 0 || pct > 100 {
+			continue
+		}
+		sum, n = sum+pct, n+1
+	}
+	if n == 0 {
+		return nil
+	}
+	level := sum / n
+	return &level
+}
+
+// defaultRouteInterface is the interface of the lowest-metric IPv4 default
+// route in /proc/net/route, or "" without one
+func defaultRouteInterface() string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	best, bestMetric := "", -1
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[0], metric
+		}
+	}
+	return best
+}
+
+// interfaceKind maps an interface onto the server's network types
+func interfaceKind(iface string) string {
+	if iface == "" {
+		return "offline"
+	}
+	dir := filepath.Join(netClassDir, iface)
+	if _, err := os.Stat(filepath.Join(dir, "wireless")); err == nil {
+		return "wifi"
+	}
+	if strings.Contains(readSys(filepath.Join(dir, "uevent")), "DEVTYPE=wwan") || strings.HasPrefix(iface, "wwan") {
+		return "cellular"
+	}
+	if readSys(filepath.Join(dir, "type")) == "1" { // ARPHRD_ETHER
+		return "ethernet"
+	}
+	return "other"
+}
+
+func readSys(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+```
+### reporter/watchdog.go
+```go
+package reporter
+
+// watchdog.go
+// - The watchdog notices a loop that has gone Watchdog report intervals
+//   without delivering a report or taking a fix it had no need to send,
+//   e.g. on a half-dead connection
+// - It then drops pooled connections, so the next request dials and looks
+//   up the server afresh, and has the transport Reset if it can
+// - If the loop is still stuck as long again after that, Stuck is called;
+//   without it the watchdog just resets again
+// - Each recovery is logged, and the count goes out as "recoveries"
+//   telemetry so the operator can spot a flaky box
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type watchdog struct {
+	intervals int
+	stuck     func()
+	client    *http.Client
+
+	last     atomic.Int64 // unix nanoseconds of the last progress
+	interval atomic.Int64
+	pending  atomic.Bool // a reset the loop has yet to act on
+	trips    atomic.Int64
+}
+
+func newWatchdog(intervals int, stuck func(), client *http.Client, interval time.Duration) *watchdog {
+	w := &watchdog{intervals: intervals, stuck: stuck, client: client}
+	w.setInterval(interval)
+	w.ok()
+	return w
+}
+
+// ok records that the loop made progress
+func (w *watchdog) ok() { w.last.Store(time.Now().UnixNano()) }
+
+// setInterval follows the loop's current report interval
+func (w *watchdog) setInterval(d time.Duration) { w.interval.Store(int64(d)) }
+
+// takeReset reports whether the loop should reset its transport
+func (w *watchdog) takeReset() bool { return w.pending.Swap(false) }
+
+func (w *watchdog) recoveries() int { return int(w.trips.Load()) }
+
+// run checks on the loop once an interval until ctx is done
+func (w *watchdog) run(ctx context.Context) {
+	if w.intervals <= 0 {
+		return
+	}
+	var tripped int64
+	for ctx.Err() == nil {
+		d := time.Duration(w.interval.Load())
+		sleep(ctx, d)
+		limit := time.Duration(w.intervals) * d
+		last := w.last.Load()
+		stalled := time.Since(time.Unix(0, last))
+		if stalled < limit || time.Since(time.Unix(0, tripped)) < limit {
+			continue
+		}
+		if tripped > last && w.stuck != nil {
+			log.Printf("watchdog: no progress in %s, even after a reset", stalled.Round(time.Second))
+			w.stuck()
+		}
+		n := w.trips.Add(1)
+		log.Printf("watchdog: no progress in %s; dropping connections (recovery %d)", stalled.Round(time.Second), n)
+		w.client.CloseIdleConnections()
+		w.pending.Store(true)
+		tripped = time.Now().UnixNano()
+	}
+}
+```
+### client.go
+```go
+package main
+
+// client.go
+// - Periodically finds its position: IP-based geolocation (see
+//   client_geoip.go) by default, or the sources listed in SOURCE (geoip,
+//   gpsd, nmea, wifi, cell), tried in order
+// - POSTs JSON to /report on the server every REPORT_INTERVAL (or
+//   --interval; default 10s, whole seconds from 1s to 24h)
+// - The loop itself is the reporter package; this binary reads its
+//   settings from the environment and supplies the sources and transports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"locationshare/reporter"
+)
+
+// GeoIP is ipinfo.io's answer
+type GeoIP struct {
+	IP      string `json:"ip"`
+	City    string `json:"city"`
+	Region  string `json:"region"`
+	Country string `json:"country"`
+	Loc     string `json:"loc"`
+}
+
+// geoIPAccuracy is what we claim for IP geolocation, which is city-level at
+// best, when the provider gives no figure of its own
+const geoIPAccuracy = 5000
+
+// locationSources builds the sources named in SOURCE, e.g. "gpsd,geoip"
+func locationSources(names string) ([]reporter.Source, error) {
+	if names == "" {
+		names = "geoip"
+	}
+	var sources []reporter.Source
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		// gpsd and nmea keep a reader running, so reuse what was started
+		if src, ok := startedSources[name]; ok {
+			sources = append(sources, src)
+			continue
+		}
+		switch name {
+		case "geoip":
+			if torSOCKS != "" {
+				return nil, errors.New("geoip over Tor would locate the Tor exit relay, not this machine")
+			}
+			src, err := newGeoIPSource(os.Getenv("GEOIP_PROVIDERS"))
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		case "gpsd":
+			sources = append(sources, newGPSDSource(os.Getenv("GPSD_ADDR")))
+		case "cell":
+			src, err := newCellSource()
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		case "wifi":
+			src, err := newWiFiSource()
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		case "nmea":
+			src, err := newNMEASource(os.Getenv("NMEA_DEVICE"))
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		default:
+			return nil, fmt.Errorf("unknown source %q", name)
+		}
+		startedSources[name] = sources[len(sources)-1]
+	}
+	return sources, nil
+}
+
+// startedSources are the sources built so far, by name
+var startedSources = map[string]reporter.Source{}
+
+func main() {
+	configFlag := flag.String("config", "", "YAML config file (default $CONFIG_FILE, or ./client.yaml if present)")
+	flag.Var(envFlag("SERVER_URL"), "server", "server URL (SERVER_URL)")
+	flag.Var(envFlag("DEVICE_PHONE"), "device", "device ID to report as (DEVICE_PHONE)")
+	flag.Var(envFlag("SOURCE"), "source", "location sources in order, e.g. gpsd,geoip (SOURCE)")
+	flag.Var(envFlag("REPORT_INTERVAL"), "interval", "time between reports, e.g. 30s or 5m (REPORT_INTERVAL)")
+	flag.Var(envFlag("PROXY_URL"), "proxy", "proxy for all traffic, e.g. socks5://127.0.0.1:1080 (PROXY_URL)")
+	torFlag := flag.Bool("tor", false, "send all traffic through Tor at TOR_SOCKS (TOR=true)")
+	flag.Parse()
+	if *torFlag {
+		os.Setenv("TOR", "true")
+	}
+	configPath, err := loadClientConfig(*configFlag)
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	interval, err := reporter.ParseInterval(os.Getenv("REPORT_INTERVAL"))
+	if err != nil {
+		log.Fatal("interval: ", err)
+	}
+	if err := setProxy(os.Getenv("PROXY_URL")); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupTor(os.Getenv("TOR") == "true"); err != nil {
+		log.Fatal("tor: ", err)
+	}
+	if flag.NArg() > 0 {
+		runCommand(flag.Args(), configPath)
+		return
+	}
+
+	server := os.Getenv("SERVER_URL") // e.g. http://127.0.0.1:5000
+	if server == "" {
+		server = "http://127.0.0.1:5000"
+	}
+	phone := os.Getenv("DEVICE_PHONE")
+	if phone == "" {
+		phone = "kali-device"
+	}
+	if err := checkOnion(server, os.Getenv("GRPC_SERVER"), os.Getenv("MQTT_BROKER")); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupSecrets(); err != nil {
+		log.Fatal("secrets: ", err)
+	}
+	token, err := secret("DEVICE_TOKEN")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token == "" {
+		log.Fatal("DEVICE_TOKEN (or DEVICE_TOKEN_FILE, or Vault) is required")
+	}
+	client, err := serverClient()
+	if err != nil {
+		log.Fatal("server transport: ", err)
+	}
+	e2eKey, err := loadE2EKey()
+	if err != nil {
+		log.Fatal("E2E_KEY: ", err)
+	}
+	sources, err := locationSources(os.Getenv("SOURCE"))
+	if err != nil {
+		log.Fatal("SOURCE: ", err)
+	}
+	cfg := reporter.Config{Server: server, Client: client, Phone: phone, Token: token,
+		Sources: sources, NewSources: locationSources, Interval: interval, E2EKey: e2eKey}
+	if torSOCKS != "" {
+		// the failure may be the circuit's, so the next try gets another
+		cfg.SendRetryMin, cfg.SendFailed = torMinRetry, func(error) { newCircuit() }
+	}
+	if err := envConfig(&cfg); err != nil {
+		log.Fatal(err)
+	}
+	switch broker, addr := os.Getenv("MQTT_BROKER"), os.Getenv("GRPC_SERVER"); {
+	case broker != "" && addr != "":
+		log.Fatal("set MQTT_BROKER or GRPC_SERVER, not both")
+	case (broker != "" || addr != "") && cfg.Sign:
+		log.Fatal("SIGN_REPORTS only applies to reports sent over HTTP")
+	case broker != "":
+		if cfg.Transport, err = newMQTTReporter(broker, phone); err != nil {
+			log.Fatal("mqtt: ", err)
+		}
+	case addr != "":
+		if cfg.Transport, err = newGRPCReporter(addr); err != nil {
+			log.Fatal("grpc: ", err)
+		}
+	}
+	r, err := reporter.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		if err := serveMetrics(addr, r); err != nil {
+			log.Fatal("metrics: ", err)
+		}
+	}
+
+	// Setting PAIRING_CODE is the operator's explicit consent to be tracked
+	if code := os.Getenv("PAIRING_CODE"); code != "" {
+		if err := pair(client, server, phone, token, code); err != nil {
+			log.Fatal("pairing: ", err)
+		}
+		log.Println("paired", phone, "- this machine's location will now be reported")
+	}
+
+	// SIGINT/SIGTERM stop the loop, so a batch still collecting is saved
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := r.Run(ctx); !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// pair completes the server's consent handshake with a code issued by an admin
+func pair(client *http.Client, server, phone, token, code string) error {
+	b, _ := json.Marshal(map[string]interface{}{"phone": phone, "token": token, "code": code, "consent": true})
+	resp, err := client.Post(server+"/v1/pair", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("server said %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+```
+
+---
+
+### client_cell.go
+```go
+package main
+
+// client_cell.go
+// - SOURCE=cell asks a mobile broadband modem which cell it is registered
+//   on and looks the cell up in OpenCellID (OPENCELLID_KEY), for LTE
+//   devices without GPS or WiFi. Expect hundreds of metres to kilometres
+// - CELL_MODEM is the modem's AT command port (e.g. /dev/ttyUSB2), or
+//   qmi:/dev/cdc-wdm0 to ask through qmicli instead. Over AT the client
+//   turns on extended registration reports (AT+CREG=2, AT+CEREG=2), which
+//   other users of the port will also see
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"locationshare/reporter"
+)
+
+const (
+	atTimeout = 5 * time.Second
+	// cellAccuracy is claimed when OpenCellID gives no range for the cell
+	cellAccuracy = 2000
+)
+
+// cellInfo identifies the serving cell
+type cellInfo struct {
+	Radio    string // GSM, UMTS or LTE
+	MCC, MNC int
+	LAC      int64 // the tracking area code on LTE
+	CellID   int64
+}
+
+type cellSource struct {
+	modem string
+	key   string
+}
+
+func newCellSource() (*cellSource, error) {
+	s := &cellSource{modem: os.Getenv("CELL_MODEM"), key: os.Getenv("OPENCELLID_KEY")}
+	if s.modem == "" || s.key == "" {
+		return nil, errors.New("SOURCE=cell needs CELL_MODEM and OPENCELLID_KEY")
+	}
+	return s, nil
+}
+
+func (s *cellSource) Name() string { return "cell" }
+
+func (s *cellSource) Locate() (reporter.Fix, error) {
+	var c cellInfo
+	var err error
+	if dev, ok := strings.CutPrefix(s.modem, "qmi:"); ok {
+		c, err = qmiCell(dev)
+	} else {
+		c, err = atCell(s.modem)
+	}
+	if err != nil {
+		return reporter.Fix{}, err
+	}
+	return openCellID(s.key, c)
+}
+
+// atCell reads the operator and serving cell over an AT command port
+func atCell(path string) (cellInfo, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return cellInfo{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	at := func(cmd string) ([]string, error) { return atCommand(f, r, cmd) }
+
+	// numeric operator: +COPS: 0,2,"26201",7
+	if _, err := at("AT+COPS=3,2"); err != nil {
+		return cellInfo{}, err
+	}
+	lines, err := at("AT+COPS?")
+	if err != nil {
+		return cellInfo{}, err
+	}
+	cops := atFields(lines, "+COPS:")
+	if len(cops) < 4 || len(cops[2]) < 5 {
+		return cellInfo{}, errors.New("modem is not on a network")
+	}
+	var c cellInfo
+	c.MCC, _ = strconv.Atoi(cops[2][:3])
+	c.MNC, _ = strconv.Atoi(cops[2][3:])
+	act, _ := strconv.Atoi(cops[3])
+	c.Radio = map[int]string{0: "GSM", 1: "GSM", 3: "GSM", 7: "LTE"}[act]
+	if c.Radio == "" {
+		c.Radio = "UMTS"
+	}
+
+	// serving cell: +CREG: 2,1,"1A2B","01A2B3C4",7, or +CEREG on LTE
+	reg := "CREG"
+	if c.Radio == "LTE" {
+		reg = "CEREG"
+	}
+	if _, err := at("AT+" + reg + "=2"); err != nil {
+		return cellInfo{}, err
+	}
+	if lines, err = at("AT+" + reg + "?"); err != nil {
+		return cellInfo{}, err
+	}
+	fields := atFields(lines, "+"+reg+":")
+	if len(fields) < 4 || (fields[1] != "1" && fields[1] != "5") {
+		return cellInfo{}, errors.New("modem is not registered")
+	}
+	if c.LAC, err = strconv.ParseInt(fields[2], 16, 64); err != nil {
+		return cellInfo{}, fmt.Errorf("bad area code %q", fields[2])
+	}
+	if c.CellID, err = strconv.ParseInt(fields[3], 16, 64); err != nil {
+		return cellInfo{}, fmt.Errorf("bad cell id %q", fields[3])
+	}
+	return c, nil
+}
+
+// atCommand sends cmd and returns the response lines before OK
+func atCommand(f *os.File, r *bufio.Reader, cmd string) ([]string, error) {
+	f.SetDeadline(time.Now().Add(atTimeout))
+	if _, err := f.WriteString(cmd + "\r"); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cmd, err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "OK":
+			return lines, nil
+		case strings.Contains(line, "ERROR"):
+			return nil, fmt.Errorf("%s: %s", cmd, line)
+		case line != "" && line != cmd:
+			lines = append(lines, line)
+		}
+	}
+}
+
+// atFields splits the response line starting with prefix into unquoted fields
+func atFields(lines []string, prefix string) []string {
+	for _, l := range lines {
+		if rest, ok := strings.CutPrefix(l, prefix); ok {
+			fields := strings.Split(rest, ",")
+			for i := range fields {
+				fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+			}
+			return fields
+		}
+	}
+	return nil
+}
+
+var qmiField = regexp.MustCompile(`(MCC|MNC|Cell ID|Tracking Area Code|Location Area Code): '(\d+)'`)
+
+// qmiCell asks qmicli for the serving cell of a QMI modem
+func qmiCell(dev string) (cellInfo, error) {
+	out, err := exec.Command("qmicli", "-d", dev, "--device-open-proxy", "--nas-get-system-info").Output()
+	if err != nil {
+		return cellInfo{}, fmt.Errorf("qmicli: %w", err)
+	}
+	// the report has one section per radio; the last one with a cell wins,
+	// LTE coming after GSM and WCDMA
+	var c, cur cellInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		switch t := strings.TrimSpace(line); {
+		case strings.HasPrefix(t, "GSM service:"):
+			cur = cellInfo{Radio: "GSM"}
+		case strings.HasPrefix(t, "WCDMA service:"):
+			cur = cellInfo{Radio: "UMTS"}
+		case strings.HasPrefix(t, "LTE service:"):
+			cur = cellInfo{Radio: "LTE"}
+		}
+		m := qmiField.FindStringSubmatch(line)
+		if m == nil || cur.Radio == "" {
+			continue
+		}
+		n, _ := strconv.ParseInt(m[2], 10, 64)
+		switch m[1] {
+		case "MCC":
+			cur.MCC = int(n)
+		case "MNC":
+			cur.MNC = int(n)
+		case "Tracking Area Code", "Location Area Code":
+			cur.LAC = n
+		case "Cell ID":
+			cur.CellID = n
+		}
+		if cur.MCC != 0 && cur.CellID != 0 && cur.LAC != 0 {
+			c = cur
+		}
+	}
+	if c.CellID == 0 {
+		return cellInfo{}, errors.New("qmicli reported no serving cell")
+	}
+	return c, nil
+}
+
+// openCellID looks a cell up in the OpenCellID database
+func openCellID(key string, c cellInfo) (reporter.Fix, error) {
+	q := url.Values{
+		"key":    {key},
+		"mcc":    {strconv.Itoa(c.MCC)},
+		"mnc":    {strconv.Itoa(c.MNC)},
+		"lac":    {strconv.FormatInt(c.LAC, 10)},
+		"cellid": {strconv.FormatInt(c.CellID, 10)},
+		"radio":  {c.Radio},
+		"format": {"json"},
+	}
+	resp, err := geoIPClient.Get("https://opencellid.org/cell/get?" + q.Encode())
+	if err != nil {
+		return reporter.Fix{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return reporter.Fix{}, rateLimited{}
+	}
+	var g struct {
+		Lat   float64 `json:"lat"`
+		Lon   float64 `json:"lon"`
+		Range float64 `json:"range"`
+		Error string  `json:"error"`
+	}
+	if err := json.Unmarshal(body, &g); err != nil {
+		return reporter.Fix{}, fmt.Errorf("opencellid said %s", resp.Status)
+	}
+	if g.Error != "" || resp.StatusCode != http.StatusOK {
+		return reporter.Fix{}, fmt.Errorf("opencellid: %s (cell %d-%d-%d-%d)", g.Error, c.MCC, c.MNC, c.LAC, c.CellID)
+	}
+	if g.Range == 0 {
+		g.Range = cellAccuracy
+	}
+	return reporter.Fix{Lat: g.Lat, Lon: g.Lon, Accuracy: g.Range}, nil
+}
+```
+
+---
+
+
+---
+
+
+---
+
+### client_config.go
+```go
+package main
+
+// client_config.go
+// - The common client settings can live in a YAML file (--config,
+//   CONFIG_FILE, or client.yaml in the working directory when present);
+//   see client.example.yaml. Anything else goes under "settings" by its
+//   environment variable name
+// - Values are layered, highest first: command-line flags, environment
+//   variables, the file, then each setting's built-in default. The file
+//   only fills in variables the environment leaves unset, and flags set
+//   theirs, so everything downstream reads the environment as before
+// - install records the file's path rather than its contents, so the
+//   service picks up later edits on restart
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultClientConfig = "client.yaml"
+
+// fileConfig is the layout of the YAML config file
+type fileConfig struct {
+	Server    string `yaml:"server"`
+	Device    string `yaml:"device"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Source    string `yaml:"source"`
+	Interval  string `yaml:"interval"`
+	Proxy     string `yaml:"proxy"`
+	Tor       bool   `yaml:"tor"`
+	TLS       struct {
+		CertFile string   `yaml:"cert_file"`
+		KeyFile  string   `yaml:"key_file"`
+		CAFile   string   `yaml:"ca_file"`
+		PinSPKI  []string `yaml:"pin_spki"`
+		PinCert  []string `yaml:"pin_cert"`
+	} `yaml:"tls"`
+	Settings map[string]string `yaml:"settings"`
+}
+
+// values flattens the file into environment variable names
+func (c *fileConfig) values() (map[string]string, error) {
+	v := map[string]string{
+		"SERVER_URL":        c.Server,
+		"DEVICE_PHONE":      c.Device,
+		"DEVICE_TOKEN":      c.Token,
+		"DEVICE_TOKEN_FILE": c.TokenFile,
+		"SOURCE":            c.Source,
+		"REPORT_INTERVAL":   c.Interval,
+		"PROXY_URL":         c.Proxy,
+		"CLIENT_CERT_FILE":  c.TLS.CertFile,
+		"CLIENT_KEY_FILE":   c.TLS.KeyFile,
+		"SERVER_CA_FILE":    c.TLS.CAFile,
+		"SERVER_PIN_SPKI":   strings.Join(c.TLS.PinSPKI, ","),
+		"SERVER_PIN_CERT":   strings.Join(c.TLS.PinCert, ","),
+	}
+	if c.Tor {
+		v["TOR"] = "true"
+	}
+	for name, val := range c.Settings {
+		name = strings.ToUpper(name)
+		if v[name] != "" {
+			return nil, fmt.Errorf("settings.%s is also set by its own config key", name)
+		}
+		v[name] = val
+	}
+	for name, val := range v {
+		if val == "" {
+			delete(v, name)
+		}
+	}
+	return v, nil
+}
+
+// fileSettings are the variables taken from the config file
+var fileSettings = map[string]bool{}
+
+// envFlag is a command-line flag that sets an environment variable
+type envFlag string
+
+func (f envFlag) String() string { return "" }
+
+func (f envFlag) Set(v string) error { return os.Setenv(string(f), v) }
+
+// loadClientConfig reads the config file, if any, into the unset
+// environment variables, returning its absolute path
+func loadClientConfig(path string) (string, error) {
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultClientConfig); err != nil {
+			return "", nil
+		}
+		path = defaultClientConfig
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var c fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	values, err := c.values()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	for name, v := range values {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err := os.Setenv(name, v); err != nil {
+			return "", err
+		}
+		fileSettings[name] = true
+	}
+	return filepath.Abs(path)
+}
+```
+### client_env.go
+```go
+package main
+
+// client_env.go
+// - Reads the reporting settings from the environment into a
+//   reporter.Config; the README describes each variable
+// - Defaults differ from the library's zero values where the client has
+//   always done more: queueing to nuloc-queue.json, carrying report
+//   numbers over between runs in nuloc-seq, telemetry, remote config
+//   every 5m, skipping repeats within 1m and a watchdog at 10 intervals
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"locationshare/reporter"
+)
+
+const (
+	defaultQueueFile  = "nuloc-queue.json"
+	defaultSeqFile    = "nuloc-seq"
+	defaultConfigPoll = 5 * time.Minute
+	defaultDedupe     = 1.0 // metres
+	defaultWatchdog   = 10
+)
+
+// envConfig fills in cfg from the environment
+func envConfig(cfg *reporter.Config) error {
+	var err error
+	for _, s := range []struct {
+		name string
+		to   *time.Duration
+	}{{"INTERVAL_MIN", &cfg.IntervalMin}, {"INTERVAL_MAX", &cfg.IntervalMax}} {
+		if v := os.Getenv(s.name); v != "" {
+			if *s.to, err = reporter.ParseInterval(v); err != nil {
+				return fmt.Errorf("%s: %v", s.name, err)
+			}
+		}
+	}
+
+	if v := os.Getenv("MIN_DISTANCE"); v != "" {
+		if cfg.MinDistance, err = parseMetres(v); err != nil {
+			return fmt.Errorf("MIN_DISTANCE: want metres, got %q", v)
+		}
+	}
+	switch v := os.Getenv("DEDUPE_EPSILON"); v {
+	case "":
+		cfg.Dedupe = defaultDedupe
+	case "off":
+		cfg.Dedupe = -1
+	default:
+		if cfg.Dedupe, err = parseMetres(v); err != nil {
+			return fmt.Errorf("DEDUPE_EPSILON: want metres, got %q", v)
+		}
+	}
+	switch v := os.Getenv("HEARTBEAT"); v {
+	case "":
+	case "off":
+		cfg.Heartbeat = -1
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("HEARTBEAT: invalid value %q", v)
+		}
+		cfg.Heartbeat = d
+	}
+
+	if v := os.Getenv("RETRY_MAX"); v != "" {
+		if cfg.RetryMax, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RETRY_MAX: %w", err)
+		}
+	}
+	if v := os.Getenv("BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > reporter.MaxBatch {
+			return fmt.Errorf("BATCH_SIZE: want 1 to %d, got %q", reporter.MaxBatch, v)
+		}
+		cfg.BatchSize = n
+	}
+	if v := os.Getenv("BATCH_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("BATCH_WAIT: invalid value %q", v)
+		}
+		cfg.BatchWait = d
+	}
+	switch v := os.Getenv("QUEUE_FILE"); v {
+	case "":
+		cfg.QueueFile = defaultQueueFile
+	case "off":
+	default:
+		cfg.QueueFile = v
+	}
+	if v := os.Getenv("QUEUE_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("QUEUE_MAX: invalid value %q", v)
+		}
+		cfg.QueueMax = n
+	}
+	switch v := os.Getenv("SEQ_FILE"); v {
+	case "":
+		cfg.SeqFile = defaultSeqFile
+	case "off":
+	default:
+		cfg.SeqFile = v
+	}
+
+	switch v := os.Getenv("SIGN_REPORTS"); v {
+	case "", "false":
+	case "true":
+		cfg.Sign = true
+	default:
+		return fmt.Errorf("SIGN_REPORTS: invalid value %q", v)
+	}
+	switch v := os.Getenv("TELEMETRY"); v {
+	case "", "on":
+		cfg.Telemetry = true
+	case "off":
+	default:
+		return fmt.Errorf("TELEMETRY: invalid value %q", v)
+	}
+	switch v := os.Getenv("CONFIG_POLL"); v {
+	case "":
+		cfg.ConfigPoll = defaultConfigPoll
+	case "off":
+	default:
+		if cfg.ConfigPoll, err = reporter.ParseInterval(v); err != nil {
+			return fmt.Errorf("CONFIG_POLL: %v", err)
+		}
+	}
+
+	switch v := os.Getenv("WATCHDOG"); v {
+	case "":
+		cfg.Watchdog = defaultWatchdog
+	case "off":
+	default:
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			return fmt.Errorf("WATCHDOG: want 2 or more intervals, got %q", v)
+		}
+		cfg.Watchdog = n
+	}
+	switch v := os.Getenv("WATCHDOG_RESTART"); v {
+	case "", "false":
+	case "true":
+		// the service manager starts us again
+		cfg.Stuck = func() {
+			log.Println("watchdog: exiting to be restarted")
+			os.Exit(1)
+		}
+	default:
+		return fmt.Errorf("WATCHDOG_RESTART: invalid value %q", v)
+	}
+	return nil
+}
+
+func parseMetres(v string) (float64, error) {
+	d, err := strconv.ParseFloat(v, 64)
+	if err != nil || d < 0 || math.IsInf(d, 0) || math.IsNaN(d) {
+		return 0, fmt.Errorf("invalid distance %q", v)
+	}
+	return d, nil
+}
+```
+### client_geoip.go
+```go
+package main
+
+// client_geoip.go
+// - IP geolocation from the providers in GEOIP_PROVIDERS, tried in order
+//   (default ipinfo,ip-api,ipapi): ipinfo.io (IPINFO_TOKEN optional),
+//   ip-api.com, ipapi.co, and maxmind, a local GeoLite2/GeoIP2 City
+//   database at MAXMIND_DB
+// - A provider that fails is skipped for that round; one that rate-limits
+//   us is left alone until it says we may come back, or a minute
+// - The MaxMind lookup needs the public address, which it asks api.ipify.org
+//   for unless MAXMIND_IP pins it
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+
+	"locationshare/reporter"
+)
+
+const defaultGeoIPProviders = "ipinfo,ip-api,ipapi"
+
+// geoIPCooldown is how long a rate-limited provider is skipped when it
+// does not say
+const geoIPCooldown = time.Minute
+
+var geoIPClient = &http.Client{Timeout: 10 * time.Second}
+
+// geoIPResult is what a provider found; Accuracy is 0 when it gives none
+type geoIPResult struct {
+	IP       string
+	Lat, Lon float64
+	Accuracy float64
+}
+
+// geoIPProvider looks up this machine's public address
+type geoIPProvider interface {
+	Name() string
+	Lookup() (geoIPResult, error)
+}
+
+// rateLimited is returned by a provider asking us to back off
+type rateLimited struct{ retry time.Duration }
+
+func (e rateLimited) Error() string { return "rate limited" }
+
+// geoIPSource tries its providers in order
+type geoIPSource struct {
+	providers []geoIPProvider
+
+	mu    sync.Mutex
+	until map[string]time.Time // rate-limited providers
+}
+
+// newGeoIPSource builds the providers named in names
+func newGeoIPSource(names string) (*geoIPSource, error) {
+	if names == "" {
+		names = defaultGeoIPProviders
+	}
+	s := &geoIPSource{until: map[string]time.Time{}}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "ipinfo":
+			s.providers = append(s.providers, ipinfoProvider{token: os.Getenv("IPINFO_TOKEN")})
+		case "ip-api":
+			s.providers = append(s.providers, ipAPIProvider{})
+		case "ipapi":
+			s.providers = append(s.providers, ipapiCoProvider{})
+		case "maxmind":
+			p, err := newMaxMindProvider(os.Getenv("MAXMIND_DB"), os.Getenv("MAXMIND_IP"))
+			if err != nil {
+				return nil, fmt.Errorf("maxmind: %w", err)
+			}
+			s.providers = append(s.providers, p)
+		default:
+			return nil, fmt.Errorf("unknown geoip provider %q", name)
+		}
+	}
+	return s, nil
+}
+
+func (s *geoIPSource) Name() string { return "geoip" }
+
+func (s *geoIPSource) Locate() (reporter.Fix, error) {
+	var errs []error
+	for _, p := range s.providers {
+		s.mu.Lock()
+		wait := time.Until(s.until[p.Name()])
+		s.mu.Unlock()
+		if wait > 0 {
+			errs = append(errs, fmt.Errorf("%s: rate limited for %s", p.Name(), wait.Round(time.Second)))
+			continue
+		}
+		r, err := p.Lookup()
+		var rl rateLimited
+		if errors.As(err, &rl) {
+			if rl.retry <= 0 {
+				rl.retry = geoIPCooldown
+			}
+			s.mu.Lock()
+			s.until[p.Name()] = time.Now().Add(rl.retry)
+			s.mu.Unlock()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		if r.Accuracy == 0 {
+			r.Accuracy = geoIPAccuracy
+		}
+		return reporter.Fix{Lat: r.Lat, Lon: r.Lon, Accuracy: r.Accuracy, IP: r.IP}, nil
+	}
+	return reporter.Fix{}, errors.Join(errs...)
+}
+
+// getGeoIPJSON fetches u into v, turning 429s into rateLimited
+func getGeoIPJSON(u string, v interface{}) error {
+	resp, err := geoIPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return rateLimited{time.Duration(secs) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server said %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(v)
+}
+
+// ipinfoProvider uses ipinfo.io, which answers with "loc": "lat,lon"
+type ipinfoProvider struct{ token string }
+
+func (ipinfoProvider) Name() string { return "ipinfo" }
+
+func (p ipinfoProvider) Lookup() (geoIPResult, error) {
+	u := "https://ipinfo.io/json"
+	if p.token != "" {
+		u += "?token=" + url.QueryEscape(p.token)
+	}
+	var g GeoIP
+	if err := getGeoIPJSON(u, &g); err != nil {
+		return geoIPResult{}, err
+	}
+	r := geoIPResult{IP: g.IP}
+	if _, err := fmt.Sscanf(g.Loc, "%f,%f", &r.Lat, &r.Lon); err != nil {
+		return geoIPResult{}, fmt.Errorf("bad loc %q", g.Loc)
+	}
+	return r, nil
+}
+
+// ipAPIProvider uses ip-api.com, whose free tier is plain HTTP only and
+// reports how many requests are left in X-Rl
+type ipAPIProvider struct{}
+
+func (ipAPIProvider) Name() string { return "ip-api" }
+
+func (ipAPIProvider) Lookup() (geoIPResult, error) {
+	var g struct {
+		Status  string  `json:"status"`
+		Message string  `json:"message"`
+		Query   string  `json:"query"`
+		Lat     float64 `json:"lat"`
+		Lon     float64 `json:"lon"`
+	}
+	if err := getGeoIPJSON("http://ip-api.com/json/?fields=status,message,query,lat,lon", &g); err != nil {
+		return geoIPResult{}, err
+	}
+	if g.Status != "success" {
+		return geoIPResult{}, fmt.Errorf("lookup failed: %s", g.Message)
+	}
+	return geoIPResult{IP: g.Query, Lat: g.Lat, Lon: g.Lon}, nil
+}
+
+// ipapiCoProvider uses ipapi.co, which reports errors in the body
+type ipapiCoProvider struct{}
+
+func (ipapiCoProvider) Name() string { return "ipapi" }
+
+func (ipapiCoProvider) Lookup() (geoIPResult, error) {
+	var g struct {
+		IP        string  `json:"ip"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Error     bool    `json:"error"`
+		Reason    string  `json:"reason"`
+	}
+	if err := getGeoIPJSON("https://ipapi.co/json/", &g); err != nil {
+		return geoIPResult{}, err
+	}
+	if g.Error {
+		if strings.Contains(strings.ToLower(g.Reason), "ratelimited") {
+			return geoIPResult{}, rateLimited{}
+		}
+		return geoIPResult{}, fmt.Errorf("lookup failed: %s", g.Reason)
+	}
+	return geoIPResult{IP: g.IP, Lat: g.Latitude, Lon: g.Longitude}, nil
+}
+
+// maxMindProvider looks the public address up in a local City database
+type maxMindProvider struct {
+	db *geoip2.Reader
+	ip string // fixed public address, or "" to ask api.ipify.org
+}
+
+func newMaxMindProvider(path, ip string) (*maxMindProvider, error) {
+	if path == "" {
+		return nil, errors.New("MAXMIND_DB is required")
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("MAXMIND_IP: bad address %q", ip)
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &maxMindProvider{db: db, ip: ip}, nil
+}
+
+func (*maxMindProvider) Name() string { return "maxmind" }
+
+func (p *maxMindProvider) Lookup() (geoIPResult, error) {
+	addr := p.ip
+	if addr == "" {
+		var err error
+		if addr, err = publicIP(); err != nil {
+			return geoIPResult{}, fmt.Errorf("public address: %w", err)
+		}
+	}
+	city, err := p.db.City(net.ParseIP(addr))
+	if err != nil {
+		return geoIPResult{}, err
+	}
+	if city.Location.Latitude == 0 && city.Location.Longitude == 0 {
+		return geoIPResult{}, fmt.Errorf("%s is not in the database", addr)
+	}
+	return geoIPResult{
+		IP:       addr,
+		Lat:      city.Location.Latitude,
+		Lon:      city.Location.Longitude,
+		Accuracy: float64(city.Location.AccuracyRadius) * 1000, // km
+	}, nil
+}
+
+// publicIP asks api.ipify.org for this machine's public address
+func publicIP() (string, error) {
+	resp, err := geoIPClient.Get("https://api.ipify.org")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(b))
+	if resp.StatusCode != http.StatusOK || net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("unexpected answer %s", resp.Status)
+	}
+	return ip, nil
+}
+```
+
+---
+
+
+---
+
+### client_gpsd.go
+```go
+package main
+
+// client_gpsd.go
+// - SOURCE=gpsd reads fixes from a local gpsd (GPSD_ADDR, default
+//   127.0.0.1:2947), for machines with a USB GPS receiver
+// - A background reader keeps the newest TPV report with at least a 2D fix
+//   and reconnects when gpsd goes away; a fix older than gpsdMaxAge counts
+//   as none, so SOURCE=gpsd,geoip falls back while the receiver is searching
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"locationshare/reporter"
+)
+
+const (
+	defaultGPSDAddr = "127.0.0.1:2947"
+	gpsdMaxAge      = 30 * time.Second
+	gpsdRetry       = 5 * time.Second
+)
+
+// gpsdTPV is the part of a gpsd TPV (time-position-velocity) report we use
+type gpsdTPV struct {
+	Class  string   `json:"class"`
+	Mode   int      `json:"mode"` // 0-1 no fix, 2 2D, 3 3D
+	Lat    float64  `json:"lat"`
+	Lon    float64  `json:"lon"`
+	Alt    *float64 `json:"alt"`
+	AltMSL *float64 `json:"altMSL"`
+	Speed  *float64 `json:"speed"` // m/s
+	Track  *float64 `json:"track"` // degrees from true north
+	Eph    float64  `json:"eph"`   // horizontal error, metres
+	Epx    float64  `json:"epx"`
+	Epy    float64  `json:"epy"`
+}
+
+// fix converts a TPV report, which must have at least a 2D fix
+func (t gpsdTPV) fix() reporter.Fix {
+	f := reporter.Fix{Lat: t.Lat, Lon: t.Lon, Speed: t.Speed, Bearing: t.Track, Accuracy: t.Eph}
+	if f.Accuracy == 0 {
+		f.Accuracy = math.Max(t.Epx, t.Epy)
+	}
+	if t.Mode >= 3 {
+		f.Altitude = t.AltMSL
+		if f.Altitude == nil {
+			f.Altitude = t.Alt
+		}
+	}
+	if f.Bearing != nil && *f.Bearing >= 360 {
+		f.Bearing = nil
+	}
+	return f
+}
+
+// latestFix holds the newest fix from a receiver read in the background
+type latestFix struct {
+	mu   sync.Mutex
+	last reporter.Fix
+	seen time.Time
+}
+
+func (l *latestFix) set(f reporter.Fix) {
+	l.mu.Lock()
+	l.last, l.seen = f, time.Now()
+	l.mu.Unlock()
+}
+
+// get returns the fix unless it is older than gpsdMaxAge
+func (l *latestFix) get() (reporter.Fix, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen.IsZero() || time.Since(l.seen) > gpsdMaxAge {
+		return reporter.Fix{}, errors.New("no recent gps fix")
+	}
+	return l.last, nil
+}
+
+type gpsdSource struct {
+	addr   string
+	latest latestFix
+}
+
+// newGPSDSource starts watching gpsd at addr
+func newGPSDSource(addr string) *gpsdSource {
+	if addr == "" {
+		addr = defaultGPSDAddr
+	}
+	s := &gpsdSource{addr: addr}
+	go s.run()
+	return s
+}
+
+func (s *gpsdSource) Name() string { return "gpsd" }
+
+func (s *gpsdSource) Locate() (reporter.Fix, error) { return s.latest.get() }
+
+// run keeps a gpsd connection open for the life of the process
+func (s *gpsdSource) run() {
+	for {
+		if err := s.watch(); err != nil {
+			log.Println("gpsd err:", err)
+		}
+		time.Sleep(gpsdRetry)
+	}
+}
+
+// watch asks gpsd for JSON reports and records each usable fix
+func (s *gpsdSource) watch() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(`?WATCH={"enable":true,"json":true};` + "\n")); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		var tpv gpsdTPV
+		if json.Unmarshal(sc.Bytes(), &tpv) != nil || tpv.Class != "TPV" || tpv.Mode < 2 {
+			continue
+		}
+		s.latest.set(tpv.fix())
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("gpsd closed the connection")
+}
+```
+
+---
+
+### client_grpc.go
+```go
+package main
+
+// client_grpc.go
+// - With GRPC_SERVER set (host:port of the server's GRPC_ADDR) reports go
+//   over the ReportStream RPC on one long-lived connection instead of an
+//   HTTP POST each, which is cheaper at high report rates; pairing and
+//   remote config still go to SERVER_URL
+// - TLS follows CLIENT_CERT_FILE/CLIENT_KEY_FILE, SERVER_CA_FILE and the
+//   server pins like HTTP does; GRPC_PLAINTEXT=true is for servers running
+//   gRPC without TLS
+// - A broken stream is reopened on the next report; refusals map onto the
+//   HTTP statuses the retry and queue logic already understand
+// - Each report must be answered within requestTimeout, or the stream is
+//   dropped, so a stalled server cannot hang the loop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"locationshare/nulocpb"
+	"locationshare/reporter"
+)
+
+type grpcReporter struct {
+	conn   *grpc.ClientConn
+	stream nulocpb.Tracker_ReportStreamClient
+	cancel context.CancelFunc
+}
+
+// newGRPCReporter sets up the connection to addr; it is dialled lazily
+func newGRPCReporter(addr string) (*grpcReporter, error) {
+	var creds credentials.TransportCredentials
+	switch v := os.Getenv("GRPC_PLAINTEXT"); v {
+	case "true":
+		creds = insecure.NewCredentials()
+	case "", "false":
+		cfg, err := tlsConfig(os.Getenv("CLIENT_CERT_FILE"), os.Getenv("CLIENT_KEY_FILE"), os.Getenv("SERVER_CA_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		pins, err := loadPins()
+		if err != nil {
+			return nil, err
+		}
+		if pins != nil {
+			cfg.VerifyConnection = pins.verify
+		}
+		creds = credentials.NewTLS(cfg)
+	default:
+		return nil, fmt.Errorf("GRPC_PLAINTEXT: invalid value %q", v)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if proxyURL.Load() != nil {
+		// the proxy resolves the name, which may be a .onion
+		addr = "passthrough:///" + addr
+		opts = append(opts, grpc.WithContextDialer(dialProxy))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcReporter{conn: conn}, nil
+}
+
+func (g *grpcReporter) Send(batch []reporter.Payload) error {
+	for i, p := range batch {
+		if err := g.sendOne(p); err != nil {
+			g.Reset()
+			return reporter.PartialError{Sent: i, Err: grpcError(err)}
+		}
+	}
+	log.Printf("streamed %d report(s)", len(batch))
+	return nil
+}
+
+func (g *grpcReporter) sendOne(p reporter.Payload) error {
+	req, err := reportPB(p)
+	if err != nil {
+		return err
+	}
+	if g.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.cancel = cancel
+		// opening waits for the connection, however long that takes
+		timeout := time.AfterFunc(requestTimeout, cancel)
+		stream, err := nulocpb.NewTrackerClient(g.conn).ReportStream(ctx)
+		timeout.Stop()
+		if err != nil {
+			return err
+		}
+		g.stream = stream
+	}
+	// cancelling the stream unblocks Send and Recv
+	timeout := time.AfterFunc(requestTimeout, g.cancel)
+	defer timeout.Stop()
+	if err := g.stream.Send(req); err != nil {
+		// the real reason comes with Recv
+		if _, rerr := g.stream.Recv(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	_, err = g.stream.Recv()
+	return err
+}
+
+// Reset drops a broken stream so the next report opens a new one
+func (g *grpcReporter) Reset() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.stream, g.cancel = nil, nil
+}
+
+func reportPB(p reporter.Payload) (*nulocpb.ReportRequest, error) {
+	req := &nulocpb.ReportRequest{
+		Phone: p.Phone, Token: p.Token, Lat: p.Lat, Lon: p.Lon, Ciphertext: p.Ciphertext,
+		Accuracy: p.Accuracy, Altitude: p.Altitude, Speed: p.Speed, Bearing: p.Bearing,
+		Network: p.Network, Hostname: p.Hostname, Uptime: p.Uptime, Interface: p.Interface,
+		Recoveries: int32(p.Recoveries), Seq: p.Seq,
+	}
+	if p.Battery != nil {
+		b := int32(*p.Battery)
+		req.Battery = &b
+	}
+	if p.When != "" {
+		when, err := time.Parse(time.RFC3339Nano, p.When)
+		if err != nil {
+			return nil, err
+		}
+		req.When = timestamppb.New(when)
+	}
+	return req, nil
+}
+
+// grpcCodes maps refusals onto the HTTP statuses of POST /report
+var grpcCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusUnprocessableEntity,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+}
+
+// grpcError turns a status from the server into a ServerError; anything
+// else (no connection, stream broken) stays as it is and gets queued
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || errors.Is(err, context.Canceled) {
+		return err
+	}
+	code, ok := grpcCodes[st.Code()]
+	if !ok {
+		return err
+	}
+	return reporter.ServerError{Code: code, Status: st.Code().String(), Body: st.Message()}
+}
+```
+
+---
+
+### client_metrics.go
+```go
+package main
+
+// client_metrics.go
+// - With METRICS_ADDR set (e.g. 127.0.0.1:9465) the client serves
+//   Prometheus metrics at /metrics there: lookups, reports delivered and
+//   failed, queue depth, watchdog recoveries and the time of the last
+//   successful report, so a fleet's reporters can be scraped for health
+// - Plain HTTP with no authentication; bind it to loopback or a
+//   management network
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"locationshare/reporter"
+)
+
+// serveMetrics starts the metrics listener on addr
+func serveMetrics(addr string, r *reporter.Reporter) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, r.Stats())
+	})
+	go func() {
+		log.Println("metrics err:", http.Serve(ln, mux))
+	}()
+	log.Printf("serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
+
+func writeMetrics(w io.Writer, st reporter.Stats) {
+	var last float64
+	if !st.LastPost.IsZero() {
+		last = float64(st.LastPost.UnixNano()) / 1e9
+	}
+	for _, m := range []struct {
+		name, kind, help string
+		v                float64
+	}{
+		{"nuloc_client_lookups_total", "counter", "Location lookups, failed ones included.", float64(st.Lookups)},
+		{"nuloc_client_lookup_failures_total", "counter", "Location lookups no source could answer.", float64(st.LookupFailures)},
+		{"nuloc_client_posts_total", "counter", "Attempts to deliver reports to the server.", float64(st.Posts)},
+		{"nuloc_client_post_failures_total", "counter", "Failed attempts to deliver reports.", float64(st.PostFailures)},
+		{"nuloc_client_queue_depth", "gauge", "Reports waiting in the offline queue.", float64(st.Queued)},
+		{"nuloc_client_watchdog_recoveries_total", "counter", "Times the watchdog reset a stalled loop.", float64(st.Recoveries)},
+		{"nuloc_client_last_post_timestamp_seconds", "gauge", "Unix time of the last successful delivery, 0 before one.", last},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.v)
+	}
+}
+```
+### client_mqtt.go
+```go
+package main
+
+// client_mqtt.go
+// - With MQTT_BROKER set (tcp://, ssl:// or ws:// URL) reports are
+//   published to the broker for the server's MQTT bridge instead of being
+//   POSTed; pairing and remote config still go to SERVER_URL
+// - MQTT_TOPIC is the server's pattern (default nuloc/+/location) with the
+//   "+" segment replaced by DEVICE_PHONE; each message is one /report body
+// - MQTT_QOS (default 1) is the publish QoS; at 1 and 2 a report only counts
+//   as sent once the broker has acknowledged it, otherwise it is queued
+// - MQTT_USERNAME, MQTT_PASSWORD and MQTT_CLIENT_ID (default
+//   nuloc-client-<phone>) log in to the broker; MQTT_CA_FILE trusts a
+//   private CA and MQTT_CERT_FILE/MQTT_KEY_FILE present a client
+//   certificate over ssl://
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"locationshare/reporter"
+)
+
+const defaultMQTTTopic = "nuloc/+/location"
+
+// mqttTimeout bounds connecting and acknowledgements; longer over Tor
+var mqttTimeout = 30 * time.Second
+
+type mqttReporter struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+}
+
+// newMQTTReporter connects to broker; the connection is retried in the
+// background, and reports sent while it is down are queued
+func newMQTTReporter(broker, phone string) (*mqttReporter, error) {
+	pattern := os.Getenv("MQTT_TOPIC")
+	if pattern == "" {
+		pattern = defaultMQTTTopic
+	}
+	segs := strings.Split(pattern, "/")
+	found := false
+	for i, s := range segs {
+		if s == "+" && !found {
+			segs[i], found = phone, true
+		}
+	}
+	if !found {
+		return nil, errors.New("MQTT_TOPIC needs a + segment for the device")
+	}
+	m := &mqttReporter{topic: strings.Join(segs, "/"), qos: 1}
+	if v := os.Getenv("MQTT_QOS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 2 {
+			return nil, fmt.Errorf("MQTT_QOS: invalid value %q", v)
+		}
+		m.qos = byte(n)
+	}
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "nuloc-client-" + phone
+	}
+	password, err := secret("MQTT_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := tlsConfig(os.Getenv("MQTT_CERT_FILE"), os.Getenv("MQTT_KEY_FILE"), os.Getenv("MQTT_CA_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("MQTT TLS: %w", err)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(password).
+		SetTLSConfig(cfg).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second)
+	if proxyURL.Load() != nil {
+		opts.SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			return dialMQTTProxy(uri, cfg)
+		})
+	}
+	m.client = mqtt.NewClient(opts)
+	// with ConnectRetry the token only fails on bad options
+	if t := m.client.Connect(); t.WaitTimeout(time.Second) && t.Error() != nil {
+		return nil, t.Error()
+	}
+	return m, nil
+}
+
+// dialMQTTProxy reaches a tcp:// or ssl:// broker through the explicit proxy
+func dialMQTTProxy(uri *url.URL, cfg *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	switch uri.Scheme {
+	case "tcp", "mqtt":
+		return dialProxy(ctx, uri.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		conn, err := dialProxy(ctx, uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = uri.Hostname()
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return nil, fmt.Errorf("a proxy only works with tcp:// and ssl:// brokers, not %s://", uri.Scheme)
+}
+
+func (m *mqttReporter) Send(batch []reporter.Payload) error {
+	for _, p := range batch {
+		// paho would hold the message until it reconnects; queue it
+		// ourselves instead so it survives a restart
+		if !m.client.IsConnectionOpen() {
+			return errors.New("not connected to the MQTT broker")
+		}
+		b, _ := json.Marshal(p)
+		t := m.client.Publish(m.topic, m.qos, false, b)
+		if m.qos == 0 {
+			continue
+		}
+		if !t.WaitTimeout(mqttTimeout) {
+			return errors.New("MQTT broker did not acknowledge the report")
+		}
+		if err := t.Error(); err != nil {
+			return err
+		}
+	}
+	log.Printf("published %d report(s) to %s", len(batch), m.topic)
+	return nil
+}
+```
+
+---
+
+### client_nmea.go
+```go
+package main
+
+// client_nmea.go
+// - SOURCE=nmea reads NMEA 0183 sentences straight from a serial GPS
+//   receiver at NMEA_DEVICE (e.g. /dev/ttyACM0), for setups without gpsd.
+//   Set the port speed first if the receiver needs it, e.g.
+//   stty -F /dev/ttyUSB0 4800 raw
+// - GGA gives the position, fix quality, HDOP and altitude, RMC the speed
+//   and course. Sentences with a bad checksum or no fix are ignored
+// - The accuracy sent is HDOP times nmeaUERE, a rough figure but far
+//   better than nothing
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"locationshare/reporter"
+)
+
+// nmeaUERE is the assumed range error of a single satellite, in metres
+const nmeaUERE = 5.0
+
+const knotsToMPS = 0.514444
+
+type nmeaSource struct {
+	path   string
+	latest latestFix
+
+	// speed and course from the last valid RMC, added to GGA fixes
+	speed, course *float64
+}
+
+// newNMEASource starts reading the receiver at path
+func newNMEASource(path string) (*nmeaSource, error) {
+	if path == "" {
+		return nil, errors.New("NMEA_DEVICE is required")
+	}
+	s := &nmeaSource{path: path}
+	go s.run()
+	return s, nil
+}
+
+func (s *nmeaSource) Name() string { return "nmea" }
+
+func (s *nmeaSource) Locate() (reporter.Fix, error) { return s.latest.get() }
+
+// run reads the device for the life of the process, reopening it when the
+// receiver is unplugged
+func (s *nmeaSource) run() {
+	for {
+		if err := s.read(); err != nil {
+			log.Println("nmea err:", err)
+		}
+		time.Sleep(gpsdRetry)
+	}
+}
+
+func (s *nmeaSource) read() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields, ok := nmeaFields(sc.Text())
+		if !ok || len(fields[0]) < 5 {
+			continue
+		}
+		// the first two letters name the constellation (GP, GN, GL, ...)
+		switch fields[0][2:] {
+		case "GGA":
+			if f, ok := parseGGA(fields); ok {
+				f.Speed, f.Bearing = s.speed, s.course
+				s.latest.set(f)
+			}
+		case "RMC":
+			s.speed, s.course = parseRMC(fields)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: end of input", s.path)
+}
+
+// nmeaFields checks a sentence's checksum and splits it into fields, the
+// first being the talker and type such as "GPGGA"
+func nmeaFields(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	star := strings.LastIndexByte(line, '*')
+	if !strings.HasPrefix(line, "$") || star < 0 || len(line) != star+3 {
+		return nil, false
+	}
+	want, err := strconv.ParseUint(line[star+1:], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	var sum byte
+	for i := 1; i < star; i++ {
+		sum ^= line[i]
+	}
+	if sum != byte(want) {
+		return nil, false
+	}
+	return strings.Split(line[1:star], ","), true
+}
+
+// parseGGA reads a GGA sentence:
+// $GPGGA,time,lat,N,lon,E,quality,satellites,hdop,altitude,M,...
+func parseGGA(f []string) (reporter.Fix, bool) {
+	if len(f) < 10 || f[6] == "" || f[6] == "0" {
+		return reporter.Fix{}, false
+	}
+	lat, ok1 := nmeaCoord(f[2], f[3])
+	lon, ok2 := nmeaCoord(f[4], f[5])
+	if !ok1 || !ok2 {
+		return reporter.Fix{}, false
+	}
+	fix := reporter.Fix{Lat: lat, Lon: lon}
+	if hdop, err := strconv.ParseFloat(f[8], 64); err == nil {
+		fix.Accuracy = hdop * nmeaUERE
+	}
+	if alt, err := strconv.ParseFloat(f[9], 64); err == nil {
+		fix.Altitude = &alt
+	}
+	return fix, true
+}
+
+// parseRMC reads the speed and course of an RMC sentence:
+// $GPRMC,time,status,lat,N,lon,E,knots,course,date,...
+func parseRMC(f []string) (speed, course *float64) {
+	if len(f) < 9 || f[2] != "A" {
+		return nil, nil
+	}
+	if v, err := strconv.ParseFloat(f[7], 64); err == nil {
+		v *= knotsToMPS
+		speed = &v
+	}
+	if v, err := strconv.ParseFloat(f[8], 64); err == nil && v >= 0 && v < 360 {
+		course = &v
+	}
+	return speed, course
+}
+
+// nmeaCoord converts ddmm.mmmm (or dddmm.mmmm) and a hemisphere to degrees
+func nmeaCoord(v, hemi string) (float64, bool) {
+	dot := strings.IndexByte(v, '.')
+	if dot < 0 {
+		dot = len(v)
+	}
+	if dot < 3 {
+		return 0, false
+	}
+	deg, err1 := strconv.ParseFloat(v[:dot-2], 64)
+	min, err2 := strconv.ParseFloat(v[dot-2:], 64)
+	if err1 != nil || err2 != nil || min >= 60 {
+		return 0, false
+	}
+	d := deg + min/60
+	switch hemi {
+	case "S", "W":
+		d = -d
+	case "N", "E":
+	default:
+		return 0, false
+	}
+	return d, true
+}
+```
+
+---
+
+
+---
+
+### client_proxy.go
+```go
+package main
+
+// client_proxy.go
+// - Without an explicit proxy, HTTP requests honour HTTP_PROXY, HTTPS_PROXY
+//   and NO_PROXY as usual, and gRPC honours HTTPS_PROXY
+// - --proxy (or PROXY_URL) names one: an http://, https:// or socks5:// URL,
+//   with user:password@ if it wants a login. It then carries everything the
+//   client sends: reports, pairing, remote config, geolocation lookups,
+//   gRPC, and MQTT to tcp:// or ssl:// brokers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyURL is the explicit proxy, nil to go by the environment. Tor swaps
+// it for a new circuit.
+var proxyURL atomic.Pointer[url.URL]
+
+// setProxy reads the --proxy value and routes HTTP through it
+func setProxy(v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("proxy %q: want e.g. http://proxy:3128 or socks5://127.0.0.1:1080", v)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy %q: scheme must be http, https or socks5", v)
+	}
+	proxyURL.Store(u)
+	routeThroughProxy()
+	return nil
+}
+
+// routeThroughProxy sends HTTP through proxyURL; every HTTP client here
+// starts from the default transport
+func routeThroughProxy() {
+	http.DefaultTransport.(*http.Transport).Proxy = func(*http.Request) (*url.URL, error) {
+		return proxyURL.Load(), nil
+	}
+}
+
+// dialProxy opens a TCP connection to addr through the explicit proxy
+func dialProxy(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL := proxyURL.Load()
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		d, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: proxyURL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u := proxyURL.User; u != nil {
+		pw, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pw)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the proxy says nothing more until the tunnel is used, so the reader
+	// cannot have buffered any of the tunnelled bytes
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+```
+
+---
+
+
+---
+
+
+---
+
+### client_service.go
+```go
+package main
+
+// client_service.go
+// - "client install" sets the reporter up as a systemd service so it
+//   survives reboots: the client settings in the current environment and
+//   flags, plus the config file's path, go to clientEnvFile (readable by
+//   root only, it holds the device token), a unit running this binary goes
+//   to clientUnitFile, and the unit is enabled and started. Run it again to
+//   change settings
+// - "client status" shows the service; "client uninstall" stops and removes
+//   it and the settings, keeping any queued reports in /var/lib/nuloc
+// - Build the client first (go build -o /usr/local/bin/nuloc-client
+//   client*.go): a binary from go run lives in a temporary directory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	clientService  = "nuloc-client.service"
+	clientUnitFile = "/etc/systemd/system/" + clientService
+	clientEnvFile  = "/etc/nuloc/client.env"
+)
+
+// clientSettings are the environment variables install copies; PAIRING_CODE
+// is left out, it is only needed once
+var clientSettings = []string{
+	"SERVER_URL", "DEVICE_PHONE", "DEVICE_TOKEN", "DEVICE_TOKEN_FILE", "E2E_KEY", "E2E_KEY_FILE",
+	"VAULT_ADDR", "VAULT_TOKEN", "VAULT_TOKEN_FILE", "VAULT_SECRET_PATH",
+	"CLIENT_CERT_FILE", "CLIENT_KEY_FILE", "SERVER_CA_FILE", "SERVER_PIN_SPKI", "SERVER_PIN_CERT", "SIGN_REPORTS",
+	"SOURCE", "GEOIP_PROVIDERS", "IPINFO_TOKEN", "MAXMIND_DB", "MAXMIND_IP", "GPSD_ADDR", "NMEA_DEVICE",
+	"WIFI_IFACE", "WIFI_PROVIDER", "WIFI_GEOLOCATE_URL", "GOOGLE_API_KEY", "CELL_MODEM", "OPENCELLID_KEY",
+	"REPORT_INTERVAL", "RETRY_MAX", "QUEUE_FILE", "QUEUE_MAX", "SEQ_FILE", "BATCH_SIZE", "BATCH_WAIT", "GZIP_MIN_SIZE",
+	"MIN_DISTANCE", "DEDUPE_EPSILON", "HEARTBEAT", "WATCHDOG", "WATCHDOG_RESTART", "METRICS_ADDR", "INTERVAL_MIN", "INTERVAL_MAX", "TELEMETRY", "CONFIG_POLL",
+	"MQTT_BROKER", "MQTT_TOPIC", "MQTT_QOS", "MQTT_USERNAME", "MQTT_PASSWORD", "MQTT_PASSWORD_FILE",
+	"MQTT_CLIENT_ID", "MQTT_CA_FILE", "MQTT_CERT_FILE", "MQTT_KEY_FILE", "GRPC_SERVER", "GRPC_PLAINTEXT",
+	"PROXY_URL", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"TOR", "TOR_SOCKS",
+}
+
+const clientUnit = `[Unit]
+Description=nuloc location reporter
+Wants=network-online.target
+After=network-online.target gpsd.service
+
+[Service]
+EnvironmentFile=%s
+ExecStart=%s
+Restart=always
+RestartSec=10
+StateDirectory=nuloc
+WorkingDirectory=/var/lib/nuloc
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// runCommand handles client subcommands:
+//
+//	install    write, enable and start the systemd service
+//	status     show the service
+//	uninstall  stop and remove the service and its settings
+func runCommand(args []string, configPath string) {
+	var err error
+	switch {
+	case args[0] == "install" && len(args) == 1:
+		err = installService(configPath)
+	case args[0] == "status" && len(args) == 1:
+		err = systemctl("status", "--no-pager", clientService)
+	case args[0] == "uninstall" && len(args) == 1:
+		err = uninstallService()
+	default:
+		fmt.Fprintln(os.Stderr, "usage: client [--config file] [--server url] [--device id] [--source list] [--interval d] [--proxy url] [--tor] [install | status | uninstall]")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// installService writes the environment's settings, and those given as
+// flags, for the service; settings from the config file at configPath are
+// left to the file
+func installService(configPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if strings.HasPrefix(exe, os.TempDir()) {
+		return fmt.Errorf("%s is a temporary build; go build the client and install from the binary", exe)
+	}
+	if os.Getenv("DEVICE_TOKEN") == "" && os.Getenv("DEVICE_TOKEN_FILE") == "" && os.Getenv("VAULT_ADDR") == "" {
+		return errors.New("set DEVICE_TOKEN (and the other settings) in the environment or config file to install with")
+	}
+
+	env := map[string]string{}
+	for _, name := range clientSettings {
+		if v, ok := os.LookupEnv(name); ok && !fileSettings[name] {
+			env[name] = v
+		}
+	}
+	if configPath != "" {
+		env["CONFIG_FILE"] = configPath
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# written by client install\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, strconv.Quote(env[name]))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(clientEnvFile), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(clientEnvFile, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that already exists
+	if err := os.Chmod(clientEnvFile, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(clientUnitFile, []byte(fmt.Sprintf(clientUnit, clientEnvFile, exe)), 0o644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", clientService); err != nil {
+		return err
+	}
+	if err := systemctl("restart", clientService); err != nil {
+		return err
+	}
+	fmt.Printf("installed %s running %s with settings from %s\n", clientService, exe, clientEnvFile)
+	return nil
+}
+
+func uninstallService() error {
+	if _, err := os.Stat(clientUnitFile); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not installed", clientService)
+	}
+	if err := systemctl("disable", "--now", clientService); err != nil {
+		return err
+	}
+	for _, f := range []string{clientUnitFile, clientEnvFile} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	fmt.Println("removed", clientService)
+	return nil
+}
+
+// systemctl runs systemctl with args, passing its output through
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+```
+
+---
+
+### client_wifi.go
+```go
+package main
+
+// client_wifi.go
+// - SOURCE=wifi scans for nearby access points with iw (on WIFI_IFACE, or
+//   the first wireless interface; scanning needs root) and asks a
+//   geolocation service where they are, typically within tens of metres
+// - WIFI_PROVIDER picks the service: mls (default) speaks the Mozilla
+//   Location Service API at WIFI_GEOLOCATE_URL, by default BeaconDB as
+//   Mozilla's own service has closed; google uses the Google Geolocation
+//   API with GOOGLE_API_KEY
+// - Networks whose name ends in _nomap have opted out and are never sent.
+//   At least two access points are needed for a fix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"locationshare/reporter"
+)
+
+const defaultMLSURL = "https://api.beacondb.net/v1/geolocate"
+
+// accessPoint is one entry of a geolocate request
+type accessPoint struct {
+	MAC    string `json:"macAddress"`
+	Signal int    `json:"signalStrength,omitempty"` // dBm
+}
+
+// geolocateRequest is the body of an MLS or Google geolocate request
+type geolocateRequest struct {
+	ConsiderIP   bool          `json:"considerIp"`
+	AccessPoints []accessPoint `json:"wifiAccessPoints,omitempty"`
+}
+
+type wifiSource struct {
+	iface string
+	url   string
+}
+
+// newWiFiSource reads WIFI_IFACE, WIFI_PROVIDER and the provider's settings
+func newWiFiSource() (*wifiSource, error) {
+	s := &wifiSource{iface: os.Getenv("WIFI_IFACE")}
+	var err error
+	if s.url, err = geolocateURL(os.Getenv("WIFI_PROVIDER"), os.Getenv("WIFI_GEOLOCATE_URL")); err != nil {
+		return nil, fmt.Errorf("WIFI_PROVIDER: %w", err)
+	}
+	return s, nil
+}
+
+// geolocateURL returns the endpoint for an MLS-style provider
+func geolocateURL(provider, custom string) (string, error) {
+	switch provider {
+	case "", "mls":
+		if custom != "" {
+			return custom, nil
+		}
+		return defaultMLSURL, nil
+	case "google":
+		key := os.Getenv("GOOGLE_API_KEY")
+		if key == "" {
+			return "", errors.New("google needs GOOGLE_API_KEY")
+		}
+		return "https://www.googleapis.com/geolocation/v1/geolocate?key=" + url.QueryEscape(key), nil
+	}
+	return "", fmt.Errorf("unknown provider %q", provider)
+}
+
+func (s *wifiSource) Name() string { return "wifi" }
+
+func (s *wifiSource) Locate() (reporter.Fix, error) {
+	iface := s.iface
+	if iface == "" {
+		var err error
+		if iface, err = wirelessInterface(); err != nil {
+			return reporter.Fix{}, err
+		}
+	}
+	aps, err := scanWiFi(iface)
+	if err != nil {
+		return reporter.Fix{}, err
+	}
+	if len(aps) < 2 {
+		return reporter.Fix{}, fmt.Errorf("%d usable access points in range, need 2", len(aps))
+	}
+	return geolocate(s.url, geolocateRequest{AccessPoints: aps})
+}
+
+// wirelessInterface returns the first interface iw knows
+func wirelessInterface() (string, error) {
+	out, err := exec.Command("iw", "dev").Output()
+	if err != nil {
+		return "", fmt.Errorf("iw dev: %w", err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) == 2 && f[0] == "Interface" {
+			return f[1], nil
+		}
+	}
+	return "", errors.New("no wireless interface, set WIFI_IFACE")
+}
+
+// scanWiFi runs an iw scan and returns the access points that may be sent
+func scanWiFi(iface string) ([]accessPoint, error) {
+	out, err := exec.Command("iw", "dev", iface, "scan").Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("iw scan: %s", bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, fmt.Errorf("iw scan: %w", err)
+	}
+	return parseIWScan(out), nil
+}
+
+// parseIWScan reads "iw scan" output: a "BSS <mac>(on wlan0)" line starts
+// each access point, followed by indented "signal:" and "SSID:" lines
+func parseIWScan(out []byte) []accessPoint {
+	var aps []accessPoint
+	var cur *accessPoint
+	optedOut := false
+	done := func() {
+		if cur != nil && !optedOut {
+			aps = append(aps, *cur)
+		}
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "BSS ") {
+			done()
+			mac := strings.TrimPrefix(line, "BSS ")
+			if i := strings.IndexAny(mac, "( "); i >= 0 {
+				mac = mac[:i]
+			}
+			cur, optedOut = &accessPoint{MAC: mac}, false
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch key {
+		case "signal":
+			if dbm, err := strconv.ParseFloat(strings.TrimSuffix(val, " dBm"), 64); err == nil {
+				cur.Signal = int(dbm)
+			}
+		case "SSID":
+			optedOut = strings.HasSuffix(val, "_nomap")
+		}
+	}
+	done()
+	return aps
+}
+
+// geolocate posts req to an MLS-style endpoint
+func geolocate(endpoint string, req geolocateRequest) (reporter.Fix, error) {
+	b, _ := json.Marshal(req)
+	resp, err := geoIPClient.Post(endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return reporter.Fix{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusNotFound {
+		return reporter.Fix{}, errors.New("location unknown to the service")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return reporter.Fix{}, fmt.Errorf("geolocate said %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var g struct {
+		Location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"location"`
+		Accuracy float64 `json:"accuracy"`
+	}
+	if err := json.Unmarshal(body, &g); err != nil {
+		return reporter.Fix{}, err
+	}
+	return reporter.Fix{Lat: g.Location.Lat, Lon: g.Location.Lng, Accuracy: g.Accuracy}, nil
+}
+```
+
+---
+
+
+---
+
+### client_tor.go
+```go
+package main
+
+// client_tor.go
+// - --tor (or TOR=true) sends everything through Tor's SOCKS port at
+//   TOR_SOCKS (default 127.0.0.1:9050), so SERVER_URL, GRPC_SERVER and
+//   MQTT_BROKER may be .onion addresses. Names are resolved by Tor, never
+//   locally; a .onion address without --tor is refused
+// - Circuits are slow to build: requests get torTimeout instead of the
+//   usual 30s, and failed reports are retried no sooner than torMinRetry
+// - After a failed report the next attempt asks for a fresh circuit with
+//   new SOCKS credentials, which Tor isolates by default
+// - SOURCE=geoip is refused, it would locate the Tor exit relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTorSOCKS = "127.0.0.1:9050"
+	torTimeout      = 2 * time.Minute
+	torMinRetry     = 30 * time.Second
+)
+
+var (
+	torSOCKS   string // empty unless --tor
+	torCircuit atomic.Uint64
+)
+
+// setupTor routes all traffic through Tor when on
+func setupTor(on bool) error {
+	if !on {
+		return nil
+	}
+	if proxyURL.Load() != nil {
+		return errors.New("use --tor or --proxy, not both")
+	}
+	torSOCKS = os.Getenv("TOR_SOCKS")
+	if torSOCKS == "" {
+		torSOCKS = defaultTorSOCKS
+	}
+	if _, _, err := net.SplitHostPort(torSOCKS); err != nil {
+		return fmt.Errorf("TOR_SOCKS: want host:port, got %q", torSOCKS)
+	}
+	newCircuit()
+	routeThroughProxy()
+	requestTimeout, mqttTimeout = torTimeout, torTimeout
+	geoIPClient.Timeout = torTimeout
+	return nil
+}
+
+// newCircuit makes the following connections use a fresh Tor circuit
+func newCircuit() {
+	if torSOCKS == "" {
+		return
+	}
+	n := torCircuit.Add(1)
+	proxyURL.Store(&url.URL{Scheme: "socks5h", Host: torSOCKS, User: url.UserPassword("nuloc", strconv.FormatUint(n, 10))})
+}
+
+// checkOnion refuses .onion addresses unless Tor is on; addrs are URLs or
+// host:port
+func checkOnion(addrs ...string) error {
+	for _, a := range addrs {
+		host := a
+		if u, err := url.Parse(a); err == nil && u.Host != "" {
+			host = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(a); err == nil {
+			host = h
+		}
+		if strings.HasSuffix(strings.ToLower(host), ".onion") && torSOCKS == "" {
+			return fmt.Errorf("%s is an onion service, run with --tor", a)
+		}
+	}
+	return nil
+}
+```
+
+---
+
+### client_transport.go
+```go
+package main
+
+// client_transport.go
+// - HTTP client used to talk to the server
+// - CLIENT_CERT_FILE/CLIENT_KEY_FILE present a device certificate for mutual
+//   TLS; SERVER_CA_FILE trusts a private CA for the server certificate
+// - Request bodies of GZIP_MIN_SIZE bytes (default 1024) or more are sent
+//   gzip-compressed, for metered links; GZIP_MIN_SIZE=off turns that off
+// - SERVER_PIN_SPKI (base64 SHA-256 of a public key, as curl's
+//   --pinnedpubkey takes) and SERVER_PIN_CERT (hex SHA-256 fingerprint of
+//   the server certificate) pin the server on top of the usual checks, so a
+//   rogue CA cannot stand in for it. A key pin may name any certificate in
+//   the chain; list several to allow for rotation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultGzipMinSize = 1024
+
+// serverClient builds the HTTP client for server requests
+func serverClient() (*http.Client, error) {
+	cfg, err := tlsConfig(os.Getenv("CLIENT_CERT_FILE"), os.Getenv("CLIENT_KEY_FILE"), os.Getenv("SERVER_CA_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := loadPins()
+	if err != nil {
+		return nil, err
+	}
+	if pins != nil {
+		cfg.VerifyConnection = pins.verify
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	var rt http.RoundTripper = tr
+	switch v := os.Getenv("GZIP_MIN_SIZE"); v {
+	case "off":
+	case "":
+		rt = gzipRequests{next: tr, min: defaultGzipMinSize}
+	default:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("GZIP_MIN_SIZE: invalid value %q", v)
+		}
+		rt = gzipRequests{next: tr, min: n}
+	}
+	return &http.Client{Transport: rt, Timeout: requestTimeout}, nil
+}
+
+// requestTimeout bounds each request to the server; longer over Tor
+var requestTimeout = 30 * time.Second
+
+// tlsConfig presents the certificate in certFile and keyFile, if given, and
+// trusts the CAs in caFile instead of the system's when that is given
+func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// serverPins are the accepted key and certificate hashes
+type serverPins struct {
+	spki map[[sha256.Size]byte]bool
+	cert map[[sha256.Size]byte]bool
 }
 
-// reportHandler accepts JSON body with phone, lat, lon, token(optional)
-func reportHandler(w http.ResponseWriter, r *http.Request) {
-	var loc Location
-	if err := json.NewDecoder(r.Body).Decode(&loc); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
-		return
+// loadPins reads SERVER_PIN_SPKI and SERVER_PIN_CERT; nil means no pinning
+func loadPins() (*serverPins, error) {
+	p := &serverPins{spki: map[[sha256.Size]byte]bool{}, cert: map[[sha256.Size]byte]bool{}}
+	for _, v := range strings.Split(os.Getenv("SERVER_PIN_SPKI"), ",") {
+		if v = strings.TrimPrefix(strings.TrimSpace(v), "sha256//"); v == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("SERVER_PIN_SPKI: %q is not a base64 SHA-256 hash", v)
+		}
+		p.spki[[sha256.Size]byte(b)] = true
 	}
-	loc.When = fmt.Sprintf("%s", r.Header.Get("Date"))
-	if loc.When == "" {
-		loc.When = fmt.Sprintf("%v", nowISO())
+	for _, v := range strings.Split(os.Getenv("SERVER_PIN_CERT"), ",") {
+		if v = strings.ReplaceAll(strings.TrimSpace(v), ":", ""); v == "" {
+			continue
+		}
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("SERVER_PIN_CERT: %q is not a hex SHA-256 fingerprint", v)
+		}
+		p.cert[[sha256.Size]byte(b)] = true
 	}
-
-	// Store
-	stMutex.Lock()
-	store[loc.Phone] = append(store[loc.Phone], loc)
-	if len(store[loc.Phone]) > 200 {
-		store[loc.Phone] = store[loc.Phone][len(store[loc.Phone])-200:]
+	if len(p.spki) == 0 && len(p.cert) == 0 {
+		return nil, nil
 	}
-	stMutex.Unlock()
-
-	// Broadcast to websocket clients
-	broadcast(loc)
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	return p, nil
 }
 
-func getHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	phone := vars["phone"]
+// verify accepts the connection if the leaf certificate or any key in
+// the chain is pinned
+func (p *serverPins) verify(cs tls.ConnectionState) error {
+	for i, c := range cs.PeerCertificates {
+		if p.spki[sha256.Sum256(c.RawSubjectPublicKeyInfo)] || i == 0 && p.cert[sha256.Sum256(c.Raw)] {
+			return nil
+		}
+	}
+	return errors.New("server certificate does not match SERVER_PIN_SPKI or SERVER_PIN_CERT")
+}
 
-	stMutex.RLock()
-	locs := store[phone]
-	stMutex.RUnlock()
+// gzipRequests compresses request bodies of at least min bytes
+type gzipRequests struct {
+	next http.RoundTripper
+	min  int64
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"phone": phone, "locations": locs})
+// CloseIdleConnections passes through to the wrapped transport
+func (t gzipRequests) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (t gzipRequests) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.ContentLength < t.min || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
 	if err != nil {
-		log.Println("ws upgrade:", err)
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	clientsMu.Lock()
-	clients[conn] = true
-	clientsMu.Unlock()
-
-	// Keep connection open
-	for {
-		var msg map[string]interface{}
-		if err := conn.ReadJSON(&msg); err != nil {
-			// client likely disconnected
-			clientsMu.Lock()
-			delete(clients, conn)
-			clientsMu.Unlock()
-			break
-		}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		return nil, err
 	}
-}
-
-func broadcast(loc Location) {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
-	for c := range clients {
-		if err := c.WriteJSON(loc); err != nil {
-			log.Println("ws write err:", err)
-			c.Close()
-			delete(clients, c)
-		}
+	out := req.Clone(req.Context())
+	if buf.Len() >= len(body) {
+		// incompressible; send it as it was
+		buf.Reset()
+		buf.Write(body)
+	} else {
+		out.Header.Set("Content-Encoding", "gzip")
 	}
+	sent := buf.Bytes()
+	out.Body = io.NopCloser(bytes.NewReader(sent))
+	out.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(sent)), nil }
+	out.ContentLength = int64(len(sent))
+	return t.next.RoundTrip(out)
 }
+```
+
+---
+
+### client_e2e.go
+```go
+package main
+
+// client_e2e.go
+// - Optional end-to-end encryption of coordinates. With E2E_KEY set (32
+//   random bytes, base64url) the client sends only ciphertext, see
+//   reporter/e2e.go
+// - Generate a key with: head -c32 /dev/urandom | base64 | tr '+/' '-_' | tr -d '='
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
 
-func nowISO() string {
-	return (time.Now()).Format(time.RFC3339)
+// loadE2EKey returns the configured key, or nil when encryption is off
+func loadE2EKey() ([]byte, error) {
+	v, err := secret("E2E_KEY")
+	if err != nil || v == "" {
+		return nil, err
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("want 32 bytes, got %d", len(key))
+	}
+	return key, nil
 }
 ```
 
 ---
 
-### client.go
+### client_secrets.go
 ```go
 package main
 
-// client.go
-// - Periodically fetches IP-based geolocation (ipinfo.io)
-// - POSTs JSON to /report on the server
+// client_secrets.go
+// - Resolves the device token and E2E key; same providers as the server
+// - For a secret NAME the providers are tried in order:
+//   env       the NAME environment variable
+//   file      the contents of the file named by NAME_FILE (Docker/K8s secrets)
+//   vault     key NAME at VAULT_SECRET_PATH in HashiCorp Vault (KV v1 or v2),
+//             enabled by VAULT_ADDR with VAULT_TOKEN or VAULT_TOKEN_FILE
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-type GeoIP struct {
-	IP      string `json:"ip"`
-	City    string `json:"city"`
-	Region  string `json:"region"`
-	Country string `json:"country"`
-	Loc     string `json:"loc"`
+// secretProvider resolves named secrets from one source
+type secretProvider interface {
+	name() string
+	lookup(key string) (string, bool, error)
 }
 
-type Payload struct {
-	Phone string  `json:"phone"`
-	Token string  `json:"token,omitempty"`
-	Lat   float64 `json:"lat"`
-	Lon   float64 `json:"lon"`
-	IP    string  `json:"ip,omitempty"`
-}
+var secretProviders = []secretProvider{envSecrets{}, fileSecrets{}}
 
-func main() {
-	server := os.Getenv("SERVER_URL") // e.g. http://127.0.0.1:5000
-	if server == "" {
-		server = "http://127.0.0.1:5000"
-	}
-	phone := os.Getenv("DEVICE_PHONE")
-	if phone == "" {
-		phone = "kali-device"
+// setupSecrets adds the Vault provider when configured
+func setupSecrets() error {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil
 	}
-	token := os.Getenv("DEVICE_TOKEN")
+	token := os.Getenv("VAULT_TOKEN")
 	if token == "" {
-		token = "mytoken123"
+		if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	path := os.Getenv("VAULT_SECRET_PATH")
+	if token == "" || path == "" {
+		return fmt.Errorf("VAULT_ADDR needs VAULT_TOKEN (or VAULT_TOKEN_FILE) and VAULT_SECRET_PATH")
 	}
+	secretProviders = append(secretProviders, &vaultSecrets{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	})
+	return nil
+}
 
-	for {
-		geo, lat, lon, err := fetchGeoIP()
+// secret returns the first value found for key, or "" if no provider has it
+func secret(key string) (string, error) {
+	for _, p := range secretProviders {
+		v, ok, err := p.lookup(key)
 		if err != nil {
-			log.Println("geoip err:", err)
-			time.Sleep(10 * time.Second)
-			continue
+			return "", fmt.Errorf("%s secret %s: %w", p.name(), key, err)
 		}
-
-		p := Payload{Phone: phone, Token: token, Lat: lat, Lon: lon, IP: geo.IP}
-		b, _ := json.Marshal(p)
-		resp, err := http.Post(server+"/report", "application/json", bytes.NewBuffer(b))
-		if err != nil {
-			log.Println("post err:", err)
-		} else {
-			body, _ := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			fmt.Println("posted:", string(body))
+		if ok {
+			return v, nil
 		}
-		time.Sleep(10 * time.Second)
 	}
+	return "", nil
 }
 
-func fetchGeoIP() (GeoIP, float64, float64, error) {
-	resp, err := http.Get("https://ipinfo.io/json")
+type envSecrets struct{}
+
+func (envSecrets) name() string { return "env" }
+
+func (envSecrets) lookup(key string) (string, bool, error) {
+	v := os.Getenv(key)
+	return v, v != "", nil
+}
+
+type fileSecrets struct{}
+
+func (fileSecrets) name() string { return "file" }
+
+func (fileSecrets) lookup(key string) (string, bool, error) {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", false, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// vaultSecrets reads every key at one Vault path once and caches them
+type vaultSecrets struct {
+	addr, token, path string
+	client            *http.Client
+
+	once sync.Once
+	data map[string]interface{}
+	err  error
+}
+
+func (v *vaultSecrets) name() string { return "vault" }
+
+func (v *vaultSecrets) lookup(key string) (string, bool, error) {
+	v.once.Do(v.fetch)
+	if v.err != nil {
+		return "", false, v.err
+	}
+	val, ok := v.data[key].(string)
+	return val, ok, nil
+}
+
+func (v *vaultSecrets) fetch() {
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		v.err = err
+		return
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
 	if err != nil {
-		return GeoIP{}, 0, 0, err
+		v.err = err
+		return
 	}
 	defer resp.Body.Close()
-	b, _ := ioutil.ReadAll(resp.Body)
-	var g GeoIP
-	json.Unmarshal(b, &g)
-	var lat, lon float64
-	fmt.Sscanf(g.Loc, "%f,%f", &lat, &lon)
-	return g, lat, lon, nil
+	if resp.StatusCode != http.StatusOK {
+		v.err = fmt.Errorf("GET %s: %s", v.path, resp.Status)
+		return
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if v.err = json.NewDecoder(resp.Body).Decode(&body); v.err != nil {
+		return
+	}
+	// KV v2 nests the secret under data.data
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		v.data = inner
+		return
+	}
+	v.data = body.Data
 }
 ```
 
@@ -256,45 +17011,195 @@ func fetchGeoIP() (GeoIP, float64, float64, error) {
 <meta charset="utf-8">
 <title>Live Viewer</title>
 <link rel="stylesheet" href="https://unpkg.com/leaflet/dist/leaflet.css" />
-<style>body{margin:0} #map{height:100vh}</style>
+<style>body{margin:0} #map{height:100vh} #devices{position:absolute;top:10px;right:10px;z-index:1000}</style>
 </head>
 <body>
 <div id="map"></div>
+<select id="devices" hidden></select>
 <script src="https://unpkg.com/leaflet/dist/leaflet.js"></script>
 <script>
 const map = L.map('map').setView([20.5937,78.9629],5);
 L.tileLayer('https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png',{maxZoom:19}).addTo(map);
 let poly = L.polyline([], {weight:3}).addTo(map);
 let marker = null;
+// label and color of each device, from GET /v1/devices
+const deviceMeta = {};
+const defaultColor = '#3388ff';
+
+// placeMarker moves the marker to the selected device's latest point, in its
+// color, with what the point says about the machine in the tooltip
+function placeMarker(loc){
+  const meta = deviceMeta[phone] || {};
+  const color = meta.color || defaultColor;
+  poly.setStyle({color});
+  if(marker) map.removeLayer(marker);
+  marker = L.circleMarker([loc.lat, loc.lon], {radius: 8, color, fillColor: color, fillOpacity: 0.8}).addTo(map);
+  const lines = [meta.label || phone];
+  if(loc.hostname) lines.push('host: ' + loc.hostname);
+  if(loc.uptime !== undefined) lines.push('up: ' + Math.floor(loc.uptime/86400) + 'd ' + Math.floor(loc.uptime%86400/3600) + 'h');
+  if(loc.battery !== undefined) lines.push('battery: ' + loc.battery + '%');
+  if(loc.interface) lines.push('via: ' + loc.interface + (loc.network ? ' (' + loc.network + ')' : ''));
+  if(loc.recoveries) lines.push('watchdog recoveries: ' + loc.recoveries);
+  if(loc.received){
+    const late = Math.round((Date.parse(loc.received) - Date.parse(loc.when))/1000);
+    if(late >= 60) lines.push('received ' + late + 's after its timestamp');
+  }
+  const tip = document.createElement('div');
+  tip.innerText = lines.join('\n');
+  marker.bindTooltip(tip);
+}
+
+let phone = new URLSearchParams(location.search).get('phone') || '';
+// An API key in ?token= wins; otherwise log in for a short-lived session token
+// A session handed back by the OIDC callback arrives in the URL fragment
+const fragment = new URLSearchParams(location.hash.slice(1));
+if(fragment.get('session')){
+  sessionStorage.setItem('session', fragment.get('session'));
+  fragment.delete('session');
+  history.replaceState(null, '', location.pathname + location.search + (fragment.toString() ? '#' + fragment : ''));
+}
+// Key for end-to-end encrypted devices (#key=...); fragments never reach the server
+const e2eKeyB64 = fragment.get('key');
+let e2eKey = null;
+
+async function decryptLoc(l){
+  if(!l.ct) return l;
+  if(!e2eKeyB64) return null;
+  if(!e2eKey){
+    const raw = Uint8Array.from(atob(e2eKeyB64.replace(/-/g,'+').replace(/_/g,'/')), c=>c.charCodeAt(0));
+    e2eKey = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+  }
+  const buf = Uint8Array.from(atob(l.ct), c=>c.charCodeAt(0));
+  try {
+    const plain = await crypto.subtle.decrypt({name:'AES-GCM', iv: buf.slice(0,12)}, e2eKey, buf.slice(12));
+    return Object.assign({}, l, JSON.parse(new TextDecoder().decode(plain)));
+  } catch(e) {
+    console.error('cannot decrypt point', e);
+    return null;
+  }
+}
+let token = new URLSearchParams(location.search).get('token') || sessionStorage.getItem('session') || '';
+
+let csrf = '';
+
+// csrfHeaders returns headers for state-changing requests, fetching a CSRF
+// token (and its cookie) on first use
+async function csrfHeaders(extra){
+  if(!csrf){
+    csrf = (await (await fetch('/v1/auth/csrf', {credentials:'same-origin'})).json()).token;
+  }
+  return Object.assign({'X-CSRF-Token': csrf}, extra);
+}
+
+async function login(){
+  const methods = await (await fetch('/v1/auth/methods')).json();
+  if(methods.oidc){
+    location.href = '/v1/auth/oidc/login';
+    return false;
+  }
+  const username = prompt('Username');
+  const password = prompt('Password');
+  const resp = await fetch('/v1/auth/login', {method:'POST', credentials:'same-origin', headers: await csrfHeaders({'Content-Type':'application/json'}), body: JSON.stringify({username, password})});
+  if(!resp.ok){alert('login failed'); return false}
+  token = (await resp.json()).token;
+  sessionStorage.setItem('session', token);
+  return true;
+}
 
-const phone = new URLSearchParams(location.search).get('phone') || 'kali-device';
-const token = new URLSearchParams(location.search).get('token') || '';
+// authGet fetches url with the current token, logging in once on 401
+async function authGet(url){
+  let resp = await fetch(url, {headers: {'Authorization': 'Bearer '+token}});
+  if(resp.status === 401 && await login()){
+    resp = await fetch(url, {headers: {'Authorization': 'Bearer '+token}});
+  }
+  return resp;
+}
+
+// loadDevices fills the device picker; without ?phone= the first device is shown
+async function loadDevices(){
+  const resp = await authGet('/v1/devices');
+  if(!resp.ok) return;
+  const list = (await resp.json()).devices || [];
+  const sel = document.getElementById('devices');
+  sel.replaceChildren(...list.map(d=>{
+    const o = document.createElement('option');
+    o.value = d.phone;
+    o.textContent = d.label ? d.label+' ('+d.phone+')' : d.phone;
+    return o;
+  }));
+  for(const d of list) deviceMeta[d.phone] = d;
+  if(!phone && list.length) phone = list[0].phone;
+  sel.value = phone;
+  sel.hidden = list.length < 2;
+}
 
-async function loadHistory(){
-  const resp = await fetch('/get/'+encodeURIComponent(phone));
-  if(!resp.ok){console.error('history fetch failed'); return}
-  const json = await resp.json();
-  const locs = json.locations || [];
+document.getElementById('devices').onchange = (ev)=>{
+  phone = ev.target.value;
+  history.replaceState(null, '', '?phone='+encodeURIComponent(phone)+location.hash);
+  poly.setLatLngs([]);
+  // a reconnect must fetch the new device's track, not replay the old one's
+  lastSeq = undefined;
+  if(ws && ws.readyState === WebSocket.OPEN){
+    ws.send(JSON.stringify({type: 'unsubscribe', phones: [following]}));
+    ws.send(JSON.stringify({type: 'subscribe', phones: [phone], snapshot: trackLength}));
+    following = phone;
+  }
+};
+
+// showTrack draws a device's recent history, newest point last
+async function showTrack(list){
+  const locs = (await Promise.all(list.map(decryptLoc))).filter(Boolean);
   poly.setLatLngs(locs.map(l=>[l.lat,l.lon]));
   if(marker) map.removeLayer(marker);
+  marker = null;
   if(locs.length){
-    marker = L.marker([locs[0].lat, locs[0].lon]).addTo(map);
+    const last = locs[locs.length-1];
+    placeMarker(last);
     map.fitBounds(poly.getBounds().pad(0.5));
   }
 }
-loadHistory();
 
-// WebSocket for live updates
-const wsProto = (location.protocol === 'https:') ? 'wss' : 'ws';
-const ws = new WebSocket(wsProto + '://' + location.host + '/ws');
-ws.onmessage = (ev)=>{
-  const loc = JSON.parse(ev.data);
-  // only display updates for our phone
-  if(loc.phone !== phone) return;
-  poly.addLatLng([loc.lat, loc.lon]);
-  if(marker) map.removeLayer(marker);
-  marker = L.marker([loc.lat, loc.lon]).addTo(map);
-};
+// WebSocket for the selected device's track and live updates; the server
+// sends up to trackLength recent points as a snapshot first, or after a
+// reconnect just what was missed since lastSeq
+const trackLength = 200;
+let ws, following, lastSeq;
+function connect(){
+  if(!phone) return;
+  const wsProto = (location.protocol === 'https:') ? 'wss' : 'ws';
+  following = phone;
+  let url = wsProto + '://' + location.host + '/v1/ws?phones=' + encodeURIComponent(phone) + '&snapshot=' + trackLength;
+  if(lastSeq !== undefined) url += '&since=' + lastSeq;
+  // the token goes in the first message rather than the URL
+  ws = new WebSocket(url);
+  ws.onopen = ()=> ws.send(JSON.stringify({type: 'auth', token: token}));
+  // reconnect after drops, but not when the server refused us
+  ws.onclose = (ev)=>{ if(ev.code !== 1008) setTimeout(connect, 2000) };
+  ws.onmessage = async (ev)=>{
+    const msg = JSON.parse(ev.data);
+    if(msg.seq) lastSeq = msg.seq;
+    if(msg.type === 'authenticated' || msg.type === 'subscribed' || msg.type === 'error'){
+      if(msg.type === 'error') console.error('live updates:', msg.error);
+      return;
+    }
+    if(msg.type === 'snapshot'){
+      showTrack((msg.locations || []).filter(l=>l.phone === phone));
+      return;
+    }
+    if(msg.type === 'geofence'){
+      if(msg.phone === phone) console.log(`${msg.phone} ${msg.event === 'enter' ? 'entered' : 'left'} ${msg.fence}`);
+      return;
+    }
+    const loc = await decryptLoc(msg);
+    if(!loc) return;
+    // a late update for the device we just switched away from
+    if(loc.phone !== phone) return;
+    poly.addLatLng([loc.lat, loc.lon]);
+    placeMarker(loc);
+  };
+}
+
+loadDevices().then(connect);
 </script>
 </body>
 </html>
@@ -302,24 +17207,114 @@ ws.onmessage = (ev)=>{
 
 ---
 
+### server.example.yaml
+```yaml
+# Copy to server.yaml and run: go run server*.go --config server.yaml
+# Environment variables and flags override anything set here.
+port: 5000
+
+storage:
+  backend: memory
+  retention: 200            # points kept per device
+  devices_file: devices.json
+  pairings_file: pairings.json
+  api_keys_file: api_keys.json
+  audit_log_file: audit.jsonl
+  geofences_file: geofences.json
+  notifiers_file: notifiers.json
+  tenants_file: tenants.json
+  usage_file: usage.json
+  summaries_file: summaries.json
+
+# Prefer ADMIN_TOKEN_FILE, DEVICE_TOKENS_FILE or Vault in production
+tokens:
+  # admin: <secret>
+  # devices:
+  #   kali-device: <device token>
+
+tls:
+  cert_file: ""
+  key_file: ""
+  autocert_hosts: []
+
+rate_limits:
+  ip_rps: 10
+  ip_burst: 20
+  device_rps: 2
+  device_burst: 10
+
+# Any other setting by its environment variable name
+settings:
+  REQUIRE_CONSENT: "true"
+  ALLOWED_ORIGINS: ""
+```
+
+---
+
+### client.example.yaml
+```yaml
+# Copy to client.yaml next to the client, or pass --config client.yaml.
+# Environment variables and flags override anything set here.
+server: http://127.0.0.1:5000
+device: kali-device
+
+# Prefer token_file (or Vault, see VAULT_ADDR) to keep the token out of here
+# token: <device token>
+token_file: ""
+
+source: geoip              # e.g. gpsd,geoip
+interval: 10s
+
+# proxy: socks5://127.0.0.1:1080
+tor: false
+
+tls:
+  cert_file: ""            # device certificate for mutual TLS
+  key_file: ""
+  ca_file: ""              # private CA for the server's certificate
+  pin_spki: []             # base64 SHA-256 of accepted server keys
+  pin_cert: []
+
+# Any other setting by its environment variable name
+settings:
+  QUEUE_FILE: nuloc-queue.json
+  TELEMETRY: "on"
+```
 ### go.mod
 ```text
 module locationshare
 
-go 1.20
+go 1.21
 
 require github.com/gorilla/mux v1.8.0
 require github.com/gorilla/websocket v1.5.0
+require github.com/golang-jwt/jwt/v5 v5.2.1
+require golang.org/x/crypto v0.24.0
+require golang.org/x/time v0.5.0
+require github.com/coreos/go-oidc/v3 v3.9.0
+require golang.org/x/oauth2 v0.18.0
+require github.com/gorilla/csrf v1.7.3
+require gopkg.in/yaml.v3 v3.0.1
+require google.golang.org/grpc v1.64.1
+require google.golang.org/protobuf v1.34.2
+require github.com/eclipse/paho.mqtt.golang v1.4.3
+require github.com/vmihailenco/msgpack/v5 v5.4.1
+require github.com/fxamacker/cbor/v2 v2.7.0
+require github.com/redis/go-redis/v9 v9.5.1
+require github.com/nats-io/nats.go v1.36.0
+require github.com/segmentio/kafka-go v0.4.47
+require github.com/oschwald/geoip2-golang v1.9.0
+require golang.org/x/net v0.26.0
 ```
 
 ---
 
 ### Dockerfile
 ```dockerfile
-FROM golang:1.20-alpine AS build
+FROM golang:1.21-alpine AS build
 WORKDIR /app
 COPY . .
-RUN go build -o /kali-tracker ./server.go ./client.go
+RUN go build -o /kali-tracker ./server*.go
 
 FROM alpine:latest
 RUN apk add --no-cache ca-certificates
@@ -327,6 +17322,7 @@ COPY --from=build /kali-tracker /usr/local/bin/kali-tracker
 COPY viewer.html /viewer.html
 COPY static/ /static/
 EXPOSE 5000
+HEALTHCHECK CMD wget -qO- http://127.0.0.1:${PORT:-5000}/healthz || exit 1
 ENTRYPOINT ["/usr/local/bin/kali-tracker"]
 ```
 
@@ -342,6 +17338,8 @@ services:
       - "5000:5000"
     environment:
       - PORT=5000
+      - DEVICE_TOKENS=${DEVICE_TOKENS}
+      - ADMIN_TOKEN=${ADMIN_TOKEN}
 ```
 
 ---
@@ -355,15 +17353,526 @@ This project runs entirely on **Kali Linux**. It uses IP-based geolocation (ipin
 - WebSocket-based live broadcast for viewers
 - Simple web map viewer (Leaflet)
 
+## API versions
+The API lives under `/v1` (`/v1/report`, `/v1/get/{phone}`, `/v1/ws`, `/v1/admin/...`); paths in this
+README are given without the prefix. The old unversioned paths still work but answer with
+`Deprecation: true` and a `Link` to the `/v1` path, so move clients over. `/healthz`, `/readyz` and the
+viewer are not versioned.
+
+`/openapi.json` describes every route as an OpenAPI 3 document, and `/docs` opens it in Swagger UI.
+The UI's scripts load from unpkg; set `SWAGGER_UI_URL` to serve `swagger-ui-dist` yourself.
+
 ## Quick start (local build)
-1. Install Go 1.20+
+1. Install Go 1.21+
 2. `git clone` this repo
 3. `go mod download`
 4. Build and run server:
-   - `go run server.go`
-5. In another shell run client:
-   - `go run client.go`
-6. Open browser to `http://127.0.0.1:5000/` to see viewer
+   - `ADMIN_TOKEN=<secret> go run server*.go`
+   - register each reporting device; the response holds its token:
+     `curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"phone":"kali-device","label":"Kali laptop"}' http://127.0.0.1:5000/devices`
+   - devices can also be fixed in config with `DEVICE_TOKENS=kali-device:<device token>`
+5. Pair the device, which records its consent to be tracked:
+   - `curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"phone":"kali-device"}' http://127.0.0.1:5000/admin/pairings`
+   - run the client once with the returned code: `DEVICE_TOKEN=<device token> PAIRING_CODE=<code> go run client*.go`
+   - hardware trackers, registered with `"hardware": true`, are confirmed by an admin instead:
+     `POST /admin/pairings/{phone}/confirm`; other devices have to pair themselves
+   - `REQUIRE_CONSENT=false` turns the check off; consent is kept in `PAIRINGS_FILE` (default `pairings.json`)
+   In another shell run client:
+   - `DEVICE_TOKEN=<device token> go run client*.go`
+6. Open browser to `http://127.0.0.1:5000/` and log in, or pass `?token=<read key>`, to see viewer
+
+## Viewer accounts
+Viewer logins are bcrypt hashes in `VIEWER_USERS` (`name:hash[:phone|phone],...`); without a
+phone list the viewer sees every phone. `POST /auth/login` returns a
+session token valid for `JWT_TTL` (default 15m), signed with `JWT_SECRET`. `/get/*`, `/latest/*` and `/ws` require
+a session token or a `viewer` API key.
+
+## Single sign-on
+Set `OIDC_ISSUER`, `OIDC_CLIENT_ID`, `OIDC_CLIENT_SECRET` and `OIDC_REDIRECT_URL`
+(`https://<host>/v1/auth/oidc/callback`) to log viewers in through Keycloak, Auth0, Google, etc.
+`OIDC_GROUP_PHONES=family:kali-device|laptop,ops:*` maps IdP groups (claim `OIDC_GROUPS_CLAIM`,
+default `groups`) to the phones they may see; members of `OIDC_ADMIN_GROUP` become admins.
+
+## Devices
+`POST /devices` (admin) registers `{"phone","label","color","icon","token"}`; without a token one is generated
+and returned once. Phones are 1 to 64 letters, digits, `-` or `_`. Add `"hardware": true` for trackers such as GT06 boxes that cannot pair themselves. Reports and imports for unregistered phones are rejected. `GET /devices` lists the devices
+you may view with label, color, icon, last-seen time and last position; the viewer uses it for its device
+picker and draws each device in its color. `PATCH /devices/{phone}` (admin) changes the label, `color`
+(`#rrggbb`) or `icon` (a short name such as `car` or `laptop`). GeoJSON exports carry them as `label`,
+`marker-color` and `marker-symbol`.
+`DELETE /devices/{phone}` (admin) decommissions a registered device: its token, history and pairing are
+removed and viewers limited to that device are disconnected.
+Reports may carry the time they were recorded as `when` (RFC 3339); otherwise the arrival time is used.
+Times are stored and returned in UTC. `POST /report/batch` takes an array of reports for one phone (e.g. queued while offline); points keep their
+`when` and are stored oldest first. `GET /latest/{phone}` returns just the newest point and its `age_seconds`.
+
+## API keys
+Set `ADMIN_TOKEN` to bootstrap, then create keys with a role. `admin` manages the server,
+`viewer` reads the listed phones and `reporter` posts for the listed phones (`"*"` means all):
+```
+curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"viewer","role":"viewer","phones":["kali-device"]}' http://127.0.0.1:5000/admin/keys
+```
+Keys can be listed (`GET /admin/keys`), rotated (`POST /admin/keys/{id}/rotate`) and revoked (`DELETE /admin/keys/{id}`).
+Set `API_KEYS_FILE` to persist them across restarts.
+
+Give a key `"daily_quota"` and/or `"monthly_quota"` (requests per UTC day and month) when creating it, or later
+with `PUT /v1/admin/keys/{id}/quota`. Once one is used up the key gets 429 with `Retry-After` until the period
+ends. `GET /v1/usage` shows a key its own quotas and counts; `GET /v1/admin/usage` lists every key's. Counts
+persist in `USAGE_FILE` (usage.json) every minute and at shutdown. Every request counts, however the key is
+presented: over HTTP, in a WebSocket's auth message or as gRPC metadata, where each report on a
+`ReportStream` is one request and an exhausted key gets `RESOURCE_EXHAUSTED`.
+
+## Tenants
+One server can host several independent teams. Devices, API keys, viewer accounts and geofences belong to
+a tenant, and callers only see, stream and manage their own tenant's devices. Everything starts in the
+default tenant, so single-team installs need no changes.
+```
+curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"id":"acme","name":"ACME"}' http://127.0.0.1:5000/v1/admin/tenants
+curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"acme-admin","role":"admin","tenant":"acme"}' http://127.0.0.1:5000/v1/admin/keys
+```
+A tenant's admins register devices, keys and fences in their own tenant. `ADMIN_TOKEN` and admin keys
+created with `"tenant":"*"` are operators: they work across tenants, pick one with `"tenant"`, and alone may
+use `/admin/tenants`, `/admin/status` and `/admin/lockouts`. Put viewer accounts in a tenant with a fourth
+`VIEWER_USERS` field (`name:hash:*:acme`) and SSO users with `OIDC_GROUP_TENANTS=acme-staff:acme`.
+Tenants persist in `TENANTS_FILE` (tenants.json) and can be deleted once empty. Phone IDs are unique
+across the server. Webhooks and notification rules are server-wide and configured by the operator.
+
+## HTTPS
+Either point `TLS_CERT_FILE`/`TLS_KEY_FILE` at a certificate, or set `AUTOCERT_HOSTS=tracker.example.com`
+(and optionally `AUTOCERT_EMAIL`, `AUTOCERT_CACHE`) to obtain one from Let's Encrypt; run with `PORT=443`.
+`HTTP_REDIRECT_ADDR` (default `:80` with autocert) redirects plain HTTP to HTTPS.
+
+## Mutual TLS
+With HTTPS enabled, set `TLS_CLIENT_CA_FILE` so reports are only accepted from devices holding a
+certificate issued by your CA (its common name must be the phone ID):
+```
+go run server*.go mtls-ca certs
+go run server*.go mtls-client certs kali-device
+```
+Run the client with `CLIENT_CERT_FILE=certs/kali-device.pem CLIENT_KEY_FILE=certs/kali-device-key.pem`
+(and `SERVER_CA_FILE` if the server certificate is self-signed).
+
+## Certificate pinning
+The client can refuse any server but yours even if a CA is compromised. Pin the server's public key with
+`SERVER_PIN_SPKI` (base64 SHA-256, as curl's `--pinnedpubkey` takes), which survives certificate renewals that
+keep the key:
+```
+openssl x509 -in server.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+```
+or the certificate itself with `SERVER_PIN_CERT` (`openssl x509 -in server.pem -noout -fingerprint -sha256`).
+Both take comma-separated lists, so the next key can be pinned before a rotation; a key pin may also name an
+intermediate CA. Pins are checked on top of the normal certificate checks.
+
+## Client proxies
+The client honours `HTTP_PROXY`, `HTTPS_PROXY` and `NO_PROXY`. For machines that can only get out through a
+proxy, `--proxy socks5://127.0.0.1:1080` (or `PROXY_URL`; `http://` and `https://` proxies work too, with
+`user:password@` if needed) sends everything through it: reports, pairing, remote config, geolocation
+lookups, gRPC and MQTT to `tcp://` or `ssl://` brokers. `install` keeps the flag and the proxy variables.
+
+`--tor` (or `TOR=true`) goes through the local Tor SOCKS port at `TOR_SOCKS` (default `127.0.0.1:9050`)
+instead, so the server can be an onion service: `SERVER_URL=http://<56 chars>.onion`, and likewise for
+`GRPC_SERVER` and `MQTT_BROKER`. Tor resolves every name. Requests may take up to 2 minutes, failed reports are
+retried after at least 30s, each on a fresh circuit, and `SOURCE=geoip` is refused because it would locate the
+exit relay; use `gpsd`, `nmea`, `wifi` or `cell`.
+
+## Live updates
+`/ws` needs a viewer or admin token before any update is sent: `?token=`, an `Authorization` header, or
+`{"type":"auth","token":"..."}` as the first message within 10s (what the viewer does, keeping the token
+out of URLs and logs).
+Each connection, and each later `subscribe`, starts with `{"type":"snapshot","locations":[...]}` holding the
+newest points of the devices followed: `?snapshot=N` (or `"snapshot":N` in the message), default 1, 0 for
+none. The viewer asks for its whole track this way instead of calling `/get` first.
+Broadcasts carry a `"seq"` number (as does the snapshot). A viewer reconnecting with `/ws?since=<seq>` is sent
+the updates it missed instead of a snapshot, as long as the server still holds them (the last 1024
+broadcasts, and fewer than 64 for that viewer); otherwise it gets a snapshot as usual.
+`/ws?phones=a,b` only delivers updates for the listed devices; change the set later by sending
+`{"type":"subscribe","phones":[...]}` or `{"type":"unsubscribe","phones":[...]}`. Without a subscription a
+connection receives every device it may view. The server pings every 54s and drops viewers that have not
+answered within 60s, or that take over 10s to accept a message. Each viewer has its own 64-message
+queue; one that falls further behind is disconnected (close code 1013) so it cannot hold up the others.
+
+## Multiple replicas
+Each replica only pushes the reports it received itself to its own viewers. With `REDIS_URL=redis://:pass@redis:6379/0`
+every replica also publishes its live updates on the Redis channel `REDIS_CHANNEL` (`nuloc:live`) and relays
+the others' to its WebSocket, SSE and gRPC viewers, so it no longer matters which replica a device posts to.
+Updates are dropped for the other replicas, never delayed, if Redis falls behind; `/readyz` reports it as
+`redis`. Sequence numbers for `?since=` are per replica, so a viewer landing on another one gets a snapshot.
+
+## WebSocket origins
+Browsers may only open `/ws` from the server's own origin. List other allowed origins in
+`ALLOWED_ORIGINS` (e.g. `https://map.example.com,https://ops.example.com`), or start the server with
+`--insecure-origins` to accept any origin.
+
+## IP restrictions
+`IP_ALLOW` and `IP_DENY` take comma-separated `prefix=cidr` entries applied by path prefix, e.g.
+`IP_ALLOW=/admin/=10.8.0.0/24,/get/=10.8.0.0/24` keeps admin and history behind a VPN while `/report`
+stays open. Deny entries always win; for allow entries the longest matching prefix applies. The gRPC and UDP
+listeners follow the rules of the endpoint each call mirrors: `/report` for reports, `/get/{phone}` for
+`Query` and `/ws` for `Subscribe`.
+
+Behind a reverse proxy set `TRUST_PROXY_HEADERS=true` so rate limits, lockouts, these rules and the logs see
+the client's address from `X-Forwarded-For`. Only the entries proxies appended are trusted: with
+`TRUSTED_PROXY_HOPS` proxies in front of the server (default 1) the client is that many entries from the
+right, and anything further left, which the client can write itself, is ignored.
+
+## Request limits
+JSON bodies are capped at `MAX_BODY_BYTES` (1 MiB) and imports at `MAX_IMPORT_BYTES` (64 MiB);
+larger bodies get 413. API requests with unknown fields or trailing data get 400.
+Reports with latitude outside [-90, 90], longitude outside [-180, 180], NaN/Inf or exactly 0,0 get 422
+with `{"error": "invalid coordinates", "details": {"field", "message"}}`; set `ALLOW_NULL_ISLAND=true`
+to accept 0,0. Imports and GT06 trackers skip such points.
+
+## CSRF
+State-changing requests from browsers (those sending `Origin`, `Sec-Fetch-Site` or cookies) must carry an
+`X-CSRF-Token` header obtained from `GET /auth/csrf`. Set `CSRF_KEY` (32+ bytes) so tokens survive restarts;
+hosts in `ALLOWED_ORIGINS` are trusted. Devices and scripts are not affected.
+
+## Lockouts
+Failed tokens, keys, passwords and pairing codes are counted per IP, device and viewer account.
+After `LOCKOUT_THRESHOLD` (5) failures requests get 429 for `LOCKOUT_BASE` (30s), doubling per
+further failure up to `LOCKOUT_MAX` (1h). `GET /admin/lockouts` lists blocks;
+`DELETE /admin/lockouts[/{key}]` clears them.
+
+## Audit log
+History reads, live subscriptions, imports and every `/admin` request are appended to
+`AUDIT_LOG_FILE` (default `audit.jsonl`). Query it with
+`GET /admin/audit?phone=&actor=&action=&since=<RFC3339>&limit=`.
+
+## End-to-end encryption
+Set `E2E_KEY` on the client (32 random bytes, base64url) to send only encrypted coordinates. The
+server stores and relays the ciphertext without being able to read it; open the viewer with
+`#key=<same key>` in the URL to decrypt in the browser. Altitude, speed and bearing are left out of encrypted reports.
+
+## Client reporting interval
+The client reports every 10 seconds. Set `REPORT_INTERVAL` or pass `--interval` (e.g. `30s`, `5m`, or plain
+seconds) to change that; whole seconds from 1s to 24h are accepted. After a failed lookup or report it
+backs off instead: the interval, then double that and so on up to `RETRY_MAX` (default `5m`), each wait
+randomised by up to half and logged, and never shorter than a server's `Retry-After`.
+
+With `MIN_DISTANCE` (metres) set, a fix is only reported once the device is that far from the last reported
+one, apart from one report every `HEARTBEAT` (default `1h`) so a parked device still shows as alive. Pick a
+distance above the source's noise: tens of metres for GPS, kilometres for IP geolocation.
+
+Even without `MIN_DISTANCE`, a fix within `DEDUPE_EPSILON` metres (default `1`) of the last reported one and
+from the same public IP is treated as a repeat and skipped until the next heartbeat, so an IP-geolocated
+machine that never moves doesn't write the same point every interval. `DEDUPE_EPSILON=off` reports every fix;
+`HEARTBEAT=off` drops repeats and still points for good.
+
+Setting `INTERVAL_MIN` and/or `INTERVAL_MAX` makes the interval adaptive: it drops to `INTERVAL_MIN` as soon as
+the device is seen moving (a speed of 0.5 m/s or more, or a jump bigger than the fixes' accuracy) and doubles
+towards `INTERVAL_MAX` on each still fix. The unset bound defaults to `REPORT_INTERVAL`, which is also where
+it starts, e.g. `REPORT_INTERVAL=1m INTERVAL_MIN=10s INTERVAL_MAX=15m`.
+
+A watchdog inside the client steps in when `WATCHDOG` intervals (default `10`, `off` to disable) pass without
+a report getting through or a fix being taken: it logs the stall, drops pooled connections so the server is
+dialled and looked up afresh, and reopens the gRPC stream. With `WATCHDOG_RESTART=true` a client still stuck
+as long again exits with status 1, which the installed service restarts. A long outage counts as a stall too.
+
+Set `METRICS_ADDR` (e.g. `127.0.0.1:9465`) to have the client serve Prometheus metrics at `/metrics`:
+`nuloc_client_lookups_total`, `nuloc_client_lookup_failures_total`, `nuloc_client_posts_total`,
+`nuloc_client_post_failures_total`, `nuloc_client_queue_depth`, `nuloc_client_watchdog_recoveries_total` and
+`nuloc_client_last_post_timestamp_seconds`. The listener has no authentication, so keep it off public addresses.
+Programs embedding the reporter package get the same figures from `Reporter.Stats`.
+
+Reports that could not be delivered because the server was down, failing or rate-limiting are kept in
+`QUEUE_FILE` (default `nuloc-queue.json`, `off` to disable) and sent through `POST /report/batch` once it
+answers again, so the history has no gap. Up to `QUEUE_MAX` (default 10000) are kept, oldest dropped first;
+the device token is not written to the file. A queued report or batch the server refuses outright (say a
+`when` it calls too far in the future) is moved to `QUEUE_FILE.rejected`, one JSON report per line, rather
+than blocking everything queued behind it.
+
+With `BATCH_SIZE` above 1 the client collects that many reports (at most 500), or however many arrive within
+`BATCH_WAIT` (default `1m`), and sends them in one batch request. A batch goes out once it is old enough even
+when no new fix arrives. Reports still being collected when the client stops are written to the queue, or sent
+straight away with `QUEUE_FILE=off`.
+
+## Client as a service
+Build the client (`go build -o /usr/local/bin/nuloc-client client*.go`) and, as root with its settings in the
+environment, run `nuloc-client install`. It writes them to `/etc/nuloc/client.env` (readable by root only), a
+systemd unit to `/etc/systemd/system/nuloc-client.service`, and enables and starts it, so reporting survives
+reboots. Queued reports live in `/var/lib/nuloc`. Run `install` again to change settings; `nuloc-client status`
+shows the service and `nuloc-client uninstall` removes it and its settings. Pair the device before installing.
+
+## Remote client configuration
+Clients ask `POST /v1/client/config` every `CONFIG_POLL` (default `5m`, `off` to stop) for central settings,
+so a fleet can be retuned without logging in to each machine:
+
+    curl -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"interval":"10m","source":"gpsd,geoip"}' \
+      http://127.0.0.1:5000/v1/admin/client-config
+    curl -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"paused":true}' \
+      http://127.0.0.1:5000/v1/admin/client-config/kali-device
+
+`interval`, `interval_min`, `interval_max` and `source` stand in for the client's `REPORT_INTERVAL`,
+`INTERVAL_MIN`, `INTERVAL_MAX` and `SOURCE`, and `paused` stops reporting until cleared. The fleet default
+(operators only) applies to every device, a device's own settings override it field by field, and whatever
+both leave empty keeps the client's local value. `DELETE /v1/admin/client-config/{phone}` drops a device's
+override and `GET /v1/admin/client-config` lists them. Settings are kept in `CLIENT_CONFIG_FILE` (default
+`client_config.json`).
+
+## Client location sources
+`SOURCE` lists where the client gets its position, tried in order until one answers (default `geoip`).
+`gpsd` reads TPV reports from a local gpsd at `GPSD_ADDR` (default `127.0.0.1:2947`), for machines with a USB
+GPS receiver, and sends its error estimate, altitude, speed and heading too. A fix older than 30s counts as
+none, so `SOURCE=gpsd,geoip` falls back to IP geolocation while the receiver has no sky view.
+`geoip` asks the providers in `GEOIP_PROVIDERS` in turn (default `ipinfo,ip-api,ipapi`): ipinfo.io (with
+`IPINFO_TOKEN` if set), ip-api.com, ipapi.co, and `maxmind`, a local GeoLite2 or GeoIP2 City database at
+`MAXMIND_DB` (the public address comes from api.ipify.org unless `MAXMIND_IP` is set). A provider that
+rate-limits the client is skipped until it allows requests again.
+`nmea` reads NMEA 0183 GGA and RMC sentences straight from a serial receiver at `NMEA_DEVICE` (e.g.
+`/dev/ttyACM0`) for setups without gpsd; set the port speed with `stty` first if it needs one. Accuracy is
+estimated from HDOP.
+`wifi` scans for nearby access points with `iw` (on `WIFI_IFACE`, or the first wireless interface; scanning
+needs root) and looks them up, which usually beats IP geolocation by far on laptops without GPS.
+`WIFI_PROVIDER=mls` (default) uses the Mozilla Location Service API at `WIFI_GEOLOCATE_URL`, by default
+BeaconDB since Mozilla's own service has shut down; `WIFI_PROVIDER=google` uses the Google Geolocation API
+with `GOOGLE_API_KEY`. Networks named `..._nomap` are never sent, and at least two access points are needed.
+`cell` asks a mobile broadband modem for its serving cell and looks it up in OpenCellID with `OPENCELLID_KEY`.
+`CELL_MODEM` is the modem's AT port (e.g. `/dev/ttyUSB2`) or `qmi:/dev/cdc-wdm0` to go through `qmicli`.
+A cell only places the device within hundreds of metres to a few kilometres, so list it after GPS and WiFi.
+
+Each report also carries the machine's hostname, uptime, battery level (from `/sys/class/power_supply`) and
+the interface of its default route with its kind (see Telemetry). Set `TELEMETRY=off` to leave them out.
+
+## Embedding the reporter
+The client's reporting loop is the `locationshare/reporter` package, for Go programs that want to report
+their own position instead of running the client next to them. Fill in a `reporter.Config` and run it:
+`reporter.New(cfg)` checks it and loads any queued reports, and `Run(ctx)` reports until `ctx` is done.
+Positions come from `Config.Sources`, anything with `Name() string` and `Locate() (reporter.Fix, error)`,
+and reports go out through `Config.Transport`, anything with `Send([]reporter.Payload) error`; without one
+they are POSTed to `Config.Server`. Return a `reporter.ServerError` from a transport to have a refusal
+queued or retried like an HTTP status would be. The remaining fields match the client's environment
+variables (`Interval` is `REPORT_INTERVAL`, `QueueFile` is `QUEUE_FILE` and so on) but default to off: no
+queue, sequence file, telemetry, remote config or watchdog unless set.
+
+## Secrets
+Tokens and keys (`DEVICE_TOKENS`, `ADMIN_TOKEN`, `JWT_SECRET`, `OIDC_CLIENT_SECRET`, `TLS_CERT`,
+`TLS_KEY`, and on the client `DEVICE_TOKEN` and `E2E_KEY`) are looked up as an environment variable,
+then as a file named by `<NAME>_FILE`, then in Vault when `VAULT_ADDR`, `VAULT_TOKEN` (or
+`VAULT_TOKEN_FILE`) and `VAULT_SECRET_PATH` (e.g. `secret/data/nu-loc`) are set.
+`DEVICE_TOKENS` may be `phone:token,...` or a JSON object. The client has no default token.
+
+## Signed reports
+Clients may sign `/report` bodies with HMAC-SHA256 keyed by their device token, sending
+`X-Signature` (hex of HMAC over `timestamp\nnonce\nbody`), `X-Timestamp` (unix seconds) and `X-Nonce`.
+Reports outside `SIGNATURE_WINDOW` (default 5m) or reusing a nonce are rejected.
+`REQUIRE_SIGNED_REPORTS=true` refuses unsigned reports.
+The bundled client signs its reports with `SIGN_REPORTS=true`, and then leaves the token out of the body so it
+never crosses the wire; keep the machine's clock in sync. Signing only covers reports sent over HTTP, not MQTT
+or gRPC.
+
+## Configuration
+Settings can come from a YAML file (`--config server.yaml` or `CONFIG_FILE`, see `server.example.yaml`),
+environment variables, or flags, each overriding the one before. Flags: `--port`, `--storage`,
+`--retention`, `--tls-cert`, `--tls-key`, and `--set NAME=value` for any other setting.
+
+The client layers its settings the same way. Its file is `client.yaml` in the working directory, or the one
+named by `--config` or `CONFIG_FILE` (see `client.example.yaml`): `server`, `device`, `token` or `token_file`,
+`source`, `interval`, `proxy`, `tor` and `tls`, plus any other variable under `settings`. Flags: `--server`,
+`--device`, `--source`, `--interval`, `--proxy` and `--tor`. `client install` records the file's path for
+the service instead of copying its contents.
+
+## Logging
+Logs are structured (`log/slog`). `LOG_LEVEL` is `debug`, `info` (default), `warn` or `error`;
+`LOG_FORMAT=json` emits one JSON object per line. Request logs carry `request_id` (also returned as
+`X-Request-ID`), `remote_ip` and, for device traffic, `device`.
+An access log line (method, path, status, bytes, latency, client IP, request ID) is written for every
+request; `ACCESS_LOG=false` disables it, `ACCESS_LOG_FILE` redirects it and `ACCESS_LOG_FORMAT=json`
+suits log pipelines.
+
+## History filters
+`/get/{phone}?bbox=minLon,minLat,maxLon,maxLat` keeps points inside a box (minLon > maxLon crosses the
+antimeridian); `?near=lat,lon&radius=500` keeps points within 500 m (haversine). Both can be combined.
+`?max_accuracy=100` keeps points whose reported `accuracy` is 100 m or better (points without one are kept).
+Encrypted points are left out by the area filters. `/latest/{phone}` takes the same filters and returns the
+newest matching point.
+
+## Accuracy
+Reports may carry `"accuracy"`, the uncertainty radius in metres (OwnTracks `acc` and Takeout `accuracy`
+are read too); the bundled client sends 5000 since IP geolocation is city-level at best. With
+`MAX_ACCURACY=1000` the server refuses less accurate reports with 422 and skips them on import.
+
+## Telemetry
+Reports may also carry `"altitude"` (metres, -1000 to 100000), `"speed"` (m/s, up to 2000), `"bearing"`
+(degrees, 0 to under 360), `"battery"` (percent) and `"network"` (`wifi`, `cellular`, `ethernet`, `offline`
+or `other`). All are optional, stored with the point and sent to live viewers; out-of-range values get 422.
+OwnTracks `alt`, `vel`, `cog`, `batt` and `conn`, and GT06 speed and course, are mapped onto them.
+`"hostname"`, `"uptime"` (seconds since boot) and `"interface"` (e.g. `wlan0`) say which box a point came
+from; the bundled client fills them in, and the viewer shows them in the marker's tooltip. So does
+`"recoveries"`, the number of times the client's watchdog has had to unstick it since it started.
+
+## Timestamps
+The bundled client stamps each report with its own clock as `"when"` (RFC3339, UTC) and numbers it with
+`"seq"`, one more than the report before. The numbers carry on across restarts through `SEQ_FILE` (default
+`nuloc-seq`, `off` to start at 1 each run), which reserves them a thousand at a time, so a restart may
+skip some. The server keeps both and adds `"received"`, when it took the report in; a `"when"` more than a
+minute ahead of that is refused. Queued reports keep their original time and number, so points that
+arrive late or out of order, or from a box whose clock is off, can be put back in order by `seq` and
+their skew read from `received`. All three are in the exports, the gRPC `Location` and live updates, and
+the viewer notes a point received a minute or more after its timestamp.
+
+## GeoJSON
+Send `Accept: application/geo+json` to `/get/{phone}` to receive a GeoJSON FeatureCollection of Point
+features (`phone` and `when` in properties) instead of the `{phone, locations}` envelope.
+
+## Statistics
+`GET /stats/{phone}` returns total distance, average and maximum speed, and moving versus stationary
+seconds, computed from consecutive points; limit it with `?from=` and `?to=` (RFC3339). Legs slower than
+0.5 m/s count as stationary and add no distance.
+
+## Heatmaps
+`GET /v1/heatmap/{phone}?cell=100m&from=...&to=...` counts points per grid cell (`cell` in metres, `m` or `km`,
+10m to 100km) and returns each cell's centre, point count and seconds spent there (time to the next point,
+at most 30 minutes), busiest first. Send `Accept: application/geo+json` for Point features instead.
+
+## Trips
+`GET /v1/trips/{phone}?from=...&to=...` splits the history into trips: stretches of movement that end after
+5 minutes standing still or a 20-minute gap in reports. Each has its start, end, duration, distance and path,
+simplified to within `tolerance` metres (10; 0 keeps every point). Trips under 200 m are left out as GPS
+jitter, and the last one is `"ongoing"` while the device is still on the move.
+
+## Stops
+`GET /v1/stops/{phone}?from=...&to=...` lists where the device stayed: points that all kept within `radius`
+metres (50) of where it arrived for at least `min_duration` (`10m`). Each stop has its centre, arrival,
+departure, duration, point count and, with reverse geocoding on, its address; one still in progress is
+`"ongoing"`. "Where did it stop today" is `?from=<midnight>`.
+
+## Summaries
+Every hour a background job summarises each device's finished UTC days and weeks (Monday to Sunday): points,
+distance, hours spent moving and the geofences it was seen inside. `GET /v1/summaries/{phone}?period=day`
+(or `week`, or both when left out) returns them newest first, without scanning the history. The last 90 of
+each are kept per device in `SUMMARIES_FILE` (summaries.json); only points still held can be counted.
+Summaries covering history in the trash are hidden until it is restored, and deleted when it is purged.
+
+## Deleting history
+`DELETE /v1/get/{phone}` (admin) moves a device's history to the trash. It disappears from queries, exports
+and WebSocket replays straight away, and new reports start a fresh history. `POST /v1/admin/trash/{phone}/restore`
+undoes it, merging in anything reported since. `POST /v1/admin/purge` removes trashed history for good once
+it is older than `PURGE_GRACE` (default `168h`); `?phone=` limits it to one device, and `GET /v1/admin/trash`
+shows what is waiting. The trash is kept in memory like the history, so a restart purges it too.
+
+## Data export
+`GET /v1/export/{phone}/bundle` (admin) answers data-subject access requests with a zip of everything held
+about a device: `history.json` (including points still in the trash), the same points as `history.gpx` and
+`history.csv`, `device.json` with its registration, pairing state and summaries, and `audit.jsonl` with the
+audit log entries naming it. Device tokens are left out.
+
+## Geofences
+Admins manage named circles (`{"name", "center": {"lat", "lon"}, "radius_m"}`) and polygons
+(`{"name", "polygon": [{"lat", "lon"}, ...]}`) with `POST /geofences`, `PUT` and `DELETE /geofences/{id}`;
+add `"phone"` to watch one device instead of all. Fences are kept in `GEOFENCES_FILE` (geofences.json).
+Crossing a boundary sends `{"type": "geofence", "event": "enter"|"exit", "fence", "phone", "location"}`
+to WebSocket viewers of the device. The first point after a restart or a fence change only records state.
+
+## Webhooks
+`WEBHOOK_URLS` (comma-separated) receive a POST of `{"id", "type", "time", "data"}` for every accepted
+location and geofence event (`WEBHOOK_EVENTS` to narrow). With `WEBHOOK_SECRET` each request carries
+`X-Timestamp` and `X-Signature`, the hex HMAC-SHA256 of `timestamp\nbody`. Failures (network, 429, 5xx)
+are retried `WEBHOOK_MAX_ATTEMPTS` (5) times, backing off from `WEBHOOK_BACKOFF` (1s) up to 5 minutes.
+
+## Notifications
+Alerts for geofence crossings, devices going offline, and speeding go to Telegram, Slack, email (SMTP) or
+SMS (Twilio). Channels and per-device rules live in `NOTIFIERS_FILE` (notifiers.json):
+
+```json
+{"channels": {"family": {"type": "telegram", "bot_token": "123:abc", "chat_id": "42"},
+              "ops": {"type": "slack", "webhook_url": "https://hooks.slack.com/services/..."}},
+ "rules": [{"phone": "alice", "alerts": ["geofence", "offline", "speed"], "offline_after": "30m",
+            "max_speed_kmh": 130, "channels": ["family"]},
+           {"alerts": ["offline"], "offline_after": "2h", "channels": ["ops"]}]}
+```
+
+`email` channels take `"to": [...]` and use `SMTP_HOST`, `SMTP_PORT` (587), `SMTP_USER`, `SMTP_PASSWORD`
+and `SMTP_FROM`; `sms` channels take `"to": [...]` and use `TWILIO_ACCOUNT_SID`, `TWILIO_AUTH_TOKEN` and
+`TWILIO_FROM`. A rule without `phone` covers every device.
+
+## Server-Sent Events
+Where WebSockets are blocked, `GET /events/{phone}?token=<read key>` streams the same live feed as SSE:
+`location` events with an arrival number as id, and `geofence` events. After a dropped connection
+the browser's `Last-Event-ID` replays the stored points that arrived since, including late points from
+batches and offline queues.
+
+## gRPC
+Set `GRPC_ADDR` (e.g. `:50051`) to serve the `Tracker` service from `nulocpb/nuloc.proto`: `Report`,
+`ReportStream` (many reports over one stream), `Query` and a server-streaming `Subscribe` for Go and
+mobile clients. The bundled client uses `ReportStream` over one connection when `GRPC_SERVER` is set
+(e.g. `tracker.example.com:50051`, with `GRPC_PLAINTEXT=true` if the server has no TLS), which is cheaper
+than a POST per report at high report rates. Reports authenticate like
+`/report` (device token in the request); `Query` and `Subscribe` take `authorization: Bearer <read key>`
+metadata. TLS and mutual TLS follow `TLS_CERT`, `TLS_KEY` and `TLS_CLIENT_CA_FILE`.
+
+## Protobuf reports
+`POST /report` accepts `Content-Type: application/x-protobuf` with a `nuloc.v1.ReportRequest` from
+`nulocpb/nuloc.proto` in place of JSON; everything else (tokens, signatures, validation) is the same.
+
+## MessagePack and CBOR
+`/report` and `/report/batch` accept `Content-Type: application/msgpack` or `application/cbor` bodies
+with the JSON field names. `/report`, `/report/batch`, `/get`, `/latest` and `/stats` answer in the same
+encodings when the client sends a matching `Accept` header.
+
+## UDP
+`UDP_ADDR=:5005` accepts one report per datagram, with no reply. Send a `/report` JSON body, or sign
+with HMAC-SHA256 (device token as key, tag truncated to 16 bytes) using the binary layout
+`0x01 | len | phone | lat | lon | unix seconds | tag` (big-endian int32 coordinates in 1e-7 degrees),
+or `0x02 | JSON | tag`. `UDP_REQUIRE_HMAC=true` refuses unsigned datagrams.
+
+## MQTT
+With `MQTT_BROKER=tcp://broker:1883` the server subscribes to `MQTT_TOPIC` (`nuloc/+/location`) and
+stores each message as a report for the device named by the `+` segment. Payloads are `/report` bodies
+(`{"token", "lat", "lon"}`); set `MQTT_TRUST_BROKER=true` to skip the token when broker ACLs already
+restrict who may publish where. `MQTT_USERNAME`, `MQTT_PASSWORD` and `MQTT_CLIENT_ID` configure the
+connection; `/readyz` reports it as `mqtt`.
+
+The bundled client publishes there instead of POSTing when given the same `MQTT_BROKER`. It fills the
+`+` of `MQTT_TOPIC` with `DEVICE_PHONE` and publishes at `MQTT_QOS` (default 1; at 1 or 2 a report the
+broker did not acknowledge goes to the offline queue). It logs in with `MQTT_USERNAME`, `MQTT_PASSWORD`
+and `MQTT_CLIENT_ID` (default `nuloc-client-<phone>`); over `ssl://`, `MQTT_CA_FILE` trusts a private CA
+and `MQTT_CERT_FILE`/`MQTT_KEY_FILE` present a client certificate. Pairing and remote config still use
+`SERVER_URL`.
+
+## NATS
+With `NATS_URL=nats://nats:4222` the server joins a NATS mesh both ways. It stores messages on `NATS_SUBJECT`
+(`nuloc.*.report`) as reports for the device in the `*` token, with the same payloads and token rules as MQTT
+(`NATS_TRUST_BROKER=true` skips the token); replicas share the `NATS_QUEUE` group (`nuloc`) so each is stored
+once. Every accepted point goes out as JSON on `nuloc.<device>.location` and every geofence event on
+`nuloc.<device>.geofence` (`NATS_PUBLISH_PREFIX` changes `nuloc`). `NATS_INGEST=false` or `NATS_PUBLISH=false`
+turns a direction off; `NATS_TOKEN` or `NATS_CREDS_FILE` authenticate; `/readyz` reports it as `nats`.
+
+## Kafka
+`KAFKA_BROKERS=kafka1:9092,kafka2:9092` writes every accepted point as JSON to `KAFKA_TOPIC`
+(`nuloc.locations`), keyed by device so each device's points stay in order (`KAFKA_KEY=tenant` or `none`
+changes that). Writes are batched in the background; a failed batch is logged and dropped rather than
+holding up reports. `KAFKA_TLS=true` and `KAFKA_USERNAME`/`KAFKA_PASSWORD` (SASL PLAIN) secure the
+connection; `/readyz` reports it as `kafka`.
+
+## Reverse geocoding
+`GEOCODER=nominatim` resolves each live point to an address in the background and returns it as
+`place` in history. Set `NOMINATIM_URL` for a self-hosted instance and `GEOCODE_EMAIL` when using the
+public one; lookups are limited to `GEOCODE_RPS` (1) and cached (`GEOCODE_CACHE_SIZE`, 10000 cells of ~10 m).
+
+## Caching
+`/get/{phone}` returns an `ETag` and `Last-Modified`; polling with `If-None-Match` (or
+`If-Modified-Since`) gets a body-less `304 Not Modified` until new points arrive or a device's label, color or
+icon changes.
+
+## Compression
+History (`/get/*`), `/devices` and admin responses over 1 KiB are gzip-compressed for clients sending
+`Accept-Encoding: gzip`. Request bodies may be sent gzip-compressed with `Content-Encoding: gzip`; size limits
+apply after decompression, and report signatures cover the uncompressed body. The client compresses reports
+of `GZIP_MIN_SIZE` bytes (default 1024) or more, which mostly means batches; `GZIP_MIN_SIZE=off` stops it, for
+servers older than this.
+
+## Shutdown
+On SIGINT/SIGTERM the server stops accepting connections, sends live viewers a WebSocket close frame,
+lets in-flight requests finish for up to `SHUTDOWN_TIMEOUT` (default 15s), flushes the audit log and exits.
+
+## Health checks
+`GET /healthz` answers 200 while the process serves HTTP. `GET /readyz` answers 200 only when storage, the
+audit log and any configured broker are usable, and 503 with the failing checks otherwise. Point liveness
+probes at the first and readiness probes / load balancers at the second.
+
+`GET /admin/status` (admin token) adds uptime, connected WebSocket viewers in total and per device,
+open event streams, reports accepted in total and over the last minute, the same checks, and Go
+memory and goroutine counts.
 
 ## Docker
 Build & run with docker-compose: